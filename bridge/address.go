@@ -0,0 +1,88 @@
+package bridge
+
+import (
+	"errors"
+	"net"
+	"strconv"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// AddressResolver picks the IP and port a service is registered with for a
+// port of a container. hostIp is the host IP from -ip or -host-ip-from, empty
+// if neither is set. An error skips the port.
+type AddressResolver interface {
+	ResolveAddress(container *dockerapi.Container, port ServicePort, hostIp string) (string, int, error)
+}
+
+// DefaultAddressResolver registers published ports on the host IP, or with
+// Internal the exposed port on the container IP, or with Global the container
+// IP with the published port if there is one and the exposed port otherwise.
+// Ports published on 0.0.0.0 are registered with hostIp, or a detected IP of
+// the host when it is empty, never with the unroutable 0.0.0.0.
+type DefaultAddressResolver struct {
+	Internal bool
+	Global   bool
+}
+
+func (r *DefaultAddressResolver) ResolveAddress(container *dockerapi.Container, port ServicePort, hostIp string) (string, int, error) {
+	if r.Internal {
+		p, _ := strconv.Atoi(port.ExposedPort)
+		return port.ExposedIP, p, nil
+	}
+	if r.Global {
+		ip := container.NetworkSettings.IPAddress
+		if ip == "" {
+			if network, ok := container.NetworkSettings.Networks[container.HostConfig.NetworkMode]; ok {
+				ip = network.IPAddress
+			}
+		}
+		if port.HostPort == "" {
+			p, _ := strconv.Atoi(port.ExposedPort)
+			return ip, p, nil
+		}
+		p, _ := strconv.Atoi(port.HostPort)
+		return ip, p, nil
+	}
+
+	ip := port.HostIP
+	if hostIp != "" {
+		ip = hostIp
+	} else if parsed := net.ParseIP(ip); parsed == nil || parsed.IsUnspecified() {
+		// published on all interfaces, as with the userland proxy
+		detected, err := detectHostIP()
+		if err != nil {
+			return "", 0, err
+		}
+		ip = detected
+	}
+	p, _ := strconv.Atoi(port.HostPort)
+	return ip, p, nil
+}
+
+// interfaceAddrs lists the addresses of the host interfaces; tests replace it.
+var interfaceAddrs = net.InterfaceAddrs
+
+// detectHostIP finds a routable IP of this host for ports published on all of
+// its interfaces: the address Hostname resolves to, unless that is a loopback
+// address as /etc/hosts often has it, or else the first IPv4 address of an
+// interface that is neither loopback nor link-local.
+func detectHostIP() (string, error) {
+	if Hostname != "" {
+		if addr, err := net.ResolveIPAddr("ip", Hostname); err == nil && !addr.IP.IsLoopback() && !addr.IP.IsUnspecified() {
+			return addr.String(), nil
+		}
+	}
+	addrs, err := interfaceAddrs()
+	if err != nil {
+		return "", err
+	}
+	for _, addr := range addrs {
+		ipnet, ok := addr.(*net.IPNet)
+		if !ok || ipnet.IP.To4() == nil || ipnet.IP.IsLoopback() || ipnet.IP.IsLinkLocalUnicast() {
+			continue
+		}
+		return ipnet.IP.String(), nil
+	}
+	return "", errors.New("no routable host IP for ports published on all interfaces, set -ip")
+}
@@ -0,0 +1,150 @@
+package bridge
+
+import (
+	"errors"
+	"net"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultAddressResolver(t *testing.T) {
+	defer func(hostname string) { Hostname = hostname }(Hostname)
+	Hostname = "192.168.1.5"
+
+	container := testContainer()
+	container.HostConfig.NetworkMode = "backend"
+	published := ServicePort{HostIP: "10.0.0.1", HostPort: "8080", ExposedIP: "172.17.0.2", ExposedPort: "80"}
+	wildcard := ServicePort{HostIP: "0.0.0.0", HostPort: "8080", ExposedIP: "172.17.0.2", ExposedPort: "80"}
+	exposed := ServicePort{ExposedIP: "172.17.0.2", ExposedPort: "80"}
+
+	for _, test := range []struct {
+		name     string
+		resolver DefaultAddressResolver
+		port     ServicePort
+		hostIp   string
+		ip       string
+		p        int
+	}{
+		{"published", DefaultAddressResolver{}, published, "", "10.0.0.1", 8080},
+		{"wildcard resolves the hostname", DefaultAddressResolver{}, wildcard, "", "192.168.1.5", 8080},
+		{"host ip", DefaultAddressResolver{}, wildcard, "10.9.9.9", "10.9.9.9", 8080},
+		{"internal", DefaultAddressResolver{Internal: true}, published, "10.9.9.9", "172.17.0.2", 80},
+		{"global published", DefaultAddressResolver{Global: true}, published, "", "172.17.0.2", 8080},
+		{"global exposed", DefaultAddressResolver{Global: true}, exposed, "", "172.17.0.2", 80},
+	} {
+		ip, p, err := test.resolver.ResolveAddress(container, test.port, test.hostIp)
+		assert.NoError(t, err, test.name)
+		assert.Equal(t, test.ip, ip, test.name)
+		assert.Equal(t, test.p, p, test.name)
+	}
+
+	// a wildcard binding never registers 0.0.0.0
+	defer func(addrs func() ([]net.Addr, error)) { interfaceAddrs = addrs }(interfaceAddrs)
+	interfaceAddrs = func() ([]net.Addr, error) {
+		return []net.Addr{
+			&net.IPNet{IP: net.ParseIP("127.0.0.1"), Mask: net.CIDRMask(8, 32)},
+			&net.IPNet{IP: net.ParseIP("169.254.0.3"), Mask: net.CIDRMask(16, 32)},
+			&net.IPNet{IP: net.ParseIP("10.4.0.12"), Mask: net.CIDRMask(24, 32)},
+		}, nil
+	}
+	Hostname = "localhost"
+	ip, p, err := (&DefaultAddressResolver{}).ResolveAddress(container, wildcard, "")
+	assert.NoError(t, err)
+	assert.Equal(t, "10.4.0.12", ip)
+	assert.Equal(t, 8080, p)
+	interfaceAddrs = func() ([]net.Addr, error) { return nil, nil }
+	_, _, err = (&DefaultAddressResolver{}).ResolveAddress(container, wildcard, "")
+	assert.Error(t, err)
+
+	// global falls back to the IP on the container's network
+	container.NetworkSettings.IPAddress = ""
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{"backend": {IPAddress: "10.1.0.7"}}
+	ip, p, _ = (&DefaultAddressResolver{Global: true}).ResolveAddress(container, exposed, "")
+	assert.Equal(t, "10.1.0.7", ip)
+	assert.Equal(t, 80, p)
+}
+
+func TestWildcardBindingRegistersHostIP(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.NetworkSettings.Ports["80/tcp"][0].HostIP = "0.0.0.0"
+	bridge, err := New(newFakeDocker(container), "fake://", Config{HostIp: "192.168.7.7"})
+	assert.NoError(t, err)
+
+	bridge.Sync(false)
+	assert.Equal(t, "192.168.7.7", bridge.services[container.ID][0].IP)
+}
+
+// labelResolver registers services on an address taken from a label.
+type labelResolver struct{}
+
+func (labelResolver) ResolveAddress(container *dockerapi.Container, port ServicePort, hostIp string) (string, int, error) {
+	ip, ok := container.Config.Labels["ip"]
+	if !ok {
+		return "", 0, errors.New("no ip label")
+	}
+	return ip, 9000, nil
+}
+
+func TestCustomAddressResolver(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Labels = map[string]string{"ip": "10.20.30.40"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{AddressResolver: labelResolver{}})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	service := bridge.services[container.ID][0]
+	assert.Equal(t, "10.20.30.40", service.IP)
+	assert.Equal(t, 9000, service.Port)
+
+	// an error skips the port
+	delete(container.Config.Labels, "ip")
+	bridge, err = New(newFakeDocker(container), "fake://", Config{AddressResolver: labelResolver{}})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Empty(t, bridge.services)
+}
+
+func TestBindingToHostIPRegistersIt(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "80", "443/tcp": "443", "8080/tcp": "8080", "9090/tcp": "9090"})
+	container.NetworkSettings.Ports["80/tcp"][0].HostIP = "10.0.0.5"
+	container.NetworkSettings.Ports["443/tcp"][0].HostIP = "0.0.0.0"
+	// bound to loopback only, advertised with -ip still
+	container.NetworkSettings.Ports["8080/tcp"][0].HostIP = "127.0.0.1"
+	container.NetworkSettings.Ports["9090/tcp"][0].HostIP = "::1"
+	bridge, err := New(newFakeDocker(container), "fake://", Config{HostIp: "192.168.7.7"})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+
+	ips := make(map[int]string)
+	for _, service := range bridge.services[container.ID] {
+		ips[service.Port] = service.IP
+	}
+	assert.Equal(t, map[int]string{80: "10.0.0.5", 443: "192.168.7.7", 8080: "192.168.7.7", 9090: "192.168.7.7"}, ips)
+}
+
+func TestForcedIPWinsOverPublishIPFilter(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.NetworkSettings.Ports["80/tcp"][0].HostIP = "0.0.0.0"
+
+	// with -ip forced, a port published on all interfaces gets it
+	bridge, err := New(newFakeDocker(container), "fake://", Config{HostIp: "192.168.7.7", PublishIpFilter: "10.0.0.5"})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	if assert.Len(t, bridge.services[container.ID], 1) {
+		assert.Equal(t, "192.168.7.7", bridge.services[container.ID][0].IP)
+	}
+
+	// without it, the filter address does
+	bridge, err = New(newFakeDocker(container), "fake://", Config{PublishIpFilter: "10.0.0.5"})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	if assert.Len(t, bridge.services[container.ID], 1) {
+		assert.Equal(t, "10.0.0.5", bridge.services[container.ID][0].IP)
+	}
+}
@@ -0,0 +1,94 @@
+package bridge
+
+import (
+	"encoding/json"
+	"os"
+	"sync"
+	"time"
+
+	. "github.com/xytis/registrator/common"
+)
+
+// auditEntry is one line of the audit log.
+type auditEntry struct {
+	Time      time.Time `json:"time"`
+	Host      string    `json:"host"`
+	Backend   string    `json:"backend"`
+	Action    string    `json:"action"`
+	Service   string    `json:"service"`
+	Name      string    `json:"name"`
+	Container string    `json:"container,omitempty"`
+	Result    string    `json:"result"`
+	Error     string    `json:"error,omitempty"`
+}
+
+// auditLog appends one JSON line per registry mutation to a file. The file
+// is reopened when it was moved away, so it can be rotated externally.
+type auditLog struct {
+	sync.Mutex
+	path string
+	file *os.File
+}
+
+func openAuditLog(path string) (*auditLog, error) {
+	a := &auditLog{path: path}
+	if err := a.open(); err != nil {
+		return nil, err
+	}
+	return a, nil
+}
+
+func (a *auditLog) open() error {
+	file, err := os.OpenFile(a.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0640)
+	if err != nil {
+		return err
+	}
+	if a.file != nil {
+		a.file.Close()
+	}
+	a.file = file
+	return nil
+}
+
+// reopen opens the path again if the open file is no longer there.
+func (a *auditLog) reopen() error {
+	current, err := a.file.Stat()
+	if err != nil {
+		return a.open()
+	}
+	if named, err := os.Stat(a.path); err != nil || !os.SameFile(current, named) {
+		return a.open()
+	}
+	return nil
+}
+
+// record writes the outcome of action on service. A nil log records nothing.
+func (a *auditLog) record(backend, action string, service *Service, err error) {
+	if a == nil {
+		return
+	}
+	entry := auditEntry{
+		Time:      time.Now().UTC(),
+		Host:      Hostname,
+		Backend:   backend,
+		Action:    action,
+		Service:   service.ID,
+		Name:      service.Name,
+		Container: service.Origin.ContainerID,
+		Result:    "ok",
+	}
+	if err != nil {
+		entry.Result, entry.Error = "error", err.Error()
+	}
+	line, _ := json.Marshal(entry)
+
+	a.Lock()
+	defer a.Unlock()
+	if err := a.reopen(); err != nil {
+		Log.Errorln("unable to open audit log:", err)
+		return
+	}
+	if _, err := a.file.Write(append(line, '\n')); err != nil {
+		Log.Errorln("unable to write audit log:", err)
+	}
+}
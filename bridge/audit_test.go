@@ -0,0 +1,69 @@
+package bridge
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func readAudit(t *testing.T, path string) []auditEntry {
+	file, err := os.Open(path)
+	assert.NoError(t, err)
+	defer file.Close()
+	entries := make([]auditEntry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		var entry auditEntry
+		assert.NoError(t, json.Unmarshal(scanner.Bytes(), &entry))
+		entries = append(entries, entry)
+	}
+	return entries
+}
+
+func TestAuditLog(t *testing.T) {
+	dir, err := ioutil.TempDir("", "audit")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "audit.log")
+
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{DeregisterCheck: "always", AuditLog: path})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	bridge.RemoveOnExit(container.ID)
+
+	entries := readAudit(t, path)
+	assert.Len(t, entries, 2)
+	assert.Equal(t, "register", entries[0].Action)
+	assert.Equal(t, "deregister", entries[1].Action)
+	for _, entry := range entries {
+		assert.Equal(t, "ok", entry.Result)
+		assert.Equal(t, container.ID, entry.Container)
+		assert.Equal(t, Hostname+":test:80", entry.Service)
+		assert.Equal(t, bridge.Backend(), entry.Backend)
+		assert.False(t, entry.Time.IsZero())
+	}
+
+	// a rotated log is reopened, failures are recorded with their error
+	assert.NoError(t, os.Rename(path, path+".1"))
+	bridge.registry.(*fakeAdapter).fail = errors.New("down")
+	bridge.Add(container.ID)
+	entries = readAudit(t, path)
+	assert.Len(t, entries, 1)
+	assert.Equal(t, "error", entries[0].Result)
+	assert.Equal(t, "down", entries[0].Error)
+}
+
+func TestAuditLogUnwritable(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	_, err := New(newFakeDocker(), "fake://", Config{AuditLog: "/nonexistent/audit.log"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,68 @@
+package bridge
+
+import (
+	"errors"
+	"net/url"
+	"strconv"
+	"time"
+)
+
+// backendOptions lets the registry URI override the retry and timeout
+// settings for its backend, with the query parameters retry (attempts, -1
+// forever), retry_interval and timeout, in milliseconds or as durations like
+// 3s, parsed like -retry-interval and -backend-timeout.
+func backendOptions(uri *url.URL, config *Config) error {
+	query := uri.Query()
+	if value := query.Get("retry"); value != "" {
+		attempts, err := strconv.Atoi(value)
+		if err != nil || attempts < -1 {
+			return errors.New("bad retry: " + value)
+		}
+		config.RetryAttempts = attempts
+	}
+	for param, field := range map[string]*int{"retry_interval": &config.RetryInterval, "timeout": &config.BackendTimeout} {
+		value := query.Get(param)
+		if value == "" {
+			continue
+		}
+		ms, err := ParseMillis(value)
+		if err == nil && ms == 0 && param == "retry_interval" {
+			err = errors.New("must be greater than 0")
+		}
+		if err != nil {
+			return errors.New("bad " + param + ": " + err.Error())
+		}
+		*field = ms
+	}
+	return nil
+}
+
+// timeoutError is returned for registry calls that took longer than
+// BackendTimeout. It is a net.Error, so the call is retried like other
+// network errors.
+type timeoutError struct {
+	after time.Duration
+}
+
+func (e *timeoutError) Error() string   { return "registry call timed out after " + e.after.String() }
+func (e *timeoutError) Timeout() bool   { return true }
+func (e *timeoutError) Temporary() bool { return true }
+
+// withTimeout runs fn, giving up on it after BackendTimeout milliseconds.
+// fn keeps running in the background then, as adapters can't be cancelled.
+func (b *Bridge) withTimeout(fn func() error) error {
+	timeout := time.Duration(b.config.BackendTimeout) * time.Millisecond
+	if timeout <= 0 {
+		return fn()
+	}
+	done := make(chan error, 1)
+	go func() { done <- fn() }()
+	timer := time.NewTimer(timeout)
+	defer timer.Stop()
+	select {
+	case err := <-done:
+		return err
+	case <-timer.C:
+		return &timeoutError{timeout}
+	}
+}
@@ -0,0 +1,46 @@
+package bridge
+
+import (
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBackendOptions(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	bridge, err := New(newFakeDocker(), "fake://?retry=5&retry_interval=2s&timeout=20ms", Config{RetryAttempts: 1, RetryInterval: 100, BackendTimeout: 5000})
+	assert.NoError(t, err)
+	assert.Equal(t, 5, bridge.config.RetryAttempts)
+	assert.Equal(t, 2000, bridge.config.RetryInterval)
+	assert.Equal(t, 20, bridge.config.BackendTimeout)
+
+	// a call slower than the URI's timeout gives up on it, not on the global one
+	adapter := bridge.registry.(*fakeAdapter)
+	adapter.refreshTime = 500 * time.Millisecond
+	start := time.Now()
+	err = bridge.call(func() error { return adapter.Refresh(&Service{ID: "slow"}) })
+	assert.True(t, time.Since(start) < 500*time.Millisecond)
+	if netErr, ok := err.(net.Error); assert.True(t, ok, "timeout is a net.Error") {
+		assert.True(t, netErr.Timeout())
+		assert.True(t, transient(err))
+	}
+
+	// without parameters the global settings apply
+	bridge, err = New(newFakeDocker(), "fake://", Config{RetryAttempts: 1, BackendTimeout: 5000})
+	assert.NoError(t, err)
+	assert.Equal(t, 1, bridge.config.RetryAttempts)
+	assert.Equal(t, 5000, bridge.config.BackendTimeout)
+
+	_, err = New(newFakeDocker(), "fake://?timeout=soon", Config{})
+	assert.Error(t, err)
+	_, err = New(newFakeDocker(), "fake://?timeout=1500us", Config{})
+	assert.Error(t, err)
+
+	// retrying without a pause would ping the backend in a hot loop
+	_, err = New(newFakeDocker(), "fake://?retry=-1&retry_interval=0", Config{RetryInterval: 100})
+	if assert.Error(t, err) {
+		assert.Contains(t, err.Error(), "bad retry_interval: must be greater than 0")
+	}
+}
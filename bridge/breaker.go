@@ -0,0 +1,91 @@
+package bridge
+
+import (
+	"errors"
+	"sync"
+	"time"
+)
+
+var ErrCircuitOpen = errors.New("registry circuit breaker is open")
+
+type BreakerState int
+
+const (
+	BreakerClosed BreakerState = iota
+	BreakerHalfOpen
+	BreakerOpen
+)
+
+func (s BreakerState) String() string {
+	switch s {
+	case BreakerHalfOpen:
+		return "half-open"
+	case BreakerOpen:
+		return "open"
+	}
+	return "closed"
+}
+
+// breaker is a circuit breaker for registry calls. It opens after threshold
+// consecutive failures and short-circuits calls until cooldown has passed.
+// The next call is then let through as a probe: success closes the breaker,
+// failure opens it again.
+type breaker struct {
+	sync.Mutex
+	threshold int
+	cooldown  time.Duration
+	failures  int
+	state     BreakerState
+	openedAt  time.Time
+	now       func() time.Time
+}
+
+func newBreaker(threshold int, cooldown time.Duration) *breaker {
+	return &breaker{threshold: threshold, cooldown: cooldown, now: time.Now}
+}
+
+// allow reports whether a call may go through.
+func (c *breaker) allow() bool {
+	c.Lock()
+	defer c.Unlock()
+	switch c.state {
+	case BreakerOpen:
+		if c.now().Sub(c.openedAt) < c.cooldown {
+			return false
+		}
+		c.state = BreakerHalfOpen
+		return true
+	case BreakerHalfOpen:
+		// only a single probe at a time
+		return false
+	}
+	return true
+}
+
+// record notes the result of a call that was allowed through and reports
+// whether it closed a breaker that was not closed before.
+func (c *breaker) record(err error) bool {
+	c.Lock()
+	defer c.Unlock()
+	if err == nil {
+		recovered := c.state != BreakerClosed
+		c.state = BreakerClosed
+		c.failures = 0
+		return recovered
+	}
+	c.failures++
+	if c.state == BreakerHalfOpen || (c.threshold > 0 && c.failures >= c.threshold) {
+		c.state = BreakerOpen
+		c.openedAt = c.now()
+	}
+	return false
+}
+
+func (c *breaker) State() BreakerState {
+	c.Lock()
+	defer c.Unlock()
+	if c.state == BreakerOpen && c.now().Sub(c.openedAt) >= c.cooldown {
+		return BreakerHalfOpen
+	}
+	return c.state
+}
@@ -0,0 +1,56 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestBreakerTransitions(t *testing.T) {
+	now := time.Now()
+	c := newBreaker(2, time.Minute)
+	c.now = func() time.Time { return now }
+	fail := errors.New("backend down")
+
+	assert.True(t, c.allow())
+	c.record(fail)
+	assert.Equal(t, BreakerClosed, c.State())
+	assert.True(t, c.allow())
+	c.record(fail)
+	assert.Equal(t, BreakerOpen, c.State())
+	assert.False(t, c.allow())
+
+	now = now.Add(time.Minute)
+	assert.Equal(t, BreakerHalfOpen, c.State())
+	assert.True(t, c.allow())
+	assert.False(t, c.allow(), "only one probe while half-open")
+	c.record(fail)
+	assert.Equal(t, BreakerOpen, c.State())
+	assert.False(t, c.allow())
+
+	now = now.Add(time.Minute)
+	assert.True(t, c.allow())
+	assert.True(t, c.record(nil))
+	assert.Equal(t, BreakerClosed, c.State())
+	assert.True(t, c.allow())
+}
+
+func TestBridgeShortCircuits(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{BreakerThreshold: 2, BreakerCooldown: 60})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	adapter.fail = errors.New("backend down")
+
+	bridge.Add(container.ID)
+	bridge.Add(container.ID)
+	assert.Equal(t, 2, adapter.registers)
+	assert.Equal(t, BreakerOpen, bridge.BreakerState())
+
+	bridge.Add(container.ID)
+	assert.Equal(t, 2, adapter.registers, "calls are short-circuited while open")
+	assert.Empty(t, bridge.services)
+}
@@ -1,6 +1,9 @@
 package bridge
 
 import (
+	"crypto/sha1"
+	"encoding/hex"
+	"encoding/json"
 	"errors"
 	. "github.com/xytis/registrator/common"
 	"net"
@@ -8,111 +11,889 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"sync"
+	"sync/atomic"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
-var serviceIDPattern = regexp.MustCompile(`^(.+?):([a-zA-Z0-9][a-zA-Z0-9_.-]+):[0-9]+(?::udp)?$`)
+var serviceIDPattern = regexp.MustCompile(`^(.+?):([a-zA-Z0-9][a-zA-Z0-9_.-]+):[0-9]+(?::udp)?(?::[a-zA-Z0-9_.-]+)?$`)
 
 type Bridge struct {
 	sync.Mutex
 	registry       RegistryAdapter
-	docker         *dockerapi.Client
+	backend        string
+	lastPingErr    error
+	docker         DockerClient
+	swarm          SwarmInspector
+	state          StateStore
+	stateSaved     bool
+	stateVersion   uint64 // change version last saved
 	services       map[string][]*Service
+	host           *Service
 	deadContainers map[string]*DeadContainer
+	retained       map[string][]*Service
+	stopped        map[string]bool
+	restarting     map[string]bool
+	recent         map[string]bool
+	pending        map[string]*Service
+	held           map[string]*time.Timer
+	starting       map[string]*time.Timer
+	retries        map[string]*scheduledRetry
+	awaiting       map[string]*Service
+	awaitTimer     *time.Timer
+	awaitRound     int
+	restartGrace   time.Duration
+	unhealthyGrace time.Duration
+	graced         map[string]*time.Timer
+	unhealthy      map[string]bool
+	registered     map[string]registration
+	imageLabels    map[string]map[string]string
+	backendErrors  uint64
+	lastSync       time.Time
+	refreshTook    time.Duration
+	audit          *auditLog
+	hook           *changeHook
+	changes        *changeFeed
+	heartbeat      *heartbeat
+	failures       *LogThrottle
+	mapping        []mappingRule
+	breaker        *breaker
+	hostIp         HostIPResolver
+	addresses      AddressResolver
+	resolvedIp     string
 	config         Config
 }
 
-func New(docker *dockerapi.Client, adapterUri string, config Config) (*Bridge, error) {
+func New(docker DockerClient, adapterUri string, config Config) (*Bridge, error) {
 	uri, err := url.Parse(adapterUri)
 	if err != nil {
 		return nil, errors.New("bad adapter uri: " + adapterUri)
 	}
 	factory, found := AdapterFactories.Lookup(uri.Scheme)
 	if !found {
-		return nil, errors.New("unrecognized adapter: " + adapterUri)
+		schemes := make([]string, 0)
+		for scheme := range AdapterFactories.All() {
+			schemes = append(schemes, scheme)
+		}
+		sort.Strings(schemes)
+		return nil, errors.New("unrecognized adapter: " + adapterUri + " (available: " + strings.Join(schemes, ", ") + ")")
+	}
+	if validator, ok := factory.(URIValidator); ok {
+		if err := validator.Validate(uri); err != nil {
+			return nil, errors.New("bad adapter uri: " + adapterUri + ": " + err.Error())
+		}
+	}
+
+	if err := backendOptions(uri, &config); err != nil {
+		return nil, errors.New("bad adapter uri: " + adapterUri + ": " + err.Error())
+	}
+	if err := validWatchEvents(config.WatchEvents); err != nil {
+		return nil, err
+	}
+	if err := validIgnoreImages(config.IgnoreImages); err != nil {
+		return nil, err
+	}
+	if err := validStateBackend(config.StateBackend); err != nil {
+		return nil, err
+	}
+	if config.UnhealthyGrace > 0 && !watches(config.WatchEvents, "health_status") {
+		Log.Warnln("health_status is not among the watched events, unhealthy containers stay registered")
+	}
+
+	switch config.WeightFrom {
+	case "", "none", "cpu", "memory":
+	default:
+		return nil, errors.New("unknown weight source: " + config.WeightFrom)
+	}
+
+	switch config.SuccessMode {
+	case "", "override", "any", "all":
+	default:
+		return nil, errors.New("unknown success mode: " + config.SuccessMode)
+	}
+
+	if config.PurgeOnStart != "" && strings.TrimSuffix(config.PurgeOnStart, "*") == "" {
+		return nil, errors.New("purge selector must name a tag or tag prefix: " + config.PurgeOnStart)
+	}
+
+	switch config.PrimaryPortBy {
+	case "", "named", "lowest":
+	default:
+		return nil, errors.New("unknown primary port heuristic: " + config.PrimaryPortBy)
+	}
+
+	if (config.MinPort > 0) != (config.MaxPort > 0) {
+		return nil, errors.New("min port and max port must be set together")
+	}
+	if config.MinPort < 0 || config.MinPort > config.MaxPort || config.MaxPort > 65535 {
+		return nil, errors.New("bad advertised port range: " + strconv.Itoa(config.MinPort) + "-" + strconv.Itoa(config.MaxPort))
+	}
+	if config.DNSTTL < 0 {
+		return nil, errors.New("dns ttl must not be negative: " + strconv.Itoa(config.DNSTTL))
+	}
+
+	addresses := config.AddressResolver
+	if addresses == nil {
+		addresses = &DefaultAddressResolver{Internal: config.Internal, Global: config.Global}
+	}
+	hostIp, err := NewHostIPResolver(config.HostIpFrom, config.HostIp)
+	if err != nil {
+		return nil, err
+	}
+
+	var mapping []mappingRule
+	if config.MappingFile != "" {
+		if mapping, err = loadMapping(config.MappingFile); err != nil {
+			return nil, errors.New("unable to load mapping file: " + err.Error())
+		}
+	}
+
+	var audit *auditLog
+	if config.AuditLog != "" {
+		if audit, err = openAuditLog(config.AuditLog); err != nil {
+			return nil, errors.New("unable to open audit log: " + err.Error())
+		}
 	}
 
-	Log.Infoln("Using", uri.Scheme, "adapter:", uri)
-	return &Bridge{
+	Log.Infoln("Using", uri.Scheme, "adapter:", redactURI(uri))
+	registry := factory.New(uri)
+	if _, ok := registry.(MaintenanceAdapter); config.RegisterStopped && !ok {
+		Log.Warnln(uri.Scheme, "adapter does not support maintenance, stopped containers will be deregistered")
+		config.RegisterStopped = false
+	}
+	if _, ok := registry.(WarningAdapter); config.RegisterRestarting && !ok {
+		Log.Warnln(uri.Scheme, "adapter cannot mark services with a warning, restarting containers will be deregistered")
+		config.RegisterRestarting = false
+	}
+	if _, ok := registry.(CriticalWatcher); config.DeregisterCritical > 0 && !ok {
+		Log.Warnln(uri.Scheme, "adapter cannot watch service health, critical services will not be deregistered")
+		config.DeregisterCritical = 0
+	}
+	var logs LogStreamer
+	if config.HeartbeatFromLogs > 0 {
+		var ok bool
+		if logs, ok = docker.(LogStreamer); !ok {
+			Log.Warnln("docker client cannot follow container logs, heartbeats from logs are disabled")
+			config.HeartbeatFromLogs = 0
+		}
+	}
+	var state StateStore
+	if config.StateBackend != "" {
+		var ok bool
+		if state, ok = registry.(StateStore); !ok {
+			return nil, errors.New("state backend " + config.StateBackend + " needs the consul adapter, not " + uri.Scheme)
+		}
+	}
+	var swarm SwarmInspector
+	if config.SwarmAware {
+		var ok bool
+		if swarm, ok = docker.(SwarmInspector); !ok {
+			Log.Warnln("docker client cannot inspect Swarm services, ingress ports are not registered")
+		}
+	}
+	if config.PreferIPAM {
+		if ipam, ok := docker.(IPAMInspector); ok {
+			docker = &ipamDocker{docker, ipam}
+		} else {
+			Log.Warnln("docker client cannot inspect IPAM addresses, using the runtime addresses")
+			config.PreferIPAM = false
+		}
+	}
+	b := &Bridge{
 		docker:         docker,
+		swarm:          swarm,
+		state:          state,
 		config:         config,
-		registry:       factory.New(uri),
+		registry:       registry,
+		backend:        redactURI(uri),
 		services:       make(map[string][]*Service),
 		deadContainers: make(map[string]*DeadContainer),
-	}, nil
+		retained:       make(map[string][]*Service),
+		stopped:        make(map[string]bool),
+		restarting:     make(map[string]bool),
+		recent:         make(map[string]bool),
+		pending:        make(map[string]*Service),
+		held:           make(map[string]*time.Timer),
+		starting:       make(map[string]*time.Timer),
+		retries:        make(map[string]*scheduledRetry),
+		awaiting:       make(map[string]*Service),
+		restartGrace:   time.Duration(config.RestartGrace) * time.Second,
+		unhealthyGrace: time.Duration(config.UnhealthyGrace) * time.Second,
+		graced:         make(map[string]*time.Timer),
+		unhealthy:      make(map[string]bool),
+		registered:     make(map[string]registration),
+		imageLabels:    make(map[string]map[string]string),
+		audit:          audit,
+		hook:           newChangeHook(config.OnChangeExec, time.Duration(config.OnChangeDebounce)*time.Millisecond),
+		changes:        newChangeFeed(),
+		failures:       NewLogThrottle(failureLogWindow),
+		mapping:        mapping,
+		breaker:        newBreaker(config.BreakerThreshold, time.Duration(config.BreakerCooldown)*time.Second),
+		hostIp:         hostIp,
+		addresses:      addresses,
+		resolvedIp:     config.HostIp,
+	}
+	if logs != nil {
+		b.heartbeat = newHeartbeat(logs, time.Duration(config.HeartbeatFromLogs)*time.Second, b.refreshContainer)
+	}
+	return b, nil
 }
 
+// Ping checks the registry is reachable. A failure is returned as a
+// *BackendError naming the backend.
 func (b *Bridge) Ping() error {
-	return b.registry.Ping()
+	var err error
+	if err = b.withTimeout(b.registry.Ping); err != nil {
+		err = &BackendError{Backend: b.backend, Op: "ping", Err: err}
+		Metrics.Set("registrator_backend_up", 0)
+	} else {
+		Metrics.Set("registrator_backend_up", 1)
+	}
+	b.Lock()
+	b.lastPingErr = err
+	b.Unlock()
+	return err
+}
+
+// Backend returns the registry URI, with secrets redacted.
+func (b *Bridge) Backend() string {
+	return b.backend
+}
+
+// LastPingError returns the error of the last Ping, or nil if it succeeded.
+func (b *Bridge) LastPingError() error {
+	b.Lock()
+	defer b.Unlock()
+	return b.lastPingErr
+}
+
+// BreakerState reports the state of the circuit breaker around the registry.
+func (b *Bridge) BreakerState() BreakerState {
+	return b.breaker.State()
+}
+
+// BackendErrors returns how many backend calls have failed so far.
+func (b *Bridge) BackendErrors() uint64 {
+	return atomic.LoadUint64(&b.backendErrors)
+}
+
+// ServiceCount returns the number of services of tracked containers.
+func (b *Bridge) ServiceCount() int {
+	b.Lock()
+	defer b.Unlock()
+	return b.countServices()
+}
+
+// countServices returns the number of services of tracked containers.
+// Callers hold the lock.
+func (b *Bridge) countServices() int {
+	count := 0
+	for _, services := range b.services {
+		count += len(services)
+	}
+	return count
+}
+
+// Stats is a snapshot of the state of the bridge, for the /metrics and
+// /stats endpoints and for programs embedding the bridge.
+type Stats struct {
+	Services        int           // services of tracked containers
+	Containers      int           // containers with services
+	LastSync        time.Time     // end of the last sync, zero before the first
+	RefreshDuration time.Duration // time the last refresh took
+	BackendErrors   uint64        // backend calls failed so far
+}
+
+// Stats returns the current Stats of the bridge.
+func (b *Bridge) Stats() Stats {
+	b.Lock()
+	defer b.Unlock()
+	stats := Stats{
+		LastSync:        b.lastSync,
+		RefreshDuration: b.refreshTook,
+		BackendErrors:   b.BackendErrors(),
+	}
+	for _, services := range b.services {
+		if len(services) > 0 {
+			stats.Containers++
+			stats.Services += len(services)
+		}
+	}
+	return stats
+}
+
+// call runs an operation against the registry for up to BackendTimeout,
+// unless the circuit breaker is open. When a call closes the breaker again,
+// the deregistrations that failed while it was open are retried and a resync
+// catches up on the registrations.
+func (b *Bridge) call(fn func() error) error {
+	if !b.breaker.allow() {
+		return ErrCircuitOpen
+	}
+	err := b.withTimeout(fn)
+	if err != nil {
+		atomic.AddUint64(&b.backendErrors, 1)
+	}
+	recovered := b.breaker.record(err)
+	Metrics.Set("registrator_registry_breaker_state", float64(b.breaker.State()))
+	if recovered {
+		go b.recover()
+	}
+	return err
+}
+
+// recover retries deregistrations that failed while the registry was down
+// and resyncs to catch up on registrations.
+func (b *Bridge) recover() {
+	Log.Infoln("registry recovered, resyncing")
+	b.Lock()
+	for id, service := range b.pending {
+		if err := b.deregister(service); err != nil {
+			b.failures.Errorln("deregister failed:", err, id)
+			continue
+		}
+		delete(b.pending, id)
+		Log.Infoln("removed:", id)
+	}
+	b.Unlock()
+	b.Sync(true)
 }
 
 func (b *Bridge) Add(containerId string) {
+	b.waitForNetwork(containerId)
 	b.Lock()
 	defer b.Unlock()
-	b.add(containerId, false)
+	if b.stopped[containerId] {
+		b.resume(containerId)
+		return
+	}
+	if b.restarting[containerId] {
+		b.restarted(containerId)
+		return
+	}
+	if timer, ok := b.held[containerId]; ok {
+		// restarted within the grace period, its address may have changed
+		timer.Stop()
+		delete(b.held, containerId)
+		Log.Infoln("restarted:", containerId[:12])
+		b.reconcile(containerId)
+		return
+	}
+	container := b.inspectNew(containerId)
+	if container == nil {
+		return
+	}
+	if delay := b.startDelay(container); delay > 0 {
+		b.delayStart(containerId, delay)
+		return
+	}
+	b.addContainer(container, false)
+}
+
+// Reconcile inspects a running container again and brings its registrations
+// in line, registering changed services and deregistering ones that are gone.
+// This picks up renames, which change service IDs, and label updates.
+func (b *Bridge) Reconcile(containerId string) {
+	b.Lock()
+	defer b.Unlock()
+	if b.stopped[containerId] {
+		return
+	}
+	if timer, ok := b.starting[containerId]; ok {
+		// a container reporting healthy is ready before its start delay ends
+		container, err := b.docker.InspectContainer(containerId)
+		if err != nil || container.State.Health.Status != "healthy" {
+			return
+		}
+		timer.Stop()
+		delete(b.starting, containerId)
+		Log.Infoln("ready:", containerId[:12])
+		b.add(containerId, false)
+		return
+	}
+	b.reconcile(containerId)
+}
+
+func (b *Bridge) reconcile(containerId string) {
+	old := b.services[containerId]
+	delete(b.services, containerId)
+	b.add(containerId, true)
+
+	current := make(map[string]bool)
+	for _, service := range b.services[containerId] {
+		current[service.ID] = true
+	}
+	for _, service := range old {
+		if current[service.ID] {
+			continue
+		}
+		if err := b.deregister(service); err != nil {
+			b.failures.Errorln("deregister failed:", err, service.ID)
+			continue
+		}
+		Log.Infoln("removed:", containerId[:12], service.ID)
+	}
 }
 
 func (b *Bridge) Remove(containerId string) {
 	b.remove(containerId, true)
 }
 
+// Destroy deregisters whatever is still registered for a container removed
+// from Docker: services kept after it exited by -deregister, held for its
+// restart or of a stopped container with RegisterStopped.
+func (b *Bridge) Destroy(containerId string) {
+	defer b.cleanupAfter(containerId)
+	b.cancelStart(containerId)
+	b.Lock()
+	defer b.Unlock()
+	// the services of dead containers are the retained ones
+	if b.services[containerId] == nil && b.deadContainers[containerId] == nil {
+		b.services[containerId] = b.retained[containerId]
+	}
+	delete(b.retained, containerId)
+	if b.services[containerId] == nil && b.deadContainers[containerId] == nil {
+		delete(b.services, containerId)
+		return
+	}
+	Log.Infoln("destroyed:", containerId[:12])
+	b.removeServices(containerId, true)
+}
+
 func (b *Bridge) RemoveOnExit(containerId string) {
+	defer b.cleanupAfter(containerId)
+	if b.cancelStart(containerId) {
+		return
+	}
+	if b.config.RegisterStopped {
+		b.Lock()
+		defer b.Unlock()
+		b.stop(containerId)
+		return
+	}
+	if b.holdForRestart(containerId) {
+		return
+	}
 	b.remove(containerId, b.shouldRemove(containerId))
 }
 
-func (b *Bridge) Refresh() {
+// holdForRestart keeps the services of an exited container registered while
+// Docker restarts it, so they don't flap. With RegisterRestarting, one Docker
+// lists as restarting is held until it runs again and its services get a
+// warning. Otherwise a restart policy that would start it again is taken at
+// its word for the restart grace period only, as docker stop exits a
+// container without restarting it. It reports whether the container is held.
+func (b *Bridge) holdForRestart(containerId string) bool {
+	if !b.config.RegisterRestarting && b.restartGrace <= 0 {
+		return false
+	}
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil {
+		return false
+	}
+	restarting := b.config.RegisterRestarting && container.State.Restarting
+	if !restarting && (b.restartGrace <= 0 || !willRestart(container)) {
+		return false
+	}
+	b.Lock()
+	defer b.Unlock()
+	if b.services[containerId] == nil {
+		return false
+	}
+	if timer, ok := b.held[containerId]; ok {
+		timer.Stop()
+		delete(b.held, containerId)
+	}
+	if b.restartGrace > 0 {
+		b.held[containerId] = time.AfterFunc(b.restartGrace, func() { b.release(containerId) })
+		Log.Infoln("holding:", containerId[:12], "until restarted, for up to", b.restartGrace)
+	}
+	if b.config.RegisterRestarting {
+		b.warnRestarting(containerId)
+	}
+	return true
+}
+
+// startDelay returns how long to wait after a container started before
+// registering it, from SERVICE_START_DELAY or else StartDelay. Callers hold
+// the lock.
+func (b *Bridge) startDelay(container *dockerapi.Container) time.Duration {
+	delay := time.Duration(b.config.StartDelay) * time.Second
+	metadata, _ := serviceMetaData(container.Config, b.imageLabelsOf(container), nil, "", b.tagsSeparator())
+	value, ok := metadata["start_delay"]
+	if !ok {
+		return delay
+	}
+	if seconds, err := strconv.Atoi(value); err == nil {
+		return time.Duration(seconds) * time.Second
+	}
+	parsed, err := time.ParseDuration(value)
+	if err != nil || parsed < 0 {
+		Log.Warnln("invalid start delay:", container.ID[:12], value)
+		return delay
+	}
+	return parsed
+}
+
+// hostIPOf returns the host IP a port of a container is registered with: the
+// value of its IPFromLabel label if it is an IP or hostname, else the IP the
+// port is published on unless that is all interfaces or loopback, else the
+// resolved host IP. Callers hold the lock.
+func (b *Bridge) hostIPOf(container *dockerapi.Container, port ServicePort) string {
+	if b.config.IPFromLabel != "" {
+		if value, ok := container.Config.Labels[b.config.IPFromLabel]; ok {
+			if validHost(value) {
+				return value
+			}
+			Log.Warnln("ignored:", container.ID[:12], "invalid IP in label", b.config.IPFromLabel+":", value)
+		}
+	}
+	// published on one host IP with -p <ip>:<port>:<port>, unless that is
+	// loopback, which other hosts can't reach. A wildcard binding that
+	// -publish-ip-filter resolved doesn't count, so a forced -ip still wins.
+	if ip := net.ParseIP(port.boundIP); ip != nil && !ip.IsUnspecified() && !ip.IsLoopback() {
+		return port.boundIP
+	}
+	return b.resolvedIp
+}
+
+// serviceTTL returns the TTL of a service from SERVICE_TTL, in seconds or as
+// a duration, or -ttl when it is unset or invalid.
+func (b *Bridge) serviceTTL(serviceId, value string) int {
+	if value == "" {
+		return b.config.RefreshTtl
+	}
+	ttl, err := strconv.Atoi(value)
+	if err != nil {
+		parsed, perr := time.ParseDuration(value)
+		ttl, err = int(parsed/time.Second), perr
+	}
+	if err != nil || ttl <= 0 {
+		Log.Warnln("invalid TTL:", serviceId, value)
+		return b.config.RefreshTtl
+	}
+	if b.config.RefreshInterval > 0 && ttl <= b.config.RefreshInterval {
+		Log.Warnln("TTL of", serviceId, "is not longer than the refresh interval, it will expire between refreshes")
+	}
+	return ttl
+}
+
+// delayStart registers a started container once its start delay has passed.
+// Callers hold the lock.
+func (b *Bridge) delayStart(containerId string, delay time.Duration) {
+	if timer, ok := b.starting[containerId]; ok {
+		timer.Stop()
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(delay, func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.starting[containerId] != timer {
+			return
+		}
+		delete(b.starting, containerId)
+		b.add(containerId, false)
+	})
+	b.starting[containerId] = timer
+	Log.Infoln("starting:", containerId[:12], "registering in", delay)
+}
+
+// cancelStart drops the pending registration of a container that exited
+// during its start delay. It reports whether one was pending.
+func (b *Bridge) cancelStart(containerId string) bool {
+	b.Lock()
+	defer b.Unlock()
+	timer, ok := b.starting[containerId]
+	if !ok {
+		return false
+	}
+	timer.Stop()
+	delete(b.starting, containerId)
+	Log.Infoln("exited before registering:", containerId[:12])
+	return true
+}
+
+// release removes the services of a held container that was not restarted
+// within the grace period.
+func (b *Bridge) release(containerId string) {
+	deregister := b.shouldRemove(containerId)
 	b.Lock()
 	defer b.Unlock()
+	if _, ok := b.held[containerId]; !ok {
+		return
+	}
+	delete(b.held, containerId)
+	Log.Infoln("not restarted:", containerId[:12])
+	b.removeServices(containerId, deregister)
+}
 
+// Refresh refreshes the TTLs of all services. Up to RefreshConcurrency
+// refreshes run at once, and they are started spread over the first half of
+// the refresh interval so large numbers of services finish before their TTLs
+// run out without hitting the registry all at once.
+func (b *Bridge) Refresh() {
+	started := time.Now()
+	b.Lock()
 	for containerId, deadContainer := range b.deadContainers {
 		deadContainer.TTL -= b.config.RefreshInterval
 		if deadContainer.TTL <= 0 {
 			delete(b.deadContainers, containerId)
 		}
 	}
-
-	for containerId, services := range b.services {
-		for _, service := range services {
-			err := b.registry.Refresh(service)
-			if err != nil {
-				Log.Warnln("refresh failed:", service.ID, err)
+	services := make([]*Service, 0)
+	for containerId, containerServices := range b.services {
+		if b.stopped[containerId] {
+			// let TTLs of stopped containers run out
+			continue
+		}
+		if b.heartbeat != nil && len(containerServices) > 0 {
+			b.heartbeat.watch(containerId)
+			if !b.heartbeat.alive(containerId) {
+				Log.Debugln("silent:", containerId[:12], "not refreshed")
 				continue
 			}
-			Log.Infoln("refreshed:", containerId[:12], service.ID)
 		}
+		for _, service := range containerServices {
+			if !service.noTTL {
+				services = append(services, service)
+			}
+		}
+	}
+	if b.host != nil {
+		services = append(services, b.host)
+	}
+	b.Unlock()
+
+	workers := b.config.RefreshConcurrency
+	if workers < 1 {
+		workers = 1
+	}
+	queue := make(chan *Service)
+	var wg sync.WaitGroup
+	for i := 0; i < workers; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			for service := range queue {
+				err := b.call(func() error { return b.registry.Refresh(service) })
+				if err != nil {
+					b.failures.Warnln("refresh failed:", err, service.ID)
+					continue
+				}
+				Log.Infoln("refreshed:", service.ID)
+			}
+		}()
+	}
+	interval := time.Duration(b.config.RefreshInterval) * time.Second
+	for i, service := range services {
+		if i > 0 {
+			time.Sleep(interval / 2 / time.Duration(len(services)))
+		}
+		queue <- service
+	}
+	close(queue)
+	wg.Wait()
+
+	took := time.Since(started)
+	Metrics.Set("registrator_refresh_duration_seconds", took.Seconds())
+	b.Lock()
+	b.refreshTook = took
+	b.Unlock()
+	if interval > 0 && took > interval {
+		Log.Warnf("refresh of %d services took %v, longer than the refresh interval of %v", len(services), took, interval)
 	}
 }
 
+// window in which an unchanged service is not sent to the registry again
+const registerDedupWindow = 10 * time.Second
+
+// window in which repeats of the same backend error are only counted, not logged
+const failureLogWindow = time.Minute
+
+type registration struct {
+	hash    string
+	fixed   string
+	at      time.Time
+	service *Service
+}
+
+func serviceHash(service *Service) string {
+	data, _ := json.Marshal(service)
+	sum := sha1.Sum(data)
+	return hex.EncodeToString(sum[:])
+}
+
+// fixedHash hashes a service leaving out its tags and attributes, to tell
+// changes a TagUpdater can apply in place apart.
+func fixedHash(service *Service) string {
+	fixed := *service
+	fixed.Tags = nil
+	fixed.Attrs = nil
+	return serviceHash(&fixed)
+}
+
+// sameScope reports whether two services are in the same namespace and
+// partition, for backends such as Consul Enterprise that have them. A Scoper
+// fills in the defaults, so a service naming the default scope matches one
+// that names none.
+func (b *Bridge) sameScope(one, other *Service) bool {
+	if scoper, ok := b.registry.(Scoper); ok {
+		return scoper.Scope(one) == scoper.Scope(other)
+	}
+	return one.Attrs["namespace"] == other.Attrs["namespace"] && one.Attrs["partition"] == other.Attrs["partition"]
+}
+
+// register sends a service to the registry, unless the same service with the
+// same content was sent within registerDedupWindow. If only its tags or
+// attributes changed and the registry is a TagUpdater, it is updated in place.
+func (b *Bridge) register(service *Service) error {
+	hash, fixed := serviceHash(service), fixedHash(service)
+	last, ok := b.registered[service.ID]
+	// a deregistration still waiting would remove it again
+	delete(b.pending, service.ID)
+	b.cancelRetry(service.ID)
+	if ok && last.hash == hash && time.Since(last.at) < registerDedupWindow {
+		Log.Debugln("unchanged:", service.ID)
+		return nil
+	}
+	var err error
+	if updater, canUpdate := b.registry.(TagUpdater); ok && canUpdate && last.hash != hash && last.fixed == fixed {
+		Log.Debugln("updating tags:", service.ID)
+		err = b.call(func() error { return updater.UpdateTags(service) })
+		b.audit.record(b.backend, "update_tags", service, err)
+	} else {
+		Traceln("registering:", *service)
+		err = b.call(func() error { return b.registry.Register(service) })
+		b.audit.record(b.backend, "register", service, err)
+	}
+	if err == nil {
+		b.registered[service.ID] = registration{hash, fixed, time.Now(), service}
+		b.changed("register", service)
+	}
+	return err
+}
+
+func (b *Bridge) deregister(service *Service) error {
+	err := b.call(func() error { return b.registry.Deregister(service) })
+	b.audit.record(b.backend, "deregister", service, err)
+	if err == nil {
+		delete(b.registered, service.ID)
+		b.changed("deregister", service)
+	}
+	return err
+}
+
 func (b *Bridge) Sync(quiet bool) {
 	b.Lock()
 	defer b.Unlock()
 
-	containers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{})
+	hostIpChanged := false
+	if ip, err := b.hostIp.HostIP(); err != nil {
+		Log.Warnln("unable to resolve host ip, keeping", b.resolvedIp+":", err)
+	} else if ip != b.resolvedIp {
+		Log.Infoln("Using host IP", ip)
+		hostIpChanged = b.resolvedIp != ""
+		b.resolvedIp = ip
+	}
+
+	containers, err := b.docker.ListContainers(dockerapi.ListContainersOptions{All: b.config.RegisterStopped})
 	if err != nil && quiet {
 		Log.Errorln("error listing containers, skipping sync")
 		return
 	} else if err != nil && !quiet {
 		Log.Fatalln(err)
 	}
+	defer func() { b.lastSync = time.Now() }()
 
-	Log.Infoln("Syncing services on %d containers", len(containers))
+	Log.Infof("Syncing services on %d containers", len(containers))
 
 	// NOTE: This assumes reregistering will do the right thing, i.e. nothing..
+	listed := make(map[string]bool)
+	var queue []syncEntry
+	var stopping []string
 	for _, listing := range containers {
+		listed[listing.ID] = true
+		stopped := b.config.RegisterStopped && listing.State != "running"
+		if !stopped && b.stopped[listing.ID] {
+			b.resume(listing.ID)
+			continue
+		}
+		if b.config.RegisterRestarting {
+			if listing.State == "restarting" {
+				b.warnRestarting(listing.ID)
+				continue
+			} else if b.restarting[listing.ID] {
+				b.restarted(listing.ID)
+				continue
+			}
+		}
 		services := b.services[listing.ID]
-		if services == nil {
-			b.add(listing.ID, quiet)
+		if b.starting[listing.ID] != nil {
+			continue
+		} else if services == nil {
+			if container := b.inspectNew(listing.ID); container != nil {
+				for _, service := range b.containerServices(container, quiet) {
+					queue = append(queue, syncEntry{listing.ID, service, false})
+				}
+			}
+		} else if hostIpChanged {
+			queue = append(queue, b.readdress(listing.ID, services)...)
 		} else {
 			for _, service := range services {
-				err := b.registry.Register(service)
-				if err != nil {
-					Log.Errorln("sync register failed:", service, err)
+				queue = append(queue, syncEntry{listing.ID, service, true})
+			}
+		}
+		if stopped {
+			stopping = append(stopping, listing.ID)
+		}
+	}
+
+	// higher SERVICE_REGISTER_PRIORITY first, otherwise in discovery order
+	sort.SliceStable(queue, func(i, j int) bool {
+		return queue[i].service.priority > queue[j].service.priority
+	})
+	for _, entry := range queue {
+		if !entry.tracked {
+			b.addService(entry.containerId, entry.service)
+		} else if err := b.register(entry.service); err != nil {
+			b.failures.Errorln("sync register failed:", err, entry.service)
+		}
+	}
+	for _, containerId := range stopping {
+		b.stop(containerId)
+	}
+
+	if b.config.HostService {
+		b.registerHost()
+	}
+
+	// Prune services of containers that exited without us seeing the event
+	if b.config.Cleanup {
+		for containerId, services := range b.services {
+			if listed[containerId] || b.held[containerId] != nil {
+				continue
+			}
+			for _, service := range services {
+				if err := b.deregister(service); err != nil {
+					b.failures.Errorln("deregister failed:", err, service.ID)
+					b.pending[service.ID] = service
+					continue
 				}
+				Log.Infoln("pruned:", containerId[:12], service.ID)
 			}
+			delete(b.services, containerId)
+			delete(b.stopped, containerId)
+			delete(b.restarting, containerId)
+		}
+	}
+	for containerId := range b.unhealthy {
+		if !listed[containerId] {
+			b.forgetHealth(containerId)
 		}
 	}
 
@@ -121,12 +902,17 @@ func (b *Bridge) Sync(quiet bool) {
 	if b.config.Cleanup {
 		Log.Infoln("Cleaning up dangling services")
 
-		extServices, err := b.registry.Services()
+		var extServices []*Service
+		err := b.call(func() (err error) {
+			extServices, err = b.registry.Services()
+			return
+		})
 		if err != nil {
-			Log.Errorln("cleanup failed:", err)
+			b.failures.Errorln("cleanup failed:", err)
 			return
 		}
 
+		var dangling []*Service
 	Outer:
 		for _, extService := range extServices {
 			matches := serviceIDPattern.FindStringSubmatch(extService.ID)
@@ -139,26 +925,102 @@ func (b *Bridge) Sync(quiet bool) {
 				// ignore because registered on a different host
 				continue
 			}
+			if !b.owned(extService) {
+				// ignore because another tool or instance registered it
+				continue
+			}
 			serviceContainerName := matches[2]
 			for _, listing := range b.services {
 				for _, service := range listing {
-					if service.Name == extService.Name && serviceContainerName == service.Origin.container.Name[1:] {
+					if service.Name == extService.Name && serviceContainerName == service.Origin.container.Name[1:] && b.sameScope(service, extService) {
 						continue Outer
 					}
 				}
 			}
 			Log.Infoln("dangling:", extService.ID)
-			err := b.registry.Deregister(extService)
-			if err != nil {
-				Log.Errorln("deregister failed:", extService.ID, err)
-				continue
+			dangling = append(dangling, extService)
+		}
+		b.deregisterAll(dangling)
+	}
+}
+
+// deregisterAll removes services in one batch when the adapter supports it,
+// and one by one otherwise or when the batch fails.
+func (b *Bridge) deregisterAll(services []*Service) {
+	if batcher, ok := b.registry.(BatchDeregisterer); ok && len(services) > 1 {
+		err := b.call(func() error { return batcher.BatchDeregister(services) })
+		if err == nil {
+			for _, service := range services {
+				b.audit.record(b.backend, "deregister", service, nil)
+				delete(b.registered, service.ID)
+				b.changed("deregister", service)
+				Log.Infoln(service.ID, "removed")
 			}
-			Log.Infoln(extService.ID, "removed")
+			return
 		}
+		b.failures.Warnln("batch deregister failed, removing one by one:", err)
 	}
+	for _, service := range services {
+		if err := b.deregister(service); err != nil {
+			b.failures.Errorln("deregister failed:", err, service.ID)
+			continue
+		}
+		Log.Infoln(service.ID, "removed")
+	}
+}
+
+// syncEntry is a service to register in a sync, tracked if it is
+// registered already.
+type syncEntry struct {
+	containerId string
+	service     *Service
+	tracked     bool
+}
+
+// readdress builds the services of a tracked container again after the host
+// IP changed, as their addresses may have moved with it. Services whose IP
+// changed are deregistered, and all are queued to be registered as new ones.
+// Callers hold the lock.
+func (b *Bridge) readdress(containerId string, services []*Service) []syncEntry {
+	container, err := b.docker.InspectContainer(containerId)
+	if err != nil {
+		Log.Errorln("unable to inspect container:", containerId[:12], err)
+		entries := make([]syncEntry, 0, len(services))
+		for _, service := range services {
+			entries = append(entries, syncEntry{containerId, service, true})
+		}
+		return entries
+	}
+	current := make(map[string]*Service)
+	var entries []syncEntry
+	for _, service := range b.containerServices(container, true) {
+		current[service.ID] = service
+		entries = append(entries, syncEntry{containerId, service, false})
+	}
+	for _, service := range services {
+		if moved, ok := current[service.ID]; ok && moved.IP == service.IP {
+			continue
+		}
+		if err := b.deregister(service); err != nil {
+			b.failures.Errorln("deregister failed:", err, service.ID)
+			continue
+		}
+		Log.Infoln("readdressed:", containerId[:12], service.ID)
+	}
+	delete(b.services, containerId)
+	return entries
 }
 
 func (b *Bridge) add(containerId string, quiet bool) {
+	if container := b.inspectNew(containerId); container != nil {
+		b.addContainer(container, quiet)
+	}
+}
+
+// inspectNew inspects a container to add, returning nil if it has services
+// already or can't be inspected.
+func (b *Bridge) inspectNew(containerId string) *dockerapi.Container {
+	delete(b.retained, containerId)
 	if d := b.deadContainers[containerId]; d != nil {
 		b.services[containerId] = d.Services
 		delete(b.deadContainers, containerId)
@@ -167,90 +1029,393 @@ func (b *Bridge) add(containerId string, quiet bool) {
 	if b.services[containerId] != nil {
 		Log.Infoln("container, ", containerId[:12], ", already exists, ignoring")
 		// Alternatively, remove and readd or resubmit.
-		return
+		return nil
 	}
 
 	container, err := b.docker.InspectContainer(containerId)
 	if err != nil {
 		Log.Errorln("unable to inspect container:", containerId[:12], err)
-		return
+		b.skipped(containerId, skipExtractionError, err)
+		return nil
+	}
+	return container
+}
+
+// reasons a container or port is not registered, counted per reason in
+// registrator_skipped_total
+const (
+	skipNoPorts         = "no-ports"
+	skipIgnored         = "ignored"
+	skipFiltered        = "filtered"
+	skipNoName          = "no-name-required"
+	skipExtractionError = "extraction-error"
+	skipMaxServices     = "max-services"
+	skipUnhealthy       = "unhealthy"
+)
+
+// skipped accounts for a container, or one of its ports, that is not
+// registered, so operators can tell why from the metrics and debug log.
+func (b *Bridge) skipped(containerId, reason string, detail ...interface{}) {
+	Metrics.Add(`registrator_skipped_total{reason="`+reason+`"}`, 1)
+	if len(containerId) > 12 {
+		containerId = containerId[:12]
+	}
+	Log.Debugln(append([]interface{}{"skipped:", containerId, reason}, detail...)...)
+}
+
+func (b *Bridge) addContainer(container *dockerapi.Container, quiet bool) {
+	for _, service := range b.containerServices(container, quiet) {
+		b.addService(container.ID, service)
+	}
+}
+
+// containerServices returns the services to register for a container, in
+// discovery order.
+func (b *Bridge) containerServices(container *dockerapi.Container, quiet bool) []*Service {
+	if project := b.config.ComposeProject; project != "" && container.Config.Labels[composeProjectLabel] != project {
+		if !quiet {
+			Log.Infoln("ignored:", container.ID[:12], "not in compose project", project)
+		}
+		b.skipped(container.ID, skipFiltered, "not in compose project", project)
+		return nil
+	}
+	if b.unhealthy[container.ID] {
+		if container.State.Health.Status == "unhealthy" {
+			b.skipped(container.ID, skipUnhealthy)
+			return nil
+		}
+		// recovered without the event reaching us
+		delete(b.unhealthy, container.ID)
+	}
+	if rule := b.globallyIgnored(container); rule != "" {
+		if !quiet {
+			Log.Infoln("ignored:", container.ID[:12], "matches", rule)
+		}
+		b.skipped(container.ID, skipIgnored, "matches", rule)
+		return nil
+	}
+
+	preferred, err := filterIPs(b.config.PublishIpFilter)
+	if err != nil {
+		Log.Warnln("unable to resolve publish ip filter:", b.config.PublishIpFilter, err)
 	}
 
 	ports := make(map[string]ServicePort)
 
 	// Extract configured host port mappings, relevant when using --net=host
 	for port, published := range container.HostConfig.PortBindings {
-		ports[string(port)] = servicePort(container, port, published)
+		ports[string(port)] = servicePort(container, port, published, preferred)
 	}
 
 	// Extract runtime port mappings, relevant when using --net=bridge
 	for port, published := range container.NetworkSettings.Ports {
-		ports[string(port)] = servicePort(container, port, published)
+		ports[string(port)] = servicePort(container, port, published, preferred)
 	}
 
-	if len(ports) == 0 && !quiet {
-		Log.Warnln("ignored:", container.ID[:12], "no published ports")
-		return
+	// Ports the Swarm service publishes on the ingress network
+	b.addSwarmPorts(container, ports, preferred)
+
+	// Ports only exposed, e.g. with EXPOSE, are registered on the container
+	// IP with -internal and -global
+	if b.config.Internal || b.config.Global {
+		for port := range container.Config.ExposedPorts {
+			if _, ok := ports[string(port)]; !ok {
+				ports[string(port)] = servicePort(container, port, nil, preferred)
+			}
+		}
 	}
 
+	fileVars, err := readServiceFile(container, b.config.ServiceFileLabel)
+	if err != nil {
+		Log.Warnln("unable to read service file:", container.ID[:12], err)
+	}
+	if _, err := serviceLabelVars(container.Config, b.imageLabelsOf(container), b.tagsSeparator()); err != nil {
+		Log.Warnln("ignored:", container.ID[:12], err)
+	}
+	for key, port := range ports {
+		port.fileVars = fileVars
+		ports[key] = port
+	}
+
+	if len(ports) == 0 {
+		if !quiet {
+			Log.Warnln("ignored:", container.ID[:12], "no published ports")
+		}
+		b.skipped(container.ID, skipNoPorts)
+		return nil
+	}
+
+	if b.config.PrimaryPortOnly && len(ports) > 1 {
+		if primary, ok := b.primaryPort(ports); ok {
+			Log.Debugln("primary port:", container.ID[:12], primary)
+			ports = map[string]ServicePort{primary: ports[primary]}
+		}
+	}
+
+	var found []*Service
 	for _, port := range ports {
-		if b.config.Internal != true && port.HostPort == "" {
+		if !b.config.Internal && !b.config.Global && port.HostPort == "" {
 			if !quiet {
 				Log.Warnln("ignored:", container.ID[:12], "port", port.ExposedPort, "not published on host")
 			}
+			b.skipped(container.ID, skipNoPorts, "port", port.ExposedPort, "not published on host")
 			continue
 		}
-		service := b.newService(port, len(ports) > 1)
-		if service == nil {
+		// with SrvMultiport all ports share the service name, each one
+		// becoming another SRV target
+		services := b.newServices(port, len(ports) > 1 && !b.config.SrvMultiport)
+		if services == nil {
 			if !quiet {
 				Log.Warnln("ignored:", container.ID[:12], "service on port", port.ExposedPort)
 			}
 			continue
 		}
-		err := b.registry.Register(service)
+		found = append(found, services...)
+	}
+	return found
+}
+
+// addService registers a new service of a container and tracks it.
+func (b *Bridge) addService(containerId string, service *Service) {
+	if len(service.requires) > 0 {
+		missing, err := b.missingRequired(service)
 		if err != nil {
-			Log.Errorln("register failed:", service, err)
+			b.failures.Warnln("unable to list services:", err, service.ID)
+		}
+		if missing != "" {
+			b.awaitRequired(service, missing)
+			return
+		}
+	}
+	b.registerService(containerId, service)
+}
+
+// registerService registers a service of a container and, once it is
+// registered, tracks it. Callers hold the lock.
+func (b *Bridge) registerService(containerId string, service *Service) {
+	if max := b.config.MaxServices; max > 0 && b.countServices() >= max {
+		Log.Errorln("NOT REGISTERED:", service.ID, "would exceed -max-services", max)
+		b.skipped(containerId, skipMaxServices, "service", service.ID)
+		return
+	}
+	err := b.register(service)
+	if err != nil {
+		b.failures.Errorln("register failed:", err, service)
+		b.registerLater(service, err)
+		return
+	}
+	b.services[containerId] = append(b.services[containerId], service)
+	Log.Infoln("added:", containerId[:12], service.ID)
+	b.heartbeat.watch(containerId)
+}
+
+// delay before the first re-inspect of a container without network settings,
+// doubled on every further attempt
+var inspectRetryDelay = 250 * time.Millisecond
+
+// waitForNetwork re-inspects a just started container, up to InspectRetries
+// times with growing delays, until Docker has filled in its network settings.
+// Inspecting right after the start event may otherwise yield an empty IP.
+func (b *Bridge) waitForNetwork(containerId string) {
+	delay := inspectRetryDelay
+	for attempt := 0; attempt < b.config.InspectRetries; attempt++ {
+		container, err := b.docker.InspectContainer(containerId)
+		if err != nil || networkReady(container) {
+			return
+		}
+		Log.Debugln("network settings not ready:", containerId[:12])
+		time.Sleep(delay)
+		delay *= 2
+	}
+}
+
+// stop keeps the services of an exited container registered, but puts them
+// into maintenance until the container is started again.
+func (b *Bridge) stop(containerId string) {
+	services := b.services[containerId]
+	if services == nil {
+		return
+	}
+	b.stopped[containerId] = true
+	for _, service := range services {
+		err := b.call(func() error {
+			return b.registry.(MaintenanceAdapter).Maintenance(service, true, "container stopped")
+		})
+		b.audit.record(b.backend, "maintenance_on", service, err)
+		if err != nil {
+			b.failures.Errorln("maintenance failed:", err, service.ID)
 			continue
 		}
-		b.services[container.ID] = append(b.services[container.ID], service)
-		Log.Infoln("added:", container.ID[:12], service.ID)
+		Log.Infoln("stopped:", containerId[:12], service.ID)
 	}
 }
 
-func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
-	container := port.container
-	defaultName := strings.Split(path.Base(container.Config.Image), ":")[0]
+// resume registers the services of a restarted container again and takes
+// them out of maintenance.
+func (b *Bridge) resume(containerId string) {
+	delete(b.stopped, containerId)
+	delete(b.services, containerId)
+	b.add(containerId, false)
+	for _, service := range b.services[containerId] {
+		err := b.call(func() error {
+			return b.registry.(MaintenanceAdapter).Maintenance(service, false, "")
+		})
+		b.audit.record(b.backend, "maintenance_off", service, err)
+		if err != nil {
+			b.failures.Errorln("maintenance failed:", err, service.ID)
+			continue
+		}
+		Log.Infoln("resumed:", containerId[:12], service.ID)
+	}
+}
 
-	// not sure about this logic. kind of want to remove it.
-	hostname := Hostname
-	if hostname == "" {
-		hostname = port.HostIP
+// primaryPort picks the one port registered with -primary-port-only out of
+// the ports that would be registered, leaving out ports that are ignored,
+// not mapped or given an empty SERVICE_<port>_NAME. The "named" heuristic
+// prefers the lowest port given a SERVICE_<port>_NAME; otherwise, and when no
+// port is named, the lowest port is picked.
+func (b *Bridge) primaryPort(ports map[string]ServicePort) (string, bool) {
+	keys := make([]string, 0, len(ports))
+	named := make(map[string]bool, len(ports))
+	for key, port := range ports {
+		if !b.config.Internal && !b.config.Global && port.HostPort == "" {
+			continue
+		}
+		metadata, metadataFromPort, mapped := b.portMetadata(port)
+		if !mapped || portSkip(metadata, metadataFromPort) != "" {
+			continue
+		}
+		keys = append(keys, key)
+		named[key] = metadataFromPort["name"] && metadata["name"] != ""
 	}
-	if port.HostIP == "0.0.0.0" {
-		ip, err := net.ResolveIPAddr("ip", hostname)
-		if err == nil {
-			port.HostIP = ip.String()
+	if len(keys) == 0 {
+		return "", false
+	}
+	sort.Slice(keys, func(i, j int) bool {
+		pi, _ := strconv.Atoi(ports[keys[i]].ExposedPort)
+		pj, _ := strconv.Atoi(ports[keys[j]].ExposedPort)
+		if pi != pj {
+			return pi < pj
 		}
+		return keys[i] < keys[j]
+	})
+	if b.config.PrimaryPortBy != "lowest" {
+		for _, key := range keys {
+			if named[key] {
+				return key, true
+			}
+		}
+	}
+	return keys[0], true
+}
+
+// portMetadata returns the metadata of a port with its mapping rule applied.
+// mapped is false if the rule leaves the port out.
+func (b *Bridge) portMetadata(port ServicePort) (metadata map[string]string, metadataFromPort map[string]bool, mapped bool) {
+	container := port.container
+	metadata, metadataFromPort = serviceMetaData(container.Config, b.imageLabelsOf(container), port.fileVars, port.ExposedPort, b.tagsSeparator())
+	if rule := b.mappingOf(container); rule != nil {
+		if !rule.Service.registers(port) {
+			return nil, nil, false
+		}
+		rule.Service.apply(metadata, metadataFromPort, b.tagsSeparator())
 	}
+	return metadata, metadataFromPort, true
+}
 
-	if b.config.HostIp != "" {
-		port.HostIP = b.config.HostIp
+// portSkip returns the reason the metadata of a port skips it, or "" if a
+// service is registered for it.
+func portSkip(metadata map[string]string, metadataFromPort map[string]bool) string {
+	if mapDefault(metadata, "ignore", "") != "" {
+		return skipIgnored
+	}
+	// SERVICE_<port>_NAME set but empty skips the port, while an unset
+	// name falls back to the default
+	if name, ok := metadata["name"]; ok && name == "" && metadataFromPort["name"] {
+		return skipNoName
 	}
+	return ""
+}
 
-	if b.config.Global {
-		port.HostIP = container.NetworkSettings.IPAddress
-		if port.HostIP == "" {
-			net, ok := container.NetworkSettings.Networks[container.HostConfig.NetworkMode]
-			if ok {
-				port.HostIP = net.IPAddress
+// newServices returns the service for a port followed by a copy of it for
+// each name listed in SERVICE_ALIASES.
+func (b *Bridge) newServices(port ServicePort, isgroup bool) []*Service {
+	service := b.newService(port, isgroup)
+	if service == nil {
+		return nil
+	}
+	aliases := combineTags(",", service.Attrs["aliases"])
+	delete(service.Attrs, "aliases")
+
+	services := []*Service{service}
+	for _, alias := range aliases {
+		if alias == service.Name {
+			continue
+		}
+		aliased := *service
+		aliased.ID = service.ID + ":" + alias
+		aliased.Name = alias
+		aliased.Attrs = make(map[string]string, len(service.Attrs))
+		for k, v := range service.Attrs {
+			aliased.Attrs[k] = v
+		}
+		services = append(services, &aliased)
+	}
+	if namer, ok := b.registry.(DNSNamer); ok && namer.NamesDNS() && b.config.DNSSafeNames {
+		for _, service := range services {
+			if safe := dnsSafeName(service.Name); safe != service.Name {
+				Log.Warnln("renamed:", service.ID, service.Name, "to", safe, "for DNS")
+				service.Attrs["original_name"] = service.Name
+				service.Name = safe
 			}
 		}
 	}
+	return services
+}
+
+// imageLabelsOf returns the labels of the container's image. Images are
+// immutable, so the labels are cached by image ID.
+func (b *Bridge) imageLabelsOf(container *dockerapi.Container) map[string]string {
+	if labels, ok := b.imageLabels[container.Image]; ok || container.Image == "" {
+		return labels
+	}
+	image, err := b.docker.InspectImage(container.Image)
+	if err != nil {
+		Log.Debugln("unable to inspect image:", container.Image, err)
+		return nil
+	}
+	var labels map[string]string
+	if image.Config != nil {
+		labels = image.Config.Labels
+	}
+	b.imageLabels[container.Image] = labels
+	return labels
+}
+
+func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
+	container := port.container
+	defaultName := strings.Split(path.Base(container.Config.Image), ":")[0]
+	if name := swarmServiceName(container.Config.Labels); b.config.SwarmAware && name != "" {
+		defaultName = name
+	}
+	if b.config.NetworkAlias {
+		if alias := networkAlias(container); alias != "" {
+			defaultName = alias
+		}
+	}
 
-	metadata, metadataFromPort := serviceMetaData(container.Config, port.ExposedPort)
+	hostname := Hostname
+	if hostname == "" {
+		hostname = port.HostIP
+	}
 
-	ignore := mapDefault(metadata, "ignore", "")
-	if ignore != "" {
+	metadata, metadataFromPort, mapped := b.portMetadata(port)
+	if !mapped {
+		b.skipped(container.ID, skipIgnored, "port", port.ExposedPort, "not in mapping")
+		return nil
+	}
+	if reason := portSkip(metadata, metadataFromPort); reason != "" {
+		b.skipped(container.ID, reason, "port", port.ExposedPort)
 		return nil
 	}
 
@@ -261,35 +1426,103 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 	if isgroup && !metadataFromPort["name"] {
 		service.Name += "-" + port.ExposedPort
 	}
-	var p int
-	if b.config.Internal == true {
-		service.IP = port.ExposedIP
-		p, _ = strconv.Atoi(port.ExposedPort)
-	} else {
-		service.IP = port.HostIP
-		p, _ = strconv.Atoi(port.HostPort)
+	ip, p, err := b.addresses.ResolveAddress(container, port, b.hostIPOf(container, port))
+	if err != nil {
+		b.skipped(container.ID, skipExtractionError, "port", port.ExposedPort, err)
+		return nil
 	}
+	service.IP = ip
 	service.Port = p
 
 	if port.PortType == "udp" {
-		service.Tags = combineTags(
+		service.Tags = combineTags(b.tagsSeparator(),
 			mapDefault(metadata, "tags", ""), b.config.ForceTags, "udp")
 		service.ID = service.ID + ":udp"
 	} else {
-		service.Tags = combineTags(
+		service.Tags = combineTags(b.tagsSeparator(),
 			mapDefault(metadata, "tags", ""), b.config.ForceTags)
 	}
+	if b.config.ProtocolTags && !hasTag(service.Tags, "_"+port.PortType) {
+		// for consumers looking services up by SRV, e.g. _web._tcp
+		service.Tags = append(service.Tags, "_"+port.PortType)
+	}
+	if b.config.Cleanup && !b.config.CleanupForeign {
+		service.Tags = append(service.Tags, ownerTag())
+	}
+	if b.config.TagLabelPrefix != "" {
+		service.Tags = append(service.Tags, labelTags(container.Config.Labels, b.config.TagLabelPrefix)...)
+	}
+	if b.config.OCILabelTags {
+		service.Tags = append(service.Tags, ociTags(container.Config.Labels, b.imageLabelsOf(container))...)
+	}
 
 	id := mapDefault(metadata, "id", "")
 	if id != "" {
 		service.ID = id
 	}
 
+	if b.config.MaxPort > 0 {
+		service.Port = advertisedPort(service.ID, b.config.MinPort, b.config.MaxPort)
+	}
+
 	delete(metadata, "id")
 	delete(metadata, "tags")
 	delete(metadata, "name")
+	delete(metadata, "file")
+	delete(metadata, "start_delay")
+	tagged, err := taggedAddresses(metadata)
+	if err != nil {
+		Log.Warnln("ignored:", container.ID[:12], err)
+	}
+	service.TaggedAddresses = tagged
+	priority, err := strconv.Atoi(mapDefault(metadata, "register_priority", "0"))
+	if err != nil {
+		Log.Warnln("ignored:", container.ID[:12], "register priority", metadata["register_priority"]+":", err)
+	}
+	service.priority = priority
+	delete(metadata, "register_priority")
+	service.requires = parseRequires(metadata["requires"])
+	delete(metadata, "requires")
+	noTTL, _ := strconv.ParseBool(metadata["no_ttl"])
+	delete(metadata, "no_ttl")
+	ttl := b.serviceTTL(service.ID, metadata["ttl"])
+	delete(metadata, "ttl")
+	// SERVICE_DNS_TTL, or else -dns-ttl, is the record TTL of DNS backends
+	if value, ok := metadata["dns_ttl"]; ok {
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			Log.Warnln("ignored:", container.ID[:12], "dns ttl", value, "is not a non-negative number")
+			delete(metadata, "dns_ttl")
+		}
+	}
+	if _, ok := metadata["dns_ttl"]; !ok && b.config.DNSTTL > 0 {
+		metadata["dns_ttl"] = strconv.Itoa(b.config.DNSTTL)
+	}
+	for k, v := range passthroughEnv(container.Config.Env, b.config.PassthroughEnv) {
+		if _, ok := metadata[k]; !ok {
+			metadata[k] = v
+		}
+	}
+	for k, v := range healthcheckAttrs(container.Config.Healthcheck) {
+		if _, ok := metadata[k]; !ok {
+			metadata[k] = v
+		}
+	}
+	weight, hasWeight := metadata["weight"]
+	delete(metadata, "weight")
 	service.Attrs = metadata
-	service.TTL = b.config.RefreshTtl
+	if noTTL {
+		service.noTTL = true
+	} else {
+		service.TTL = ttl
+	}
+	service.Weight = containerWeight(container, b.config.WeightFrom)
+	if hasWeight {
+		if n, err := strconv.Atoi(weight); err == nil && n > 0 {
+			service.Weight = n
+		} else {
+			Log.Warnln("ignored:", container.ID[:12], "weight", weight, "is not a positive number")
+		}
+	}
 
 	return service
 }
@@ -297,13 +1530,24 @@ func (b *Bridge) newService(port ServicePort, isgroup bool) *Service {
 func (b *Bridge) remove(containerId string, deregister bool) {
 	b.Lock()
 	defer b.Unlock()
+	b.removeServices(containerId, deregister)
+}
 
+func (b *Bridge) removeServices(containerId string, deregister bool) {
+	if timer, ok := b.held[containerId]; ok {
+		timer.Stop()
+		delete(b.held, containerId)
+	}
+	b.cancelRetries(containerId)
+	b.cancelAwaiting(containerId)
 	if deregister {
 		deregisterAll := func(services []*Service) {
 			for _, service := range services {
-				err := b.registry.Deregister(service)
+				err := b.deregister(service)
 				if err != nil {
-					Log.Errorln("deregister failed:", service.ID, err)
+					b.failures.Errorln("deregister failed:", err, service.ID)
+					b.pending[service.ID] = service
+					b.deregisterLater(service, err)
 					continue
 				}
 				Log.Infoln("removed:", containerId[:12], service.ID)
@@ -314,13 +1558,24 @@ func (b *Bridge) remove(containerId string, deregister bool) {
 			deregisterAll(d.Services)
 			delete(b.deadContainers, containerId)
 		}
-	} else if b.config.RefreshTtl != 0 && b.services[containerId] != nil {
-		// need to stop the refreshing, but can't delete it yet
-		b.deadContainers[containerId] = &DeadContainer{b.config.RefreshTtl, b.services[containerId]}
+	} else if b.services[containerId] != nil {
+		// kept registered, until the container is destroyed
+		b.retained[containerId] = b.services[containerId]
+		if b.config.RefreshTtl != 0 {
+			// need to stop the refreshing, but can't delete it yet
+			b.deadContainers[containerId] = &DeadContainer{b.config.RefreshTtl, b.services[containerId]}
+		}
 	}
+	b.heartbeat.forget(containerId)
 	delete(b.services, containerId)
+	delete(b.stopped, containerId)
+	delete(b.restarting, containerId)
+	b.forgetHealth(containerId)
 }
 
+// label docker-compose sets to the project a container belongs to
+const composeProjectLabel = "com.docker.compose.project"
+
 // bit set on ExitCode if it represents an exit via a signal
 var dockerSignaledBit = 128
 
@@ -333,27 +1588,71 @@ func (b *Bridge) shouldRemove(containerId string) bool {
 		// the container has already been removed from Docker
 		// e.g. probabably run with "--rm" to remove immediately
 		// so its exit code is not accessible
-		Log.Errorln("registrator: container %v was removed, could not fetch exit code", containerId[:12])
+		Log.Errorf("registrator: container %v was removed, could not fetch exit code", containerId[:12])
 		return true
 	}
 
 	switch {
 	case err != nil:
-		Log.Errorln("registrator: error fetching status for container %v on \"die\" event: %v\n", containerId[:12], err)
+		Log.Errorf("registrator: error fetching status for container %v on \"die\" event: %v", containerId[:12], err)
 		return false
 	case container.State.Running:
-		Log.Errorln("registrator: not removing container %v, still running", containerId[:12])
+		Log.Errorf("registrator: not removing container %v, still running", containerId[:12])
 		return false
-	case container.State.ExitCode == 0:
-		return true
-	case container.State.ExitCode&dockerSignaledBit == dockerSignaledBit:
-		return true
 	}
-	return false
+
+	exited := container.State.ExitCode == 0 || container.State.ExitCode&dockerSignaledBit == dockerSignaledBit
+	labeled, ok := b.successLabel(container)
+	if !ok {
+		return exited
+	}
+	// the label overrides the exit code, either signals success or both must
+	switch b.config.SuccessMode {
+	case "any":
+		return exited || labeled
+	case "all":
+		return exited && labeled
+	default:
+		return labeled
+	}
+}
+
+// successLabel reports whether the container carries the success label with
+// its value, and whether it has the label at all.
+func (b *Bridge) successLabel(container *dockerapi.Container) (success bool, ok bool) {
+	if b.config.SuccessLabel == "" || container.Config == nil {
+		return false, false
+	}
+	kv := strings.SplitN(b.config.SuccessLabel, "=", 2)
+	value, ok := container.Config.Labels[kv[0]]
+	if !ok {
+		return false, false
+	}
+	return len(kv) == 1 || value == kv[1], true
 }
 
 var Hostname string
 
+// ownerTag marks the services registered by this host, so -cleanup leaves
+// services registered by others alone.
+func ownerTag() string {
+	return "registrator-host=" + Hostname
+}
+
+// owned reports whether a service listed by the registry may be cleaned up as
+// registered by this host: it carries the ownership tag, CleanupForeign is
+// set, or the registry does not list tags, leaving only the hostname in the
+// ID to go by.
+func (b *Bridge) owned(service *Service) bool {
+	if b.config.CleanupForeign {
+		return true
+	}
+	if lister, ok := b.registry.(TagLister); !ok || !lister.ListsTags() {
+		return true
+	}
+	return hasTag(service.Tags, ownerTag())
+}
+
 func init() {
 	// It's ok for Hostname to ultimately be an empty string
 	// An empty string will fall back to trying to make a best guess
@@ -1,9 +1,17 @@
 package bridge
 
 import (
+	"bytes"
+	"errors"
+	"io"
+	"sort"
+	"strconv"
 	"testing"
+	"time"
 
+	dockerapi "github.com/fsouza/go-dockerclient"
 	"github.com/stretchr/testify/assert"
+	. "github.com/xytis/registrator/common"
 )
 
 func TestNewError(t *testing.T) {
@@ -12,6 +20,23 @@ func TestNewError(t *testing.T) {
 	assert.Error(t, err)
 }
 
+func TestNewUnknownScheme(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	bridge, err := New(nil, "nope://localhost", Config{})
+	assert.Nil(t, bridge)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "unrecognized adapter: nope://localhost (available: ")
+	assert.Contains(t, err.Error(), "fake")
+}
+
+func TestNewInvalidURI(t *testing.T) {
+	Register(new(validatingFactory), "validating")
+	defer Unregister("validating")
+	bridge, err := New(nil, "validating://", Config{})
+	assert.Nil(t, bridge)
+	assert.EqualError(t, err, "bad adapter uri: validating://: host required")
+}
+
 func TestNewValid(t *testing.T) {
 	Register(new(fakeFactory), "fake")
 	// Note: the following is valid for New() since it does not
@@ -21,3 +46,1199 @@ func TestNewValid(t *testing.T) {
 	assert.NotNil(t, bridge)
 	assert.NoError(t, err)
 }
+
+func TestRegisterStoppedCycle(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	docker := newFakeDocker(container)
+	bridge, err := New(docker, "fake://", Config{RegisterStopped: true})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	assert.Len(t, adapter.services, 1)
+	id := bridge.services[container.ID][0].ID
+	assert.False(t, adapter.maintenance[id])
+
+	container.State.Running = false
+	bridge.RemoveOnExit(container.ID)
+	assert.Len(t, adapter.services, 1)
+	assert.True(t, adapter.maintenance[id])
+
+	container.State.Running = true
+	bridge.Add(container.ID)
+	assert.Len(t, adapter.services, 1)
+	assert.False(t, adapter.maintenance[id])
+}
+
+func TestRegisterStoppedSync(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.State.Running = false
+	docker := newFakeDocker(container)
+	bridge, err := New(docker, "fake://", Config{RegisterStopped: true})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Sync(true)
+	assert.Len(t, adapter.services, 1)
+	id := bridge.services[container.ID][0].ID
+	assert.True(t, adapter.maintenance[id])
+
+	container.State.Running = true
+	bridge.Sync(true)
+	assert.False(t, adapter.maintenance[id])
+}
+
+func TestServiceAliases(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"SERVICE_NAME=web", "SERVICE_80_ALIASES=web-canary,web-v2"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{DeregisterCheck: "always"})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	names := make([]string, 0)
+	for _, service := range adapter.services {
+		names = append(names, service.Name)
+		assert.Equal(t, 8080, service.Port)
+		assert.NotContains(t, service.Attrs, "aliases")
+	}
+	assert.ElementsMatch(t, []string{"web", "web-canary", "web-v2"}, names)
+
+	bridge.RemoveOnExit(container.ID)
+	assert.Empty(t, adapter.services)
+}
+
+func TestEmptyPortNameSkipsPort(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "443/tcp": "8443", "9090/tcp": "9090"})
+	container.Config.Env = []string{"SERVICE_9090_NAME=", "SERVICE_443_NAME=web-tls"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	names := make([]string, 0)
+	for _, service := range adapter.services {
+		names = append(names, service.Name)
+	}
+	assert.ElementsMatch(t, []string{"test-80", "web-tls"}, names)
+}
+
+func TestPrimaryPortOnly(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	for _, test := range []struct {
+		by   string
+		env  []string
+		want string
+		port int
+	}{
+		{"lowest", nil, "test", 8000},
+		{"lowest", []string{"SERVICE_443_NAME=web"}, "test", 8000},
+		{"named", []string{"SERVICE_443_NAME=web"}, "web", 8443},
+		{"", nil, "test", 8000},
+		// ports that register no service are never primary
+		{"lowest", []string{"SERVICE_80_NAME="}, "test", 8443},
+		{"named", []string{"SERVICE_80_IGNORE=1", "SERVICE_443_NAME="}, "test", 18080},
+	} {
+		container := publishedContainer("0123456789abcdef", map[string]string{"8080/tcp": "18080", "443/tcp": "8443", "80/tcp": "8000"})
+		container.Config.Env = test.env
+		bridge, err := New(newFakeDocker(container), "fake://", Config{PrimaryPortOnly: true, PrimaryPortBy: test.by})
+		assert.NoError(t, err)
+		adapter := bridge.registry.(*fakeAdapter)
+
+		bridge.Add(container.ID)
+		assert.Len(t, adapter.services, 1, test.env)
+		for _, service := range adapter.services {
+			assert.Equal(t, test.want, service.Name, test.env)
+			assert.Equal(t, test.port, service.Port, test.env)
+		}
+	}
+
+	_, err := New(newFakeDocker(), "fake://", Config{PrimaryPortBy: "busiest"})
+	assert.Error(t, err)
+}
+
+func TestRestartPolicyHold(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.HostConfig.RestartPolicy = dockerapi.AlwaysRestart()
+	docker := newFakeDocker(container)
+	bridge, err := New(docker, "fake://", Config{DeregisterCheck: "always", RestartGrace: 1})
+	assert.NoError(t, err)
+	bridge.restartGrace = 20 * time.Millisecond
+	adapter := bridge.registry.(*fakeAdapter)
+
+	// restarted within the grace period, the services stay
+	bridge.Add(container.ID)
+	bridge.RemoveOnExit(container.ID)
+	assert.Len(t, adapter.services, 1)
+	bridge.Add(container.ID)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, adapter.services, 1)
+	assert.Empty(t, bridge.held)
+
+	// not restarted, the services go once the grace period is over
+	bridge.RemoveOnExit(container.ID)
+	assert.Len(t, adapter.services, 1)
+	assert.Eventually(t, func() bool {
+		adapter.Lock()
+		defer adapter.Unlock()
+		return len(adapter.services) == 0
+	}, time.Second, time.Millisecond)
+	bridge.Lock()
+	assert.Empty(t, bridge.services)
+	assert.Empty(t, bridge.held)
+	bridge.Unlock()
+
+	// containers without a restart policy are removed right away
+	container.HostConfig.RestartPolicy = dockerapi.NeverRestart()
+	bridge.Add(container.ID)
+	bridge.RemoveOnExit(container.ID)
+	assert.Empty(t, adapter.services)
+}
+
+func TestStartDelay(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"SERVICE_START_DELAY=20ms"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{DeregisterCheck: "always"})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	// registered once the delay has passed
+	bridge.Add(container.ID)
+	adapter.Lock()
+	assert.Empty(t, adapter.services)
+	adapter.Unlock()
+	assert.Eventually(t, func() bool {
+		adapter.Lock()
+		defer adapter.Unlock()
+		return len(adapter.services) == 1
+	}, time.Second, time.Millisecond)
+	bridge.Lock()
+	assert.Empty(t, bridge.services[container.ID][0].Attrs)
+	bridge.Unlock()
+
+	// exited during the delay, never registered
+	bridge.RemoveOnExit(container.ID)
+	bridge.Add(container.ID)
+	bridge.RemoveOnExit(container.ID)
+	time.Sleep(50 * time.Millisecond)
+	adapter.Lock()
+	assert.Empty(t, adapter.services)
+	adapter.Unlock()
+	bridge.Lock()
+	assert.Empty(t, bridge.starting)
+	bridge.Unlock()
+}
+
+func TestStartDelayEndsWhenHealthy(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{StartDelay: 60})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	container.State.Health.Status = "starting"
+	bridge.Reconcile(container.ID)
+	assert.Empty(t, adapter.services)
+
+	container.State.Health.Status = "healthy"
+	bridge.Reconcile(container.ID)
+	assert.Len(t, adapter.services, 1)
+	assert.Empty(t, bridge.starting)
+}
+
+func TestUnhealthyGrace(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{UnhealthyGrace: 1, WatchEvents: []string{"health_status"}})
+	assert.NoError(t, err)
+	bridge.unhealthyGrace = 20 * time.Millisecond
+	adapter := bridge.registry.(*fakeAdapter)
+	registered := func() int {
+		adapter.Lock()
+		defer adapter.Unlock()
+		return len(adapter.services)
+	}
+
+	// unhealthy once, healthy again within the grace period, stays
+	bridge.Add(container.ID)
+	container.State.Health.Status = "unhealthy"
+	bridge.HealthChanged(container.ID)
+	container.State.Health.Status = "healthy"
+	bridge.HealthChanged(container.ID)
+	time.Sleep(50 * time.Millisecond)
+	assert.Equal(t, 1, registered())
+	bridge.Lock()
+	assert.Empty(t, bridge.graced)
+	bridge.Unlock()
+
+	// unhealthy for the whole grace period, deregistered
+	container.State.Health.Status = "unhealthy"
+	bridge.HealthChanged(container.ID)
+	assert.Equal(t, 1, registered())
+	assert.Eventually(t, func() bool { return registered() == 0 }, time.Second, time.Millisecond)
+
+	// not registered again while unhealthy, but once healthy
+	bridge.Sync(false)
+	assert.Equal(t, 0, registered())
+	container.State.Health.Status = "healthy"
+	bridge.HealthChanged(container.ID)
+	assert.Equal(t, 1, registered())
+}
+
+func TestServiceRequires(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	defer func(interval time.Duration) { requiresPollInterval = interval }(requiresPollInterval)
+	requiresPollInterval = 10 * time.Millisecond
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"SERVICE_NAME=api", "SERVICE_REQUIRES=db"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	registered := func(name string) bool {
+		services, _ := adapter.Services()
+		for _, service := range services {
+			if service.Name == name {
+				return true
+			}
+		}
+		return false
+	}
+
+	// not registered while the dependency is missing
+	bridge.Add(container.ID)
+	time.Sleep(50 * time.Millisecond)
+	assert.False(t, registered("api"))
+
+	// registered once it appears in the backend
+	adapter.Register(&Service{ID: "other:db:5432", Name: "db"})
+	assert.Eventually(t, func() bool { return registered("api") }, time.Second, time.Millisecond)
+	bridge.Lock()
+	assert.Len(t, bridge.services[container.ID], 1)
+	assert.NotContains(t, bridge.services[container.ID][0].Attrs, "requires")
+	assert.Empty(t, bridge.awaiting)
+	bridge.Unlock()
+
+	// exiting while waiting drops the registration
+	adapter.Deregister(&Service{ID: "other:db:5432"})
+	container.State.Running = false
+	bridge.RemoveOnExit(container.ID)
+	container.State.Running = true
+	bridge.Add(container.ID)
+	bridge.Lock()
+	assert.Len(t, bridge.awaiting, 1)
+	bridge.Unlock()
+	container.State.Running = false
+	bridge.RemoveOnExit(container.ID)
+	bridge.Lock()
+	assert.Empty(t, bridge.awaiting)
+	bridge.Unlock()
+}
+
+func TestServiceRequiresLookups(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	defer func(interval time.Duration) { requiresPollInterval = interval }(requiresPollInterval)
+	requiresPollInterval = time.Hour
+	api := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	api.Config.Env = []string{"SERVICE_NAME=api", "SERVICE_REQUIRES=db,cache"}
+	worker := publishedContainer("fedcba9876543210", map[string]string{"80/tcp": "8081"})
+	worker.Name = "/worker"
+	worker.Config.Env = []string{"SERVICE_NAME=worker", "SERVICE_REQUIRES=db"}
+	bridge, err := New(newFakeDocker(api, worker), "fake://", Config{})
+	assert.NoError(t, err)
+	adapter := &findingAdapter{fakeAdapter: bridge.registry.(*fakeAdapter)}
+	bridge.registry = adapter
+
+	// both wait, and are looked up by name rather than by listing
+	bridge.Add(api.ID)
+	bridge.Add(worker.ID)
+	assert.Len(t, bridge.awaiting, 2)
+	adapter.Register(&Service{ID: "other:db:5432", Name: "db"})
+
+	// one look serves all waiting services, each name looked up once
+	adapter.lookups = nil
+	bridge.checkAwaiting(bridge.awaitRound, time.Hour)
+	names := append([]string(nil), adapter.lookups...)
+	sort.Strings(names)
+	assert.Equal(t, []string{"cache", "db"}, names)
+	bridge.Lock()
+	assert.Len(t, bridge.services[worker.ID], 1)
+	assert.Empty(t, bridge.services[api.ID])
+	assert.Len(t, bridge.awaiting, 1)
+	bridge.Unlock()
+}
+
+func TestDNSTTL(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	for _, test := range []struct {
+		global int
+		env    string
+		want   string
+	}{
+		{0, "", ""},
+		{60, "", "60"},
+		{60, "SERVICE_DNS_TTL=300", "300"},
+		{0, "SERVICE_DNS_TTL=0", "0"},
+		{60, "SERVICE_DNS_TTL=-1", "60"},
+		{0, "SERVICE_DNS_TTL=long", ""},
+	} {
+		container.Config.Env = []string{test.env}
+		bridge, err := New(newFakeDocker(container), "fake://", Config{DNSTTL: test.global})
+		assert.NoError(t, err)
+		bridge.Add(container.ID)
+		assert.Equal(t, test.want, bridge.services[container.ID][0].Attrs["dns_ttl"], "-dns-ttl %d, %s", test.global, test.env)
+	}
+
+	_, err := New(nil, "fake://", Config{DNSTTL: -5})
+	assert.EqualError(t, err, "dns ttl must not be negative: -5")
+}
+
+func TestSkippedReasons(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	skipped := func(reason string) float64 {
+		return Metrics.Value(`registrator_skipped_total{reason="` + reason + `"}`)
+	}
+	for _, test := range []struct {
+		reason string
+		config Config
+		setup  func(*fakeDocker, *dockerapi.Container)
+	}{
+		{skipNoPorts, Config{}, func(d *fakeDocker, c *dockerapi.Container) {
+			c.NetworkSettings.Ports = nil
+		}},
+		{skipNoPorts, Config{}, func(d *fakeDocker, c *dockerapi.Container) {
+			c.NetworkSettings.Ports["80/tcp"] = nil
+		}},
+		{skipIgnored, Config{}, func(d *fakeDocker, c *dockerapi.Container) {
+			c.Config.Env = []string{"SERVICE_IGNORE=true"}
+		}},
+		{skipFiltered, Config{ComposeProject: "shop"}, func(d *fakeDocker, c *dockerapi.Container) {}},
+		{skipNoName, Config{}, func(d *fakeDocker, c *dockerapi.Container) {
+			c.Config.Env = []string{"SERVICE_80_NAME="}
+		}},
+		{skipExtractionError, Config{}, func(d *fakeDocker, c *dockerapi.Container) {
+			delete(d.containers, c.ID)
+		}},
+	} {
+		container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+		docker := newFakeDocker(container)
+		bridge, err := New(docker, "fake://", test.config)
+		assert.NoError(t, err)
+		test.setup(docker, container)
+
+		before := skipped(test.reason)
+		bridge.Add(container.ID)
+		assert.Equal(t, before+1, skipped(test.reason), test.reason)
+		assert.Empty(t, bridge.services, test.reason)
+	}
+}
+
+func TestMaxServices(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	web := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "443/tcp": "8443"})
+	flood := publishedContainer("fedcba9876543210", map[string]string{"9000/tcp": "9000", "9001/tcp": "9001"})
+	bridge, err := New(newFakeDocker(web, flood), "fake://", Config{MaxServices: 3})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	var logged bytes.Buffer
+	defer func(out io.Writer) { Log.Out = out }(Log.Out)
+	Log.Out = &logged
+	before := Metrics.Value(`registrator_skipped_total{reason="max-services"}`)
+
+	bridge.Add(web.ID)
+	bridge.Add(flood.ID)
+	assert.Len(t, adapter.services, 3)
+	assert.Equal(t, 3, bridge.ServiceCount())
+	assert.Equal(t, before+1, Metrics.Value(`registrator_skipped_total{reason="max-services"}`))
+	assert.Contains(t, logged.String(), "would exceed -max-services 3")
+}
+
+func TestNoTTL(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "5432/tcp": "5432"})
+	container.Config.Env = []string{"SERVICE_5432_NO_TTL=true"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{RefreshTtl: 30, RefreshInterval: 10})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	ttls := make(map[int]int)
+	for _, service := range adapter.services {
+		ttls[service.Port] = service.TTL
+		assert.NotContains(t, service.Attrs, "no_ttl")
+	}
+	assert.Equal(t, map[int]int{8080: 30, 5432: 0}, ttls)
+
+	bridge.Refresh()
+	assert.Equal(t, 1, adapter.refreshes)
+}
+
+func TestServiceTTLFromLabels(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "5432/tcp": "5432", "6379/tcp": "6379"})
+	container.Config.Labels = map[string]string{"SERVICE_TTL": "45", "SERVICE_5432_TTL": "2m", "SERVICE_6379_TTL": "soon"}
+	container.Config.Env = []string{"SERVICE_5432_TTL=90"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{RefreshTtl: 30})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	bridge.Refresh()
+	ttls := make(map[int]int)
+	for _, service := range adapter.services {
+		ttls[service.Port] = adapter.ttls[service.ID]
+		assert.NotContains(t, service.Attrs, "ttl")
+	}
+	assert.Equal(t, map[int]int{8080: 45, 5432: 90, 6379: 30}, ttls)
+}
+
+func TestTaggedAddressesFromMetadata(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"SERVICE_TAGGED_ADDRESS_WAN=203.0.113.7:80", "SERVICE_TAGGED_ADDRESS_LAN=bogus"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	service := bridge.services[container.ID][0]
+	assert.Equal(t, map[string]string{"wan": "203.0.113.7:80"}, service.TaggedAddresses)
+	assert.Empty(t, service.Attrs)
+}
+
+func TestServiceIDPatternAliases(t *testing.T) {
+	matches := serviceIDPattern.FindStringSubmatch("host:web-1:80:udp:web-canary")
+	assert.Equal(t, []string{"host:web-1:80:udp:web-canary", "host", "web-1"}, matches)
+}
+
+func TestRefreshStopsWithContainer(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{DeregisterCheck: "always"})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	bridge.Refresh()
+	assert.Equal(t, 1, adapter.refreshes)
+
+	bridge.RemoveOnExit(container.ID)
+	bridge.Refresh()
+	assert.Equal(t, 1, adapter.refreshes)
+}
+
+func TestComposeProjectFilter(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	inside := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	inside.Config.Labels = map[string]string{"com.docker.compose.project": "shop"}
+	other := publishedContainer("fedcba9876543210", map[string]string{"80/tcp": "8081"})
+	other.Name = "/other"
+	other.Config.Labels = map[string]string{"com.docker.compose.project": "blog"}
+	loose := publishedContainer("0011223344556677", map[string]string{"80/tcp": "8082"})
+	loose.Name = "/loose"
+	bridge, err := New(newFakeDocker(inside, other, loose), "fake://", Config{ComposeProject: "shop"})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Sync(false)
+	assert.Len(t, adapter.services, 1)
+	assert.Contains(t, bridge.services, inside.ID)
+}
+
+func TestRegisterDedup(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{DeregisterCheck: "always"})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	bridge.Add(container.ID)
+	bridge.Sync(true)
+	assert.Equal(t, 1, adapter.registers)
+
+	bridge.RemoveOnExit(container.ID)
+	bridge.Add(container.ID)
+	assert.Equal(t, 2, adapter.registers)
+}
+
+func TestTagsFromLabels(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"SERVICE_TAGS=web"}
+	container.Config.Labels = map[string]string{
+		"com.example.tag.env":  "prod",
+		"com.example.tag.zone": "a",
+	}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{TagLabelPrefix: "com.example.tag."})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	assert.Equal(t, []string{"web", "env=prod", "zone=a"}, bridge.services[container.ID][0].Tags)
+}
+
+func TestOCILabelTags(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Labels = map[string]string{
+		"org.opencontainers.image.version":  "2.0.1",
+		"org.opencontainers.image.revision": "deadbeef",
+	}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{OCILabelTags: true})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	assert.Equal(t, []string{"version=2.0.1", "revision=deadbeef"}, bridge.services[container.ID][0].Tags)
+}
+
+func TestUseNetworkAlias(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{
+		"backend":  {Aliases: []string{"web", "0123456789ab"}},
+		"frontend": {Aliases: []string{"www"}},
+	}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{NetworkAlias: true})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	assert.Equal(t, "web", bridge.services[container.ID][0].Name)
+
+	container.ID = "fedcba9876543210"
+	container.Config.Env = []string{"SERVICE_NAME=api"}
+	bridge, err = New(newFakeDocker(container), "fake://", Config{NetworkAlias: true})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Equal(t, "api", bridge.services[container.ID][0].Name)
+}
+
+func TestPreferIPAMAddress(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.NetworkSettings.IPAddress = ""
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{
+		"backend": {IPAddress: "172.20.0.9"},
+	}
+	docker := &ipamFakeDocker{newFakeDocker(container), map[string]map[string]string{
+		container.ID: {"backend": "172.20.0.10"},
+	}}
+
+	bridge, err := New(docker, "fake://", Config{Internal: true})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Equal(t, "172.20.0.9", bridge.services[container.ID][0].IP)
+
+	bridge, err = New(docker, "fake://", Config{Internal: true, PreferIPAM: true})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Equal(t, "172.20.0.10", bridge.services[container.ID][0].IP)
+}
+
+func TestSwarmServiceName(t *testing.T) {
+	assert.Equal(t, "web_api", swarmServiceName(map[string]string{
+		"com.docker.swarm.service.id":   "svc1",
+		"com.docker.swarm.service.name": "web_api",
+		"com.docker.swarm.task.name":    "web_api.1.abcdef",
+	}))
+	assert.Equal(t, "", swarmServiceName(map[string]string{"com.example": "x"}))
+	assert.Equal(t, "", swarmServiceName(nil))
+}
+
+func TestSwarmAware(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{})
+	container.Name = "/web_api.1.abcdef"
+	container.Config.Labels = map[string]string{
+		"com.docker.swarm.service.id":   "svc1",
+		"com.docker.swarm.service.name": "web_api",
+	}
+	docker := &swarmFakeDocker{newFakeDocker(container), map[string]map[string]string{
+		"svc1": {"80/tcp": "8080"},
+	}}
+
+	bridge, err := New(docker, "fake://", Config{})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Empty(t, bridge.services[container.ID])
+
+	bridge, err = New(docker, "fake://", Config{SwarmAware: true, HostIp: "10.0.0.5"})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	if assert.Len(t, bridge.services[container.ID], 1) {
+		service := bridge.services[container.ID][0]
+		assert.Equal(t, "web_api", service.Name)
+		assert.Equal(t, "10.0.0.5", service.IP)
+		assert.Equal(t, 8080, service.Port)
+	}
+}
+
+func TestSrvMultiport(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "443/tcp": "8443"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{SrvMultiport: true})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	ports := make([]int, 0)
+	for _, service := range adapter.services {
+		assert.Equal(t, "test", service.Name)
+		ports = append(ports, service.Port)
+	}
+	assert.ElementsMatch(t, []int{8080, 8443}, ports)
+}
+
+// slowNetworkDocker reports a container without network settings on the
+// first inspect, like Docker may right after the start event.
+type slowNetworkDocker struct {
+	*fakeDocker
+	inspects int
+}
+
+func (d *slowNetworkDocker) InspectContainer(id string) (*dockerapi.Container, error) {
+	d.inspects++
+	container, err := d.fakeDocker.InspectContainer(id)
+	if err != nil || d.inspects > 1 {
+		return container, err
+	}
+	early := *container
+	early.NetworkSettings = &dockerapi.NetworkSettings{}
+	return &early, nil
+}
+
+func TestAddWaitsForNetwork(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	inspectRetryDelay = time.Millisecond
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	docker := &slowNetworkDocker{fakeDocker: newFakeDocker(container)}
+	bridge, err := New(docker, "fake://", Config{InspectRetries: 3, Internal: true})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	assert.Equal(t, 3, docker.inspects)
+	assert.Equal(t, "172.17.0.2", bridge.services[container.ID][0].IP)
+}
+
+func TestPingErrorNamesBackend(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	bridge, err := New(nil, "fake://registry:1234?token=secret", Config{})
+	assert.NoError(t, err)
+	down := errors.New("connection refused")
+	bridge.registry.(*fakeAdapter).pingErr = down
+
+	err = bridge.Ping()
+	assert.EqualError(t, err, "backend fake://registry:1234?token=redacted: ping: connection refused")
+	var backendErr *BackendError
+	assert.True(t, errors.As(err, &backendErr))
+	assert.Equal(t, "fake://registry:1234?token=redacted", backendErr.Backend)
+	assert.True(t, errors.Is(err, down))
+	assert.Equal(t, err, bridge.LastPingError())
+}
+
+func TestImageLabelsAreCached(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Image = "sha256:feed"
+	docker := newFakeDocker(container)
+	docker.images[container.Image] = &dockerapi.Image{
+		Config: &dockerapi.Config{Labels: map[string]string{"SERVICE_NAME": "web"}},
+	}
+	bridge, err := New(docker, "fake://", Config{})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	bridge.Refresh()
+	bridge.Sync(false)
+	assert.Equal(t, "web", bridge.services[container.ID][0].Name)
+	assert.Equal(t, 1, docker.imageInspects[container.Image])
+}
+
+func TestAdvertisedPortRange(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{MinPort: 20000, MaxPort: 20009})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	service := bridge.services[container.ID][0]
+	assert.Equal(t, advertisedPort(service.ID, 20000, 20009), service.Port)
+
+	_, err = New(newFakeDocker(), "fake://", Config{MaxPort: 20009})
+	assert.Error(t, err)
+	_, err = New(newFakeDocker(), "fake://", Config{MinPort: 20009, MaxPort: 20000})
+	assert.Error(t, err)
+}
+
+func TestRefreshConcurrency(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	ports := make(map[string]string)
+	for port := 8000; port < 8020; port++ {
+		ports[strconv.Itoa(port)+"/tcp"] = strconv.Itoa(port)
+	}
+	container := publishedContainer("0123456789abcdef", ports)
+	bridge, err := New(newFakeDocker(container), "fake://", Config{RefreshInterval: 1, RefreshConcurrency: 4})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	adapter.refreshTime = 100 * time.Millisecond
+	bridge.Add(container.ID)
+
+	started := time.Now()
+	bridge.Refresh()
+	assert.True(t, time.Since(started) < time.Second, time.Since(started))
+	assert.Equal(t, 20, adapter.refreshes)
+	assert.True(t, adapter.maxParallel <= 4, adapter.maxParallel)
+}
+
+func TestPassthroughEnvAttrs(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"GIT_SHA=abc123", "DB_PASSWORD=secret", "SERVICE_REGION=us-east"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{PassthroughEnv: []string{"GIT_SHA"}})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	assert.Equal(t, map[string]string{"git_sha": "abc123", "region": "us-east"}, bridge.services[container.ID][0].Attrs)
+}
+
+func TestCleanupKeepsForeignServices(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	owned := &Service{ID: Hostname + ":gone:80", Name: "gone", Tags: []string{ownerTag()}}
+	foreign := &Service{ID: Hostname + ":other:80", Name: "other"}
+
+	bridge, err := New(newFakeDocker(container), "fake://", Config{Cleanup: true})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	adapter.services[owned.ID] = owned
+	adapter.services[foreign.ID] = foreign
+
+	bridge.Sync(false)
+	assert.Contains(t, bridge.services[container.ID][0].Tags, ownerTag())
+	assert.NotContains(t, adapter.services, owned.ID)
+	assert.Contains(t, adapter.services, foreign.ID)
+
+	bridge, err = New(newFakeDocker(container), "fake://", Config{Cleanup: true, CleanupForeign: true})
+	assert.NoError(t, err)
+	adapter = bridge.registry.(*fakeAdapter)
+	adapter.services[foreign.ID] = foreign
+
+	bridge.Sync(false)
+	assert.NotContains(t, bridge.services[container.ID][0].Tags, ownerTag())
+	assert.NotContains(t, adapter.services, foreign.ID)
+}
+
+func TestCleanupWithoutListedTags(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	gone := &Service{ID: Hostname + ":gone:80", Name: "gone", Tags: []string{ownerTag()}}
+	otherHost := &Service{ID: "elsewhere:gone:80", Name: "gone"}
+
+	bridge, err := New(newFakeDocker(container), "fake://", Config{Cleanup: true})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	bridge.registry = &taglessAdapter{adapter}
+	adapter.services[gone.ID] = gone
+	adapter.services[otherHost.ID] = otherHost
+
+	// the adapter lists no tags, so services of this host go by their ID
+	bridge.Sync(false)
+	assert.NotContains(t, adapter.services, gone.ID)
+	assert.Contains(t, adapter.services, otherHost.ID)
+	assert.Contains(t, adapter.services, bridge.services[container.ID][0].ID)
+}
+
+func TestCleanupInDefaultScope(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"SERVICE_NAMESPACE=shared"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{Cleanup: true})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	bridge.registry = &scopedAdapter{adapter, "shared"}
+
+	// listed without the default namespace it names, still the same service
+	bridge.Sync(false)
+	assert.Len(t, adapter.services, 1)
+	assert.Contains(t, adapter.services, bridge.services[container.ID][0].ID)
+
+	// another namespace is not the same
+	other := &Service{ID: bridge.services[container.ID][0].ID, Name: "test", Tags: []string{ownerTag()},
+		Attrs: map[string]string{"namespace": "team-a"}}
+	assert.False(t, bridge.sameScope(bridge.services[container.ID][0], other))
+	assert.True(t, bridge.sameScope(bridge.services[container.ID][0], &Service{}))
+}
+
+func TestCleanupDeregistersInBatch(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+
+	bridge, err := New(newFakeDocker(container), "fake://", Config{Cleanup: true})
+	assert.NoError(t, err)
+	adapter := &batchAdapter{fakeAdapter: bridge.registry.(*fakeAdapter)}
+	bridge.registry = adapter
+	for i := 0; i < 5; i++ {
+		service := &Service{ID: Hostname + ":gone:" + strconv.Itoa(i), Name: "gone", Tags: []string{ownerTag()}}
+		adapter.services[service.ID] = service
+	}
+
+	bridge.Sync(false)
+	assert.Equal(t, 1, adapter.batches)
+	assert.Len(t, adapter.services, 1)
+	assert.Contains(t, adapter.services, bridge.services[container.ID][0].ID)
+}
+
+func TestServiceCountAndBackendErrors(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "443/tcp": "8443"})
+
+	bridge, err := New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+	bridge.Sync(false)
+	assert.Equal(t, 2, bridge.ServiceCount())
+	assert.Equal(t, uint64(0), bridge.BackendErrors())
+
+	bridge.registry.(*fakeAdapter).fail = errors.New("down")
+	bridge.registered = make(map[string]registration)
+	bridge.Sync(true)
+	assert.Equal(t, uint64(2), bridge.BackendErrors())
+}
+
+func TestStats(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	web := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "443/tcp": "8443"})
+	db := publishedContainer("fedcba9876543210", map[string]string{"5432/tcp": "5432"})
+	bridge, err := New(newFakeDocker(web, db), "fake://", Config{})
+	assert.NoError(t, err)
+	assert.True(t, bridge.Stats().LastSync.IsZero())
+
+	bridge.Sync(false)
+	bridge.Refresh()
+	stats := bridge.Stats()
+	assert.Equal(t, 3, stats.Services)
+	assert.Equal(t, 2, stats.Containers)
+	assert.False(t, stats.LastSync.IsZero())
+	assert.True(t, stats.RefreshDuration > 0)
+	assert.Equal(t, uint64(0), stats.BackendErrors)
+
+	bridge.Remove(web.ID)
+	stats = bridge.Stats()
+	assert.Equal(t, 1, stats.Services)
+	assert.Equal(t, 1, stats.Containers)
+	assert.Len(t, bridge.registry.(*fakeAdapter).services, 1)
+}
+
+func TestProtocolTags(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "53/udp": "53"})
+	container.Config.Env = []string{"SERVICE_TAGS=web"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{ProtocolTags: true})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	tags := make(map[int][]string)
+	for _, service := range bridge.registry.(*fakeAdapter).services {
+		tags[service.Port] = service.Tags
+	}
+	assert.Equal(t, map[int][]string{8080: {"web", "_tcp"}, 53: {"web", "udp", "_udp"}}, tags)
+}
+
+func TestIPFromLabel(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	for label, ip := range map[string]string{
+		"10.30.0.4":        "10.30.0.4",
+		"node-4.internal":  "node-4.internal",
+		"not an address!":  "10.0.0.9",
+		"":                 "10.0.0.9",
+		"-bad.example.com": "10.0.0.9",
+	} {
+		container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+		container.NetworkSettings.Ports["80/tcp"][0].HostIP = "0.0.0.0"
+		container.Config.Labels = map[string]string{"io.example.advertise-ip": label}
+		bridge, err := New(newFakeDocker(container), "fake://", Config{HostIp: "10.0.0.9", IPFromLabel: "io.example.advertise-ip"})
+		assert.NoError(t, err)
+		bridge.Sync(false)
+		assert.Equal(t, ip, bridge.services[container.ID][0].IP, label)
+	}
+
+	// containers without the label fall back to the usual address
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{IPFromLabel: "io.example.advertise-ip"})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Equal(t, "10.0.0.1", bridge.services[container.ID][0].IP)
+}
+
+func TestServiceAddressModes(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	for _, mode := range []struct {
+		config Config
+		ip     string
+		port   int
+	}{
+		{Config{}, "10.0.0.1", 8080},
+		{Config{Internal: true}, "172.17.0.2", 80},
+		{Config{Global: true}, "172.17.0.2", 8080},
+		// a binding to one host IP wins over -ip
+		{Config{HostIp: "192.168.1.5"}, "10.0.0.1", 8080},
+	} {
+		bridge, err := New(newFakeDocker(container), "fake://", mode.config)
+		assert.NoError(t, err)
+		bridge.Sync(false)
+		service := bridge.services[container.ID][0]
+		assert.Equal(t, mode.ip, service.IP, "%+v", mode.config)
+		assert.Equal(t, mode.port, service.Port, "%+v", mode.config)
+	}
+}
+
+func TestResyncPrunesExitedContainers(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	docker := newFakeDocker(container)
+	bridge, err := New(docker, "fake://", Config{Cleanup: true})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	bridge.Sync(false)
+	id := bridge.services[container.ID][0].ID
+	assert.Contains(t, adapter.services, id)
+
+	// the container exits without a die event reaching us
+	docker.Lock()
+	container.State.Running = false
+	docker.Unlock()
+
+	bridge.Sync(true)
+	assert.NotContains(t, adapter.services, id)
+	assert.NotContains(t, bridge.services, container.ID)
+}
+
+func TestSuccessLabel(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.State.Running = false
+	container.State.ExitCode = 1
+	container.Config.Labels = map[string]string{"com.example.job-succeeded": "true"}
+	docker := newFakeDocker(container)
+
+	for mode, remove := range map[string]bool{"": true, "override": true, "any": true, "all": false} {
+		bridge, err := New(docker, "fake://", Config{
+			DeregisterCheck: "on-success",
+			SuccessLabel:    "com.example.job-succeeded=true",
+			SuccessMode:     mode,
+		})
+		assert.NoError(t, err)
+		assert.Equal(t, remove, bridge.shouldRemove(container.ID), mode)
+	}
+
+	// without the label the exit code decides
+	bridge, err := New(docker, "fake://", Config{DeregisterCheck: "on-success", SuccessLabel: "com.example.done=true"})
+	assert.NoError(t, err)
+	assert.False(t, bridge.shouldRemove(container.ID))
+
+	_, err = New(docker, "fake://", Config{SuccessMode: "sometimes"})
+	assert.Error(t, err)
+}
+
+func TestDestroyRemovesRetained(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	for _, ttl := range []int{0, 30} {
+		container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+		docker := newFakeDocker(container)
+		bridge, err := New(docker, "fake://", Config{DeregisterCheck: "on-success", RefreshTtl: ttl})
+		assert.NoError(t, err)
+		adapter := bridge.registry.(*fakeAdapter)
+		bridge.Add(container.ID)
+		id := bridge.services[container.ID][0].ID
+
+		docker.Lock()
+		container.State.Running = false
+		container.State.ExitCode = 1
+		docker.Unlock()
+		bridge.RemoveOnExit(container.ID)
+		assert.Contains(t, adapter.services, id, "ttl %d", ttl)
+
+		docker.Lock()
+		delete(docker.containers, container.ID)
+		docker.Unlock()
+		bridge.Destroy(container.ID)
+		assert.NotContains(t, adapter.services, id, "ttl %d", ttl)
+		assert.Empty(t, bridge.retained)
+		assert.Empty(t, bridge.deadContainers)
+	}
+}
+
+func TestTagOnlyChangeUpdatesTags(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"SERVICE_TAGS=canary"}
+	docker := newFakeDocker(container)
+	bridge, err := New(docker, "fake://", Config{WatchEvents: []string{"start", "die", "update"}})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	bridge.Add(container.ID)
+	assert.Equal(t, 1, adapter.registers)
+
+	docker.Lock()
+	container.Config.Env = []string{"SERVICE_TAGS=stable"}
+	docker.Unlock()
+	bridge.Reconcile(container.ID)
+	assert.Equal(t, 1, adapter.registers)
+	assert.Equal(t, 1, adapter.tagUpdates)
+	assert.Equal(t, []string{"stable"}, bridge.services[container.ID][0].Tags)
+
+	// so are attributes
+	docker.Lock()
+	container.Config.Env = []string{"SERVICE_TAGS=stable", "SERVICE_CHECK_HTTP=/health"}
+	docker.Unlock()
+	bridge.Reconcile(container.ID)
+	assert.Equal(t, 1, adapter.registers)
+	assert.Equal(t, 2, adapter.tagUpdates)
+
+	// anything else changing registers the service again
+	docker.Lock()
+	container.Config.Env = []string{"SERVICE_TAGS=stable", "SERVICE_CHECK_HTTP=/health", "SERVICE_NAME=web"}
+	docker.Unlock()
+	bridge.Reconcile(container.ID)
+	assert.Equal(t, 2, adapter.registers)
+	assert.Equal(t, 2, adapter.tagUpdates)
+}
+
+func TestExposedOnlyPorts(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.ExposedPorts = map[dockerapi.Port]struct{}{"80/tcp": {}, "9000/tcp": {}}
+
+	for mode, want := range map[string]map[string]int{
+		"published": {"test": 8080},
+		"internal":  {"test-80": 80, "test-9000": 9000},
+		"global":    {"test-80": 8080, "test-9000": 9000},
+	} {
+		bridge, err := New(newFakeDocker(container), "fake://", Config{Internal: mode == "internal", Global: mode == "global"})
+		assert.NoError(t, err)
+		bridge.Add(container.ID)
+		got := make(map[string]int)
+		for _, service := range bridge.services[container.ID] {
+			got[service.Name] = service.Port
+			if mode != "published" {
+				assert.Equal(t, "172.17.0.2", service.IP, mode)
+			}
+		}
+		assert.Equal(t, want, got, mode)
+	}
+}
+
+func TestDNSSafeNames(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{"SERVICE_NAME=My_Service", "SERVICE_ALIASES=Other_Name"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{DNSSafeNames: true})
+	assert.NoError(t, err)
+	bridge.registry = &dnsAdapter{newFakeAdapter()}
+	bridge.Add(container.ID)
+
+	services := bridge.services[container.ID]
+	if assert.Len(t, services, 2) {
+		assert.Equal(t, "my-service", services[0].Name)
+		assert.Equal(t, "My_Service", services[0].Attrs["original_name"])
+		assert.Equal(t, "other-name", services[1].Name)
+		assert.Equal(t, "Other_Name", services[1].Attrs["original_name"])
+	}
+
+	// names are left alone without the option, and for adapters not serving
+	// DNS
+	bridge, err = New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+	bridge.registry = &dnsAdapter{newFakeAdapter()}
+	bridge.Add(container.ID)
+	assert.Equal(t, "My_Service", bridge.services[container.ID][0].Name)
+	assert.NotContains(t, bridge.services[container.ID][0].Attrs, "original_name")
+
+	bridge, err = New(newFakeDocker(container), "fake://", Config{DNSSafeNames: true})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Equal(t, "My_Service", bridge.services[container.ID][0].Name)
+}
+
+func TestSyncRegistersByPriority(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	var containers []*dockerapi.Container
+	for i, env := range [][]string{
+		{"SERVICE_NAME=low"},
+		{"SERVICE_NAME=high", "SERVICE_REGISTER_PRIORITY=10"},
+		{"SERVICE_NAME=mid", "SERVICE_REGISTER_PRIORITY=5"},
+	} {
+		container := publishedContainer(strconv.Itoa(i)+"123456789abcdef", map[string]string{"80/tcp": "8080"})
+		container.Config.Env = env
+		containers = append(containers, container)
+	}
+	bridge, err := New(newFakeDocker(containers...), "fake://", Config{})
+	assert.NoError(t, err)
+	bridge.Sync(true)
+
+	changes, _ := bridge.Changes(0, 0)
+	var names []string
+	for _, change := range changes {
+		names = append(names, change.Name)
+	}
+	assert.Equal(t, []string{"high", "mid", "low"}, names)
+	assert.NotContains(t, bridge.services[containers[1].ID][0].Attrs, "register_priority")
+}
+
+func TestHealthcheckAttrs(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Healthcheck = &dockerapi.HealthConfig{
+		Test:     []string{"CMD-SHELL", "curl -f http://localhost/health"},
+		Interval: 10 * time.Second,
+	}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+
+	registered := bridge.registry.(*fakeAdapter).services[bridge.services[container.ID][0].ID]
+	assert.Equal(t, "curl -f http://localhost/health", registered.Attrs["healthcheck"])
+	assert.Equal(t, "10s", registered.Attrs["healthcheck_interval"])
+
+	assert.Nil(t, healthcheckAttrs(&dockerapi.HealthConfig{Test: []string{"NONE"}}))
+	assert.Equal(t, map[string]string{"healthcheck": "/bin/check --quick"}, healthcheckAttrs(&dockerapi.HealthConfig{Test: []string{"CMD", "/bin/check", "--quick"}}))
+}
+
+func TestTagsSeparator(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Env = []string{`SERVICE_TAGS={"a":1,"b":2};plain`}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{TagsSeparator: ";", ForceTags: "x,y;z"})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Equal(t, []string{`{"a":1,"b":2}`, "plain", "x,y", "z"}, bridge.services[container.ID][0].Tags)
+
+	// lists of the registrator.service label keep their commas too
+	container.Config.Env = nil
+	container.Config.Labels = map[string]string{serviceLabel: `{"tags": ["k=1,2", "l"]}`}
+	bridge, err = New(newFakeDocker(container), "fake://", Config{TagsSeparator: ";"})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	assert.Equal(t, []string{"k=1,2", "l"}, bridge.services[container.ID][0].Tags)
+}
+
+func TestServiceWeight(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.HostConfig.NanoCPUs = 1500000000
+	for env, want := range map[string]int{"": 150, "SERVICE_WEIGHT=5": 5, "SERVICE_WEIGHT=heavy": 150, "SERVICE_WEIGHT=0": 150} {
+		container.Config.Env = []string{env}
+		bridge, err := New(newFakeDocker(container), "fake://", Config{WeightFrom: "cpu"})
+		assert.NoError(t, err)
+		bridge.Add(container.ID)
+		if assert.Len(t, bridge.services[container.ID], 1, env) {
+			assert.Equal(t, want, bridge.services[container.ID][0].Weight, env)
+		}
+	}
+}
@@ -0,0 +1,92 @@
+package bridge
+
+import (
+	"sort"
+	"sync"
+	"time"
+)
+
+// Change is a registration or deregistration the bridge made, numbered by an
+// increasing version.
+type Change struct {
+	Version uint64
+	Action  string // register or deregister
+	Service string // service ID
+	Name    string
+	Time    time.Time
+}
+
+// maxChanges is how many of the latest changes are kept for Changes.
+const maxChanges = 1000
+
+// changeFeed keeps the latest changes and wakes up those waiting for one.
+type changeFeed struct {
+	sync.Mutex
+	version uint64
+	changes []Change      // oldest first
+	next    chan struct{} // closed on the next change
+}
+
+func newChangeFeed() *changeFeed {
+	return &changeFeed{next: make(chan struct{})}
+}
+
+func (f *changeFeed) add(action string, service *Service) {
+	f.Lock()
+	defer f.Unlock()
+	f.version++
+	f.changes = append(f.changes, Change{f.version, action, service.ID, service.Name, time.Now()})
+	if len(f.changes) > maxChanges {
+		f.changes = f.changes[len(f.changes)-maxChanges:]
+	}
+	close(f.next)
+	f.next = make(chan struct{})
+}
+
+// since returns the changes after version, the latest version and a channel
+// closed on the next change.
+func (f *changeFeed) since(version uint64) ([]Change, uint64, <-chan struct{}) {
+	f.Lock()
+	defer f.Unlock()
+	i := sort.Search(len(f.changes), func(i int) bool { return f.changes[i].Version > version })
+	changes := append([]Change(nil), f.changes[i:]...)
+	return changes, f.version, f.next
+}
+
+// changed notes a successful registry change for the change hook and
+// Changes. Callers hold the lock.
+func (b *Bridge) changed(action string, service *Service) {
+	b.hook.changed(action, service)
+	b.changes.add(action, service)
+}
+
+// Changes returns the changes made after version since and the latest
+// version, waiting up to wait for a change when there is none yet. Only the
+// latest 1000 changes are kept; a gap in the versions means older ones were
+// dropped. Pass 0 to get all that are kept.
+func (b *Bridge) Changes(since uint64, wait time.Duration) ([]Change, uint64) {
+	changes, version, next := b.changes.since(since)
+	if len(changes) > 0 || wait <= 0 {
+		return changes, version
+	}
+	select {
+	case <-next:
+		changes, version, _ = b.changes.since(since)
+	case <-time.After(wait):
+	}
+	return changes, version
+}
+
+// Services returns copies of the services of tracked containers, by ID.
+func (b *Bridge) Services() []Service {
+	b.Lock()
+	defer b.Unlock()
+	services := make([]Service, 0, b.countServices())
+	for _, tracked := range b.services {
+		for _, service := range tracked {
+			services = append(services, *service)
+		}
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services
+}
@@ -0,0 +1,52 @@
+package bridge
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestChanges(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{DeregisterCheck: "always"})
+	assert.NoError(t, err)
+
+	changes, version := bridge.Changes(0, 0)
+	assert.Empty(t, changes)
+	assert.Equal(t, uint64(0), version)
+
+	// a waiting watcher wakes up on the registration
+	done := make(chan []Change)
+	go func() {
+		changes, _ := bridge.Changes(0, time.Second)
+		done <- changes
+	}()
+	time.Sleep(10 * time.Millisecond)
+	bridge.Add(container.ID)
+	select {
+	case changes := <-done:
+		if assert.Len(t, changes, 1) {
+			assert.Equal(t, "register", changes[0].Action)
+			assert.Equal(t, "test", changes[0].Name)
+		}
+	case <-time.After(time.Second):
+		t.Fatal("watcher not woken up by the registration")
+	}
+	services := bridge.Services()
+	assert.Len(t, services, 1)
+
+	bridge.RemoveOnExit(container.ID)
+	changes, version = bridge.Changes(1, 0)
+	assert.Equal(t, uint64(2), version)
+	if assert.Len(t, changes, 1) {
+		assert.Equal(t, Change{Version: 2, Action: "deregister", Service: services[0].ID, Name: "test", Time: changes[0].Time}, changes[0])
+	}
+
+	// nothing new, the wait runs out
+	start := time.Now()
+	changes, _ = bridge.Changes(2, 20*time.Millisecond)
+	assert.Empty(t, changes)
+	assert.True(t, time.Since(start) >= 20*time.Millisecond)
+}
@@ -0,0 +1,61 @@
+package bridge
+
+import (
+	dockerapi "github.com/fsouza/go-dockerclient"
+	. "github.com/xytis/registrator/common"
+)
+
+// deregisterCritical deregisters a service the registry reported critical
+// for longer than DeregisterCritical, if registrator registered it on this
+// host and its container no longer exists. Services of known containers are
+// left to the container lifecycle.
+func (b *Bridge) deregisterCritical(service *Service) {
+	matches := serviceIDPattern.FindStringSubmatch(service.ID)
+	if len(matches) != 3 || matches[1] != Hostname {
+		return
+	}
+	if b.config.Cleanup && !b.owned(service) {
+		return
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	if b.tracked(service.ID) {
+		return
+	}
+	_, err := b.docker.InspectContainer(matches[2])
+	if _, gone := err.(*dockerapi.NoSuchContainer); !gone {
+		if err != nil {
+			Log.Warnln("unable to inspect container of critical service:", service.ID, err)
+		}
+		return
+	}
+	if err := b.deregister(service); err != nil {
+		b.failures.Errorln("deregister failed:", err, service.ID)
+		return
+	}
+	Log.Infoln("deregistered critical:", service.ID, "container", matches[2], "is gone")
+}
+
+// tracked reports whether a service with the ID belongs to a container
+// registrator knows about.
+func (b *Bridge) tracked(serviceId string) bool {
+	groups := make([][]*Service, 0, len(b.services)+len(b.retained)+len(b.deadContainers))
+	for _, services := range b.services {
+		groups = append(groups, services)
+	}
+	for _, services := range b.retained {
+		groups = append(groups, services)
+	}
+	for _, dead := range b.deadContainers {
+		groups = append(groups, dead.Services)
+	}
+	for _, services := range groups {
+		for _, service := range services {
+			if service.ID == serviceId {
+				return true
+			}
+		}
+	}
+	return false
+}
@@ -0,0 +1,33 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDeregisterCritical(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	running := publishedContainer("running", map[string]string{"80/tcp": "8080"})
+	tracked := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(running, tracked), "fake://", Config{})
+	assert.NoError(t, err)
+	bridge.Add(tracked.ID)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	gone := &Service{ID: Hostname + ":gone:80", Name: "gone"}
+	alive := &Service{ID: Hostname + ":running:80", Name: "running"}
+	foreign := &Service{ID: "elsewhere:gone:80", Name: "gone"}
+	for _, service := range []*Service{gone, alive, foreign} {
+		adapter.services[service.ID] = service
+	}
+	registered := bridge.services[tracked.ID][0]
+
+	for _, service := range []*Service{gone, alive, foreign, registered} {
+		bridge.deregisterCritical(service)
+	}
+	assert.NotContains(t, adapter.services, gone.ID)
+	assert.Contains(t, adapter.services, alive.ID)
+	assert.Contains(t, adapter.services, foreign.ID)
+	assert.Contains(t, adapter.services, registered.ID)
+}
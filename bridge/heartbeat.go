@@ -0,0 +1,152 @@
+package bridge
+
+import (
+	"context"
+	"sync"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	. "github.com/xytis/registrator/common"
+)
+
+// heartbeat follows the log output of containers for HeartbeatFromLogs. A
+// container is alive while it wrote output within the silence threshold;
+// services of silent containers are left out of refreshes, so their TTLs
+// and TTL checks run out until the container writes again.
+type heartbeat struct {
+	sync.Mutex
+	logs    LogStreamer
+	silence time.Duration
+	last    map[string]time.Time  // last output, by container
+	streams map[string]*logStream // followed containers
+	woke    func(containerId string)
+}
+
+type logStream struct {
+	cancel context.CancelFunc
+}
+
+func newHeartbeat(logs LogStreamer, silence time.Duration, woke func(string)) *heartbeat {
+	return &heartbeat{
+		logs:    logs,
+		silence: silence,
+		last:    make(map[string]time.Time),
+		streams: make(map[string]*logStream),
+		woke:    woke,
+	}
+}
+
+// watch starts following the output of a container unless it already is.
+// Starting counts as output. A nil heartbeat does nothing.
+func (h *heartbeat) watch(containerId string) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if _, ok := h.streams[containerId]; ok {
+		return
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	stream := &logStream{cancel}
+	h.streams[containerId] = stream
+	if _, ok := h.last[containerId]; !ok {
+		h.last[containerId] = time.Now()
+	}
+	out := &logActivity{h, containerId}
+	go func() {
+		err := h.logs.Logs(dockerapi.LogsOptions{
+			Context:      ctx,
+			Container:    containerId,
+			OutputStream: out,
+			ErrorStream:  out,
+			Follow:       true,
+			Stdout:       true,
+			Stderr:       true,
+			Tail:         "0",
+			// only activity matters, so don't demultiplex
+			RawTerminal: true,
+		})
+		if err != nil && ctx.Err() == nil {
+			Log.Debugln("log stream ended:", containerId[:12], err)
+		}
+		h.Lock()
+		defer h.Unlock()
+		// the next refresh follows it again if it still runs
+		if h.streams[containerId] == stream {
+			delete(h.streams, containerId)
+		}
+	}()
+}
+
+// forget stops following a container.
+func (h *heartbeat) forget(containerId string) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if stream, ok := h.streams[containerId]; ok {
+		stream.cancel()
+		delete(h.streams, containerId)
+	}
+	delete(h.last, containerId)
+}
+
+// alive reports whether a container wrote output within the threshold.
+// Containers not followed yet are alive.
+func (h *heartbeat) alive(containerId string) bool {
+	if h == nil {
+		return true
+	}
+	h.Lock()
+	defer h.Unlock()
+	last, ok := h.last[containerId]
+	return !ok || time.Since(last) <= h.silence
+}
+
+// logActivity records output of a container as its heartbeat.
+type logActivity struct {
+	h           *heartbeat
+	containerId string
+}
+
+func (a *logActivity) Write(p []byte) (int, error) {
+	h := a.h
+	h.Lock()
+	if _, ok := h.streams[a.containerId]; !ok {
+		// forgotten meanwhile
+		h.Unlock()
+		return len(p), nil
+	}
+	woke := time.Since(h.last[a.containerId]) > h.silence
+	h.last[a.containerId] = time.Now()
+	h.Unlock()
+	if woke && h.woke != nil {
+		Log.Infoln("heartbeat:", a.containerId[:12], "wrote output again")
+		go h.woke(a.containerId)
+	}
+	return len(p), nil
+}
+
+// refreshContainer refreshes the services of one container right away, for
+// a container whose heartbeat resumed.
+func (b *Bridge) refreshContainer(containerId string) {
+	b.Lock()
+	services := make([]*Service, 0, len(b.services[containerId]))
+	if !b.stopped[containerId] {
+		for _, service := range b.services[containerId] {
+			if !service.noTTL {
+				services = append(services, service)
+			}
+		}
+	}
+	b.Unlock()
+	for _, service := range services {
+		if err := b.call(func() error { return b.registry.Refresh(service) }); err != nil {
+			b.failures.Warnln("refresh failed:", err, service.ID)
+			continue
+		}
+		Log.Infoln("refreshed:", service.ID)
+	}
+}
@@ -0,0 +1,86 @@
+package bridge
+
+import (
+	"io"
+	"sync"
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+// logsFakeDocker is a fakeDocker whose containers' log streams the test
+// writes to.
+type logsFakeDocker struct {
+	*fakeDocker
+	sync.Mutex
+	streams map[string]io.Writer
+}
+
+func (d *logsFakeDocker) Logs(opts dockerapi.LogsOptions) error {
+	d.Lock()
+	d.streams[opts.Container] = opts.OutputStream
+	d.Unlock()
+	<-opts.Context.Done()
+	return opts.Context.Err()
+}
+
+func (d *logsFakeDocker) write(containerId, line string) bool {
+	d.Lock()
+	defer d.Unlock()
+	stream, ok := d.streams[containerId]
+	if ok {
+		stream.Write([]byte(line))
+	}
+	return ok
+}
+
+func TestHeartbeatFromLogs(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	docker := &logsFakeDocker{fakeDocker: newFakeDocker(container), streams: make(map[string]io.Writer)}
+	bridge, err := New(docker, "fake://", Config{HeartbeatFromLogs: 1, DeregisterCheck: "always"})
+	assert.NoError(t, err)
+	bridge.heartbeat.silence = 30 * time.Millisecond
+	adapter := bridge.registry.(*fakeAdapter)
+	refreshes := func() int {
+		adapter.Lock()
+		defer adapter.Unlock()
+		return adapter.refreshes
+	}
+
+	// a container that just started is alive
+	bridge.Add(container.ID)
+	bridge.Refresh()
+	assert.Equal(t, 1, refreshes())
+
+	// output keeps it alive
+	assert.Eventually(t, func() bool { return docker.write(container.ID, "working\n") }, time.Second, time.Millisecond)
+	bridge.Refresh()
+	assert.Equal(t, 2, refreshes())
+
+	// silent past the threshold, its TTL check is left to expire
+	time.Sleep(50 * time.Millisecond)
+	bridge.Refresh()
+	assert.Equal(t, 2, refreshes())
+
+	// output after the silence passes it right away
+	docker.write(container.ID, "back\n")
+	assert.Eventually(t, func() bool { return refreshes() == 3 }, time.Second, time.Millisecond)
+	bridge.Refresh()
+	assert.Equal(t, 4, refreshes())
+
+	// removed containers are no longer followed
+	bridge.RemoveOnExit(container.ID)
+	bridge.heartbeat.Lock()
+	assert.Empty(t, bridge.heartbeat.streams)
+	bridge.heartbeat.Unlock()
+}
+
+func TestHeartbeatFromLogsNeedsLogStreamer(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	bridge, err := New(newFakeDocker(), "fake://", Config{HeartbeatFromLogs: 10})
+	assert.NoError(t, err)
+	assert.Nil(t, bridge.heartbeat)
+}
@@ -0,0 +1,82 @@
+package bridge
+
+import (
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/exec"
+	"strconv"
+	"sync"
+	"time"
+
+	. "github.com/xytis/registrator/common"
+)
+
+// changeHook runs a shell command once the registered services stopped
+// changing for the debounce interval, so configuration generated from the
+// registry can be rendered again. A burst of changes runs it once.
+type changeHook struct {
+	sync.Mutex
+	command  string
+	debounce time.Duration
+	timer    *time.Timer
+	summary  changeSummary
+	running  sync.Mutex // runs don't overlap
+}
+
+// changeSummary is written to the command's stdin as JSON.
+type changeSummary struct {
+	Registered   []string `json:"registered"`
+	Deregistered []string `json:"deregistered"`
+}
+
+func newChangeHook(command string, debounce time.Duration) *changeHook {
+	if command == "" {
+		return nil
+	}
+	return &changeHook{command: command, debounce: debounce}
+}
+
+// changed notes a successful registry change and restarts the debounce
+// timer. A nil hook does nothing.
+func (h *changeHook) changed(action string, service *Service) {
+	if h == nil {
+		return
+	}
+	h.Lock()
+	defer h.Unlock()
+	if action == "deregister" {
+		h.summary.Deregistered = append(h.summary.Deregistered, service.ID)
+	} else {
+		h.summary.Registered = append(h.summary.Registered, service.ID)
+	}
+	if h.timer != nil {
+		h.timer.Stop()
+	}
+	h.timer = time.AfterFunc(h.debounce, h.run)
+}
+
+func (h *changeHook) run() {
+	h.running.Lock()
+	defer h.running.Unlock()
+	h.Lock()
+	summary := h.summary
+	h.summary = changeSummary{}
+	h.Unlock()
+	if len(summary.Registered) == 0 && len(summary.Deregistered) == 0 {
+		return
+	}
+
+	input, _ := json.Marshal(summary)
+	cmd := exec.Command("/bin/sh", "-c", h.command)
+	cmd.Env = append(os.Environ(),
+		"REGISTRATOR_REGISTERED="+strconv.Itoa(len(summary.Registered)),
+		"REGISTRATOR_DEREGISTERED="+strconv.Itoa(len(summary.Deregistered)),
+	)
+	cmd.Stdin = bytes.NewReader(input)
+	if output, err := cmd.CombinedOutput(); err != nil {
+		Log.Errorln("on-change command failed:", err, string(output))
+		return
+	}
+	Log.Infof("on-change command ran after %d registrations and %d deregistrations", len(summary.Registered), len(summary.Deregistered))
+}
@@ -0,0 +1,48 @@
+package bridge
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestOnChangeExecDebounces(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hook")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	runs := filepath.Join(dir, "runs")
+	input := filepath.Join(dir, "input.json")
+
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "443/tcp": "8443", "9000/tcp": "9000"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{
+		DeregisterCheck:  "always",
+		OnChangeExec:     `echo "$REGISTRATOR_REGISTERED $REGISTRATOR_DEREGISTERED" >> ` + runs + ` && cat > ` + input,
+		OnChangeDebounce: 50,
+	})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	bridge.RemoveOnExit(container.ID)
+	assert.Eventually(t, func() bool {
+		_, err := os.Stat(input)
+		return err == nil
+	}, time.Second, 5*time.Millisecond)
+	time.Sleep(150 * time.Millisecond)
+
+	content, err := ioutil.ReadFile(runs)
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"3 3"}, strings.Split(strings.TrimSpace(string(content)), "\n"))
+	var summary changeSummary
+	content, err = ioutil.ReadFile(input)
+	assert.NoError(t, err)
+	assert.NoError(t, json.Unmarshal(content, &summary))
+	assert.Len(t, summary.Registered, 3)
+	assert.ElementsMatch(t, summary.Registered, summary.Deregistered)
+}
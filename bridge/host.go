@@ -0,0 +1,61 @@
+package bridge
+
+import (
+	"net"
+
+	. "github.com/xytis/registrator/common"
+)
+
+// HostServiceName is the name the registrator host registers itself under
+// with -register-host-service.
+const HostServiceName = "registrator"
+
+// hostService returns the service standing for the registrator host itself,
+// so consumers can discover which hosts are alive.
+func (b *Bridge) hostService() *Service {
+	ip := b.resolvedIp
+	if ip == "" {
+		if addr, err := net.ResolveIPAddr("ip", Hostname); err == nil {
+			ip = addr.String()
+		}
+	}
+	tags := combineTags(b.tagsSeparator(), b.config.ForceTags)
+	if b.config.Cleanup && !b.config.CleanupForeign {
+		tags = append(tags, ownerTag())
+	}
+	return &Service{
+		ID:    Hostname + ":" + HostServiceName,
+		Name:  HostServiceName,
+		IP:    ip,
+		Tags:  tags,
+		Attrs: map[string]string{"host_id": Hostname},
+		TTL:   b.config.RefreshTtl,
+	}
+}
+
+// registerHost registers the host service, or registers it again in case
+// the host IP changed or the registry lost it. Callers hold the lock.
+func (b *Bridge) registerHost() {
+	service := b.hostService()
+	if err := b.register(service); err != nil {
+		b.failures.Errorln("register failed:", err, service.ID)
+		return
+	}
+	if b.host == nil {
+		Log.Infoln("added:", service.ID)
+	}
+	b.host = service
+}
+
+// deregisterHost removes the host service. Callers hold the lock.
+func (b *Bridge) deregisterHost() {
+	if b.host == nil {
+		return
+	}
+	if err := b.deregister(b.host); err != nil {
+		b.failures.Errorln("deregister failed:", err, b.host.ID)
+		return
+	}
+	Log.Infoln("removed:", b.host.ID)
+	b.host = nil
+}
@@ -0,0 +1,108 @@
+package bridge
+
+import (
+	"errors"
+	"io/ioutil"
+	"net/http"
+	"strings"
+	"time"
+)
+
+// HostIPResolver finds the IP address services published on the host are
+// registered with. An empty IP leaves the address to the usual detection.
+type HostIPResolver interface {
+	HostIP() (string, error)
+}
+
+// NewHostIPResolver returns the resolver for a -host-ip-from value, which is
+// one of "static", "interface:<name>", "cloud" or "cloud:public". The static
+// resolver returns staticIp.
+func NewHostIPResolver(from string, staticIp string) (HostIPResolver, error) {
+	switch {
+	case from == "" || from == "static":
+		return staticResolver(staticIp), nil
+	case strings.HasPrefix(from, "interface:"):
+		return interfaceResolver(strings.TrimPrefix(from, "interface:")), nil
+	case from == "cloud":
+		return &cloudResolver{endpoints: cloudEndpoints(false)}, nil
+	case from == "cloud:public":
+		return &cloudResolver{endpoints: cloudEndpoints(true)}, nil
+	}
+	return nil, errors.New("unknown host ip source: " + from)
+}
+
+type staticResolver string
+
+func (r staticResolver) HostIP() (string, error) {
+	return string(r), nil
+}
+
+type interfaceResolver string
+
+func (r interfaceResolver) HostIP() (string, error) {
+	ips, err := filterIPs(string(r))
+	if err != nil {
+		return "", err
+	}
+	if len(ips) == 0 {
+		return "", errors.New("no IPv4 address on interface " + string(r))
+	}
+	return ips[0], nil
+}
+
+type metadataEndpoint struct {
+	provider string
+	url      string
+	header   map[string]string
+}
+
+func cloudEndpoints(public bool) []metadataEndpoint {
+	if public {
+		return []metadataEndpoint{
+			{"aws", "http://169.254.169.254/latest/meta-data/public-ipv4", nil},
+			{"gcp", "http://metadata.google.internal/computeMetadata/v1/instance/network-interfaces/0/access-configs/0/external-ip",
+				map[string]string{"Metadata-Flavor": "Google"}},
+			{"azure", "http://169.254.169.254/metadata/instance/network/interface/0/ipv4/ipAddress/0/publicIpAddress?api-version=2017-08-01&format=text",
+				map[string]string{"Metadata": "true"}},
+		}
+	}
+	return []metadataEndpoint{
+		{"aws", "http://169.254.169.254/latest/meta-data/local-ipv4", nil},
+		{"gcp", "http://metadata.google.internal/computeMetadata/v1/instance/network-interfaces/0/ip",
+			map[string]string{"Metadata-Flavor": "Google"}},
+		{"azure", "http://169.254.169.254/metadata/instance/network/interface/0/ipv4/ipAddress/0/privateIpAddress?api-version=2017-08-01&format=text",
+			map[string]string{"Metadata": "true"}},
+	}
+}
+
+// cloudResolver asks the instance metadata services of AWS, GCP and Azure
+// for the IP of the host, using the first one that answers.
+type cloudResolver struct {
+	endpoints []metadataEndpoint
+}
+
+var metadataClient = &http.Client{Timeout: 2 * time.Second}
+
+func (r *cloudResolver) HostIP() (string, error) {
+	for _, endpoint := range r.endpoints {
+		req, err := http.NewRequest("GET", endpoint.url, nil)
+		if err != nil {
+			continue
+		}
+		for k, v := range endpoint.header {
+			req.Header.Set(k, v)
+		}
+		res, err := metadataClient.Do(req)
+		if err != nil {
+			continue
+		}
+		body, err := ioutil.ReadAll(res.Body)
+		res.Body.Close()
+		ip := strings.TrimSpace(string(body))
+		if err != nil || res.StatusCode != http.StatusOK || ip == "" {
+			continue
+		}
+		return ip, nil
+	}
+	return "", errors.New("no cloud metadata service found")
+}
@@ -0,0 +1,87 @@
+package bridge
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestCloudResolver(t *testing.T) {
+	aws := httptest.NewServer(http.NotFoundHandler())
+	defer aws.Close()
+	gcp := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.Header.Get("Metadata-Flavor") != "Google" {
+			w.WriteHeader(http.StatusForbidden)
+			return
+		}
+		w.Write([]byte("10.128.0.7\n"))
+	}))
+	defer gcp.Close()
+
+	resolver := &cloudResolver{endpoints: []metadataEndpoint{
+		{"aws", aws.URL, nil},
+		{"gcp", gcp.URL, map[string]string{"Metadata-Flavor": "Google"}},
+	}}
+	ip, err := resolver.HostIP()
+	assert.NoError(t, err)
+	assert.Equal(t, "10.128.0.7", ip)
+
+	resolver.endpoints = resolver.endpoints[:1]
+	_, err = resolver.HostIP()
+	assert.Error(t, err)
+}
+
+func TestNewHostIPResolver(t *testing.T) {
+	resolver, err := NewHostIPResolver("static", "10.0.0.5")
+	assert.NoError(t, err)
+	ip, _ := resolver.HostIP()
+	assert.Equal(t, "10.0.0.5", ip)
+
+	resolver, err = NewHostIPResolver("interface:lo", "")
+	assert.NoError(t, err)
+	ip, err = resolver.HostIP()
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1", ip)
+
+	_, err = NewHostIPResolver("dns", "")
+	assert.Error(t, err)
+}
+
+func TestSyncResolvesHostIP(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.NetworkSettings.Ports["80/tcp"][0].HostIP = "0.0.0.0"
+	bridge, err := New(newFakeDocker(container), "fake://", Config{HostIpFrom: "interface:lo"})
+	assert.NoError(t, err)
+
+	bridge.Sync(false)
+	assert.Equal(t, "127.0.0.1", bridge.services[container.ID][0].IP)
+}
+
+func TestSyncReaddressesOnHostIPChange(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.NetworkSettings.Ports["80/tcp"][0].HostIP = "0.0.0.0"
+	pinned := publishedContainer("fedcba9876543210", map[string]string{"80/tcp": "8081"})
+	pinned.Name = "/pinned"
+	bridge, err := New(newFakeDocker(container, pinned), "fake://", Config{HostIp: "192.168.0.1"})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	bridge.Sync(false)
+	moving := bridge.services[container.ID][0]
+	assert.Equal(t, "192.168.0.1", moving.IP)
+	assert.Equal(t, "10.0.0.1", bridge.services[pinned.ID][0].IP)
+	registers := adapter.registers
+
+	// the host moved: the service on the host IP follows it, the one
+	// published on a fixed IP stays as it is
+	bridge.hostIp = staticResolver("192.168.0.2")
+	bridge.Sync(false)
+	assert.Equal(t, "192.168.0.2", bridge.services[container.ID][0].IP)
+	assert.Equal(t, "192.168.0.2", adapter.services[moving.ID].IP)
+	assert.Equal(t, "10.0.0.1", bridge.services[pinned.ID][0].IP)
+	assert.Equal(t, registers+1, adapter.registers)
+	assert.Len(t, bridge.services[container.ID], 1)
+}
@@ -0,0 +1,50 @@
+package bridge
+
+import (
+	"errors"
+	"path"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// validIgnoreImages checks the IgnoreImages patterns.
+func validIgnoreImages(patterns []string) error {
+	for _, pattern := range patterns {
+		if _, err := path.Match(pattern, ""); err != nil {
+			return errors.New("bad -ignore-images pattern: " + pattern)
+		}
+	}
+	return nil
+}
+
+// globallyIgnored returns the IgnoreLabels, IgnoreEnv or IgnoreImages rule
+// the container matches, or "" if none does. Matching containers are never
+// registered, whatever their own SERVICE_ metadata says.
+func (b *Bridge) globallyIgnored(container *dockerapi.Container) string {
+	for _, rule := range b.config.IgnoreLabels {
+		if rule != "" && matchKeyValue(rule, container.Config.Labels) {
+			return "label " + rule
+		}
+	}
+	if len(b.config.IgnoreEnv) > 0 {
+		env := make(map[string]string, len(container.Config.Env))
+		for _, kv := range container.Config.Env {
+			kvp := strings.SplitN(kv, "=", 2)
+			if len(kvp) == 2 {
+				env[kvp[0]] = kvp[1]
+			}
+		}
+		for _, rule := range b.config.IgnoreEnv {
+			if rule != "" && matchKeyValue(rule, env) {
+				return "environment " + rule
+			}
+		}
+	}
+	for _, pattern := range b.config.IgnoreImages {
+		if pattern != "" && matchImage(pattern, container.Config.Image) {
+			return "image " + pattern
+		}
+	}
+	return ""
+}
@@ -0,0 +1,48 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestGlobalIgnore(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	config := Config{
+		IgnoreLabels: []string{"com.example.agent", "tier=monitoring"},
+		IgnoreEnv:    []string{"ROLE=sidecar"},
+		IgnoreImages: []string{"datadog/*", ""},
+	}
+	for _, test := range []struct {
+		name    string
+		labels  map[string]string
+		env     []string
+		image   string
+		ignored bool
+	}{
+		{"plain", nil, nil, "web:1", false},
+		{"label", map[string]string{"com.example.agent": ""}, nil, "web:1", true},
+		{"label value", map[string]string{"tier": "monitoring"}, nil, "web:1", true},
+		{"other label value", map[string]string{"tier": "web"}, nil, "web:1", false},
+		{"env", nil, []string{"ROLE=sidecar", "SERVICE_IGNORE=false"}, "web:1", true},
+		{"image", nil, nil, "datadog/agent:7", true},
+	} {
+		container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+		container.Config.Labels = test.labels
+		container.Config.Env = test.env
+		container.Config.Image = test.image
+		bridge, err := New(newFakeDocker(container), "fake://", config)
+		assert.NoError(t, err)
+		bridge.Sync(true)
+		bridge.Add(container.ID)
+		adapter := bridge.registry.(*fakeAdapter)
+		if test.ignored {
+			assert.Empty(t, adapter.services, test.name)
+		} else {
+			assert.Len(t, adapter.services, 1, test.name)
+		}
+	}
+
+	_, err := New(newFakeDocker(), "fake://", Config{IgnoreImages: []string{"[bad"}})
+	assert.Error(t, err)
+}
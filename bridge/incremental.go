@@ -0,0 +1,78 @@
+package bridge
+
+import (
+	dockerapi "github.com/fsouza/go-dockerclient"
+	. "github.com/xytis/registrator/common"
+)
+
+// incremental reports whether IncrementalCleanup is on. It needs Cleanup.
+func (b *Bridge) incremental() bool {
+	return b.config.Cleanup && b.config.IncrementalCleanup > 0
+}
+
+// noteChange queues a container an event was seen for for the next
+// cleanupRecent.
+func (b *Bridge) noteChange(containerId string) {
+	if !b.incremental() {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.recent[containerId] = true
+}
+
+// cleanupAfter removes the dangling services of one container after its die
+// or destroy was handled, without a full cleanup.
+func (b *Bridge) cleanupAfter(containerId string) {
+	if !b.incremental() {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+	b.cleanupContainer(containerId)
+}
+
+// cleanupContainer deregisters the services registered for a container that
+// registrator no longer keeps, e.g. after a change of their ID whose
+// deregistration failed. It goes by the services registered by this run,
+// without listing the registry. Callers hold the lock.
+func (b *Bridge) cleanupContainer(containerId string) {
+	var dangling []*Service
+	for id, last := range b.registered {
+		if last.service.Origin.ContainerID != containerId || b.tracked(id) || b.pending[id] != nil {
+			continue
+		}
+		Log.Infoln("dangling:", id)
+		dangling = append(dangling, last.service)
+	}
+	b.deregisterAll(dangling)
+}
+
+// cleanupRecent checks only the containers changed since the last run:
+// those gone are destroyed, cleaning up after them, and running ones without
+// services are added, in case an event was missed.
+func (b *Bridge) cleanupRecent() {
+	b.Lock()
+	containers := make([]string, 0, len(b.recent))
+	for containerId := range b.recent {
+		containers = append(containers, containerId)
+	}
+	b.recent = make(map[string]bool)
+	b.Unlock()
+
+	for _, containerId := range containers {
+		container, err := b.docker.InspectContainer(containerId)
+		if _, gone := err.(*dockerapi.NoSuchContainer); gone {
+			b.Destroy(containerId)
+			continue
+		}
+		if err != nil || !container.State.Running {
+			continue
+		}
+		b.Lock()
+		if b.services[containerId] == nil && b.starting[containerId] == nil && !b.stopped[containerId] && b.held[containerId] == nil {
+			b.add(containerId, true)
+		}
+		b.Unlock()
+	}
+}
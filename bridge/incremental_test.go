@@ -0,0 +1,48 @@
+package bridge
+
+import (
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestIncrementalCleanup(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	docker := newFakeDocker(container)
+	bridge, err := New(docker, "fake://", Config{Cleanup: true, IncrementalCleanup: 60})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	// left by an earlier run, with the name of the container
+	other := &Service{ID: Hostname + ":test:81", Name: "other", Tags: []string{ownerTag()}}
+	adapter.services[other.ID] = other
+
+	// registered, then lost track of, as when deregistering an old ID failed
+	bridge.Add(container.ID)
+	bridge.Lock()
+	id := bridge.services[container.ID][0].ID
+	delete(bridge.services, container.ID)
+	bridge.Unlock()
+	assert.Contains(t, adapter.services, id)
+
+	bridge.handle(&dockerapi.APIEvents{Status: "destroy", ID: container.ID}, bridge.Destroy)
+	assert.NotContains(t, adapter.services, id)
+	// only services registered for the container are cleaned up, without
+	// listing the registry
+	assert.Contains(t, adapter.services, other.ID)
+
+	// the periodic check destroys a container whose event was missed
+	bridge.Add(container.ID)
+	bridge.Lock()
+	delete(bridge.services, container.ID)
+	bridge.Unlock()
+	docker.Lock()
+	delete(docker.containers, container.ID)
+	docker.Unlock()
+	bridge.noteChange(container.ID)
+	bridge.cleanupRecent()
+	assert.NotContains(t, adapter.services, id)
+	assert.Empty(t, bridge.recent)
+}
@@ -0,0 +1,39 @@
+package bridge
+
+import (
+	dockerapi "github.com/fsouza/go-dockerclient"
+	. "github.com/xytis/registrator/common"
+)
+
+// ipamDocker inspects containers with the static address configured with
+// IPAM for a network, e.g. by `docker run --ip`, in place of the address
+// Docker assigned at runtime. The two should match, but the IPAM config is
+// authoritative.
+type ipamDocker struct {
+	DockerClient
+	ipam IPAMInspector
+}
+
+func (d *ipamDocker) InspectContainer(id string) (*dockerapi.Container, error) {
+	container, err := d.DockerClient.InspectContainer(id)
+	if err != nil {
+		return nil, err
+	}
+	addresses, err := d.ipam.InspectIPAM(id)
+	if err != nil {
+		Log.Warnln("unable to inspect IPAM addresses of", container.ID, err)
+		return container, nil
+	}
+	for name, network := range container.NetworkSettings.Networks {
+		addr := addresses[name]
+		if addr == "" || addr == network.IPAddress {
+			continue
+		}
+		if container.NetworkSettings.IPAddress == network.IPAddress {
+			container.NetworkSettings.IPAddress = addr
+		}
+		network.IPAddress = addr
+		container.NetworkSettings.Networks[name] = network
+	}
+	return container, nil
+}
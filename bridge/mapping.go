@@ -0,0 +1,155 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	. "github.com/xytis/registrator/common"
+)
+
+// mappingRule declares the service of the containers it matches, taking
+// precedence over their SERVICE_ environment, labels and service file.
+type mappingRule struct {
+	Match   mappingMatch   `json:"match"`
+	Service mappingService `json:"service"`
+}
+
+// mappingMatch selects containers. Name and image are glob patterns, label
+// is key=value or only a key that must be present. Unset fields match all
+// containers.
+type mappingMatch struct {
+	Name  string `json:"name"`
+	Image string `json:"image"`
+	Label string `json:"label"`
+}
+
+// mappingService is what matched containers are registered with. With a
+// port, only that exposed port is registered, e.g. "6379" or "53/udp".
+// Attrs are further SERVICE_ metadata, e.g. {"check_tcp": "true"}.
+type mappingService struct {
+	Name  string            `json:"name"`
+	Tags  []string          `json:"tags"`
+	Port  string            `json:"port"`
+	Attrs map[string]string `json:"attrs"`
+}
+
+// loadMapping reads the rules of a mapping file, a JSON array of rules tried
+// in order.
+func loadMapping(file string) ([]mappingRule, error) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+	var rules []mappingRule
+	if err := json.Unmarshal(data, &rules); err != nil {
+		return nil, errors.New("bad mapping file: " + err.Error())
+	}
+	for _, rule := range rules {
+		for _, pattern := range []string{rule.Match.Name, rule.Match.Image} {
+			if _, err := path.Match(pattern, ""); err != nil {
+				return nil, errors.New("bad mapping file: bad pattern " + pattern)
+			}
+		}
+	}
+	return rules, nil
+}
+
+// ReloadMapping reads the mapping file again, e.g. on SIGHUP, and brings the
+// registrations of running containers in line with it. A mapping file that
+// can't be read leaves the previous rules in place.
+func (b *Bridge) ReloadMapping() error {
+	if b.config.MappingFile == "" {
+		return nil
+	}
+	rules, err := loadMapping(b.config.MappingFile)
+	if err != nil {
+		return err
+	}
+	b.Lock()
+	b.mapping = rules
+	containers := make([]string, 0, len(b.services))
+	for containerId := range b.services {
+		containers = append(containers, containerId)
+	}
+	for _, containerId := range containers {
+		if !b.stopped[containerId] {
+			b.reconcile(containerId)
+		}
+	}
+	b.Unlock()
+	Log.Infoln("reloaded mapping file:", b.config.MappingFile, len(rules), "rules")
+	// containers a previous rule left without services
+	b.Sync(true)
+	return nil
+}
+
+// mappingOf returns the first rule matching the container, or nil.
+func (b *Bridge) mappingOf(container *dockerapi.Container) *mappingRule {
+	for i := range b.mapping {
+		if b.mapping[i].Match.matches(container) {
+			return &b.mapping[i]
+		}
+	}
+	return nil
+}
+
+func (m mappingMatch) matches(container *dockerapi.Container) bool {
+	if m.Name != "" {
+		if ok, _ := path.Match(m.Name, strings.TrimPrefix(container.Name, "/")); !ok {
+			return false
+		}
+	}
+	if m.Image != "" && !matchImage(m.Image, container.Config.Image) {
+		return false
+	}
+	if m.Label != "" && !matchKeyValue(m.Label, container.Config.Labels) {
+		return false
+	}
+	return true
+}
+
+// matchKeyValue matches key=value, or only a key that must be present,
+// against labels or environment variables.
+func matchKeyValue(rule string, values map[string]string) bool {
+	kv := strings.SplitN(rule, "=", 2)
+	value, ok := values[kv[0]]
+	return ok && (len(kv) == 1 || value == kv[1])
+}
+
+// matchImage matches an image against pattern with and without its tag, so
+// "redis" matches "redis:7".
+func matchImage(pattern, image string) bool {
+	if ok, _ := path.Match(pattern, image); ok {
+		return true
+	}
+	repo := image
+	if i := strings.LastIndex(image, ":"); i > strings.LastIndex(image, "/") {
+		repo = image[:i]
+	}
+	ok, _ := path.Match(pattern, repo)
+	return ok
+}
+
+// registers reports whether the rule lets the port be registered.
+func (s mappingService) registers(port ServicePort) bool {
+	return s.Port == "" || s.Port == port.ExposedPort || s.Port == port.ExposedPort+"/"+port.PortType
+}
+
+// apply overrides the metadata extracted for a port with the rule's.
+func (s mappingService) apply(metadata map[string]string, metadataFromPort map[string]bool, tagsSep string) {
+	for k, v := range s.Attrs {
+		metadata[strings.TrimPrefix(strings.ToLower(k), "service_")] = v
+	}
+	if s.Name != "" {
+		metadata["name"] = s.Name
+		// a rule for one port names it, without the port suffix
+		metadataFromPort["name"] = s.Port != ""
+	}
+	if s.Tags != nil {
+		metadata["tags"] = strings.Join(s.Tags, tagsSep)
+	}
+}
@@ -0,0 +1,57 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMappingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mapping")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	file := filepath.Join(dir, "mapping.json")
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`[
+		{"match": {"image": "bitnami/redis"}, "service": {"name": "cache", "tags": ["primary"], "port": "6379", "attrs": {"SERVICE_CHECK_TCP": "true"}}},
+		{"match": {"image": "bitnami/*"}, "service": {"name": "other"}}
+	]`), 0644))
+
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"6379/tcp": "6379", "9121/tcp": "9121"})
+	container.Config.Image = "bitnami/redis:7.2"
+	container.Config.Env = []string{"SERVICE_NAME=redis", "SERVICE_TAGS=from-env"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{MappingFile: file})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+
+	// the rule wins over the environment and leaves the exporter port out
+	services := bridge.services[container.ID]
+	if assert.Len(t, services, 1) {
+		assert.Equal(t, "cache", services[0].Name)
+		assert.Equal(t, 6379, services[0].Port)
+		assert.Equal(t, []string{"primary"}, services[0].Tags)
+		assert.Equal(t, "true", services[0].Attrs["check_tcp"])
+	}
+
+	// on reload, running containers are registered by the new rules
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`[
+		{"match": {"name": "test", "label": "tier"}, "service": {"name": "cache"}},
+		{"match": {"image": "bitnami/*"}, "service": {"name": "other", "tags": []}}
+	]`), 0644))
+	assert.NoError(t, bridge.ReloadMapping())
+	registry := bridge.registry.(*fakeAdapter)
+	names := make(map[string]int)
+	for _, service := range registry.services {
+		names[service.Name]++
+		assert.Empty(t, service.Tags)
+	}
+	assert.Equal(t, map[string]int{"other-6379": 1, "other-9121": 1}, names)
+
+	// a broken file keeps the rules in place
+	assert.NoError(t, ioutil.WriteFile(file, []byte(`[{"match": {"name": "["}}]`), 0644))
+	assert.Error(t, bridge.ReloadMapping())
+	assert.Len(t, bridge.mapping, 2)
+}
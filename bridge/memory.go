@@ -0,0 +1,202 @@
+package bridge
+
+import (
+	"net/url"
+	"sort"
+	"sync"
+)
+
+func init() {
+	Register(new(memoryFactory), "memory")
+}
+
+// memoryFactory hands out one MemoryAdapter per URI host, so a test can get
+// hold of the adapter its bridge uses with Memory.
+type memoryFactory struct{}
+
+var (
+	memoryLock     sync.Mutex
+	memoryAdapters = make(map[string]*MemoryAdapter)
+)
+
+func (f *memoryFactory) New(uri *url.URL) RegistryAdapter {
+	return Memory(uri.Host)
+}
+
+// Memory returns the MemoryAdapter behind the registry URI memory://<name>,
+// creating it if needed.
+func Memory(name string) *MemoryAdapter {
+	memoryLock.Lock()
+	defer memoryLock.Unlock()
+	adapter, ok := memoryAdapters[name]
+	if !ok {
+		adapter = NewMemoryAdapter()
+		memoryAdapters[name] = adapter
+	}
+	return adapter
+}
+
+// MemoryAdapter is a registry kept in memory, for tests of code embedding the
+// bridge. It is not meant for production use. Besides the adapter methods it
+// can list what is registered, count calls and fail calls on demand.
+type MemoryAdapter struct {
+	sync.Mutex
+	services    map[string]*Service
+	maintenance map[string]bool
+	warnings    map[string]bool
+	calls       map[string]int
+	errors      map[string]error
+}
+
+func NewMemoryAdapter() *MemoryAdapter {
+	return &MemoryAdapter{
+		services:    make(map[string]*Service),
+		maintenance: make(map[string]bool),
+		warnings:    make(map[string]bool),
+		calls:       make(map[string]int),
+		errors:      make(map[string]error),
+	}
+}
+
+// call counts a call of the method and returns the error injected for it.
+// It must be called with the lock held.
+func (m *MemoryAdapter) call(method string) error {
+	m.calls[method]++
+	return m.errors[method]
+}
+
+func (m *MemoryAdapter) Ping() error {
+	m.Lock()
+	defer m.Unlock()
+	return m.call("Ping")
+}
+
+func (m *MemoryAdapter) Register(service *Service) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.call("Register"); err != nil {
+		return err
+	}
+	m.services[service.ID] = service
+	return nil
+}
+
+func (m *MemoryAdapter) Deregister(service *Service) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.call("Deregister"); err != nil {
+		return err
+	}
+	delete(m.services, service.ID)
+	delete(m.maintenance, service.ID)
+	delete(m.warnings, service.ID)
+	return nil
+}
+
+func (m *MemoryAdapter) Refresh(service *Service) error {
+	m.Lock()
+	defer m.Unlock()
+	return m.call("Refresh")
+}
+
+func (m *MemoryAdapter) Services() ([]*Service, error) {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.call("Services"); err != nil {
+		return nil, err
+	}
+	return m.registered(), nil
+}
+
+// ListsTags reports that Services lists services with their tags.
+func (m *MemoryAdapter) ListsTags() bool {
+	return true
+}
+
+func (m *MemoryAdapter) Maintenance(service *Service, enable bool, reason string) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.call("Maintenance"); err != nil {
+		return err
+	}
+	if enable {
+		m.maintenance[service.ID] = true
+	} else {
+		delete(m.maintenance, service.ID)
+	}
+	return nil
+}
+
+func (m *MemoryAdapter) Warning(service *Service, enable bool, reason string) error {
+	m.Lock()
+	defer m.Unlock()
+	if err := m.call("Warning"); err != nil {
+		return err
+	}
+	if enable {
+		m.warnings[service.ID] = true
+	} else {
+		delete(m.warnings, service.ID)
+	}
+	return nil
+}
+
+// Registered lists the registered services, ordered by ID.
+func (m *MemoryAdapter) Registered() []*Service {
+	m.Lock()
+	defer m.Unlock()
+	return m.registered()
+}
+
+func (m *MemoryAdapter) registered() []*Service {
+	services := make([]*Service, 0, len(m.services))
+	for _, service := range m.services {
+		services = append(services, service)
+	}
+	sort.Slice(services, func(i, j int) bool { return services[i].ID < services[j].ID })
+	return services
+}
+
+// InMaintenance reports whether a service is in maintenance.
+func (m *MemoryAdapter) InMaintenance(id string) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.maintenance[id]
+}
+
+// InWarning reports whether a service is marked with a warning.
+func (m *MemoryAdapter) InWarning(id string) bool {
+	m.Lock()
+	defer m.Unlock()
+	return m.warnings[id]
+}
+
+// Calls returns how often an adapter method, such as "Register", was called.
+func (m *MemoryAdapter) Calls(method string) int {
+	m.Lock()
+	defer m.Unlock()
+	return m.calls[method]
+}
+
+// FailWith makes calls of an adapter method return err from now on, or
+// succeed again if err is nil.
+func (m *MemoryAdapter) FailWith(method string, err error) {
+	m.Lock()
+	defer m.Unlock()
+	if err == nil {
+		delete(m.errors, method)
+		return
+	}
+	m.errors[method] = err
+}
+
+// Reset forgets all services, calls and injected errors.
+func (m *MemoryAdapter) Reset() {
+	m.Lock()
+	defer m.Unlock()
+	m.services = make(map[string]*Service)
+	m.maintenance = make(map[string]bool)
+	m.warnings = make(map[string]bool)
+	m.calls = make(map[string]int)
+	m.errors = make(map[string]error)
+}
@@ -0,0 +1,116 @@
+package bridge
+
+import (
+	"errors"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestMemoryAdapter(t *testing.T) {
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "memory://adapter-test", Config{RegisterStopped: true})
+	assert.NoError(t, err)
+	memory := Memory("adapter-test")
+	defer memory.Reset()
+
+	down := errors.New("registry down")
+	memory.FailWith("Register", down)
+	bridge.Add(container.ID)
+	assert.Empty(t, memory.Registered())
+	assert.Equal(t, 1, memory.Calls("Register"))
+
+	services, err := memory.Services()
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+
+	memory.FailWith("Register", nil)
+	bridge.Sync(true)
+	assert.Len(t, memory.Registered(), 1)
+	id := memory.Registered()[0].ID
+
+	bridge.RemoveOnExit(container.ID)
+	assert.True(t, memory.InMaintenance(id))
+
+	memory.FailWith("Ping", down)
+	assert.True(t, errors.Is(bridge.Ping(), down))
+}
+
+func TestRegisterRestarting(t *testing.T) {
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.HostConfig.RestartPolicy.Name = "always"
+	bridge, err := New(newFakeDocker(container), "memory://restarting-test", Config{RegisterRestarting: true})
+	assert.NoError(t, err)
+	memory := Memory("restarting-test")
+	defer memory.Reset()
+
+	bridge.Add(container.ID)
+	assert.Len(t, memory.Registered(), 1)
+	id := memory.Registered()[0].ID
+	assert.False(t, memory.InWarning(id))
+
+	// restarting: kept registered with a warning
+	container.State.Running = false
+	container.State.Restarting = true
+	bridge.RemoveOnExit(container.ID)
+	assert.Len(t, memory.Registered(), 1)
+	assert.True(t, memory.InWarning(id))
+
+	// running again: passing
+	container.State.Running = true
+	container.State.Restarting = false
+	bridge.Add(container.ID)
+	assert.Len(t, memory.Registered(), 1)
+	assert.False(t, memory.InWarning(id))
+
+	// stopped with docker stop, which its restart policy doesn't restart
+	container.State.Running = false
+	bridge.RemoveOnExit(container.ID)
+	assert.Empty(t, memory.Registered())
+
+	// without a restart it is removed as usual
+	container.HostConfig.RestartPolicy.Name = "no"
+	container.State.Running = true
+	bridge.Add(container.ID)
+	container.State.Running = false
+	bridge.RemoveOnExit(container.ID)
+	assert.Empty(t, memory.Registered())
+}
+
+func TestRegisterRestartingGrace(t *testing.T) {
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.HostConfig.RestartPolicy.Name = "always"
+	bridge, err := New(newFakeDocker(container), "memory://restarting-grace-test", Config{RegisterRestarting: true, RestartGrace: 1})
+	assert.NoError(t, err)
+	bridge.restartGrace = 20 * time.Millisecond
+	memory := Memory("restarting-grace-test")
+	defer memory.Reset()
+
+	// held with a warning on the restart policy alone, but not for longer
+	// than the grace period
+	bridge.Add(container.ID)
+	id := memory.Registered()[0].ID
+	container.State.Running = false
+	bridge.RemoveOnExit(container.ID)
+	assert.Len(t, memory.Registered(), 1)
+	assert.True(t, memory.InWarning(id))
+	assert.Eventually(t, func() bool { return len(memory.Registered()) == 0 }, time.Second, time.Millisecond)
+
+	// restarting, also bounded by the grace period
+	container.State.Running = true
+	bridge.Add(container.ID)
+	container.State.Running = false
+	container.State.Restarting = true
+	bridge.RemoveOnExit(container.ID)
+	assert.True(t, memory.InWarning(id))
+	container.State.Running = true
+	container.State.Restarting = false
+	bridge.Add(container.ID)
+	time.Sleep(50 * time.Millisecond)
+	assert.Len(t, memory.Registered(), 1)
+	assert.False(t, memory.InWarning(id))
+	bridge.Lock()
+	assert.Empty(t, bridge.held)
+	bridge.Unlock()
+}
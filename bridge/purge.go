@@ -0,0 +1,51 @@
+package bridge
+
+import (
+	"strings"
+
+	. "github.com/xytis/registrator/common"
+)
+
+// purge deregisters every backend service with a tag matched by
+// Config.PurgeOnStart, for starting from a clean slate before the first
+// sync. Services of other hosts and tools are removed too if they carry the
+// tag, so the selector is all that limits it.
+func (b *Bridge) purge() {
+	selector := b.config.PurgeOnStart
+	if selector == "" {
+		return
+	}
+	b.Lock()
+	defer b.Unlock()
+
+	var services []*Service
+	err := b.call(func() (err error) {
+		services, err = b.registry.Services()
+		return
+	})
+	if err != nil {
+		b.failures.Errorln("purge failed:", err)
+		return
+	}
+	var matched []*Service
+	for _, service := range services {
+		if purgeMatches(selector, service.Tags) {
+			matched = append(matched, service)
+		}
+	}
+	Log.Warnf("Purging %d services tagged %s", len(matched), selector)
+	b.deregisterAll(matched)
+}
+
+// purgeMatches reports whether one of the tags is the selector, or starts
+// with it when the selector ends in *.
+func purgeMatches(selector string, tags []string) bool {
+	prefix := strings.HasSuffix(selector, "*")
+	selector = strings.TrimSuffix(selector, "*")
+	for _, tag := range tags {
+		if tag == selector || prefix && strings.HasPrefix(tag, selector) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,157 @@
+package bridge
+
+import (
+	"strings"
+	"time"
+
+	. "github.com/xytis/registrator/common"
+)
+
+// first wait before looking for the services waiting services require
+// again, doubled on every further look up to maxRetryDelay
+var requiresPollInterval = time.Second
+
+// parseRequires returns the service names listed in SERVICE_REQUIRES.
+func parseRequires(value string) []string {
+	var names []string
+	for _, name := range strings.Split(value, ",") {
+		if name = strings.TrimSpace(name); name != "" {
+			names = append(names, name)
+		}
+	}
+	return names
+}
+
+// missingRequired returns the first service the service requires that is
+// not in the registry, or "" once all are. Callers hold the lock.
+func (b *Bridge) missingRequired(service *Service) (string, error) {
+	present, err := b.presentRequired(service.requires)
+	if err != nil {
+		return service.requires[0], err
+	}
+	return firstMissing(service, present), nil
+}
+
+// presentRequired looks up which of the named services are in the registry,
+// from any host: with one lookup per name on a ServiceFinder, else with one
+// listing of the registry.
+func (b *Bridge) presentRequired(names []string) (map[string]bool, error) {
+	present := make(map[string]bool, len(names))
+	if finder, ok := b.registry.(ServiceFinder); ok {
+		for _, name := range names {
+			var found bool
+			err := b.call(func() error {
+				var err error
+				found, err = finder.HasService(name)
+				return err
+			})
+			if err != nil {
+				return present, err
+			}
+			present[name] = found
+		}
+		return present, nil
+	}
+	var registered []*Service
+	err := b.call(func() error {
+		var err error
+		registered, err = b.registry.Services()
+		return err
+	})
+	for _, other := range registered {
+		present[other.Name] = true
+	}
+	return present, err
+}
+
+func firstMissing(service *Service, present map[string]bool) string {
+	for _, name := range service.requires {
+		if !present[name] {
+			return name
+		}
+	}
+	return ""
+}
+
+// awaitRequired registers a service once the services it requires are in
+// the registry. A service already waiting registers as the latest version.
+// Callers hold the lock.
+func (b *Bridge) awaitRequired(service *Service, missing string) {
+	if _, ok := b.awaiting[service.ID]; ok {
+		b.awaiting[service.ID] = service
+		return
+	}
+	Log.Infoln("waiting:", service.ID, "requires", missing)
+	b.awaiting[service.ID] = service
+	b.scheduleAwaiting(requiresPollInterval)
+}
+
+// scheduleAwaiting looks for the services the waiting services require
+// after the delay, for all of them at once, and again with growing delays
+// while some are still missing. Scheduling again replaces the pending look.
+// Callers hold the lock.
+func (b *Bridge) scheduleAwaiting(delay time.Duration) {
+	if b.awaitTimer != nil {
+		b.awaitTimer.Stop()
+	}
+	b.awaitRound++
+	round := b.awaitRound
+	b.awaitTimer = time.AfterFunc(delay, func() { b.checkAwaiting(round, delay) })
+}
+
+func (b *Bridge) checkAwaiting(round int, delay time.Duration) {
+	b.Lock()
+	if round != b.awaitRound {
+		b.Unlock()
+		return
+	}
+	seen := make(map[string]bool)
+	var names []string
+	for _, service := range b.awaiting {
+		for _, name := range service.requires {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	b.Unlock()
+
+	// looked up without the lock, the registry may be slow
+	present, err := b.presentRequired(names)
+
+	b.Lock()
+	defer b.Unlock()
+	if round != b.awaitRound {
+		return
+	}
+	if err != nil {
+		b.failures.Warnln("unable to list services:", err)
+	}
+	for id, service := range b.awaiting {
+		if missing := firstMissing(service, present); missing != "" {
+			Log.Debugln("still waiting:", id, "requires", missing)
+			continue
+		}
+		delete(b.awaiting, id)
+		b.registerService(service.Origin.ContainerID, service)
+	}
+	if len(b.awaiting) == 0 {
+		b.awaitTimer = nil
+		return
+	}
+	if delay *= 2; delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	b.scheduleAwaiting(delay)
+}
+
+// cancelAwaiting drops the services of a container waiting for the services
+// they require. Callers hold the lock.
+func (b *Bridge) cancelAwaiting(containerId string) {
+	for id, service := range b.awaiting {
+		if service.Origin.ContainerID == containerId {
+			delete(b.awaiting, id)
+		}
+	}
+}
@@ -0,0 +1,46 @@
+package bridge
+
+import (
+	. "github.com/xytis/registrator/common"
+)
+
+// warnRestarting marks the services of a restarting container with a
+// warning, once. Callers hold the lock.
+func (b *Bridge) warnRestarting(containerId string) {
+	if b.restarting[containerId] || b.services[containerId] == nil {
+		return
+	}
+	b.restarting[containerId] = true
+	b.warn(containerId, true, "container restarting")
+	Log.Infoln("restarting:", containerId[:12])
+}
+
+// restarted brings the services of a container that runs again in line, as
+// its address may have changed, and takes their warning away. Callers hold
+// the lock.
+func (b *Bridge) restarted(containerId string) {
+	if timer, ok := b.held[containerId]; ok {
+		timer.Stop()
+		delete(b.held, containerId)
+	}
+	delete(b.restarting, containerId)
+	Log.Infoln("restarted:", containerId[:12])
+	b.reconcile(containerId)
+	b.warn(containerId, false, "")
+}
+
+func (b *Bridge) warn(containerId string, enable bool, reason string) {
+	for _, service := range b.services[containerId] {
+		err := b.call(func() error {
+			return b.registry.(WarningAdapter).Warning(service, enable, reason)
+		})
+		action := "warning_off"
+		if enable {
+			action = "warning_on"
+		}
+		b.audit.record(b.backend, action, service, err)
+		if err != nil {
+			b.failures.Errorln("warning failed:", err, service.ID)
+		}
+	}
+}
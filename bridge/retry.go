@@ -0,0 +1,116 @@
+package bridge
+
+import (
+	"errors"
+	"net"
+	"time"
+
+	. "github.com/xytis/registrator/common"
+)
+
+// longest wait between two retries of a failed registry call
+var maxRetryDelay = time.Minute
+
+// scheduledRetry is a registry call waiting to be retried.
+type scheduledRetry struct {
+	timer   *time.Timer
+	service *Service
+}
+
+// transient reports whether a failed registry call is worth retrying right
+// away. Network errors and errors reporting themselves as temporary are;
+// errors the backend answered with, e.g. a rejected registration, and calls
+// short-circuited by the breaker are not.
+func transient(err error) bool {
+	if err == nil || errors.Is(err, ErrCircuitOpen) {
+		return false
+	}
+	var netErr net.Error
+	if errors.As(err, &netErr) {
+		return true
+	}
+	var temporary interface{ Temporary() bool }
+	return errors.As(err, &temporary) && temporary.Temporary()
+}
+
+// retryLater schedules fn to be called again for service after it failed
+// with err, when err is transient and fewer than RetryAttempts retries were
+// made (-1 retries until the breaker opens). The first retry waits
+// RetryInterval milliseconds, doubled on every further attempt. fn is called
+// with the lock held; callers hold the lock too.
+func (b *Bridge) retryLater(service *Service, attempt int, err error, fn func() error) {
+	if !transient(err) || (b.config.RetryAttempts != -1 && attempt >= b.config.RetryAttempts) {
+		return
+	}
+	delay := time.Duration(b.config.RetryInterval) * time.Millisecond
+	for i := 0; i < attempt && delay < maxRetryDelay; i++ {
+		delay *= 2
+	}
+	if delay > maxRetryDelay {
+		delay = maxRetryDelay
+	}
+	b.cancelRetry(service.ID)
+	retry := &scheduledRetry{service: service}
+	retry.timer = time.AfterFunc(delay, func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.retries[service.ID] != retry {
+			return
+		}
+		delete(b.retries, service.ID)
+		if err := fn(); err != nil {
+			b.failures.Errorln("retry failed:", err, service.ID)
+			b.retryLater(service, attempt+1, err, fn)
+		}
+	})
+	b.retries[service.ID] = retry
+	Log.Debugln("retrying in", delay.String()+":", service.ID)
+}
+
+// cancelRetry drops a retry scheduled for a service. Callers hold the lock.
+func (b *Bridge) cancelRetry(serviceId string) {
+	if retry, ok := b.retries[serviceId]; ok {
+		retry.timer.Stop()
+		delete(b.retries, serviceId)
+	}
+}
+
+// cancelRetries drops the retries scheduled for the services of a container.
+// Callers hold the lock.
+func (b *Bridge) cancelRetries(containerId string) {
+	for id, retry := range b.retries {
+		if retry.service.Origin.ContainerID == containerId {
+			retry.timer.Stop()
+			delete(b.retries, id)
+		}
+	}
+}
+
+// registerLater retries a registration that failed while adding a container.
+func (b *Bridge) registerLater(service *Service, err error) {
+	b.retryLater(service, 0, err, func() error {
+		if err := b.register(service); err != nil {
+			return err
+		}
+		containerId := service.Origin.ContainerID
+		b.services[containerId] = append(b.services[containerId], service)
+		Log.Infoln("added:", containerId[:12], service.ID)
+		return nil
+	})
+}
+
+// deregisterLater retries a deregistration that failed, unless the service
+// was registered again in the meantime.
+func (b *Bridge) deregisterLater(service *Service, err error) {
+	b.retryLater(service, 0, err, func() error {
+		if b.pending[service.ID] != service {
+			return nil
+		}
+		if err := b.deregister(service); err != nil {
+			return err
+		}
+		delete(b.pending, service.ID)
+		Log.Infoln("removed:", service.ID)
+		return nil
+	})
+}
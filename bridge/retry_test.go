@@ -0,0 +1,114 @@
+package bridge
+
+import (
+	"errors"
+	"fmt"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTransient(t *testing.T) {
+	assert.True(t, transient(errFlaky))
+	assert.True(t, transient(fmt.Errorf("register: %w", errFlaky)))
+	assert.False(t, transient(errors.New("Unexpected response code: 400 (bad check)")))
+	assert.False(t, transient(ErrCircuitOpen))
+	assert.False(t, transient(nil))
+}
+
+func TestAddRetriesTransientErrors(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{RetryAttempts: 3, RetryInterval: 1})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	adapter.flaky = 2
+
+	bridge.Add(container.ID)
+	assert.Eventually(t, func() bool {
+		bridge.Lock()
+		defer bridge.Unlock()
+		return len(bridge.services[container.ID]) == 1
+	}, time.Second, time.Millisecond)
+	adapter.Lock()
+	defer adapter.Unlock()
+	assert.Equal(t, 3, adapter.registers)
+	assert.Len(t, adapter.services, 1)
+}
+
+func TestAddGivesUpOnPermanentErrors(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{RetryAttempts: 3, RetryInterval: 1})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	adapter.fail = errors.New("Unexpected response code: 400 (bad check)")
+
+	bridge.Add(container.ID)
+	time.Sleep(20 * time.Millisecond)
+	adapter.Lock()
+	defer adapter.Unlock()
+	assert.Equal(t, 1, adapter.registers)
+	assert.Empty(t, bridge.retries)
+}
+
+func TestAddRetriesAreBounded(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{RetryAttempts: 2, RetryInterval: 1})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+	adapter.flaky = 10
+
+	bridge.Add(container.ID)
+	time.Sleep(50 * time.Millisecond)
+	adapter.Lock()
+	defer adapter.Unlock()
+	assert.Equal(t, 3, adapter.registers)
+	bridge.Lock()
+	defer bridge.Unlock()
+	assert.Empty(t, bridge.services[container.ID])
+}
+
+func TestRemoveRetriesTransientErrors(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	docker := newFakeDocker(container)
+	bridge, err := New(docker, "fake://", Config{DeregisterCheck: "always", RetryAttempts: 3, RetryInterval: 1})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	adapter.Lock()
+	adapter.flaky = 1
+	adapter.Unlock()
+	bridge.RemoveOnExit(container.ID)
+	assert.Eventually(t, func() bool {
+		adapter.Lock()
+		defer adapter.Unlock()
+		return len(adapter.services) == 0
+	}, time.Second, time.Millisecond)
+	bridge.Lock()
+	defer bridge.Unlock()
+	assert.Empty(t, bridge.pending)
+}
+
+func TestRegisterCancelsPendingDeregister(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	bridge, err := New(newFakeDocker(container), "fake://", Config{DeregisterCheck: "always", RetryAttempts: 3, RetryInterval: 20})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	adapter.Lock()
+	adapter.flaky = 1
+	adapter.Unlock()
+	bridge.RemoveOnExit(container.ID)
+	bridge.Add(container.ID)
+	time.Sleep(60 * time.Millisecond)
+	adapter.Lock()
+	defer adapter.Unlock()
+	assert.Len(t, adapter.services, 1)
+}
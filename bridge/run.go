@@ -0,0 +1,346 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"hash/fnv"
+	"strings"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	. "github.com/xytis/registrator/common"
+)
+
+// Run creates a bridge for the registry URI and runs it until ctx is done.
+// It is the entrypoint for embedding registrator without its CLI.
+func Run(ctx context.Context, docker DockerClient, adapterUri string, config Config) error {
+	b, err := New(docker, adapterUri, config)
+	if err != nil {
+		return err
+	}
+	return b.Run(ctx)
+}
+
+// Run connects to the registry, syncs all containers and then processes
+// Docker events, refreshing and resyncing services as configured, until ctx
+// is done. It returns nil once stopped through ctx.
+func (b *Bridge) Run(ctx context.Context) error {
+	if err := b.connect(ctx); err != nil {
+		return err
+	}
+
+	// Start event listener before listing containers to avoid missing anything
+	buffer := b.config.EventBuffer
+	if buffer <= 0 {
+		buffer = DefaultEventBuffer()
+	}
+	events := make(chan *dockerapi.APIEvents, buffer)
+	if err := b.docker.AddEventListener(events); err != nil {
+		return err
+	}
+	defer b.docker.RemoveEventListener(events)
+	Log.Infoln("Listening for Docker events ...")
+
+	b.purge()
+	saved := b.loadState()
+	b.Sync(false)
+	if b.state != nil {
+		b.dropStale(saved)
+		b.saveState()
+		go b.every(ctx, stateSaveInterval, b.saveState)
+	}
+
+	// Start the TTL refresh timer
+	if b.config.RefreshInterval > 0 {
+		go b.every(ctx, time.Duration(b.config.RefreshInterval)*time.Second, b.Refresh)
+	}
+
+	// Start the resync timer if enabled
+	if b.config.ResyncInterval > 0 {
+		go b.every(ctx, time.Duration(b.config.ResyncInterval)*time.Second, func() { b.Sync(true) })
+	}
+
+	// Start the incremental cleanup of recently changed containers
+	if b.incremental() {
+		go b.every(ctx, time.Duration(b.config.IncrementalCleanup)*time.Second, b.cleanupRecent)
+	}
+
+	// Start pinging the backend to keep /health current if enabled
+	if b.config.PingInterval > 0 {
+		go b.watchBackend(ctx, time.Duration(b.config.PingInterval)*time.Second)
+	}
+
+	// Start watching the registry for critical services of removed containers
+	if b.config.DeregisterCritical > 0 {
+		after := time.Duration(b.config.DeregisterCritical) * time.Second
+		go b.registry.(CriticalWatcher).WatchCritical(ctx, after, b.deregisterCritical)
+	}
+
+	actions := b.eventActions()
+
+	// Events of one container always go to the same worker, so they are
+	// handled in order
+	workers := b.config.EventWorkers
+	if workers <= 0 {
+		workers = DefaultEventWorkers()
+	}
+	queues := make([]chan *dockerapi.APIEvents, workers)
+	for i := range queues {
+		queues[i] = make(chan *dockerapi.APIEvents)
+		defer close(queues[i])
+		go func(queue <-chan *dockerapi.APIEvents) {
+			for msg := range queue {
+				// health_status events come as "health_status: <status>"
+				status := strings.SplitN(msg.Status, ":", 2)[0]
+				b.handle(msg, actions[status])
+			}
+		}(queues[i])
+	}
+
+	// Process Docker events
+	dedup := newEventDeduper()
+	for {
+		select {
+		case msg, ok := <-events:
+			if !ok {
+				return errors.New("docker event loop closed")
+			}
+			Traceln("event:", msg.Status, msg.ID)
+			status := strings.SplitN(msg.Status, ":", 2)[0]
+			if _, ok := actions[status]; ok {
+				if dedup.duplicate(msg) {
+					Log.Debugln("dropped duplicate event:", msg.Status, msg.ID)
+					Metrics.Add("registrator_events_duplicate_total", 1)
+					continue
+				}
+				shard := fnv.New32a()
+				shard.Write([]byte(msg.ID))
+				queues[shard.Sum32()%uint32(workers)] <- msg
+			}
+		case <-ctx.Done():
+			Log.Infoln("Stopping registrator ...")
+			if b.config.ShutdownDrain > 0 {
+				b.Drain(time.Duration(b.config.ShutdownDrain) * time.Second)
+			}
+			b.Lock()
+			b.deregisterHost()
+			b.Unlock()
+			b.saveState()
+			return nil
+		}
+	}
+}
+
+// Drain takes all services out of rotation before registrator stops: they
+// are put into maintenance, which marks them critical, and deregistered once
+// wait has passed, giving load balancers time to shift traffic away.
+func (b *Bridge) Drain(wait time.Duration) {
+	if maintenance, ok := b.registry.(MaintenanceAdapter); ok {
+		// events may still come in while draining, so the lock is only held
+		// to take the services, not for the backend calls and the wait
+		b.Lock()
+		var draining []*Service
+		for containerId, services := range b.services {
+			if !b.stopped[containerId] {
+				draining = append(draining, services...)
+			}
+		}
+		b.Unlock()
+		for _, service := range draining {
+			err := b.call(func() error {
+				return maintenance.Maintenance(service, true, "registrator shutting down")
+			})
+			b.audit.record(b.backend, "maintenance_on", service, err)
+			if err != nil {
+				b.failures.Errorln("maintenance failed:", err, service.ID)
+				continue
+			}
+			Log.Infoln("draining:", service.ID)
+		}
+		Log.Infof("Waiting %v for services to drain ...", wait)
+		time.Sleep(wait)
+	} else {
+		Log.Warnln("adapter does not support maintenance, deregistering without draining")
+	}
+
+	b.Lock()
+	defer b.Unlock()
+	for containerId, services := range b.services {
+		for _, service := range services {
+			if err := b.deregister(service); err != nil {
+				b.failures.Errorln("deregister failed:", err, service.ID)
+				continue
+			}
+			Log.Infoln("removed:", containerId[:12], service.ID)
+		}
+		delete(b.services, containerId)
+	}
+}
+
+// eventDedupWindow is how long events are remembered to drop duplicates.
+const eventDedupWindow = 10 * time.Second
+
+type eventKey struct {
+	id     string
+	status string
+	time   int64
+}
+
+// eventDeduper drops events some Docker versions send twice for one
+// transition. Events are duplicates when their container, status and time
+// match; events without a time are never taken for duplicates.
+type eventDeduper struct {
+	seen   map[eventKey]time.Time
+	pruned time.Time
+	now    func() time.Time
+}
+
+func newEventDeduper() *eventDeduper {
+	return &eventDeduper{seen: make(map[eventKey]time.Time), now: time.Now}
+}
+
+// duplicate reports whether msg was seen within the window and remembers it.
+func (d *eventDeduper) duplicate(msg *dockerapi.APIEvents) bool {
+	happened := msg.TimeNano
+	if happened == 0 {
+		happened = msg.Time * int64(time.Second)
+	}
+	if happened == 0 {
+		return false
+	}
+	now := d.now()
+	if now.Sub(d.pruned) > eventDedupWindow {
+		for key, at := range d.seen {
+			if now.Sub(at) > eventDedupWindow {
+				delete(d.seen, key)
+			}
+		}
+		d.pruned = now
+	}
+	key := eventKey{msg.ID, msg.Status, happened}
+	if at, ok := d.seen[key]; ok && now.Sub(at) <= eventDedupWindow {
+		return true
+	}
+	d.seen[key] = now
+	return false
+}
+
+// handle runs the action for an event and records how long after the event
+// it finished, which grows when registrator falls behind.
+func (b *Bridge) handle(msg *dockerapi.APIEvents, action func(string)) {
+	b.noteChange(msg.ID)
+	action(msg.ID)
+	var happened time.Time
+	switch {
+	case msg.TimeNano != 0:
+		happened = time.Unix(0, msg.TimeNano)
+	case msg.Time != 0:
+		happened = time.Unix(msg.Time, 0)
+	default:
+		return
+	}
+	lag := time.Since(happened).Seconds()
+	Metrics.Set("registrator_event_lag_seconds", lag)
+	Metrics.Add("registrator_event_lag_seconds_sum", lag)
+	Metrics.Add("registrator_event_lag_seconds_count", 1)
+}
+
+// DefaultWatchEvents are the Docker events acted on unless configured otherwise.
+var DefaultWatchEvents = []string{"start", "die", "destroy", "update"}
+
+// eventActions maps the watched Docker event statuses to their actions.
+func (b *Bridge) eventActions() map[string]func(string) {
+	available := map[string]func(string){
+		"start":         b.Add,
+		"die":           b.RemoveOnExit,
+		"destroy":       b.Destroy,
+		"rename":        b.Reconcile,
+		"update":        b.Reconcile,
+		"health_status": b.HealthChanged,
+	}
+	watch := b.config.WatchEvents
+	if len(watch) == 0 {
+		watch = DefaultWatchEvents
+	}
+	actions := make(map[string]func(string))
+	for _, event := range watch {
+		actions[event] = available[event]
+	}
+	return actions
+}
+
+// watches reports whether event is among the watched events.
+func watches(events []string, event string) bool {
+	for _, watched := range events {
+		if watched == event {
+			return true
+		}
+	}
+	return false
+}
+
+func validWatchEvents(events []string) error {
+	for _, event := range events {
+		switch event {
+		case "start", "die", "destroy", "rename", "update", "health_status":
+		default:
+			return errors.New("unknown event to watch: " + event)
+		}
+	}
+	return nil
+}
+
+// connect pings the registry until it answers, making up to RetryAttempts
+// further attempts RetryInterval milliseconds apart (-1 retries forever).
+func (b *Bridge) connect(ctx context.Context) error {
+	attempt := 0
+	for {
+		Log.Infof("Connecting to backend (%v/%v)", attempt, b.config.RetryAttempts)
+
+		err := b.Ping()
+		if err == nil {
+			return nil
+		}
+		Log.Warnln(err)
+		if b.config.RetryAttempts != -1 && attempt >= b.config.RetryAttempts {
+			return err
+		}
+
+		select {
+		case <-time.After(time.Duration(b.config.RetryInterval) * time.Millisecond):
+		case <-ctx.Done():
+			return err
+		}
+		attempt++
+	}
+}
+
+// watchBackend pings the backend every interval, so LastPingError and the
+// registrator_backend_up metric follow its reachability even when nothing
+// else calls it.
+func (b *Bridge) watchBackend(ctx context.Context, interval time.Duration) {
+	var failing bool
+	b.every(ctx, interval, func() {
+		err := b.Ping()
+		if err != nil && !failing {
+			Log.Warnln("backend unreachable:", err)
+		} else if err == nil && failing {
+			Log.Infoln("backend reachable again:", b.backend)
+		}
+		failing = err != nil
+	})
+}
+
+// every calls fn on each interval until ctx is done.
+func (b *Bridge) every(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			fn()
+		case <-ctx.Done():
+			return
+		}
+	}
+}
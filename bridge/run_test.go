@@ -0,0 +1,341 @@
+package bridge
+
+import (
+	"context"
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+	. "github.com/xytis/registrator/common"
+)
+
+func TestRun(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	running := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	started := publishedContainer("fedcba9876543210", map[string]string{"443/tcp": "8443"})
+	started.State.Running = false
+	docker := newFakeDocker(running, started)
+	b, err := New(docker, "fake://", Config{DeregisterCheck: "always"})
+	assert.NoError(t, err)
+	adapter := b.registry.(*fakeAdapter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.Run(ctx)
+	}()
+
+	assert.Eventually(t, func() bool {
+		services, _ := adapter.Services()
+		return len(services) == 1
+	}, time.Second, time.Millisecond)
+
+	docker.Lock()
+	started.State.Running = true
+	docker.Unlock()
+	docker.emit(&dockerapi.APIEvents{Status: "start", ID: started.ID})
+	assert.Eventually(t, func() bool {
+		services, _ := adapter.Services()
+		return len(services) == 2
+	}, time.Second, time.Millisecond)
+
+	docker.emit(&dockerapi.APIEvents{Status: "die", ID: running.ID})
+	assert.Eventually(t, func() bool {
+		services, _ := adapter.Services()
+		return len(services) == 1
+	}, time.Second, time.Millisecond)
+
+	cancel()
+	select {
+	case err := <-done:
+		assert.NoError(t, err)
+	case <-time.After(time.Second):
+		t.Fatal("Run did not stop after cancel")
+	}
+}
+
+func TestRunRenameReregisters(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	docker := newFakeDocker(container)
+	b, err := New(docker, "fake://", Config{WatchEvents: []string{"start", "die", "rename"}})
+	assert.NoError(t, err)
+	adapter := b.registry.(*fakeAdapter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	serviceIDs := func() []string {
+		services, _ := adapter.Services()
+		ids := make([]string, 0)
+		for _, service := range services {
+			ids = append(ids, service.ID)
+		}
+		return ids
+	}
+	assert.Eventually(t, func() bool {
+		return len(serviceIDs()) == 1
+	}, time.Second, time.Millisecond)
+	before := serviceIDs()[0]
+
+	docker.Lock()
+	container.Name = "/renamed"
+	docker.Unlock()
+	docker.emit(&dockerapi.APIEvents{Status: "rename", ID: container.ID})
+	assert.Eventually(t, func() bool {
+		ids := serviceIDs()
+		return len(ids) == 1 && ids[0] != before
+	}, time.Second, time.Millisecond)
+	assert.Contains(t, serviceIDs()[0], ":renamed:80")
+}
+
+func TestRunUpdateReregisters(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Config.Labels = map[string]string{"SERVICE_TAGS": "canary"}
+	docker := newFakeDocker(container)
+	b, err := New(docker, "fake://", Config{})
+	assert.NoError(t, err)
+	adapter := b.registry.(*fakeAdapter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	tags := func() []string {
+		services, _ := adapter.Services()
+		if len(services) != 1 {
+			return nil
+		}
+		return services[0].Tags
+	}
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(tags(), []string{"canary"})
+	}, time.Second, time.Millisecond)
+
+	docker.Lock()
+	container.Config.Labels = map[string]string{"SERVICE_TAGS": "stable"}
+	docker.Unlock()
+	docker.emit(&dockerapi.APIEvents{Status: "update", ID: container.ID})
+	assert.Eventually(t, func() bool {
+		return reflect.DeepEqual(tags(), []string{"stable"})
+	}, time.Second, time.Millisecond)
+}
+
+func TestNewUnknownWatchEvent(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	_, err := New(nil, "fake://", Config{WatchEvents: []string{"start", "explode"}})
+	assert.EqualError(t, err, "unknown event to watch: explode")
+}
+
+func TestDrain(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	b, err := New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+	adapter := b.registry.(*fakeAdapter)
+	b.Add(container.ID)
+	id := b.services[container.ID][0].ID
+
+	done := make(chan struct{})
+	go func() {
+		b.Drain(200 * time.Millisecond)
+		close(done)
+	}()
+
+	assert.Eventually(t, func() bool {
+		adapter.Lock()
+		defer adapter.Unlock()
+		return adapter.maintenance[id]
+	}, time.Second, 10*time.Millisecond)
+	adapter.Lock()
+	assert.Contains(t, adapter.services, id)
+	adapter.Unlock()
+
+	// the bridge isn't locked while waiting, events are still handled
+	locked := make(chan struct{})
+	go func() {
+		b.Lock()
+		b.Unlock()
+		close(locked)
+	}()
+	select {
+	case <-locked:
+	case <-done:
+		t.Fatal("locked for the whole drain")
+	}
+
+	<-done
+	assert.NotContains(t, adapter.services, id)
+	assert.Empty(t, b.services)
+}
+
+func TestEventLag(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	b, err := New(newFakeDocker(), "fake://", Config{})
+	assert.NoError(t, err)
+	count := Metrics.Value("registrator_event_lag_seconds_count")
+
+	handled := ""
+	event := &dockerapi.APIEvents{ID: "0123456789abcdef", Status: "start", Time: time.Now().Add(-5 * time.Second).Unix()}
+	b.handle(event, func(id string) { handled = id })
+
+	assert.Equal(t, event.ID, handled)
+	assert.True(t, Metrics.Value("registrator_event_lag_seconds") >= 5)
+	assert.Equal(t, count+1, Metrics.Value("registrator_event_lag_seconds_count"))
+}
+
+func TestRunDropsDuplicateEvents(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.State.Running = false
+	docker := newFakeDocker(container)
+	b, err := New(docker, "fake://", Config{DeregisterCheck: "always", InspectRetries: 1})
+	assert.NoError(t, err)
+	adapter := b.registry.(*fakeAdapter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.Run(ctx)
+
+	docker.Lock()
+	container.State.Running = true
+	docker.Unlock()
+	docker.emit(&dockerapi.APIEvents{Status: "start", ID: container.ID, TimeNano: 1})
+	docker.emit(&dockerapi.APIEvents{Status: "start", ID: container.ID, TimeNano: 1})
+	docker.emit(&dockerapi.APIEvents{Status: "die", ID: container.ID, TimeNano: 2})
+	assert.Eventually(t, func() bool {
+		adapter.Lock()
+		defer adapter.Unlock()
+		return adapter.registers == 1 && len(adapter.services) == 0
+	}, time.Second, time.Millisecond)
+
+	// one Add inspects the container twice: waiting for its network and
+	// reading its ports
+	docker.Lock()
+	defer docker.Unlock()
+	assert.Equal(t, 2, docker.containerInspects[container.ID])
+}
+
+func TestEventDeduper(t *testing.T) {
+	now := time.Unix(1000, 0)
+	dedup := newEventDeduper()
+	dedup.now = func() time.Time { return now }
+
+	start := &dockerapi.APIEvents{Status: "start", ID: "0123456789abcdef", TimeNano: 5}
+	assert.False(t, dedup.duplicate(start))
+	assert.True(t, dedup.duplicate(&dockerapi.APIEvents{Status: "start", ID: start.ID, TimeNano: 5}))
+	assert.False(t, dedup.duplicate(&dockerapi.APIEvents{Status: "die", ID: start.ID, TimeNano: 5}))
+	assert.False(t, dedup.duplicate(&dockerapi.APIEvents{Status: "start", ID: start.ID, TimeNano: 6}))
+	assert.False(t, dedup.duplicate(&dockerapi.APIEvents{Status: "start", ID: "fedcba9876543210", TimeNano: 5}))
+
+	// without a time events can't be told apart from new ones
+	assert.False(t, dedup.duplicate(&dockerapi.APIEvents{Status: "start", ID: start.ID}))
+	assert.False(t, dedup.duplicate(&dockerapi.APIEvents{Status: "start", ID: start.ID}))
+
+	now = now.Add(eventDedupWindow + time.Second)
+	assert.False(t, dedup.duplicate(start))
+}
+
+func TestWatchBackend(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	b, err := New(newFakeDocker(), "fake://", Config{})
+	assert.NoError(t, err)
+	adapter := b.registry.(*fakeAdapter)
+	adapter.pingErr = errors.New("down")
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	go b.watchBackend(ctx, time.Millisecond)
+
+	assert.Eventually(t, func() bool {
+		return b.LastPingError() != nil
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 0.0, Metrics.Value("registrator_backend_up"))
+
+	adapter.Lock()
+	adapter.pingErr = nil
+	adapter.Unlock()
+	assert.Eventually(t, func() bool {
+		return b.LastPingError() == nil
+	}, time.Second, time.Millisecond)
+	assert.Equal(t, 1.0, Metrics.Value("registrator_backend_up"))
+
+	adapter.Lock()
+	defer adapter.Unlock()
+	assert.True(t, adapter.pings >= 2)
+}
+
+func TestRunHostService(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	b, err := New(newFakeDocker(container), "fake://", Config{HostService: true, HostIp: "10.0.0.9", ForceTags: "dc1"})
+	assert.NoError(t, err)
+	adapter := b.registry.(*fakeAdapter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.Run(ctx)
+	}()
+
+	hostID := Hostname + ":" + HostServiceName
+	assert.Eventually(t, func() bool {
+		adapter.Lock()
+		defer adapter.Unlock()
+		return adapter.services[hostID] != nil && len(adapter.services) == 2
+	}, time.Second, time.Millisecond)
+	adapter.Lock()
+	host := adapter.services[hostID]
+	adapter.Unlock()
+	assert.Equal(t, HostServiceName, host.Name)
+	assert.Equal(t, "10.0.0.9", host.IP)
+	assert.Equal(t, []string{"dc1"}, host.Tags)
+	assert.Equal(t, Hostname, host.Attrs["host_id"])
+
+	cancel()
+	assert.NoError(t, <-done)
+	adapter.Lock()
+	defer adapter.Unlock()
+	assert.NotContains(t, adapter.services, hostID)
+	assert.Len(t, adapter.services, 1)
+}
+
+func TestRunPurgeOnStart(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	b, err := New(newFakeDocker(container), "fake://", Config{PurgeOnStart: "env=staging*"})
+	assert.NoError(t, err)
+	adapter := b.registry.(*fakeAdapter)
+	for id, tags := range map[string][]string{
+		"other:stale:80":  {"env=staging"},
+		"other:stale2:80": {"env=staging-2", "web"},
+		"other:keep:80":   {"env=production"},
+		"other:bare:80":   nil,
+	} {
+		adapter.services[id] = &Service{ID: id, Tags: tags}
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	done := make(chan error)
+	go func() {
+		done <- b.Run(ctx)
+	}()
+	assert.Eventually(t, func() bool { return b.ServiceCount() == 1 }, time.Second, time.Millisecond)
+	cancel()
+	assert.NoError(t, <-done)
+
+	adapter.Lock()
+	defer adapter.Unlock()
+	assert.NotContains(t, adapter.services, "other:stale:80")
+	assert.NotContains(t, adapter.services, "other:stale2:80")
+	assert.Contains(t, adapter.services, "other:keep:80")
+	assert.Contains(t, adapter.services, "other:bare:80")
+
+	_, err = New(newFakeDocker(), "fake://", Config{PurgeOnStart: "*"})
+	assert.Error(t, err)
+}
@@ -0,0 +1,191 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"path"
+	"strconv"
+	"strings"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// serviceFileEnv names the service file in the container environment.
+const serviceFileEnv = "SERVICE_FILE"
+
+// serviceFilePath returns the path of the service file inside the
+// container, from the SERVICE_FILE environment variable or else the label
+// named by label.
+func serviceFilePath(container *dockerapi.Container, label string) string {
+	for _, kv := range container.Config.Env {
+		kvp := strings.SplitN(kv, "=", 2)
+		if kvp[0] == serviceFileEnv && len(kvp) > 1 && kvp[1] != "" {
+			return kvp[1]
+		}
+	}
+	if label != "" {
+		return container.Config.Labels[label]
+	}
+	return ""
+}
+
+// mountedPath maps a path inside the container to the host path it is
+// mounted from, so a file on a shared mount can be read without copying it
+// out of the container.
+func mountedPath(container *dockerapi.Container, p string) (string, bool) {
+	p = path.Clean(p)
+	var match dockerapi.Mount
+	for _, mount := range container.Mounts {
+		dest := path.Clean(mount.Destination)
+		if p != dest && !strings.HasPrefix(p, strings.TrimSuffix(dest, "/")+"/") {
+			continue
+		}
+		if len(dest) > len(match.Destination) {
+			match = mount
+			match.Destination = dest
+		}
+	}
+	if match.Source == "" {
+		return "", false
+	}
+	return path.Join(match.Source, strings.TrimPrefix(p, match.Destination)), true
+}
+
+// readServiceFile reads the SERVICE_ variables of the container's service
+// file, a JSON object of variable names to values, e.g.
+// {"SERVICE_80_NAME": "web", "SERVICE_TAGS": "a,b"}. A container without a
+// service file has no variables.
+func readServiceFile(container *dockerapi.Container, label string) (map[string]string, error) {
+	p := serviceFilePath(container, label)
+	if p == "" {
+		return nil, nil
+	}
+	hostPath, ok := mountedPath(container, p)
+	if !ok {
+		return nil, errors.New("service file " + p + " is not on a mount")
+	}
+	data, err := ioutil.ReadFile(hostPath)
+	if err != nil {
+		return nil, err
+	}
+	return parseServiceFile(data)
+}
+
+// parseServiceFile parses the content of a service file. Values may be
+// strings, numbers or booleans, as written in JSON.
+func parseServiceFile(data []byte) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return nil, errors.New("bad service file: " + err.Error())
+	}
+	vars := make(map[string]string, len(raw))
+	for k, v := range raw {
+		value, err := scalarValue(v)
+		if err != nil {
+			return nil, errors.New("bad service file: " + k + " " + err.Error())
+		}
+		vars[k] = value
+	}
+	return vars, nil
+}
+
+// scalarValue returns a JSON string, number or boolean as a string.
+func scalarValue(v json.RawMessage) (string, error) {
+	var s string
+	if err := json.Unmarshal(v, &s); err == nil {
+		return s, nil
+	}
+	var scalar interface{}
+	if err := json.Unmarshal(v, &scalar); err != nil {
+		return "", err
+	}
+	switch scalar.(type) {
+	case float64, bool:
+		return strings.TrimSpace(string(v)), nil
+	}
+	return "", errors.New("is not a string, number or boolean")
+}
+
+// serviceLabel is the label holding all SERVICE_ metadata of a container as
+// one JSON object, e.g.
+// {"name": "web", "tags": ["a"], "check": {"http": "/health"}, "ports": {"443": {"name": "web-tls"}}}.
+const serviceLabel = "registrator.service"
+
+// parseServiceLabel turns the JSON object of a registrator.service label into
+// SERVICE_ variables. Keys are the variable names without SERVICE_, lists of
+// tags, by tagsSep, and aliases are joined, "check" holds the CHECK_ settings and
+// "checks" a list of them, numbered from 1, "meta" holds attributes and
+// "ports" the settings of single ports, by exposed port.
+func parseServiceLabel(value, tagsSep string) (map[string]string, error) {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal([]byte(value), &raw); err != nil {
+		return nil, errors.New("bad " + serviceLabel + " label: " + err.Error())
+	}
+	vars := make(map[string]string)
+	if err := addServiceVars(vars, "SERVICE_", raw, true, tagsSep); err != nil {
+		return nil, errors.New("bad " + serviceLabel + " label: " + err.Error())
+	}
+	return vars, nil
+}
+
+func addServiceVars(vars map[string]string, prefix string, raw map[string]json.RawMessage, top bool, tagsSep string) error {
+	for key, v := range raw {
+		name := prefix + strings.ToUpper(key)
+		switch {
+		case key == "tags" || key == "aliases":
+			var list []string
+			if err := json.Unmarshal(v, &list); err == nil {
+				sep := ","
+				if key == "tags" {
+					sep = tagsSep
+				}
+				vars[name] = strings.Join(list, sep)
+				continue
+			}
+		case key == "check" || key == "meta" || (key == "ports" && top):
+			var object map[string]json.RawMessage
+			if err := json.Unmarshal(v, &object); err != nil {
+				return errors.New(key + " is not an object")
+			}
+			switch key {
+			case "check":
+				if err := addServiceVars(vars, name+"_", object, false, tagsSep); err != nil {
+					return err
+				}
+			case "meta":
+				if err := addServiceVars(vars, prefix, object, false, tagsSep); err != nil {
+					return err
+				}
+			case "ports":
+				for port, settings := range object {
+					var portRaw map[string]json.RawMessage
+					if err := json.Unmarshal(settings, &portRaw); err != nil {
+						return errors.New("port " + port + " is not an object")
+					}
+					if err := addServiceVars(vars, prefix+strings.Split(port, "/")[0]+"_", portRaw, false, tagsSep); err != nil {
+						return err
+					}
+				}
+			}
+			continue
+		case key == "checks":
+			var checks []map[string]json.RawMessage
+			if err := json.Unmarshal(v, &checks); err != nil {
+				return errors.New("checks is not a list of objects")
+			}
+			for i, check := range checks {
+				if err := addServiceVars(vars, prefix+"CHECK_"+strconv.Itoa(i+1)+"_", check, false, tagsSep); err != nil {
+					return err
+				}
+			}
+			continue
+		}
+		value, err := scalarValue(v)
+		if err != nil {
+			return errors.New(key + " " + err.Error())
+		}
+		vars[name] = value
+	}
+	return nil
+}
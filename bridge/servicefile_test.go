@@ -0,0 +1,142 @@
+package bridge
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestParseServiceFile(t *testing.T) {
+	vars, err := parseServiceFile([]byte(`{"SERVICE_80_NAME": "web", "SERVICE_WEIGHT": 10, "SERVICE_IGNORE": false}`))
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"SERVICE_80_NAME": "web",
+		"SERVICE_WEIGHT":  "10",
+		"SERVICE_IGNORE":  "false",
+	}, vars)
+
+	_, err = parseServiceFile([]byte(`{"SERVICE_TAGS": ["a", "b"]}`))
+	assert.Error(t, err)
+	_, err = parseServiceFile([]byte(`SERVICE_NAME=web`))
+	assert.Error(t, err)
+}
+
+func TestMountedPath(t *testing.T) {
+	container := &dockerapi.Container{Mounts: []dockerapi.Mount{
+		{Source: "/srv/config", Destination: "/etc/app"},
+		{Source: "/srv/registrator", Destination: "/etc/app/registrator/"},
+	}}
+	p, ok := mountedPath(container, "/etc/app/registrator/service.json")
+	assert.True(t, ok)
+	assert.Equal(t, "/srv/registrator/service.json", p)
+	p, ok = mountedPath(container, "/etc/app/service.json")
+	assert.True(t, ok)
+	assert.Equal(t, "/srv/config/service.json", p)
+	_, ok = mountedPath(container, "/etc/application/service.json")
+	assert.False(t, ok)
+}
+
+func TestServiceFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service-file")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "service.json"), []byte(`{
+		"SERVICE_80_NAME": "web",
+		"SERVICE_443_NAME": "web-tls",
+		"SERVICE_TAGS": "file",
+		"SERVICE_REGION": "file"
+	}`), 0644))
+
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "443/tcp": "8443"})
+	container.Mounts = []dockerapi.Mount{{Source: dir, Destination: "/etc/registrator"}}
+	container.Config.Labels = map[string]string{
+		"service-file":   "/etc/registrator/service.json",
+		"SERVICE_TAGS":   "label",
+		"SERVICE_REGION": "label",
+	}
+	container.Config.Env = []string{"SERVICE_REGION=env"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{ServiceFileLabel: "service-file"})
+	assert.NoError(t, err)
+	adapter := bridge.registry.(*fakeAdapter)
+
+	bridge.Add(container.ID)
+	names := make(map[string]int)
+	for _, service := range adapter.services {
+		names[service.Name] = service.Port
+		assert.Equal(t, []string{"file"}, service.Tags)
+		assert.Equal(t, "env", service.Attrs["region"])
+	}
+	assert.Equal(t, map[string]int{"web": 8080, "web-tls": 8443}, names)
+}
+
+func TestServiceFileEnv(t *testing.T) {
+	dir, err := ioutil.TempDir("", "service-file")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	assert.NoError(t, ioutil.WriteFile(filepath.Join(dir, "web.json"), []byte(`{"SERVICE_NAME": "web"}`), 0644))
+
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	container.Mounts = []dockerapi.Mount{{Source: dir, Destination: "/run/service"}}
+	container.Config.Env = []string{"SERVICE_FILE=/run/service/web.json"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+
+	bridge.Add(container.ID)
+	assert.Equal(t, "web", bridge.services[container.ID][0].Name)
+	assert.Empty(t, bridge.services[container.ID][0].Attrs["file"])
+}
+
+func TestServiceLabel(t *testing.T) {
+	vars, err := parseServiceLabel(`{
+		"name": "web",
+		"tags": ["a", "b"],
+		"ttl": 30,
+		"check": {"http": "/health", "interval": "5s"},
+		"checks": [{"tcp": true}],
+		"meta": {"region": "eu-west"},
+		"ports": {"443/tcp": {"name": "web-tls", "check": {"tcp": true}}}
+	}`, ",")
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{
+		"SERVICE_NAME":           "web",
+		"SERVICE_TAGS":           "a,b",
+		"SERVICE_TTL":            "30",
+		"SERVICE_CHECK_HTTP":     "/health",
+		"SERVICE_CHECK_INTERVAL": "5s",
+		"SERVICE_CHECK_1_TCP":    "true",
+		"SERVICE_REGION":         "eu-west",
+		"SERVICE_443_NAME":       "web-tls",
+		"SERVICE_443_CHECK_TCP":  "true",
+	}, vars)
+
+	_, err = parseServiceLabel(`{"check": "/health"}`, ",")
+	assert.EqualError(t, err, "bad registrator.service label: check is not an object")
+
+	// the label fills in what SERVICE_ variables don't set
+	Register(new(fakeFactory), "fake")
+	container := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080", "443/tcp": "8443"})
+	container.Config.Labels = map[string]string{
+		serviceLabel:   `{"name": "web", "tags": ["a"], "meta": {"region": "eu-west"}, "ports": {"443": {"name": "web-tls"}}}`,
+		"SERVICE_TAGS": "from-label",
+	}
+	container.Config.Env = []string{"SERVICE_REGION=us-east"}
+	bridge, err := New(newFakeDocker(container), "fake://", Config{})
+	assert.NoError(t, err)
+	bridge.Add(container.ID)
+	services := make(map[string]*Service)
+	for _, service := range bridge.services[container.ID] {
+		services[service.Name] = service
+	}
+	if assert.Len(t, services, 2) {
+		assert.Equal(t, 8080, services["web-80"].Port)
+		assert.Equal(t, []string{"from-label"}, services["web-80"].Tags)
+		assert.Equal(t, map[string]string{"region": "us-east"}, services["web-80"].Attrs)
+		assert.Equal(t, 8443, services["web-tls"].Port)
+	}
+}
@@ -0,0 +1,120 @@
+package bridge
+
+import (
+	"encoding/json"
+	"errors"
+	"time"
+
+	. "github.com/xytis/registrator/common"
+)
+
+// how often the service map is saved to the state backend when it changed
+var stateSaveInterval = 10 * time.Second
+
+// stateSchemaVersion is the version of the saved state schema, raised on
+// changes older versions cannot read.
+const stateSchemaVersion = 1
+
+// savedState is the service map a bridge keeps in its state backend, so a
+// restarted registrator on the same host can tell which services it
+// registered before.
+type savedState struct {
+	Version  int                   `json:"version"`
+	Host     string                `json:"host"`
+	Saved    time.Time             `json:"saved"`
+	Services map[string][]*Service `json:"services"` // by container ID
+}
+
+func validStateBackend(backend string) error {
+	switch backend {
+	case "", "consul":
+		return nil
+	}
+	return errors.New("unknown state backend: " + backend)
+}
+
+// loadState reads the services saved by the previous run on this host.
+func (b *Bridge) loadState() []*Service {
+	if b.state == nil {
+		return nil
+	}
+	var data []byte
+	err := b.call(func() (err error) {
+		data, err = b.state.LoadState(Hostname)
+		return
+	})
+	if err != nil {
+		b.failures.Errorln("unable to load state:", err)
+		return nil
+	}
+	if data == nil {
+		return nil
+	}
+	var state savedState
+	if err := json.Unmarshal(data, &state); err != nil || state.Version != stateSchemaVersion {
+		Log.Warnln("ignored saved state: not readable, version", state.Version, err)
+		return nil
+	}
+	var services []*Service
+	for _, saved := range state.Services {
+		services = append(services, saved...)
+	}
+	Log.Infoln("loaded state of", len(services), "services saved", state.Saved.Format(time.RFC3339))
+	return services
+}
+
+// dropStale deregisters the services of a previous run that the first sync
+// did not register again, as their container is gone or their ID changed
+// while registrator was down.
+func (b *Bridge) dropStale(saved []*Service) {
+	b.Lock()
+	defer b.Unlock()
+	var stale []*Service
+	for _, service := range saved {
+		if !b.tracked(service.ID) {
+			stale = append(stale, service)
+		}
+	}
+	if len(stale) == 0 {
+		return
+	}
+	Log.Infoln("removing", len(stale), "services of the saved state no longer running")
+	b.deregisterAll(stale)
+}
+
+// saveState writes the service map to the state backend if it changed since
+// it was last saved.
+func (b *Bridge) saveState() {
+	if b.state == nil {
+		return
+	}
+	_, version, _ := b.changes.since(^uint64(0))
+	b.Lock()
+	if b.stateSaved && version == b.stateVersion {
+		b.Unlock()
+		return
+	}
+	state := savedState{
+		Version:  stateSchemaVersion,
+		Host:     Hostname,
+		Saved:    time.Now().UTC(),
+		Services: make(map[string][]*Service, len(b.services)),
+	}
+	for containerId, services := range b.services {
+		state.Services[containerId] = services
+	}
+	data, err := json.Marshal(state)
+	b.Unlock()
+	if err != nil {
+		Log.Errorln("unable to encode state:", err)
+		return
+	}
+	if err := b.call(func() error { return b.state.SaveState(Hostname, data) }); err != nil {
+		b.failures.Errorln("unable to save state:", err)
+		return
+	}
+	b.Lock()
+	b.stateSaved, b.stateVersion = true, version
+	b.Unlock()
+	Log.Debugln("saved state of", len(state.Services), "containers")
+}
@@ -0,0 +1,74 @@
+package bridge
+
+import (
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// fakeStateStore keeps saved state in memory, by host.
+type fakeStateStore struct {
+	sync.Mutex
+	states map[string][]byte
+}
+
+func (s *fakeStateStore) SaveState(host string, state []byte) error {
+	s.Lock()
+	defer s.Unlock()
+	s.states[host] = state
+	return nil
+}
+
+func (s *fakeStateStore) LoadState(host string) ([]byte, error) {
+	s.Lock()
+	defer s.Unlock()
+	return s.states[host], nil
+}
+
+func TestStateSaveAndRestore(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	store := &fakeStateStore{states: make(map[string][]byte)}
+	kept := publishedContainer("0123456789abcdef", map[string]string{"80/tcp": "8080"})
+	gone := publishedContainer("fedcba9876543210", map[string]string{"80/tcp": "8081"})
+	gone.Name = "/gone"
+
+	first, err := New(newFakeDocker(kept, gone), "fake://", Config{})
+	assert.NoError(t, err)
+	first.state = store
+	adapter := first.registry.(*fakeAdapter)
+	first.Sync(false)
+	first.saveState()
+	assert.Len(t, adapter.services, 2)
+	assert.NotEmpty(t, store.states[Hostname])
+
+	// unchanged, not saved again
+	store.states[Hostname] = nil
+	first.saveState()
+	assert.Nil(t, store.states[Hostname])
+	first.changes.add("register", first.services[kept.ID][0])
+	first.saveState()
+	assert.NotEmpty(t, store.states[Hostname])
+
+	// restarted after a container went away, its services are removed
+	second, err := New(newFakeDocker(kept), "fake://", Config{})
+	assert.NoError(t, err)
+	second.state = store
+	second.registry = adapter
+	saved := second.loadState()
+	assert.Len(t, saved, 2)
+	second.Sync(false)
+	second.dropStale(saved)
+	assert.Len(t, adapter.services, 1)
+	for id := range adapter.services {
+		assert.Contains(t, id, ":test:80")
+	}
+}
+
+func TestStateBackendNeedsStore(t *testing.T) {
+	Register(new(fakeFactory), "fake")
+	_, err := New(nil, "fake://", Config{StateBackend: "consul"})
+	assert.EqualError(t, err, "state backend consul needs the consul adapter, not fake")
+	_, err = New(nil, "fake://", Config{StateBackend: "etcd"})
+	assert.EqualError(t, err, "unknown state backend: etcd")
+}
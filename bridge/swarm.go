@@ -0,0 +1,44 @@
+package bridge
+
+import (
+	dockerapi "github.com/fsouza/go-dockerclient"
+	. "github.com/xytis/registrator/common"
+)
+
+// Labels Docker sets on the containers of Swarm service tasks.
+const (
+	swarmServiceNameLabel = "com.docker.swarm.service.name"
+	swarmServiceIdLabel   = "com.docker.swarm.service.id"
+)
+
+// swarmServiceName returns the name of the Swarm service a task container
+// belongs to, or "" for a container not started by Swarm.
+func swarmServiceName(labels map[string]string) string {
+	return labels[swarmServiceNameLabel]
+}
+
+// addSwarmPorts adds the ports the Swarm service of a task container
+// publishes on the ingress network to ports, with SwarmAware. They are
+// reachable on every node, so they are registered on the host IP like
+// ports bound on this host; a binding of the container itself wins.
+func (b *Bridge) addSwarmPorts(container *dockerapi.Container, ports map[string]ServicePort, preferred []string) {
+	if !b.config.SwarmAware || b.swarm == nil {
+		return
+	}
+	serviceId := container.Config.Labels[swarmServiceIdLabel]
+	if serviceId == "" {
+		return
+	}
+	published, err := b.swarm.InspectSwarmPorts(serviceId)
+	if err != nil {
+		Log.Warnln("unable to inspect swarm service of", container.ID[:12], err)
+		return
+	}
+	for target, hostPort := range published {
+		if port, ok := ports[target]; ok && port.HostPort != "" {
+			continue
+		}
+		binding := []dockerapi.PortBinding{{HostPort: hostPort}}
+		ports[target] = servicePort(container, dockerapi.Port(target), binding, preferred)
+	}
+}
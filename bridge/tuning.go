@@ -0,0 +1,61 @@
+package bridge
+
+import (
+	"bufio"
+	"os"
+	"runtime"
+	"strconv"
+	"strings"
+)
+
+// numCPU and totalMemory are variables so tests can fake the host.
+var (
+	numCPU      = runtime.NumCPU
+	totalMemory = memTotal
+)
+
+// DefaultEventWorkers is the number of event workers used unless configured:
+// two per CPU, between 2 and 64.
+func DefaultEventWorkers() int {
+	workers := 2 * numCPU()
+	if workers < 2 {
+		workers = 2
+	}
+	if workers > 64 {
+		workers = 64
+	}
+	return workers
+}
+
+// DefaultEventBuffer is the number of Docker events buffered unless
+// configured: 64 per worker, or 16 per worker on hosts with less than 1GiB of
+// memory.
+func DefaultEventBuffer() int {
+	perWorker := 64
+	if memory := totalMemory(); memory > 0 && memory < 1<<30 {
+		perWorker = 16
+	}
+	return perWorker * DefaultEventWorkers()
+}
+
+// memTotal reads the memory of the host from /proc/meminfo, returning 0 where
+// that isn't available.
+func memTotal() uint64 {
+	file, err := os.Open("/proc/meminfo")
+	if err != nil {
+		return 0
+	}
+	defer file.Close()
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		fields := strings.Fields(scanner.Text())
+		if len(fields) >= 2 && fields[0] == "MemTotal:" {
+			kb, err := strconv.ParseUint(fields[1], 10, 64)
+			if err != nil {
+				return 0
+			}
+			return kb * 1024
+		}
+	}
+	return 0
+}
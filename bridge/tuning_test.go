@@ -0,0 +1,26 @@
+package bridge
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+func TestDefaultsScaleWithHost(t *testing.T) {
+	defer func(cpu func() int, memory func() uint64) {
+		numCPU, totalMemory = cpu, memory
+	}(numCPU, totalMemory)
+	totalMemory = func() uint64 { return 16 << 30 }
+
+	for cpus, workers := range map[int]int{1: 2, 4: 8, 16: 32, 128: 64} {
+		numCPU = func() int { return cpus }
+		assert.Equal(t, workers, DefaultEventWorkers(), cpus)
+		assert.Equal(t, 64*workers, DefaultEventBuffer(), cpus)
+	}
+
+	numCPU = func() int { return 1 }
+	totalMemory = func() uint64 { return 512 << 20 }
+	assert.Equal(t, 32, DefaultEventBuffer())
+	totalMemory = func() uint64 { return 0 }
+	assert.Equal(t, 128, DefaultEventBuffer())
+}
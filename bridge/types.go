@@ -2,15 +2,59 @@
 package bridge
 
 import (
+	"context"
 	"net/url"
+	"time"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 )
 
+// DockerClient is the part of the Docker API used by the bridge.
+type DockerClient interface {
+	InspectContainer(id string) (*dockerapi.Container, error)
+	InspectImage(name string) (*dockerapi.Image, error)
+	ListContainers(opts dockerapi.ListContainersOptions) ([]dockerapi.APIContainers, error)
+	AddEventListener(listener chan<- *dockerapi.APIEvents) error
+	RemoveEventListener(listener chan *dockerapi.APIEvents) error
+}
+
+// IPAMInspector is implemented by Docker clients that can report the
+// addresses configured with IPAM for the networks of a container, which
+// go-dockerclient does not decode when inspecting it.
+type IPAMInspector interface {
+	InspectIPAM(id string) (map[string]string, error)
+}
+
+// StateStore is implemented by adapters that can keep registrator's own
+// state, a JSON document by host, for StateBackend.
+type StateStore interface {
+	SaveState(host string, state []byte) error
+	LoadState(host string) ([]byte, error)
+}
+
+// SwarmInspector is implemented by Docker clients that can report the ports
+// a Swarm service publishes on the ingress network, by target port, e.g.
+// "80/tcp", for SwarmAware.
+type SwarmInspector interface {
+	InspectSwarmPorts(serviceId string) (map[string]string, error)
+}
+
+// LogStreamer is implemented by Docker clients that can follow the output of
+// a container, as *dockerapi.Client does, for HeartbeatFromLogs.
+type LogStreamer interface {
+	Logs(opts dockerapi.LogsOptions) error
+}
+
 type AdapterFactory interface {
 	New(uri *url.URL) RegistryAdapter
 }
 
+// URIValidator is implemented by adapter factories that check the registry
+// URI for required components before an adapter is created.
+type URIValidator interface {
+	Validate(uri *url.URL) error
+}
+
 type RegistryAdapter interface {
 	Ping() error
 	Register(service *Service) error
@@ -19,15 +63,140 @@ type RegistryAdapter interface {
 	Services() ([]*Service, error)
 }
 
+// TagUpdater is implemented by adapters that can change the tags and
+// attributes of a registered service in place, without the blip of
+// deregistering it. The bridge uses it when nothing else changed.
+type TagUpdater interface {
+	UpdateTags(service *Service) error
+}
+
+// TagLister is implemented by adapters whose Services list the tags services
+// were registered with. Cleanup only checks the ownership tag of services
+// listed by them; others are matched by the hostname in their ID alone.
+type TagLister interface {
+	ListsTags() bool
+}
+
+// Scoper is implemented by adapters whose services live in namespaces or
+// partitions with defaults of their own. Scope returns the scope of a
+// service with the defaults filled in, so equal scopes compare equal however
+// they were named.
+type Scoper interface {
+	Scope(service *Service) string
+}
+
+// ServiceFinder is implemented by adapters that can look up whether a
+// service of a name is registered by any host. SERVICE_REQUIRES uses it and
+// falls back to listing Services without it.
+type ServiceFinder interface {
+	HasService(name string) (bool, error)
+}
+
+// DNSNamer is implemented by adapters whose registry serves services by name
+// over DNS. DNSSafeNames only renames services registered with them.
+type DNSNamer interface {
+	NamesDNS() bool
+}
+
+// BatchDeregisterer is implemented by adapters that can remove many services
+// in one call, e.g. a backend transaction. Cleanup uses it for dangling
+// services and falls back to one Deregister per service without it. Only
+// Consul KV implements it: the Consul agent API has no batch deregistration,
+// as catalog transactions would be undone by the agent, and etcd v2 has no
+// transactions.
+type BatchDeregisterer interface {
+	BatchDeregister(services []*Service) error
+}
+
+// MaintenanceAdapter is implemented by adapters that can keep a service
+// registered while marking it as unavailable.
+type MaintenanceAdapter interface {
+	Maintenance(service *Service, enable bool, reason string) error
+}
+
+// CriticalWatcher is implemented by adapters that can watch the health the
+// registry reports for registered services, for DeregisterCritical.
+type CriticalWatcher interface {
+	// WatchCritical calls critical with every service that has been
+	// critical for longer than after, until ctx is done.
+	WatchCritical(ctx context.Context, after time.Duration, critical func(service *Service))
+}
+
+// WarningAdapter is implemented by adapters that can keep a service
+// registered and available while marking it as degraded with a warning.
+type WarningAdapter interface {
+	Warning(service *Service, enable bool, reason string) error
+}
+
 type Config struct {
-	HostIp          string
-	Internal        bool
-	Global          bool
-	ForceTags       string
-	RefreshTtl      int
-	RefreshInterval int
-	DeregisterCheck string
-	Cleanup         bool
+	HostIp             string
+	HostIpFrom         string
+	IPFromLabel        string
+	PublishIpFilter    string
+	ComposeProject     string
+	IgnoreLabels       []string
+	IgnoreEnv          []string
+	IgnoreImages       []string
+	Internal           bool
+	Global             bool
+	ForceTags          string
+	TagsSeparator      string
+	ProtocolTags       bool
+	PassthroughEnv     []string
+	TagLabelPrefix     string
+	ServiceFileLabel   string
+	MappingFile        string
+	OCILabelTags       bool
+	NetworkAlias       bool
+	DNSSafeNames       bool
+	PreferIPAM         bool
+	SwarmAware         bool
+	StateBackend       string
+	DNSTTL             int
+	RefreshTtl         int
+	RefreshInterval    int
+	RefreshConcurrency int
+	ResyncInterval     int
+	PingInterval       int
+	RetryAttempts      int
+	RetryInterval      int
+	BackendTimeout     int
+	DeregisterCheck    string
+	DeregisterCritical int
+	RestartGrace       int
+	UnhealthyGrace     int
+	HeartbeatFromLogs  int
+	StartDelay         int
+	SuccessLabel       string
+	SuccessMode        string
+	Cleanup            bool
+	CleanupForeign     bool
+	IncrementalCleanup int
+	PurgeOnStart       string
+	RegisterStopped    bool
+	RegisterRestarting bool
+	ShutdownDrain      int
+	HostService        bool
+	SrvMultiport       bool
+	PrimaryPortOnly    bool
+	PrimaryPortBy      string
+	WeightFrom         string
+	MinPort            int
+	MaxPort            int
+	MaxServices        int
+	InspectRetries     int
+	EventWorkers       int
+	EventBuffer        int
+	WatchEvents        []string
+	BreakerThreshold   int
+	BreakerCooldown    int
+	AuditLog           string
+	OnChangeExec       string
+	OnChangeDebounce   int
+
+	// AddressResolver replaces the default choice of service addresses,
+	// for programs embedding the bridge
+	AddressResolver AddressResolver `json:"-"`
 }
 
 type Service struct {
@@ -39,7 +208,16 @@ type Service struct {
 	Attrs map[string]string
 	TTL   int
 
+	Weight int // relative share of traffic, 0 if not set
 	Origin ServicePort
+
+	// TaggedAddresses are alternative <ip>:<port> addresses by name, such
+	// as lan and wan, for backends that support them
+	TaggedAddresses map[string]string `json:",omitempty"`
+
+	noTTL    bool     // registered without a TTL and never refreshed
+	priority int      // SERVICE_REGISTER_PRIORITY, higher registers first in a sync
+	requires []string // SERVICE_REQUIRES, services to wait for in the registry
 }
 
 type DeadContainer struct {
@@ -57,4 +235,6 @@ type ServicePort struct {
 	ContainerID       string
 	ContainerName     string
 	container         *dockerapi.Container
+	fileVars          map[string]string
+	boundIP           string // host IP of the binding, before -publish-ip-filter
 }
@@ -1,25 +1,342 @@
 package bridge
 
-import "net/url"
+import (
+	"errors"
+	"net"
+	"net/url"
+	"sync"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
 
 type fakeFactory struct{}
 
 func (f *fakeFactory) New(uri *url.URL) RegistryAdapter {
 
-	return &fakeAdapter{}
+	return newFakeAdapter()
 }
 
-type fakeAdapter struct{}
+type validatingFactory struct {
+	fakeFactory
+}
 
-func (f *fakeAdapter) Ping() error {
+func (f *validatingFactory) Validate(uri *url.URL) error {
+	if uri.Host == "" {
+		return errors.New("host required")
+	}
 	return nil
 }
+
+type fakeAdapter struct {
+	sync.Mutex
+	services    map[string]*Service
+	maintenance map[string]bool
+	pings       int
+	registers   int
+	refreshes   int
+	ttls        map[string]int // TTL of the last refresh, by service ID
+	tagUpdates  int
+	refreshing  int
+	maxParallel int
+	refreshTime time.Duration
+	fail        error
+	flaky       int // calls to fail with a network error before working
+	pingErr     error
+}
+
+var errFlaky = &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+
+func newFakeAdapter() *fakeAdapter {
+	return &fakeAdapter{
+		services:    make(map[string]*Service),
+		maintenance: make(map[string]bool),
+		ttls:        make(map[string]int),
+	}
+}
+
+func (f *fakeAdapter) Ping() error {
+	f.Lock()
+	defer f.Unlock()
+	f.pings++
+	return f.pingErr
+}
 func (f *fakeAdapter) Register(service *Service) error {
+	f.Lock()
+	defer f.Unlock()
+	f.registers++
+	if f.fail != nil {
+		return f.fail
+	}
+	if f.flaky > 0 {
+		f.flaky--
+		return errFlaky
+	}
+	f.services[service.ID] = service
+	return nil
+}
+func (f *fakeAdapter) UpdateTags(service *Service) error {
+	f.Lock()
+	defer f.Unlock()
+	f.tagUpdates++
+	f.services[service.ID] = service
 	return nil
 }
 func (f *fakeAdapter) Deregister(service *Service) error {
+	f.Lock()
+	defer f.Unlock()
+	if f.flaky > 0 {
+		f.flaky--
+		return errFlaky
+	}
+	delete(f.services, service.ID)
+	delete(f.maintenance, service.ID)
 	return nil
 }
 func (f *fakeAdapter) Refresh(service *Service) error {
+	f.Lock()
+	f.refreshes++
+	f.ttls[service.ID] = service.TTL
+	f.refreshing++
+	if f.refreshing > f.maxParallel {
+		f.maxParallel = f.refreshing
+	}
+	f.Unlock()
+	time.Sleep(f.refreshTime)
+	f.Lock()
+	f.refreshing--
+	f.Unlock()
 	return nil
 }
+func (f *fakeAdapter) Services() ([]*Service, error) {
+	f.Lock()
+	defer f.Unlock()
+	services := make([]*Service, 0, len(f.services))
+	for _, service := range f.services {
+		services = append(services, service)
+	}
+	return services, nil
+}
+func (f *fakeAdapter) ListsTags() bool {
+	return true
+}
+
+// taglessAdapter lists services without their tags, like backends that do
+// not store them.
+type taglessAdapter struct {
+	RegistryAdapter
+}
+
+func (a *taglessAdapter) Services() ([]*Service, error) {
+	services, err := a.RegistryAdapter.Services()
+	untagged := make([]*Service, 0, len(services))
+	for _, service := range services {
+		listed := *service
+		listed.Tags = nil
+		untagged = append(untagged, &listed)
+	}
+	return untagged, err
+}
+
+// dnsAdapter serves its services over DNS, like SkyDNS.
+type dnsAdapter struct {
+	*fakeAdapter
+}
+
+func (a *dnsAdapter) NamesDNS() bool {
+	return true
+}
+
+// scopedAdapter has a default namespace, and lists the services in it
+// without naming it, like Consul Enterprise.
+type scopedAdapter struct {
+	*fakeAdapter
+	namespace string
+}
+
+func (a *scopedAdapter) Scope(service *Service) string {
+	if namespace := service.Attrs["namespace"]; namespace != "" {
+		return namespace
+	}
+	return a.namespace
+}
+
+func (a *scopedAdapter) Services() ([]*Service, error) {
+	services, err := a.fakeAdapter.Services()
+	listed := make([]*Service, 0, len(services))
+	for _, service := range services {
+		unnamed := *service
+		if unnamed.Attrs["namespace"] == a.namespace {
+			unnamed.Attrs = nil
+		}
+		listed = append(listed, &unnamed)
+	}
+	return listed, err
+}
+
+// findingAdapter looks services up by name, counting the lookups, like
+// backends with a catalog of all hosts.
+type findingAdapter struct {
+	*fakeAdapter
+	lookups []string
+}
+
+func (a *findingAdapter) HasService(name string) (bool, error) {
+	a.lookups = append(a.lookups, name)
+	services, err := a.Services()
+	for _, service := range services {
+		if service.Name == name {
+			return true, err
+		}
+	}
+	return false, err
+}
+
+func (f *fakeAdapter) Maintenance(service *Service, enable bool, reason string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.maintenance[service.ID] = enable
+	return nil
+}
+
+// batchAdapter is a fakeAdapter that also deregisters in batches.
+type batchAdapter struct {
+	*fakeAdapter
+	batches int
+}
+
+func (f *batchAdapter) BatchDeregister(services []*Service) error {
+	f.Lock()
+	f.batches++
+	f.Unlock()
+	for _, service := range services {
+		f.fakeAdapter.Deregister(service)
+	}
+	return nil
+}
+
+type fakeDocker struct {
+	sync.Mutex
+	containers        map[string]*dockerapi.Container
+	images            map[string]*dockerapi.Image
+	imageInspects     map[string]int // by image name
+	containerInspects map[string]int // by container ID
+	listener          chan<- *dockerapi.APIEvents
+}
+
+func newFakeDocker(containers ...*dockerapi.Container) *fakeDocker {
+	d := &fakeDocker{
+		containers:        make(map[string]*dockerapi.Container),
+		images:            make(map[string]*dockerapi.Image),
+		imageInspects:     make(map[string]int),
+		containerInspects: make(map[string]int),
+	}
+	for _, container := range containers {
+		d.containers[container.ID] = container
+	}
+	return d
+}
+
+func (d *fakeDocker) InspectContainer(id string) (*dockerapi.Container, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.containerInspects[id]++
+	container, ok := d.containers[id]
+	if !ok {
+		return nil, &dockerapi.NoSuchContainer{ID: id}
+	}
+	return container, nil
+}
+
+func (d *fakeDocker) InspectImage(name string) (*dockerapi.Image, error) {
+	d.Lock()
+	defer d.Unlock()
+	d.imageInspects[name]++
+	image, ok := d.images[name]
+	if !ok {
+		return nil, dockerapi.ErrNoSuchImage
+	}
+	return image, nil
+}
+
+func (d *fakeDocker) ListContainers(opts dockerapi.ListContainersOptions) ([]dockerapi.APIContainers, error) {
+	d.Lock()
+	defer d.Unlock()
+	listing := make([]dockerapi.APIContainers, 0)
+	for id, container := range d.containers {
+		if !opts.All && !container.State.Running {
+			continue
+		}
+		state := "exited"
+		if container.State.Running {
+			state = "running"
+		}
+		listing = append(listing, dockerapi.APIContainers{ID: id, State: state})
+	}
+	return listing, nil
+}
+
+func (d *fakeDocker) AddEventListener(listener chan<- *dockerapi.APIEvents) error {
+	d.Lock()
+	defer d.Unlock()
+	d.listener = listener
+	return nil
+}
+
+func (d *fakeDocker) RemoveEventListener(listener chan *dockerapi.APIEvents) error {
+	d.Lock()
+	defer d.Unlock()
+	d.listener = nil
+	return nil
+}
+
+// ipamFakeDocker is a fakeDocker that also reports IPAM addresses, by
+// container and network.
+type ipamFakeDocker struct {
+	*fakeDocker
+	addresses map[string]map[string]string
+}
+
+func (d *ipamFakeDocker) InspectIPAM(id string) (map[string]string, error) {
+	return d.addresses[id], nil
+}
+
+// swarmFakeDocker is a fakeDocker that also reports the ingress ports of
+// Swarm services, by service ID.
+type swarmFakeDocker struct {
+	*fakeDocker
+	ports map[string]map[string]string
+}
+
+func (d *swarmFakeDocker) InspectSwarmPorts(serviceId string) (map[string]string, error) {
+	return d.ports[serviceId], nil
+}
+
+// emit sends an event to the listener once one is added.
+func (d *fakeDocker) emit(event *dockerapi.APIEvents) {
+	for {
+		d.Lock()
+		listener := d.listener
+		d.Unlock()
+		if listener != nil {
+			listener <- event
+			return
+		}
+		time.Sleep(time.Millisecond)
+	}
+}
+
+// publishedContainer returns a running container with the given ports
+// published on the host.
+func publishedContainer(id string, ports map[string]string) *dockerapi.Container {
+	container := testContainer()
+	container.ID = id
+	container.State.Running = true
+	container.NetworkSettings.Ports = make(map[dockerapi.Port][]dockerapi.PortBinding)
+	for exposed, published := range ports {
+		container.NetworkSettings.Ports[dockerapi.Port(exposed)] = []dockerapi.PortBinding{
+			{HostIP: "10.0.0.1", HostPort: published},
+		}
+	}
+	return container
+}
@@ -0,0 +1,73 @@
+package bridge
+
+import (
+	"time"
+
+	. "github.com/xytis/registrator/common"
+)
+
+// HealthChanged handles a health_status event. With UnhealthyGrace, a
+// container reporting unhealthy is deregistered only once it stayed unhealthy
+// for the grace period, so a single failed probe does not take it out of
+// rotation; reporting healthy within it cancels the deregistration. Docker
+// sends the event on changes of the status only, so the grace is a duration
+// rather than a number of events.
+func (b *Bridge) HealthChanged(containerId string) {
+	if b.unhealthyGrace > 0 {
+		if container, err := b.docker.InspectContainer(containerId); err == nil {
+			b.Lock()
+			if container.State.Health.Status == "unhealthy" {
+				b.graceUnhealthy(containerId)
+			} else {
+				b.healthy(containerId)
+			}
+			b.Unlock()
+		}
+	}
+	b.Reconcile(containerId)
+}
+
+// graceUnhealthy deregisters the services of an unhealthy container once the
+// grace period has passed, unless it did already. Callers hold the lock.
+func (b *Bridge) graceUnhealthy(containerId string) {
+	if _, ok := b.graced[containerId]; ok || b.unhealthy[containerId] {
+		return
+	}
+	var timer *time.Timer
+	timer = time.AfterFunc(b.unhealthyGrace, func() {
+		b.Lock()
+		defer b.Unlock()
+		if b.graced[containerId] != timer {
+			return
+		}
+		Log.Infoln("unhealthy:", containerId[:12], "for", b.unhealthyGrace, "deregistering")
+		b.removeServices(containerId, true)
+		b.unhealthy[containerId] = true
+	})
+	b.graced[containerId] = timer
+	Log.Infoln("unhealthy:", containerId[:12], "deregistering in", b.unhealthyGrace, "unless healthy again")
+}
+
+// healthy cancels the pending deregistration of a container that recovered
+// and lets one deregistered as unhealthy register again. Callers hold the
+// lock.
+func (b *Bridge) healthy(containerId string) {
+	if timer, ok := b.graced[containerId]; ok {
+		timer.Stop()
+		delete(b.graced, containerId)
+		Log.Infoln("healthy again:", containerId[:12])
+	}
+	if b.unhealthy[containerId] {
+		delete(b.unhealthy, containerId)
+		Log.Infoln("healthy again:", containerId[:12], "registering")
+	}
+}
+
+// forgetHealth drops the health state of a container. Callers hold the lock.
+func (b *Bridge) forgetHealth(containerId string) {
+	if timer, ok := b.graced[containerId]; ok {
+		timer.Stop()
+		delete(b.graced, containerId)
+	}
+	delete(b.unhealthy, containerId)
+}
@@ -1,8 +1,14 @@
 package bridge
 
 import (
+	"errors"
+	"hash/fnv"
+	"net"
+	"net/url"
+	"sort"
 	"strconv"
 	"strings"
+	"time"
 
 	"github.com/cenkalti/backoff"
 	dockerapi "github.com/fsouza/go-dockerclient"
@@ -12,6 +18,112 @@ func retry(fn func() error) error {
 	return backoff.Retry(fn, backoff.NewExponentialBackOff())
 }
 
+// ParseSeconds reads a number of seconds given either as a bare integer or
+// as a duration like 90s or 1m30s. Durations must be whole seconds.
+func ParseSeconds(value string) (int, error) {
+	return parseUnits(value, time.Second, "seconds")
+}
+
+// ParseMillis reads a number of milliseconds given either as a bare integer
+// or as a duration like 500ms or 2s. Durations must be whole milliseconds.
+func ParseMillis(value string) (int, error) {
+	return parseUnits(value, time.Millisecond, "milliseconds")
+}
+
+func parseUnits(value string, unit time.Duration, units string) (int, error) {
+	if n, err := strconv.Atoi(value); err == nil {
+		if n < 0 {
+			return 0, errors.New("must not be negative")
+		}
+		return n, nil
+	}
+	d, err := time.ParseDuration(value)
+	if err != nil {
+		return 0, errors.New("not " + units + " or a duration: " + value)
+	}
+	if d < 0 {
+		return 0, errors.New("must not be negative")
+	}
+	if d%unit != 0 {
+		return 0, errors.New("must be whole " + units + ": " + value)
+	}
+	return int(d / unit), nil
+}
+
+// BackendError is an error from a registry backend, naming the backend.
+type BackendError struct {
+	Backend string
+	Op      string
+	Err     error
+}
+
+func (e *BackendError) Error() string {
+	return "backend " + e.Backend + ": " + e.Op + ": " + e.Err.Error()
+}
+
+func (e *BackendError) Unwrap() error {
+	return e.Err
+}
+
+// RedactURI hides passwords and tokens in a registry URI, for printing it.
+func RedactURI(adapterUri string) string {
+	uri, err := url.Parse(adapterUri)
+	if err != nil {
+		return "<unparseable uri>"
+	}
+	return redactURI(uri)
+}
+
+// redactURI formats a registry URI for logs, hiding passwords and tokens.
+func redactURI(uri *url.URL) string {
+	redacted := *uri
+	if redacted.User != nil {
+		if _, ok := redacted.User.Password(); ok {
+			redacted.User = url.UserPassword(redacted.User.Username(), "redacted")
+		}
+	}
+	query := redacted.Query()
+	for key := range query {
+		if strings.Contains(strings.ToLower(key), "token") {
+			query.Set(key, "redacted")
+		}
+	}
+	redacted.RawQuery = query.Encode()
+	return redacted.String()
+}
+
+// containerWeight derives a service weight from the container's limits: with
+// "cpu" the CPU limit in hundredths of a CPU, or its CPU shares where 1024 is
+// 100, and with "memory" the memory limit in MiB. It is 0 if there is nothing
+// to go by.
+func containerWeight(container *dockerapi.Container, from string) int {
+	if container.HostConfig == nil {
+		return 0
+	}
+	switch from {
+	case "cpu":
+		if nano := container.HostConfig.NanoCPUs; nano > 0 {
+			return int(nano / 1e7)
+		}
+		shares := container.HostConfig.CPUShares
+		if shares <= 0 {
+			shares = 1024
+		}
+		return int(shares * 100 / 1024)
+	case "memory":
+		return int(container.HostConfig.Memory >> 20)
+	}
+	return 0
+}
+
+// advertisedPort maps a service ID to a port between min and max, the
+// same one every time.
+func advertisedPort(id string, min, max int) int {
+	hash := fnv.New32a()
+	hash.Write([]byte(id))
+	return min + int(hash.Sum32()%uint32(max-min+1))
+}
+
 func mapDefault(m map[string]string, key, default_ string) string {
 	v, ok := m[key]
 	if !ok || v == "" {
@@ -20,21 +132,195 @@ func mapDefault(m map[string]string, key, default_ string) string {
 	return v
 }
 
-func combineTags(tagParts ...string) []string {
+// tagsSeparator is what SERVICE_TAGS and -tags are split on, "," unless
+// TagsSeparator is set.
+func (b *Bridge) tagsSeparator() string {
+	if b.config.TagsSeparator != "" {
+		return b.config.TagsSeparator
+	}
+	return ","
+}
+
+func combineTags(sep string, tagParts ...string) []string {
 	tags := make([]string, 0)
 	for _, element := range tagParts {
 		if element != "" {
-			tags = append(tags, strings.Split(element, ",")...)
+			tags = append(tags, strings.Split(element, sep)...)
 		}
 	}
 	return tags
 }
 
-func serviceMetaData(config *dockerapi.Config, port string) (map[string]string, map[string]bool) {
-	meta := config.Env
+func hasTag(tags []string, tag string) bool {
+	for _, t := range tags {
+		if t == tag {
+			return true
+		}
+	}
+	return false
+}
+
+// labelTags turns the labels starting with prefix into tags of the form
+// <rest of key>=<value>, or just <rest of key> for labels without a value.
+func labelTags(labels map[string]string, prefix string) []string {
+	tags := make([]string, 0)
+	for k, v := range labels {
+		if !strings.HasPrefix(k, prefix) || len(k) == len(prefix) {
+			continue
+		}
+		tag := strings.TrimPrefix(k, prefix)
+		if v != "" {
+			tag += "=" + v
+		}
+		tags = append(tags, tag)
+	}
+	sort.Strings(tags)
+	return tags
+}
+
+// willRestart reports whether Docker's restart policy is going to start an
+// exited container again.
+func willRestart(container *dockerapi.Container) bool {
+	if container.HostConfig == nil {
+		return false
+	}
+	policy := container.HostConfig.RestartPolicy
+	switch policy.Name {
+	case "always", "unless-stopped":
+		return true
+	case "on-failure":
+		return container.State.ExitCode != 0 &&
+			(policy.MaximumRetryCount == 0 || container.RestartCount < policy.MaximumRetryCount)
+	}
+	return false
+}
+
+// ociLabelTags maps well-known OCI image labels to the tag names used for them.
+var ociLabelTags = []struct{ label, tag string }{
+	{"org.opencontainers.image.version", "version"},
+	{"org.opencontainers.image.revision", "revision"},
+}
+
+// networkAlias returns the alias the container was given on a Docker
+// network, e.g. with --network-alias, ignoring the short ID and hostname
+// Docker adds itself. Of several aliases the alphabetically first is used,
+// so the name doesn't depend on the order networks are listed in.
+func networkAlias(container *dockerapi.Container) string {
+	implicit := map[string]bool{container.Config.Hostname: true}
+	if len(container.ID) >= 12 {
+		implicit[container.ID[:12]] = true
+	}
+	aliases := make([]string, 0)
+	for _, network := range container.NetworkSettings.Networks {
+		for _, alias := range network.Aliases {
+			if alias != "" && !implicit[alias] {
+				aliases = append(aliases, alias)
+			}
+		}
+	}
+	if len(aliases) == 0 {
+		return ""
+	}
+	sort.Strings(aliases)
+	return aliases[0]
+}
+
+// validHost reports whether value is an IP address or a DNS hostname.
+func validHost(value string) bool {
+	if net.ParseIP(value) != nil {
+		return true
+	}
+	if value == "" || len(value) > 253 {
+		return false
+	}
+	for _, label := range strings.Split(strings.TrimSuffix(value, "."), ".") {
+		if len(label) == 0 || len(label) > 63 || label[0] == '-' || label[len(label)-1] == '-' {
+			return false
+		}
+		for _, c := range label {
+			if !(c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '-') {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// dnsSafeName turns a service name into a valid DNS label: lowercased, with
+// every character but letters, digits and hyphens replaced by a hyphen, no
+// leading or trailing hyphens and at most 63 characters. Names with nothing
+// left are returned unchanged.
+func dnsSafeName(name string) string {
+	safe := []byte(strings.ToLower(name))
+	for i, c := range safe {
+		if !(c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-') {
+			safe[i] = '-'
+		}
+	}
+	label := string(safe)
+	if len(label) > 63 {
+		label = label[:63]
+	}
+	label = strings.Trim(label, "-")
+	if label == "" {
+		return name
+	}
+	return label
+}
+
+// serviceLabelVars returns the SERVICE_ variables of the registrator.service
+// label of the container, or else of its image, joining tags with sep.
+func serviceLabelVars(config *dockerapi.Config, imageLabels map[string]string, sep string) (map[string]string, error) {
+	value, ok := config.Labels[serviceLabel]
+	if !ok {
+		value, ok = imageLabels[serviceLabel]
+	}
+	if !ok {
+		return nil, nil
+	}
+	return parseServiceLabel(value, sep)
+}
+
+// ociTags turns the OCI version and revision labels into version=<value>
+// and revision=<value> tags. Container labels override the image's.
+func ociTags(labels, imageLabels map[string]string) []string {
+	tags := make([]string, 0)
+	for _, oci := range ociLabelTags {
+		v := labels[oci.label]
+		if v == "" {
+			v = imageLabels[oci.label]
+		}
+		if v != "" {
+			tags = append(tags, oci.tag+"="+v)
+		}
+	}
+	return tags
+}
+
+// serviceMetaData collects the SERVICE_ metadata of a container for a port.
+// The registrator.service label and then labels of the image are the
+// defaults, overridden by labels set on the container, then by the service
+// file, which are all overridden by the environment. Tags of the
+// registrator.service label are joined with tagsSep.
+func serviceMetaData(config *dockerapi.Config, imageLabels, fileVars map[string]string, port, tagsSep string) (map[string]string, map[string]bool) {
+	meta := make([]string, 0)
+	// the registrator.service label is below all explicit SERVICE_ metadata
+	labelVars, _ := serviceLabelVars(config, imageLabels, tagsSep)
+	for k, v := range labelVars {
+		meta = append(meta, k+"="+v)
+	}
+	for k, v := range imageLabels {
+		meta = append(meta, k+"="+v)
+	}
 	for k, v := range config.Labels {
+		if image, ok := imageLabels[k]; !ok || image != v {
+			meta = append(meta, k+"="+v)
+		}
+	}
+	for k, v := range fileVars {
 		meta = append(meta, k+"="+v)
 	}
+	meta = append(meta, config.Env...)
 	metadata := make(map[string]string)
 	metadataFromPort := make(map[string]bool)
 	for _, kv := range meta {
@@ -60,11 +346,146 @@ func serviceMetaData(config *dockerapi.Config, port string) (map[string]string,
 	return metadata, metadataFromPort
 }
 
-func servicePort(container *dockerapi.Container, port dockerapi.Port, published []dockerapi.PortBinding) ServicePort {
-	var hp, hip, ep, ept, eip string
+// taggedAddresses takes the SERVICE_TAGGED_ADDRESS_<name>=<ip>:<port>
+// metadata out of a service's attributes, keyed by name, e.g. lan or wan.
+// Addresses that aren't an IP and port are left out and reported.
+func taggedAddresses(metadata map[string]string) (map[string]string, error) {
+	var addrs map[string]string
+	var invalid error
+	for key, value := range metadata {
+		if !strings.HasPrefix(key, "tagged_address_") {
+			continue
+		}
+		delete(metadata, key)
+		name := strings.TrimPrefix(key, "tagged_address_")
+		host, port, err := net.SplitHostPort(value)
+		if err == nil && net.ParseIP(host) == nil {
+			err = errors.New("not an IP: " + host)
+		} else if n, perr := strconv.Atoi(port); err == nil && (perr != nil || n < 1 || n > 65535) {
+			err = errors.New("bad port: " + port)
+		}
+		if name == "" || err != nil {
+			if invalid == nil {
+				invalid = errors.New("bad tagged address " + key + "=" + value + ": want <ip>:<port>")
+			}
+			continue
+		}
+		if addrs == nil {
+			addrs = make(map[string]string)
+		}
+		addrs[name] = value
+	}
+	return addrs, invalid
+}
+
+// passthroughEnv picks the allowed variables out of a container environment,
+// keyed by their lowercased names like other attributes.
+func passthroughEnv(env []string, allowed []string) map[string]string {
+	attrs := make(map[string]string)
+	for _, name := range allowed {
+		if name == "" {
+			continue
+		}
+		for _, kv := range env {
+			if strings.HasPrefix(kv, name+"=") {
+				attrs[strings.ToLower(name)] = kv[len(name)+1:]
+			}
+		}
+	}
+	return attrs
+}
+
+// healthcheckAttrs describes the Docker HEALTHCHECK of a container as the
+// healthcheck and healthcheck_interval attributes, for operators to see from
+// the registry what Docker checks. Containers without one, or with it
+// disabled, get none.
+func healthcheckAttrs(healthcheck *dockerapi.HealthConfig) map[string]string {
+	if healthcheck == nil || len(healthcheck.Test) < 2 {
+		return nil
+	}
+	attrs := map[string]string{"healthcheck": strings.Join(healthcheck.Test[1:], " ")}
+	if healthcheck.Interval > 0 {
+		attrs["healthcheck_interval"] = healthcheck.Interval.String()
+	}
+	return attrs
+}
+
+// filterIPs resolves a publish IP filter, which is either an IP address or
+// the name of a network interface, to the addresses it stands for.
+func filterIPs(filter string) ([]string, error) {
+	if filter == "" {
+		return nil, nil
+	}
+	if ip := net.ParseIP(filter); ip != nil {
+		return []string{ip.String()}, nil
+	}
+	iface, err := net.InterfaceByName(filter)
+	if err != nil {
+		return nil, err
+	}
+	addrs, err := iface.Addrs()
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]string, 0)
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok && ipnet.IP.To4() != nil {
+			ips = append(ips, ipnet.IP.String())
+		}
+	}
+	return ips, nil
+}
+
+// publishedBinding picks the binding to advertise when Docker publishes a
+// port on several host IPs. A binding on one of the preferred IPs wins,
+// otherwise the first one is used.
+func publishedBinding(published []dockerapi.PortBinding, preferred []string) dockerapi.PortBinding {
+	for _, ip := range preferred {
+		for _, binding := range published {
+			if binding.HostIP == ip {
+				return binding
+			}
+		}
+	}
+	return published[0]
+}
+
+// networkReady reports whether the network settings of a container are
+// filled in, meaning it has an IP unless it has no network of its own.
+func networkReady(container *dockerapi.Container) bool {
+	if !container.State.Running {
+		return true
+	}
+	if container.HostConfig != nil {
+		switch container.HostConfig.NetworkMode {
+		case "host", "none":
+			return true
+		}
+	}
+	if container.NetworkSettings == nil {
+		return false
+	}
+	if container.NetworkSettings.IPAddress != "" {
+		return true
+	}
+	for _, network := range container.NetworkSettings.Networks {
+		if network.IPAddress != "" {
+			return true
+		}
+	}
+	return false
+}
+
+func servicePort(container *dockerapi.Container, port dockerapi.Port, published []dockerapi.PortBinding, preferred []string) ServicePort {
+	var hp, hip, bip, ep, ept, eip string
 	if len(published) > 0 {
-		hp = published[0].HostPort
-		hip = published[0].HostIP
+		binding := publishedBinding(published, preferred)
+		hp = binding.HostPort
+		hip = binding.HostIP
+		bip = binding.HostIP
+	}
+	if (hip == "" || hip == "0.0.0.0") && len(preferred) > 0 {
+		hip = preferred[0]
 	}
 	if hip == "" {
 		hip = "0.0.0.0"
@@ -94,5 +515,6 @@ func servicePort(container *dockerapi.Container, port dockerapi.Port, published
 		ContainerID:       container.ID,
 		ContainerHostname: container.Config.Hostname,
 		container:         container,
+		boundIP:           bip,
 	}
 }
@@ -0,0 +1,193 @@
+package bridge
+
+import (
+	"strings"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/stretchr/testify/assert"
+)
+
+func testContainer() *dockerapi.Container {
+	return &dockerapi.Container{
+		ID:              "0123456789abcdef",
+		Name:            "/test",
+		Config:          &dockerapi.Config{Image: "test"},
+		HostConfig:      &dockerapi.HostConfig{},
+		NetworkSettings: &dockerapi.NetworkSettings{IPAddress: "172.17.0.2"},
+	}
+}
+
+func TestServicePortMultipleBindings(t *testing.T) {
+	published := []dockerapi.PortBinding{
+		{HostIP: "0.0.0.0", HostPort: "8080"},
+		{HostIP: "10.0.0.5", HostPort: "8081"},
+	}
+
+	port := servicePort(testContainer(), "80/tcp", published, nil)
+	assert.Equal(t, "0.0.0.0", port.HostIP)
+	assert.Equal(t, "8080", port.HostPort)
+
+	port = servicePort(testContainer(), "80/tcp", published, []string{"10.0.0.5"})
+	assert.Equal(t, "10.0.0.5", port.HostIP)
+	assert.Equal(t, "8081", port.HostPort)
+}
+
+func TestServicePortWildcardResolvesToFilter(t *testing.T) {
+	published := []dockerapi.PortBinding{{HostIP: "0.0.0.0", HostPort: "8080"}}
+
+	port := servicePort(testContainer(), "80/tcp", published, []string{"192.168.1.10"})
+	assert.Equal(t, "192.168.1.10", port.HostIP)
+	assert.Equal(t, "8080", port.HostPort)
+}
+
+func TestFilterIPs(t *testing.T) {
+	ips, err := filterIPs("10.0.0.5")
+	assert.NoError(t, err)
+	assert.Equal(t, []string{"10.0.0.5"}, ips)
+
+	ips, err = filterIPs("lo")
+	assert.NoError(t, err)
+	assert.Contains(t, ips, "127.0.0.1")
+
+	_, err = filterIPs("no-such-interface0")
+	assert.Error(t, err)
+}
+
+func TestLabelTags(t *testing.T) {
+	labels := map[string]string{
+		"com.example.tag.env":    "prod",
+		"com.example.tag.canary": "",
+		"com.example.tag.":       "empty-key",
+		"com.example.owner":      "team",
+	}
+	assert.Equal(t, []string{"canary", "env=prod"}, labelTags(labels, "com.example.tag."))
+}
+
+func TestOCITags(t *testing.T) {
+	image := map[string]string{
+		"org.opencontainers.image.version":  "1.4.0",
+		"org.opencontainers.image.revision": "0a1b2c3",
+		"org.opencontainers.image.title":    "web",
+	}
+	assert.Equal(t, []string{"version=1.4.0", "revision=0a1b2c3"}, ociTags(nil, image))
+
+	container := map[string]string{"org.opencontainers.image.version": "1.4.1"}
+	assert.Equal(t, []string{"version=1.4.1", "revision=0a1b2c3"}, ociTags(container, image))
+	assert.Empty(t, ociTags(nil, nil))
+}
+
+func TestServiceMetaDataPrecedence(t *testing.T) {
+	imageLabels := map[string]string{
+		"SERVICE_NAME":   "image",
+		"SERVICE_TAGS":   "image",
+		"SERVICE_REGION": "image",
+	}
+	config := &dockerapi.Config{
+		Labels: map[string]string{
+			// Docker copies image labels into the container's labels.
+			"SERVICE_NAME":   "image",
+			"SERVICE_TAGS":   "label",
+			"SERVICE_REGION": "label",
+		},
+		Env: []string{"SERVICE_NAME=env", "SERVICE_REGION=env"},
+	}
+
+	metadata, _ := serviceMetaData(config, imageLabels, nil, "80", ",")
+	assert.Equal(t, "env", metadata["name"])
+	assert.Equal(t, "label", metadata["tags"])
+	assert.Equal(t, "env", metadata["region"])
+
+	metadata, _ = serviceMetaData(&dockerapi.Config{}, imageLabels, nil, "80", ",")
+	assert.Equal(t, "image", metadata["name"])
+}
+
+func TestAdvertisedPort(t *testing.T) {
+	for _, id := range []string{"host:web:80", "host:web:443", "host:db:5432:udp"} {
+		port := advertisedPort(id, 20000, 20009)
+		assert.True(t, port >= 20000 && port <= 20009, port)
+		assert.Equal(t, port, advertisedPort(id, 20000, 20009))
+	}
+	assert.Equal(t, 20000, advertisedPort("host:web:80", 20000, 20000))
+}
+
+func TestPassthroughEnv(t *testing.T) {
+	env := []string{"GIT_SHA=abc123", "BUILD_ID=42", "DB_PASSWORD=secret", "GIT_SHA_SHORT=abc"}
+
+	attrs := passthroughEnv(env, []string{"GIT_SHA", "BUILD_ID", "MISSING"})
+	assert.Equal(t, map[string]string{"git_sha": "abc123", "build_id": "42"}, attrs)
+	assert.Empty(t, passthroughEnv(env, []string{""}))
+}
+
+func TestContainerWeight(t *testing.T) {
+	container := testContainer()
+	assert.Equal(t, 0, containerWeight(container, "none"))
+	assert.Equal(t, 100, containerWeight(container, "cpu"))
+	assert.Equal(t, 0, containerWeight(container, "memory"))
+
+	container.HostConfig.CPUShares = 512
+	container.HostConfig.Memory = 256 << 20
+	assert.Equal(t, 50, containerWeight(container, "cpu"))
+	assert.Equal(t, 256, containerWeight(container, "memory"))
+
+	container.HostConfig.NanoCPUs = 1500000000
+	assert.Equal(t, 150, containerWeight(container, "cpu"))
+}
+
+func TestWillRestart(t *testing.T) {
+	container := testContainer()
+	assert.False(t, willRestart(container))
+	container.HostConfig.RestartPolicy = dockerapi.RestartUnlessStopped()
+	assert.True(t, willRestart(container))
+
+	container.HostConfig.RestartPolicy = dockerapi.RestartOnFailure(3)
+	assert.False(t, willRestart(container))
+	container.State.ExitCode = 1
+	assert.True(t, willRestart(container))
+	container.RestartCount = 3
+	assert.False(t, willRestart(container))
+}
+
+func TestNetworkAlias(t *testing.T) {
+	container := testContainer()
+	assert.Equal(t, "", networkAlias(container))
+
+	container.Config.Hostname = "db-host"
+	container.NetworkSettings.Networks = map[string]dockerapi.ContainerNetwork{
+		"a": {Aliases: []string{"0123456789ab", "db-host"}},
+	}
+	assert.Equal(t, "", networkAlias(container))
+
+	container.NetworkSettings.Networks["b"] = dockerapi.ContainerNetwork{Aliases: []string{"postgres", "db"}}
+	assert.Equal(t, "db", networkAlias(container))
+}
+
+func TestTaggedAddresses(t *testing.T) {
+	metadata := map[string]string{
+		"tagged_address_lan": "10.0.0.1:8080",
+		"tagged_address_wan": "[2001:db8::1]:80",
+		"region":             "us-east",
+	}
+	addrs, err := taggedAddresses(metadata)
+	assert.NoError(t, err)
+	assert.Equal(t, map[string]string{"lan": "10.0.0.1:8080", "wan": "[2001:db8::1]:80"}, addrs)
+	assert.Equal(t, map[string]string{"region": "us-east"}, metadata)
+
+	for _, bad := range []string{"10.0.0.1", "example.com:80", "10.0.0.1:http", "10.0.0.1:70000"} {
+		addrs, err = taggedAddresses(map[string]string{"tagged_address_wan": bad, "tagged_address_lan": "10.0.0.1:80"})
+		assert.Error(t, err, bad)
+		assert.Equal(t, map[string]string{"lan": "10.0.0.1:80"}, addrs, bad)
+	}
+}
+
+func TestDNSSafeName(t *testing.T) {
+	for name, safe := range map[string]string{
+		"web":                   "web",
+		"My_Service":            "my-service",
+		"_api.v2_":              "api-v2",
+		strings.Repeat("a", 70): strings.Repeat("a", 63),
+		"___":                   "___",
+	} {
+		assert.Equal(t, safe, dnsSafeName(name), name)
+	}
+}
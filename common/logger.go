@@ -38,6 +38,10 @@ var (
 
 var (
 	Log *logrus.Logger
+
+	// tracing is set by the trace level. The vendored logrus has no trace
+	// level, so trace messages are logged as debug messages while it is set.
+	tracing bool
 )
 
 func init() {
@@ -45,7 +49,14 @@ func init() {
 	Log.Formatter = standardTextFormatter
 }
 
+// SetLogLevel sets the level by its logrus name, or to "trace", which logs
+// the messages of Traceln as well as debug messages.
 func SetLogLevel(levelname string) {
+	tracing = levelname == "trace"
+	if tracing {
+		Log.Level = logrus.DebugLevel
+		return
+	}
 	level, err := logrus.ParseLevel(levelname)
 	if err != nil {
 		Log.Fatal(err)
@@ -53,6 +64,14 @@ func SetLogLevel(levelname string) {
 	Log.Level = level
 }
 
+// Traceln logs messages too detailed for debug, such as every Docker event
+// and service sent to the registry, at the trace level.
+func Traceln(args ...interface{}) {
+	if tracing {
+		Log.Debugln(append([]interface{}{"trace:"}, args...)...)
+	}
+}
+
 func CheckFatal(e error) {
 	if e != nil {
 		Log.Fatal(e)
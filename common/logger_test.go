@@ -0,0 +1,29 @@
+package common
+
+import (
+	"bytes"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestTraceLevel(t *testing.T) {
+	var out bytes.Buffer
+	previous, level := Log.Out, Log.Level
+	Log.Out = &out
+	defer func() {
+		Log.Out, Log.Level, tracing = previous, level, false
+	}()
+
+	SetLogLevel("debug")
+	Traceln("hidden")
+	Log.Debugln("shown")
+	assert.NotContains(t, out.String(), "hidden")
+	assert.Contains(t, out.String(), "shown")
+
+	SetLogLevel("trace")
+	assert.Equal(t, logrus.DebugLevel, Log.Level)
+	Traceln("event:", "start")
+	assert.Contains(t, out.String(), "trace: event: start")
+}
@@ -0,0 +1,58 @@
+package common
+
+import (
+	"fmt"
+	"io"
+	"sort"
+	"sync"
+)
+
+var (
+	Metrics = NewMetricsRegistry()
+)
+
+// MetricsRegistry holds the values exported on the /metrics endpoint. Names
+// may carry Prometheus labels, e.g. `registrator_skipped_total{reason="ignored"}`.
+type MetricsRegistry struct {
+	sync.Mutex
+	values map[string]float64
+}
+
+func NewMetricsRegistry() *MetricsRegistry {
+	return &MetricsRegistry{values: make(map[string]float64)}
+}
+
+func (m *MetricsRegistry) Set(name string, value float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.values[name] = value
+}
+
+func (m *MetricsRegistry) Add(name string, delta float64) {
+	m.Lock()
+	defer m.Unlock()
+	m.values[name] += delta
+}
+
+func (m *MetricsRegistry) Value(name string) float64 {
+	m.Lock()
+	defer m.Unlock()
+	return m.values[name]
+}
+
+// Write outputs all values in the Prometheus text format.
+func (m *MetricsRegistry) Write(w io.Writer) error {
+	m.Lock()
+	defer m.Unlock()
+	names := make([]string, 0, len(m.values))
+	for name := range m.values {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		if _, err := fmt.Fprintf(w, "%s %v\n", name, m.values[name]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
@@ -0,0 +1,78 @@
+package common
+
+import (
+	"os"
+	"strconv"
+	"sync"
+)
+
+// RotatingFile is a writer appending to a file, which is rotated once a
+// write would grow it past maxSize bytes: the file becomes <path>.1, older
+// backups shift up to <path>.<maxBackups> and the oldest is removed.
+type RotatingFile struct {
+	sync.Mutex
+	path       string
+	maxSize    int64
+	maxBackups int
+	file       *os.File
+	size       int64
+}
+
+// NewRotatingFile opens path for appending. A maxSize of 0 never rotates.
+func NewRotatingFile(path string, maxSize int64, maxBackups int) (*RotatingFile, error) {
+	f := &RotatingFile{path: path, maxSize: maxSize, maxBackups: maxBackups}
+	if err := f.open(); err != nil {
+		return nil, err
+	}
+	return f, nil
+}
+
+func (f *RotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
+	if err != nil {
+		file.Close()
+		return err
+	}
+	f.file, f.size = file, info.Size()
+	return nil
+}
+
+func (f *RotatingFile) Write(p []byte) (int, error) {
+	f.Lock()
+	defer f.Unlock()
+	if f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize {
+		if err := f.rotate(); err != nil {
+			return 0, err
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *RotatingFile) rotate() error {
+	f.file.Close()
+	backup := func(i int) string { return f.path + "." + strconv.Itoa(i) }
+	if f.maxBackups > 0 {
+		os.Remove(backup(f.maxBackups))
+		for i := f.maxBackups - 1; i > 0; i-- {
+			os.Rename(backup(i), backup(i+1))
+		}
+		if err := os.Rename(f.path, backup(1)); err != nil {
+			return err
+		}
+	} else if err := os.Remove(f.path); err != nil {
+		return err
+	}
+	return f.open()
+}
+
+func (f *RotatingFile) Close() error {
+	f.Lock()
+	defer f.Unlock()
+	return f.file.Close()
+}
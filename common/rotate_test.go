@@ -0,0 +1,48 @@
+package common
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/Sirupsen/logrus"
+	"github.com/stretchr/testify/assert"
+)
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "registrator")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registrator.log")
+
+	out, err := NewRotatingFile(path, 100, 2)
+	assert.NoError(t, err)
+	defer out.Close()
+	logger := logrus.New()
+	logger.Formatter = standardTextFormatter
+	logger.Out = out
+
+	logger.Infoln("first")
+	content, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "INFO:")
+	assert.Contains(t, string(content), "first")
+
+	for i := 0; i < 5; i++ {
+		logger.Infoln(strings.Repeat("x", 40))
+	}
+	logger.Infoln("last")
+
+	content, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Contains(t, string(content), "last")
+	assert.True(t, len(content) <= 100)
+	_, err = os.Stat(path + ".1")
+	assert.NoError(t, err)
+	_, err = os.Stat(path + ".2")
+	assert.NoError(t, err)
+	_, err = os.Stat(path + ".3")
+	assert.True(t, os.IsNotExist(err))
+}
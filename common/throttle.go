@@ -0,0 +1,95 @@
+package common
+
+import (
+	"sync"
+	"time"
+)
+
+// LogThrottle collapses identical errors logged within a window into one
+// line. The first occurrence is logged in full; repeats are counted and
+// summed up in a single "still failing" line once the window has passed, so
+// a backend that is down does not log the same error for every event.
+type LogThrottle struct {
+	sync.Mutex
+	window time.Duration
+	seen   map[string]*throttled
+}
+
+type throttled struct {
+	logged     time.Time
+	suppressed int
+	logf       func(args ...interface{})
+	what       string
+	err        error
+	timer      *time.Timer
+}
+
+// NewLogThrottle returns a LogThrottle collapsing errors within window. A
+// window of 0 logs every error.
+func NewLogThrottle(window time.Duration) *LogThrottle {
+	return &LogThrottle{window: window, seen: make(map[string]*throttled)}
+}
+
+// Errorln logs what, args and err at error level, unless the same what and
+// err were logged within the window.
+func (t *LogThrottle) Errorln(what string, err error, args ...interface{}) {
+	t.log(Log.Errorln, what, err, args)
+}
+
+// Warnln logs what, args and err at warning level, unless the same what and
+// err were logged within the window.
+func (t *LogThrottle) Warnln(what string, err error, args ...interface{}) {
+	t.log(Log.Warnln, what, err, args)
+}
+
+func (t *LogThrottle) log(logf func(args ...interface{}), what string, err error, args []interface{}) {
+	line := append(append([]interface{}{what}, args...), err)
+	if t == nil || t.window <= 0 {
+		logf(line...)
+		return
+	}
+	key := what + "\x00" + err.Error()
+	now := time.Now()
+
+	t.Lock()
+	defer t.Unlock()
+	e, ok := t.seen[key]
+	if !ok || (e.suppressed == 0 && now.Sub(e.logged) >= t.window) {
+		if !ok {
+			t.prune(now)
+		}
+		t.seen[key] = &throttled{logged: now}
+		logf(line...)
+		return
+	}
+	e.suppressed++
+	e.logf, e.what, e.err = logf, what, err
+	if e.timer == nil {
+		e.timer = time.AfterFunc(t.window-now.Sub(e.logged), func() { t.summarize(key) })
+	}
+}
+
+// summarize logs how often the error of key was suppressed since it was
+// last logged and starts a new window.
+func (t *LogThrottle) summarize(key string) {
+	t.Lock()
+	defer t.Unlock()
+	e, ok := t.seen[key]
+	if !ok || e.suppressed == 0 {
+		return
+	}
+	e.logf(e.what, "still failing,", e.suppressed, "more occurrences:", e.err)
+	e.logged = time.Now()
+	e.suppressed = 0
+	e.timer = nil
+}
+
+// prune forgets errors last logged more than a window ago with nothing
+// left to summarize. Callers hold the lock.
+func (t *LogThrottle) prune(now time.Time) {
+	for key, e := range t.seen {
+		if e.suppressed == 0 && now.Sub(e.logged) >= t.window {
+			delete(t.seen, key)
+		}
+	}
+}
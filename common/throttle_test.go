@@ -0,0 +1,74 @@
+package common
+
+import (
+	"bytes"
+	"errors"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// lockedBuffer is written by the summary timers while tests read it.
+type lockedBuffer struct {
+	sync.Mutex
+	buf bytes.Buffer
+}
+
+func (b *lockedBuffer) Write(p []byte) (int, error) {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.Write(p)
+}
+
+func (b *lockedBuffer) String() string {
+	b.Lock()
+	defer b.Unlock()
+	return b.buf.String()
+}
+
+func TestLogThrottleCollapsesRepeats(t *testing.T) {
+	var out lockedBuffer
+	previous := Log.Out
+	Log.Out = &out
+	defer func() { Log.Out = previous }()
+
+	throttle := NewLogThrottle(50 * time.Millisecond)
+	refused := errors.New("connection refused")
+	for i := 0; i < 5; i++ {
+		throttle.Errorln("register failed:", refused, "service", i)
+	}
+	throttle.Errorln("register failed:", errors.New("bad request"), "service", 5)
+
+	lines := strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 2)
+	assert.Contains(t, lines[0], "register failed: service 0 connection refused")
+	assert.Contains(t, lines[1], "register failed: service 5 bad request")
+
+	time.Sleep(100 * time.Millisecond)
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 3)
+	assert.Contains(t, lines[2], "ERRO:")
+	assert.Contains(t, lines[2], "register failed: still failing, 4 more occurrences: connection refused")
+
+	// quiet for a whole window, the next occurrence is logged in full again
+	time.Sleep(60 * time.Millisecond)
+	throttle.Errorln("register failed:", refused, "service", 6)
+	lines = strings.Split(strings.TrimSpace(out.String()), "\n")
+	assert.Len(t, lines, 4)
+	assert.Contains(t, lines[3], "register failed: service 6 connection refused")
+}
+
+func TestLogThrottleWithoutWindow(t *testing.T) {
+	var out bytes.Buffer
+	previous := Log.Out
+	Log.Out = &out
+	defer func() { Log.Out = previous }()
+
+	var throttle *LogThrottle
+	throttle.Warnln("refresh failed:", errors.New("timeout"), "a")
+	NewLogThrottle(0).Warnln("refresh failed:", errors.New("timeout"), "b")
+	assert.Equal(t, 2, strings.Count(out.String(), "WARN:"))
+}
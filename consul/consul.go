@@ -1,10 +1,19 @@
 package consul
 
 import (
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"net/http"
 	"net/url"
+	"os"
+	"sort"
+	"strconv"
 	"strings"
+	"sync"
+	"time"
 
 	consulapi "github.com/hashicorp/consul/api"
 	"github.com/xytis/registrator/bridge"
@@ -12,41 +21,302 @@ import (
 
 const DefaultInterval = "10s"
 
+// NamespaceEnvName and PartitionEnvName name the environment variables with
+// the Consul Enterprise namespace and admin partition services go to unless
+// they set SERVICE_NAMESPACE or SERVICE_PARTITION.
+const (
+	NamespaceEnvName = "CONSUL_NAMESPACE"
+	PartitionEnvName = "CONSUL_PARTITION"
+)
+
+// TagOverrideEnvName names the environment variable turning on
+// EnableTagOverride for services without SERVICE_TAG_OVERRIDE.
+const TagOverrideEnvName = "CONSUL_TAG_OVERRIDE"
+
+// TokenFileEnvName names the environment variable holding the path of a file
+// with the ACL token. The file is re-read whenever it changes.
+const TokenFileEnvName = "CONSUL_HTTP_TOKEN_FILE"
+
+// CACertEnvName, ClientCertEnvName and ClientKeyEnvName name the environment
+// variables with the paths of the CA certificate and client key pair for
+// HTTPS. The cacert, client_cert and client_key URI parameters override them.
+const (
+	CACertEnvName     = "CONSUL_CACERT"
+	ClientCertEnvName = "CONSUL_CLIENT_CERT"
+	ClientKeyEnvName  = "CONSUL_CLIENT_KEY"
+)
+
 func init() {
 	f := new(Factory)
 	bridge.Register(f, "consul")
 	bridge.Register(f, "consul-unix")
 }
 
+// interpolateService fills in the address the service is registered with,
+// which follows -internal, -global and -ip, unlike the published binding.
 func (r *ConsulAdapter) interpolateService(script string, service *bridge.Service) string {
-	withIp := strings.Replace(script, "$SERVICE_IP", service.Origin.HostIP, -1)
-	withPort := strings.Replace(withIp, "$SERVICE_PORT", service.Origin.HostPort, -1)
+	withIp := strings.Replace(script, "$SERVICE_IP", service.IP, -1)
+	withPort := strings.Replace(withIp, "$SERVICE_PORT", strconv.Itoa(service.Port), -1)
 	return withPort
 }
 
 type Factory struct{}
 
+func (f *Factory) Validate(uri *url.URL) error {
+	if uri.Scheme == "consul-unix" && uri.Path == "" {
+		return errors.New("socket path required e.g.: consul-unix:///path/to/consul.sock")
+	}
+	return nil
+}
+
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	config := consulapi.DefaultConfig()
+	query := uri.Query()
 	if uri.Scheme == "consul-unix" {
-		config.Address = strings.TrimPrefix(uri.String(), "consul-")
+		base := *uri
+		base.RawQuery = ""
+		config.Address = strings.TrimPrefix(base.String(), "consul-")
 	} else if uri.Host != "" {
 		config.Address = uri.Host
 	}
+	if token := query.Get("token"); token != "" {
+		config.Token = token
+	}
+	tagOverride, _ := strconv.ParseBool(os.Getenv(TagOverrideEnvName))
+	datacenters := os.Getenv(DatacentersEnvName)
+	if list, ok := query["datacenters"]; ok {
+		datacenters = strings.Join(list, ",")
+	}
+	if err := configureTLS(config, query); err != nil {
+		log.Fatal("consul: ", err)
+	}
 	client, err := consulapi.NewClient(config)
 	if err != nil {
 		log.Fatal("consul: ", uri.Scheme)
 	}
-	return &ConsulAdapter{client: client}
+	return &ConsulAdapter{
+		client:    client,
+		config:    config,
+		tokenFile: os.Getenv(TokenFileEnvName),
+		defaults:  scope{namespace: os.Getenv(NamespaceEnvName), partition: os.Getenv(PartitionEnvName)},
+
+		tagOverride: tagOverride,
+		datacenters: parseDatacenters(datacenters),
+		maintenance: make(map[string]string),
+	}
+}
+
+// configureTLS sets up HTTPS from the URI query and the environment. The API
+// client reads CONSUL_HTTP_SSL and CONSUL_HTTP_SSL_VERIFY itself; the ssl and
+// ssl_verify parameters override them. Giving a CA certificate or client key
+// pair implies HTTPS.
+func configureTLS(config *consulapi.Config, query url.Values) error {
+	tlsConfig := &consulapi.TLSConfig{
+		Address:  config.Address,
+		CAFile:   os.Getenv(CACertEnvName),
+		CertFile: os.Getenv(ClientCertEnvName),
+		KeyFile:  os.Getenv(ClientKeyEnvName),
+	}
+	if path := query.Get("cacert"); path != "" {
+		tlsConfig.CAFile = path
+	}
+	if path := query.Get("client_cert"); path != "" {
+		tlsConfig.CertFile = path
+	}
+	if path := query.Get("client_key"); path != "" {
+		tlsConfig.KeyFile = path
+	}
+	if (tlsConfig.CertFile == "") != (tlsConfig.KeyFile == "") {
+		return errors.New("client certificate and key must be given together")
+	}
+	if tlsConfig.CAFile != "" || tlsConfig.CertFile != "" {
+		config.Scheme = "https"
+	}
+	if ssl := query.Get("ssl"); ssl != "" {
+		enabled, err := strconv.ParseBool(ssl)
+		if err != nil {
+			return fmt.Errorf("bad ssl parameter %q", ssl)
+		}
+		if enabled {
+			config.Scheme = "https"
+		} else {
+			config.Scheme = "http"
+		}
+	}
+	verify := os.Getenv(consulapi.HTTPSSLVerifyEnvName)
+	if v := query.Get("ssl_verify"); v != "" {
+		verify = v
+	}
+	if verify != "" {
+		enabled, err := strconv.ParseBool(verify)
+		if err != nil {
+			return fmt.Errorf("bad ssl_verify setting %q", verify)
+		}
+		tlsConfig.InsecureSkipVerify = !enabled
+	}
+	if tlsConfig.CAFile == "" && tlsConfig.CertFile == "" && !tlsConfig.InsecureSkipVerify {
+		return nil
+	}
+	if config.HttpClient == nil || config.HttpClient.Transport == nil {
+		// newer consul/api configs leave the client to NewClient
+		config.HttpClient = &http.Client{Transport: http.DefaultTransport.(*http.Transport).Clone()}
+	}
+	transport, ok := config.HttpClient.Transport.(*http.Transport)
+	if !ok {
+		return errors.New("TLS needs an HTTP transport")
+	}
+	tlsClientConfig, err := consulapi.SetupTLSConfig(tlsConfig)
+	if err != nil {
+		return err
+	}
+	transport.TLSClientConfig = tlsClientConfig
+	return nil
 }
 
 type ConsulAdapter struct {
+	sync.Mutex
 	client *consulapi.Client
+	config *consulapi.Config
+
+	tokenFile    string
+	tokenModTime time.Time
+
+	defaults scope
+	scoped   map[scope]*consulapi.Client
+	seen     map[scope]bool
+
+	tagOverride bool
+	datacenters []string
+	nodeName    string
+	nodeAddr    string
+	// reasons of the services in maintenance, for their check in other
+	// datacenters
+	maintenance map[string]string
+}
+
+// scope is a Consul Enterprise namespace and admin partition. The zero scope
+// is the agent's default.
+type scope struct {
+	namespace string
+	partition string
+}
+
+// serviceScope returns the scope a service was given with SERVICE_NAMESPACE
+// and SERVICE_PARTITION, empty parts meaning the adapter's defaults.
+func serviceScope(service *bridge.Service) scope {
+	return scope{namespace: service.Attrs["namespace"], partition: service.Attrs["partition"]}
+}
+
+// scopeTransport adds the namespace and partition to every request.
+type scopeTransport struct {
+	base  http.RoundTripper
+	scope scope
+}
+
+func (t *scopeTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	scoped := *req
+	u := *req.URL
+	query := u.Query()
+	if t.scope.namespace != "" {
+		query.Set("ns", t.scope.namespace)
+	}
+	if t.scope.partition != "" {
+		query.Set("partition", t.scope.partition)
+	}
+	u.RawQuery = query.Encode()
+	scoped.URL = &u
+	return t.base.RoundTrip(&scoped)
+}
+
+// resolve fills in the parts of s left to the defaults.
+func (r *ConsulAdapter) resolve(s scope) scope {
+	if s.namespace == "" {
+		s.namespace = r.defaults.namespace
+	}
+	if s.partition == "" {
+		s.partition = r.defaults.partition
+	}
+	return s
+}
+
+// Scope returns the namespace and partition a service is registered in,
+// with the defaults filled in.
+func (r *ConsulAdapter) Scope(service *bridge.Service) string {
+	s := r.resolve(serviceScope(service))
+	return s.namespace + "/" + s.partition
+}
+
+// in returns the client for calls about services in scope s.
+func (r *ConsulAdapter) in(s scope) *consulapi.Client {
+	client := r.api()
+	s = r.resolve(s)
+	if s == (scope{}) {
+		return client
+	}
+	r.Lock()
+	defer r.Unlock()
+	if scoped, ok := r.scoped[s]; ok {
+		return scoped
+	}
+	config := *r.config
+	base := http.DefaultTransport
+	if config.HttpClient != nil && config.HttpClient.Transport != nil {
+		base = config.HttpClient.Transport
+	}
+	config.HttpClient = &http.Client{Transport: &scopeTransport{base: base, scope: s}}
+	scoped, err := consulapi.NewClient(&config)
+	if err != nil {
+		log.Println("consul: unable to create client for namespace", s.namespace, "partition", s.partition+":", err)
+		return client
+	}
+	if r.scoped == nil {
+		r.scoped = make(map[scope]*consulapi.Client)
+	}
+	r.scoped[s] = scoped
+	return scoped
+}
+
+// api returns the client to use for the next call, rebuilding it first if
+// the token file has changed since it was last read.
+func (r *ConsulAdapter) api() *consulapi.Client {
+	r.Lock()
+	defer r.Unlock()
+	if r.tokenFile == "" {
+		return r.client
+	}
+	info, err := os.Stat(r.tokenFile)
+	if err != nil {
+		log.Println("consul: unable to stat token file:", err)
+		return r.client
+	}
+	if info.ModTime().Equal(r.tokenModTime) {
+		return r.client
+	}
+	data, err := ioutil.ReadFile(r.tokenFile)
+	if err != nil {
+		log.Println("consul: unable to read token file:", err)
+		return r.client
+	}
+	config := *r.config
+	config.Token = strings.TrimSpace(string(data))
+	client, err := consulapi.NewClient(&config)
+	if err != nil {
+		log.Println("consul: unable to apply new token:", err)
+		return r.client
+	}
+	if r.tokenModTime.IsZero() {
+		log.Println("consul: using token from", r.tokenFile)
+	} else {
+		log.Println("consul: token reloaded from", r.tokenFile)
+	}
+	r.client, r.config, r.tokenModTime = client, &config, info.ModTime()
+	r.scoped = nil
+	return r.client
 }
 
 // Ping will try to connect to consul by attempting to retrieve the current leader.
 func (r *ConsulAdapter) Ping() error {
-	status := r.client.Status()
+	status := r.api().Status()
 	leader, err := status.Leader()
 	if err != nil {
 		return err
@@ -56,68 +326,461 @@ func (r *ConsulAdapter) Ping() error {
 	return nil
 }
 
+// Register registers the service with the agent and into the catalogs of
+// the other datacenters given, if any.
 func (r *ConsulAdapter) Register(service *bridge.Service) error {
+	err := r.register(service, r.buildChecks(service, true))
+	return r.inDatacenters(err, func(dc string) error { return r.registerIn(dc, service) })
+}
+
+// UpdateTags applies changed tags and attributes of a service. It sends the
+// same registration as Register, checks included, as registering a service
+// without its checks would remove them from the agent.
+func (r *ConsulAdapter) UpdateTags(service *bridge.Service) error {
+	return r.Register(service)
+}
+
+func (r *ConsulAdapter) register(service *bridge.Service, checks []*serviceCheck) error {
 	registration := new(consulapi.AgentServiceRegistration)
 	registration.ID = service.ID
 	registration.Name = service.Name
 	registration.Port = service.Port
 	registration.Tags = service.Tags
 	registration.Address = service.IP
-	registration.Check = r.buildCheck(service)
-	return r.client.Agent().ServiceRegister(registration)
+	registration.EnableTagOverride = r.enableTagOverride(service)
+	var check *serviceCheck
+	if len(checks) == 1 {
+		check, checks = checks[0], nil
+		registration.Check = check.AgentServiceCheck
+	}
+	connect, err := buildConnect(service)
+	if err != nil {
+		return err
+	}
+	var weights *serviceWeights
+	if service.Weight > 0 {
+		weights = &serviceWeights{Passing: service.Weight, Warning: 1}
+	}
+	s := serviceScope(service)
+	r.Lock()
+	if r.seen == nil {
+		r.seen = make(map[scope]bool)
+	}
+	r.seen[s] = true
+	r.Unlock()
+	tagged := buildTaggedAddresses(service)
+	if connect == nil && weights == nil && tagged == nil && checks == nil && (check == nil || check.UDP == "") {
+		return r.in(s).Agent().ServiceRegister(registration)
+	}
+	_, err = r.in(s).Raw().Write("/v1/agent/service/register", &extendedRegistration{registration, check, checks, connect, weights, tagged}, nil, nil)
+	return err
+}
+
+// enableTagOverride reports whether Consul keeps tags edited in its catalog
+// rather than those registered, by SERVICE_TAG_OVERRIDE or else the
+// adapter's default.
+func (r *ConsulAdapter) enableTagOverride(service *bridge.Service) bool {
+	value, ok := service.Attrs["tag_override"]
+	if !ok {
+		return r.tagOverride
+	}
+	enable, err := strconv.ParseBool(value)
+	if err != nil {
+		log.Println("consul: invalid SERVICE_TAG_OVERRIDE for", service.ID+":", value)
+		return r.tagOverride
+	}
+	return enable
+}
+
+// extendedRegistration adds the Connect and Weights blocks, tagged
+// addresses, UDP checks and lists of checks, which the vendored API client
+// does not know about, to a service registration.
+type extendedRegistration struct {
+	*consulapi.AgentServiceRegistration
+	Check           *serviceCheck             `json:",omitempty"`
+	Checks          []*serviceCheck           `json:",omitempty"`
+	Connect         *serviceConnect           `json:",omitempty"`
+	Weights         *serviceWeights           `json:",omitempty"`
+	TaggedAddresses map[string]serviceAddress `json:",omitempty"`
+}
+
+type serviceCheck struct {
+	*consulapi.AgentServiceCheck
+	UDP string `json:",omitempty"`
+}
+
+type serviceAddress struct {
+	Address string
+	Port    int
+}
+
+// buildTaggedAddresses turns the tagged addresses of a service, already
+// checked to be <ip>:<port> by the bridge, into Consul's form.
+func buildTaggedAddresses(service *bridge.Service) map[string]serviceAddress {
+	if len(service.TaggedAddresses) == 0 {
+		return nil
+	}
+	tagged := make(map[string]serviceAddress, len(service.TaggedAddresses))
+	for name, addr := range service.TaggedAddresses {
+		host, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			continue
+		}
+		p, _ := strconv.Atoi(port)
+		tagged[name] = serviceAddress{host, p}
+	}
+	return tagged
+}
+
+type serviceWeights struct {
+	Passing int
+	Warning int
+}
+
+type serviceConnect struct {
+	Native         bool            `json:",omitempty"`
+	SidecarService *sidecarService `json:",omitempty"`
+}
+
+type sidecarService struct {
+	Port int `json:",omitempty"`
+}
+
+// buildConnect reads SERVICE_CONNECT, which is "native" (or "true") for
+// services that speak Connect themselves and "sidecar" to register a sidecar
+// proxy with them, optionally on SERVICE_CONNECT_SIDECAR_PORT.
+func buildConnect(service *bridge.Service) (*serviceConnect, error) {
+	mode := service.Attrs["connect"]
+	sidecarPort := service.Attrs["connect_sidecar_port"]
+	switch mode {
+	case "":
+		if sidecarPort != "" {
+			return nil, errors.New("consul: SERVICE_CONNECT_SIDECAR_PORT needs SERVICE_CONNECT=sidecar")
+		}
+		return nil, nil
+	case "true", "native":
+		if sidecarPort != "" {
+			return nil, errors.New("consul: SERVICE_CONNECT=native cannot have a sidecar port")
+		}
+		return &serviceConnect{Native: true}, nil
+	case "sidecar":
+		sidecar := new(sidecarService)
+		if sidecarPort != "" {
+			port, err := strconv.Atoi(sidecarPort)
+			if err != nil {
+				return nil, errors.New("consul: bad SERVICE_CONNECT_SIDECAR_PORT: " + sidecarPort)
+			}
+			sidecar.Port = port
+		}
+		return &serviceConnect{SidecarService: sidecar}, nil
+	default:
+		return nil, errors.New("consul: SERVICE_CONNECT must be native or sidecar, not " + mode)
+	}
+}
+
+// buildChecks returns the checks configured for the service: the one from
+// SERVICE_CHECK_*, if any, followed by those from SERVICE_CHECK_<n>_* in the
+// order of n. Warnings about skipped checks are only logged when warn is set.
+func (r *ConsulAdapter) buildChecks(service *bridge.Service, warn bool) []*serviceCheck {
+	logf := func(v ...interface{}) {
+		if warn {
+			log.Println(v...)
+		}
+	}
+	var checks []*serviceCheck
+	if check := r.checkFrom(service, "check_", logf); check != nil {
+		checks = append(checks, check)
+	}
+	for _, n := range checkIndexes(service.Attrs) {
+		if check := r.checkFrom(service, "check_"+strconv.Itoa(n)+"_", logf); check != nil {
+			checks = append(checks, check)
+		}
+	}
+	return checks
 }
 
-func (r *ConsulAdapter) buildCheck(service *bridge.Service) *consulapi.AgentServiceCheck {
-	check := new(consulapi.AgentServiceCheck)
-	if path := service.Attrs["check_http"]; path != "" {
-		check.HTTP = fmt.Sprintf("http://%s:%d%s", service.IP, service.Port, path)
-		if timeout := service.Attrs["check_timeout"]; timeout != "" {
+// checkIndexes returns the n of the SERVICE_CHECK_<n>_* attributes, sorted.
+func checkIndexes(attrs map[string]string) []int {
+	seen := make(map[int]bool)
+	var indexes []int
+	for key := range attrs {
+		if !strings.HasPrefix(key, "check_") {
+			continue
+		}
+		rest := strings.TrimPrefix(key, "check_")
+		i := strings.Index(rest, "_")
+		if i <= 0 {
+			continue
+		}
+		n, err := strconv.Atoi(rest[:i])
+		if err != nil || n < 0 || seen[n] {
+			continue
+		}
+		seen[n] = true
+		indexes = append(indexes, n)
+	}
+	sort.Ints(indexes)
+	return indexes
+}
+
+// checkIDs returns the IDs Consul gives to the checks of a service: the
+// service ID alone for a single check, numbered from 1 for several.
+func checkIDs(service *bridge.Service, checks []*serviceCheck) []string {
+	if len(checks) == 1 {
+		return []string{"service:" + service.ID}
+	}
+	ids := make([]string, len(checks))
+	for i := range checks {
+		ids[i] = "service:" + service.ID + ":" + strconv.Itoa(i+1)
+	}
+	return ids
+}
+
+// buildCheck returns the check configured by SERVICE_CHECK_*, if any.
+func (r *ConsulAdapter) buildCheck(service *bridge.Service) *serviceCheck {
+	return r.checkFrom(service, "check_", log.Println)
+}
+
+// checkFrom returns the check configured by the attributes starting with
+// prefix, if any. HTTP and TCP checks can't reach a UDP service and UDP
+// checks only work on one, so checks not matching the port protocol are
+// skipped with a warning. An absolute HTTP URL is used as is, for health
+// endpoints served by another container.
+func (r *ConsulAdapter) checkFrom(service *bridge.Service, prefix string, logf func(...interface{})) *serviceCheck {
+	attr := func(name string) string { return service.Attrs[prefix+name] }
+	check := &serviceCheck{AgentServiceCheck: new(consulapi.AgentServiceCheck)}
+	target := net.JoinHostPort(service.IP, strconv.Itoa(service.Port))
+	path := attr("http")
+	tcp := attr("tcp") == "true"
+	udp := attr("udp") == "true"
+	absolute := strings.HasPrefix(path, "http://") || strings.HasPrefix(path, "https://")
+	if absolute {
+		if u, err := url.Parse(path); err != nil || u.Host == "" {
+			logf("consul: skipping HTTP check of", service.ID, "with bad URL", path)
+			path, absolute = "", false
+		}
+	}
+	if service.Origin.PortType == "udp" {
+		if path != "" && !absolute {
+			logf("consul: skipping HTTP check of UDP service", service.ID)
+			path = ""
+		}
+		if tcp {
+			logf("consul: skipping TCP check of UDP service", service.ID)
+			tcp = false
+		}
+	} else if udp {
+		logf("consul: skipping UDP check of TCP service", service.ID)
+		udp = false
+	}
+	if absolute {
+		check.HTTP = path
+		if timeout := attr("timeout"); timeout != "" {
+			check.Timeout = timeout
+		}
+	} else if path != "" {
+		check.HTTP = fmt.Sprintf("http://%s%s", target, path)
+		if timeout := attr("timeout"); timeout != "" {
 			check.Timeout = timeout
 		}
-	} else if cmd := service.Attrs["check_cmd"]; cmd != "" {
+	} else if tcp {
+		check.TCP = target
+		if timeout := attr("timeout"); timeout != "" {
+			check.Timeout = timeout
+		}
+	} else if udp {
+		check.UDP = target
+		if timeout := attr("timeout"); timeout != "" {
+			check.Timeout = timeout
+		}
+	} else if cmd := attr("cmd"); cmd != "" {
 		check.Script = fmt.Sprintf("check-cmd %s %s %s", service.Origin.ContainerID[:12], service.Origin.ExposedPort, cmd)
-	} else if script := service.Attrs["check_script"]; script != "" {
+	} else if script := attr("script"); script != "" {
 		check.Script = r.interpolateService(script, service)
-	} else if ttl := service.Attrs["check_ttl"]; ttl != "" {
+	} else if ttl := attr("ttl"); ttl != "" {
 		check.TTL = ttl
 	} else {
 		return nil
 	}
-	if check.Script != "" || check.HTTP != "" {
-		if interval := service.Attrs["check_interval"]; interval != "" {
+	check.Notes = attr("notes")
+	if check.Notes == "" && service.Attrs["healthcheck"] != "" {
+		check.Notes = "Docker HEALTHCHECK: " + service.Attrs["healthcheck"]
+		if interval := service.Attrs["healthcheck_interval"]; interval != "" {
+			check.Notes += " every " + interval
+		}
+	}
+	if check.Script != "" || check.HTTP != "" || check.TCP != "" || check.UDP != "" {
+		if interval := attr("interval"); interval != "" {
 			check.Interval = interval
 		} else {
 			check.Interval = DefaultInterval
 		}
 	}
+	if after := attr("deregister_critical_after"); after != "" {
+		if _, err := time.ParseDuration(after); err != nil {
+			logf("consul: ignoring bad SERVICE_CHECK_DEREGISTER_CRITICAL_AFTER of", service.ID+":", after)
+		} else {
+			check.DeregisterCriticalServiceAfter = after
+		}
+	}
 	return check
 }
 
 func (r *ConsulAdapter) Deregister(service *bridge.Service) error {
-	return r.client.Agent().ServiceDeregister(service.ID)
+	r.Lock()
+	delete(r.maintenance, service.ID)
+	r.Unlock()
+	if dc := service.Attrs[remoteDatacenterAttr]; dc != "" {
+		// listed only in another datacenter, the agent doesn't know it
+		return r.deregisterIn(dc, service)
+	}
+	err := r.in(serviceScope(service)).Agent().ServiceDeregister(service.ID)
+	return r.inDatacenters(err, func(dc string) error { return r.deregisterIn(dc, service) })
 }
 
+// Maintenance puts a service into maintenance with the agent, and turns its
+// check critical in every other datacenter.
+func (r *ConsulAdapter) Maintenance(service *bridge.Service, enable bool, reason string) error {
+	agent := r.in(serviceScope(service)).Agent()
+	var err error
+	r.Lock()
+	if enable {
+		r.maintenance[service.ID] = reason
+	} else {
+		delete(r.maintenance, service.ID)
+	}
+	r.Unlock()
+	if enable {
+		err = agent.EnableServiceMaintenance(service.ID, reason)
+	} else {
+		err = agent.DisableServiceMaintenance(service.ID)
+	}
+	return r.inDatacenters(err, func(dc string) error { return r.registerIn(dc, service) })
+}
+
+// warningCheckTTL keeps the check added by Warning from expiring until it is
+// removed again.
+const warningCheckTTL = "720h"
+
+// Warning adds a check in the warning state to a service, or removes it,
+// leaving the service's own checks alone.
+func (r *ConsulAdapter) Warning(service *bridge.Service, enable bool, reason string) error {
+	agent := r.in(serviceScope(service)).Agent()
+	id := "_service_warning:" + service.ID
+	if !enable {
+		return agent.CheckDeregister(id)
+	}
+	return agent.CheckRegister(&consulapi.AgentCheckRegistration{
+		ID:        id,
+		Name:      "Service Warning",
+		Notes:     reason,
+		ServiceID: service.ID,
+		AgentServiceCheck: consulapi.AgentServiceCheck{
+			TTL:    warningCheckTTL,
+			Status: consulapi.HealthWarning,
+		},
+	})
+}
+
+// Refresh passes the TTL checks of services registered with
+// SERVICE_CHECK_TTL or SERVICE_CHECK_<n>_TTL, so the checks stay healthy for
+// as long as the container is running. In other datacenters it registers the
+// service again, which refreshes its check there.
 func (r *ConsulAdapter) Refresh(service *bridge.Service) error {
+	return r.inDatacenters(r.passTTLs(service), func(dc string) error { return r.registerIn(dc, service) })
+}
+
+func (r *ConsulAdapter) passTTLs(service *bridge.Service) error {
+	checks := r.buildChecks(service, false)
+	for i, id := range checkIDs(service, checks) {
+		if checks[i].TTL == "" {
+			continue
+		}
+		if err := r.in(serviceScope(service)).Agent().PassTTL(id, ""); err != nil {
+			return err
+		}
+	}
 	return nil
 }
 
+// HasService looks up in the catalog whether any node has a service of the
+// name, for SERVICE_REQUIRES.
+func (r *ConsulAdapter) HasService(name string) (bool, error) {
+	services, _, err := r.api().Catalog().Service(name, "", nil)
+	return len(services) > 0, err
+}
+
+// ListsTags reports that Services lists the tags of services, so cleanup
+// can tell services registered by this host by their ownership tag.
+func (r *ConsulAdapter) ListsTags() bool {
+	return true
+}
+
+// NamesDNS reports that Consul serves services by name on its DNS
+// interface, for -dns-safe-names.
+func (r *ConsulAdapter) NamesDNS() bool {
+	return true
+}
+
+// Services lists the services of the default scope and of every scope
+// services were registered to, with those only left on the agent's node in
+// other datacenters. Each carries its scope in its attributes, so
+// deregistering it during cleanup stays within its namespace and partition.
 func (r *ConsulAdapter) Services() ([]*bridge.Service, error) {
-	services, err := r.client.Agent().Services()
-	if err != nil {
-		return []*bridge.Service{}, err
-	}
-	out := make([]*bridge.Service, len(services))
-	i := 0
-	for _, v := range services {
-		s := &bridge.Service{
-			ID:   v.ID,
-			Name: v.Service,
-			Port: v.Port,
-			Tags: v.Tags,
-			IP:   v.Address,
-		}
-		out[i] = s
-		i++
+	scopes := []scope{{}}
+	listed := map[scope]bool{r.resolve(scope{}): true}
+	r.Lock()
+	for s := range r.seen {
+		if !listed[r.resolve(s)] {
+			listed[r.resolve(s)] = true
+			scopes = append(scopes, s)
+		}
+	}
+	r.Unlock()
+
+	out := make([]*bridge.Service, 0)
+	for _, s := range scopes {
+		listedIDs := make(map[string]bool)
+		add := func(v *consulapi.AgentService, dc string) {
+			if listedIDs[v.ID] {
+				return
+			}
+			listedIDs[v.ID] = true
+			attrs := make(map[string]string)
+			if s.namespace != "" {
+				attrs["namespace"] = s.namespace
+			}
+			if s.partition != "" {
+				attrs["partition"] = s.partition
+			}
+			if dc != "" {
+				attrs[remoteDatacenterAttr] = dc
+			}
+			out = append(out, &bridge.Service{
+				ID:    v.ID,
+				Name:  v.Service,
+				Port:  v.Port,
+				Tags:  v.Tags,
+				IP:    v.Address,
+				Attrs: attrs,
+			})
+		}
+		services, err := r.in(s).Agent().Services()
+		if err != nil {
+			return []*bridge.Service{}, err
+		}
+		for _, v := range services {
+			add(v, "")
+		}
+		for _, dc := range r.datacenters {
+			remote, err := r.remoteServices(s, dc)
+			if err != nil {
+				return []*bridge.Service{}, err
+			}
+			for _, v := range remote {
+				add(v, dc)
+			}
+		}
 	}
 	return out, nil
 }
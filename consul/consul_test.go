@@ -0,0 +1,560 @@
+package consul
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/json"
+	"encoding/pem"
+	"io/ioutil"
+	"log"
+	"math/big"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+func TestTokenFileReload(t *testing.T) {
+	var token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token = req.Header.Get("X-Consul-Token")
+		w.Write([]byte(`"127.0.0.1:8300"`))
+	}))
+	defer server.Close()
+
+	dir, err := ioutil.TempDir("", "consul-token")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	tokenFile := filepath.Join(dir, "token")
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("first\n"), 0600))
+
+	os.Setenv(TokenFileEnvName, tokenFile)
+	defer os.Unsetenv(TokenFileEnvName)
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String() + "?token=static")
+	adapter := new(Factory).New(uri)
+
+	assert.NoError(t, adapter.Ping())
+	assert.Equal(t, "first", token)
+
+	assert.NoError(t, ioutil.WriteFile(tokenFile, []byte("second\n"), 0600))
+	later := time.Now().Add(time.Minute)
+	assert.NoError(t, os.Chtimes(tokenFile, later, later))
+
+	assert.NoError(t, adapter.Ping())
+	assert.Equal(t, "second", token)
+}
+
+func TestTokenFromURI(t *testing.T) {
+	var token string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		token = req.Header.Get("X-Consul-Token")
+		w.Write([]byte(`"127.0.0.1:8300"`))
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String() + "?token=static")
+	adapter := new(Factory).New(uri)
+
+	assert.NoError(t, adapter.Ping())
+	assert.Equal(t, "static", token)
+}
+
+func TestRefreshPassesTTLCheck(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.Method+" "+req.URL.Path)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+
+	assert.NoError(t, adapter.Refresh(&bridge.Service{ID: "host:web:80", Attrs: map[string]string{}}))
+	assert.Empty(t, paths)
+
+	service := &bridge.Service{ID: "host:web:80", Attrs: map[string]string{"check_ttl": "30s"}}
+	assert.NoError(t, adapter.Refresh(service))
+	assert.Equal(t, []string{"PUT /v1/agent/check/pass/service:host:web:80"}, paths)
+}
+
+func TestRegisterMultipleChecks(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8080, Attrs: map[string]string{
+		"check_1_http":  "/health",
+		"check_1_notes": "application health",
+		"check_2_tcp":   "true",
+		"check_2_notes": "port open",
+	}}
+
+	assert.NoError(t, adapter.Register(service))
+	assert.NotContains(t, body, "Check")
+	assert.Equal(t, []interface{}{
+		map[string]interface{}{"HTTP": "http://10.0.0.1:8080/health", "Interval": DefaultInterval, "Notes": "application health"},
+		map[string]interface{}{"TCP": "10.0.0.1:8080", "Interval": DefaultInterval, "Notes": "port open"},
+	}, body["Checks"])
+}
+
+func TestRefreshPassesNumberedTTLChecks(t *testing.T) {
+	var paths []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.Method+" "+req.URL.Path)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Port: 80, Attrs: map[string]string{
+		"check_http":  "/health",
+		"check_1_ttl": "30s",
+	}}
+
+	assert.NoError(t, adapter.Refresh(service))
+	assert.Equal(t, []string{"PUT /v1/agent/check/pass/service:host:web:80:2"}, paths)
+}
+
+func TestRegisterConnect(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", Port: 80, Attrs: map[string]string{}}
+
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, "web", body["Name"])
+	assert.NotContains(t, body, "Connect")
+
+	service.Attrs["connect"] = "true"
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, "web", body["Name"])
+	assert.Equal(t, map[string]interface{}{"Native": true}, body["Connect"])
+
+	service.Attrs["connect"] = "sidecar"
+	service.Attrs["connect_sidecar_port"] = "21000"
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, map[string]interface{}{"SidecarService": map[string]interface{}{"Port": 21000.0}}, body["Connect"])
+
+	service.Attrs["connect"] = "native"
+	assert.Error(t, adapter.Register(service))
+	service.Attrs["connect"] = "mesh"
+	assert.Error(t, adapter.Register(service))
+}
+
+func TestCheckTargetsServiceAddress(t *testing.T) {
+	adapter := new(ConsulAdapter)
+	// with -internal the service has the container address, not the binding
+	service := &bridge.Service{
+		ID:   "host:web:80",
+		IP:   "172.17.0.2",
+		Port: 80,
+		Origin: bridge.ServicePort{
+			HostIP:      "10.0.0.1",
+			HostPort:    "8080",
+			ExposedIP:   "172.17.0.2",
+			ExposedPort: "80",
+		},
+	}
+
+	service.Attrs = map[string]string{"check_http": "/health"}
+	assert.Equal(t, "http://172.17.0.2:80/health", adapter.buildCheck(service).HTTP)
+
+	service.Attrs = map[string]string{"check_tcp": "true"}
+	check := adapter.buildCheck(service)
+	assert.Equal(t, "172.17.0.2:80", check.TCP)
+	assert.Equal(t, DefaultInterval, check.Interval)
+
+	service.Attrs = map[string]string{"check_script": "nc $SERVICE_IP $SERVICE_PORT"}
+	assert.Equal(t, "nc 172.17.0.2 80", adapter.buildCheck(service).Script)
+
+	// published services are checked on the host binding
+	service.IP, service.Port = "10.0.0.1", 8080
+	service.Attrs = map[string]string{"check_tcp": "true"}
+	assert.Equal(t, "10.0.0.1:8080", adapter.buildCheck(service).TCP)
+}
+
+func TestNamespaces(t *testing.T) {
+	var requests []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		requests = append(requests, req.Method+" "+req.URL.Path+"?"+req.URL.RawQuery)
+		if req.URL.Path == "/v1/agent/services" {
+			switch req.URL.Query().Get("ns") {
+			case "team-a":
+				w.Write([]byte(`{"host:web:80": {"ID": "host:web:80", "Service": "web"}}`))
+			default:
+				w.Write([]byte(`{"host:db:5432": {"ID": "host:db:5432", "Service": "db"}}`))
+			}
+		}
+	}))
+	defer server.Close()
+
+	os.Setenv(NamespaceEnvName, "shared")
+	defer os.Unsetenv(NamespaceEnvName)
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+
+	web := &bridge.Service{ID: "host:web:80", Name: "web", Attrs: map[string]string{"namespace": "team-a", "partition": "eu"}}
+	assert.NoError(t, adapter.Register(web))
+	assert.NoError(t, adapter.Register(&bridge.Service{ID: "host:db:5432", Name: "db", Attrs: map[string]string{}}))
+	assert.Equal(t, []string{
+		"PUT /v1/agent/service/register?ns=team-a&partition=eu",
+		"PUT /v1/agent/service/register?ns=shared",
+	}, requests)
+
+	requests = nil
+	services, err := adapter.Services()
+	assert.NoError(t, err)
+	assert.ElementsMatch(t, []string{
+		"GET /v1/agent/services?ns=shared",
+		"GET /v1/agent/services?ns=team-a&partition=eu",
+	}, requests)
+	assert.Len(t, services, 2)
+
+	// naming the default namespace is the same as naming none
+	scoper := adapter.(bridge.Scoper)
+	assert.Equal(t, scoper.Scope(&bridge.Service{Attrs: map[string]string{}}),
+		scoper.Scope(&bridge.Service{Attrs: map[string]string{"namespace": "shared"}}))
+	assert.NotEqual(t, scoper.Scope(&bridge.Service{Attrs: map[string]string{}}), scoper.Scope(web))
+
+	// cleanup deregisters listed services in the scope they were listed from
+	requests = nil
+	for _, service := range services {
+		assert.NoError(t, adapter.Deregister(service))
+	}
+	assert.ElementsMatch(t, []string{
+		"PUT /v1/agent/service/deregister/host:db:5432?ns=shared",
+		"PUT /v1/agent/service/deregister/host:web:80?ns=team-a&partition=eu",
+	}, requests)
+}
+
+func TestUpdateTagsKeepsCheck(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri).(*ConsulAdapter)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 80, Tags: []string{"canary"},
+		Attrs: map[string]string{"check_http": "/health"}}
+
+	assert.NoError(t, adapter.Register(service))
+	registered := body["Check"]
+	assert.NotNil(t, registered)
+
+	service.Tags = []string{"stable"}
+	assert.NoError(t, adapter.UpdateTags(service))
+	assert.Equal(t, registered, body["Check"])
+	assert.Equal(t, []interface{}{"stable"}, body["Tags"])
+
+	// all checks stay, not only the first
+	service.Attrs = map[string]string{"check_1_http": "/health", "check_2_tcp": "true"}
+	assert.NoError(t, adapter.UpdateTags(service))
+	if checks, ok := body["Checks"].([]interface{}); assert.True(t, ok, "no checks in %v", body) {
+		assert.Len(t, checks, 2)
+	}
+}
+
+func TestHasService(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path == "/v1/catalog/service/db" {
+			w.Write([]byte(`[{"Node": "node-2", "ServiceID": "other:db:5432", "ServiceName": "db"}]`))
+			return
+		}
+		w.Write([]byte(`[]`))
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	finder := new(Factory).New(uri).(bridge.ServiceFinder)
+	found, err := finder.HasService("db")
+	assert.NoError(t, err)
+	assert.True(t, found)
+	found, err = finder.HasService("cache")
+	assert.NoError(t, err)
+	assert.False(t, found)
+}
+
+func TestRegisterWeights(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", Port: 80, Attrs: map[string]string{}}
+
+	assert.NoError(t, adapter.Register(service))
+	assert.NotContains(t, body, "Weights")
+
+	service.Weight = 256
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, map[string]interface{}{"Passing": 256.0, "Warning": 1.0}, body["Weights"])
+}
+
+func TestUDPChecks(t *testing.T) {
+	var logged bytes.Buffer
+	log.SetOutput(&logged)
+	defer log.SetOutput(os.Stderr)
+
+	adapter := new(ConsulAdapter)
+	service := &bridge.Service{ID: "host:dns:53:udp", IP: "10.0.0.1", Port: 53,
+		Origin: bridge.ServicePort{PortType: "udp"}}
+
+	service.Attrs = map[string]string{"check_tcp": "true"}
+	assert.Nil(t, adapter.buildCheck(service))
+	assert.Contains(t, logged.String(), "skipping TCP check of UDP service host:dns:53:udp")
+
+	service.Attrs = map[string]string{"check_http": "/health", "check_ttl": "30s"}
+	check := adapter.buildCheck(service)
+	assert.Empty(t, check.HTTP)
+	assert.Equal(t, "30s", check.TTL)
+
+	service.Attrs = map[string]string{"check_udp": "true"}
+	check = adapter.buildCheck(service)
+	assert.Equal(t, "10.0.0.1:53", check.UDP)
+	assert.Empty(t, check.TCP)
+	assert.Equal(t, DefaultInterval, check.Interval)
+
+	logged.Reset()
+	service.Origin.PortType = "tcp"
+	assert.Nil(t, adapter.buildCheck(service))
+	assert.Contains(t, logged.String(), "skipping UDP check of TCP service")
+}
+
+func TestRegisterUDPCheck(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:dns:53:udp", Name: "dns", IP: "10.0.0.1", Port: 53,
+		Origin: bridge.ServicePort{PortType: "udp"}, Attrs: map[string]string{"check_udp": "true"}}
+
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, "dns", body["Name"])
+	assert.Equal(t, "10.0.0.1:53", body["Check"].(map[string]interface{})["UDP"])
+	assert.Equal(t, DefaultInterval, body["Check"].(map[string]interface{})["Interval"])
+}
+
+// writeCert writes a self-signed certificate and its key to dir.
+func writeCert(t *testing.T, dir string) (certFile, keyFile string) {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	assert.NoError(t, err)
+	template := &x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "consul.local"},
+		NotBefore:             time.Now(),
+		NotAfter:              time.Now().Add(time.Hour),
+		IsCA:                  true,
+		BasicConstraintsValid: true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	assert.NoError(t, err)
+	keyDer, err := x509.MarshalECPrivateKey(key)
+	assert.NoError(t, err)
+
+	certFile, keyFile = filepath.Join(dir, "cert.pem"), filepath.Join(dir, "key.pem")
+	assert.NoError(t, ioutil.WriteFile(certFile, pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der}), 0600))
+	assert.NoError(t, ioutil.WriteFile(keyFile, pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDer}), 0600))
+	return certFile, keyFile
+}
+
+func TestTLSConfig(t *testing.T) {
+	dir, err := ioutil.TempDir("", "consul-tls")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	certFile, keyFile := writeCert(t, dir)
+
+	os.Setenv(CACertEnvName, certFile)
+	defer os.Unsetenv(CACertEnvName)
+	uri, _ := url.Parse("consul://consul.local:8501?client_cert=" + certFile + "&client_key=" + keyFile)
+	adapter := new(Factory).New(uri).(*ConsulAdapter)
+	assert.Equal(t, "https", adapter.config.Scheme)
+	tlsConfig := adapter.config.HttpClient.Transport.(*http.Transport).TLSClientConfig
+	assert.Equal(t, "consul.local", tlsConfig.ServerName)
+	assert.Len(t, tlsConfig.Certificates, 1)
+	assert.NotNil(t, tlsConfig.RootCAs)
+	assert.False(t, tlsConfig.InsecureSkipVerify)
+
+	os.Unsetenv(CACertEnvName)
+	uri, _ = url.Parse("consul://consul.local:8501?ssl=true&ssl_verify=false")
+	adapter = new(Factory).New(uri).(*ConsulAdapter)
+	assert.Equal(t, "https", adapter.config.Scheme)
+	assert.True(t, adapter.config.HttpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+
+	config := consulapi.DefaultConfig()
+	assert.Error(t, configureTLS(config, url.Values{"client_cert": {certFile}}))
+	assert.Error(t, configureTLS(config, url.Values{"ssl": {"maybe"}}))
+
+	config = &consulapi.Config{Address: "consul.local:8501"}
+	assert.NoError(t, configureTLS(config, url.Values{"ssl_verify": {"false"}}))
+	assert.True(t, config.HttpClient.Transport.(*http.Transport).TLSClientConfig.InsecureSkipVerify)
+	if shared := http.DefaultTransport.(*http.Transport).TLSClientConfig; shared != nil {
+		assert.False(t, shared.InsecureSkipVerify)
+	}
+}
+
+func TestAbsoluteCheckURL(t *testing.T) {
+	adapter := new(ConsulAdapter)
+	service := &bridge.Service{ID: "host:web:80", IP: "10.0.0.1", Port: 8080,
+		Origin: bridge.ServicePort{PortType: "tcp"}}
+
+	service.Attrs = map[string]string{"check_http": "http://sidecar.local:9901/ready?full=1", "check_timeout": "2s"}
+	check := adapter.buildCheck(service)
+	assert.Equal(t, "http://sidecar.local:9901/ready?full=1", check.HTTP)
+	assert.Equal(t, "2s", check.Timeout)
+
+	service.Attrs = map[string]string{"check_http": "https://10.0.0.2:8443/health"}
+	assert.Equal(t, "https://10.0.0.2:8443/health", adapter.buildCheck(service).HTTP)
+
+	// a sidecar can check a UDP service over HTTP
+	service.Origin.PortType = "udp"
+	assert.Equal(t, "https://10.0.0.2:8443/health", adapter.buildCheck(service).HTTP)
+
+	service.Attrs = map[string]string{"check_http": "http:///health"}
+	assert.Nil(t, adapter.buildCheck(service))
+}
+
+func TestHealthcheckNotes(t *testing.T) {
+	adapter := new(ConsulAdapter)
+	service := &bridge.Service{ID: "host:web:80", IP: "10.0.0.1", Port: 8080,
+		Origin: bridge.ServicePort{PortType: "tcp"}}
+
+	service.Attrs = map[string]string{"check_tcp": "true", "healthcheck": "curl -f http://localhost/health", "healthcheck_interval": "10s"}
+	assert.Equal(t, "Docker HEALTHCHECK: curl -f http://localhost/health every 10s", adapter.buildCheck(service).Notes)
+
+	service.Attrs["check_notes"] = "port open"
+	assert.Equal(t, "port open", adapter.buildCheck(service).Notes)
+}
+
+func TestDeregisterCriticalAfter(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 80,
+		Attrs: map[string]string{"check_http": "/health", "check_deregister_critical_after": "90m"}}
+
+	assert.NoError(t, adapter.Register(service))
+	check := body["Check"].(map[string]interface{})
+	assert.Equal(t, "90m", check["DeregisterCriticalServiceAfter"])
+
+	service.Attrs["check_deregister_critical_after"] = "soon"
+	assert.NoError(t, adapter.Register(service))
+	assert.NotContains(t, body["Check"], "DeregisterCriticalServiceAfter")
+}
+
+func TestTaggedAddresses(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8080,
+		TaggedAddresses: map[string]string{"lan": "10.0.0.1:8080", "wan": "203.0.113.7:80"}}
+
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, map[string]interface{}{
+		"lan": map[string]interface{}{"Address": "10.0.0.1", "Port": 8080.0},
+		"wan": map[string]interface{}{"Address": "203.0.113.7", "Port": 80.0},
+	}, body["TaggedAddresses"])
+
+	service.TaggedAddresses = nil
+	assert.NoError(t, adapter.Register(service))
+	assert.NotContains(t, body, "TaggedAddresses")
+}
+
+func TestEnableTagOverride(t *testing.T) {
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", Port: 80, Attrs: map[string]string{"tag_override": "true"}}
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, true, body["EnableTagOverride"])
+
+	service.Attrs = map[string]string{}
+	assert.NoError(t, adapter.Register(service))
+	assert.NotContains(t, body, "EnableTagOverride")
+
+	// the default from -tag-override, which a service can turn off
+	os.Setenv(TagOverrideEnvName, "true")
+	defer os.Unsetenv(TagOverrideEnvName)
+	adapter = new(Factory).New(uri)
+	assert.NoError(t, adapter.(*ConsulAdapter).UpdateTags(service))
+	assert.Equal(t, true, body["EnableTagOverride"])
+	service.Attrs["tag_override"] = "false"
+	assert.NoError(t, adapter.Register(service))
+	assert.NotContains(t, body, "EnableTagOverride")
+}
+
+func TestWarning(t *testing.T) {
+	var paths []string
+	var body map[string]interface{}
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		paths = append(paths, req.URL.Path)
+		body = nil
+		json.NewDecoder(req.Body).Decode(&body)
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri).(*ConsulAdapter)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", Attrs: map[string]string{}}
+
+	assert.NoError(t, adapter.Warning(service, true, "container restarting"))
+	assert.Equal(t, "/v1/agent/check/register", paths[0])
+	assert.Equal(t, "_service_warning:host:web:80", body["ID"])
+	assert.Equal(t, "host:web:80", body["ServiceID"])
+	assert.Equal(t, "warning", body["Status"])
+	assert.Equal(t, "container restarting", body["Notes"])
+
+	assert.NoError(t, adapter.Warning(service, false, ""))
+	assert.Equal(t, "/v1/agent/check/deregister/_service_warning:host:web:80", paths[1])
+}
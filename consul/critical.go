@@ -0,0 +1,86 @@
+package consul
+
+import (
+	"context"
+	"log"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/xytis/registrator/bridge"
+)
+
+// criticalPollInterval is how often WatchCritical reads the agent's checks.
+var criticalPollInterval = 10 * time.Second
+
+// WatchCritical reads the check states of the local agent until ctx is done
+// and calls critical with every service having a critical check for longer
+// than after. The bridge decides whether to deregister it; a service it keeps
+// is reported again once it stayed critical for another after.
+func (r *ConsulAdapter) WatchCritical(ctx context.Context, after time.Duration, critical func(service *bridge.Service)) {
+	since := make(map[string]time.Time)
+	ticker := time.NewTicker(criticalPollInterval)
+	defer ticker.Stop()
+	for {
+		r.pollCritical(since, after, critical)
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+// pollCritical does one round of WatchCritical. since holds when each
+// service was first seen critical.
+func (r *ConsulAdapter) pollCritical(since map[string]time.Time, after time.Duration, critical func(service *bridge.Service)) {
+	checks, err := r.api().Agent().Checks()
+	if err != nil {
+		log.Println("consul: unable to read checks:", err)
+		return
+	}
+	failing := make(map[string]bool)
+	for _, check := range checks {
+		if check.ServiceID != "" && check.Status == consulapi.HealthCritical {
+			failing[check.ServiceID] = true
+		}
+	}
+	now := time.Now()
+	var due []string
+	for id := range since {
+		if !failing[id] {
+			delete(since, id)
+		}
+	}
+	for id := range failing {
+		if first, ok := since[id]; !ok {
+			since[id] = now
+		} else if now.Sub(first) >= after {
+			due = append(due, id)
+		}
+	}
+	if len(due) == 0 {
+		return
+	}
+
+	services, err := r.api().Agent().Services()
+	if err != nil {
+		log.Println("consul: unable to list services:", err)
+		return
+	}
+	for _, id := range due {
+		delete(since, id)
+		v, ok := services[id]
+		if !ok {
+			continue
+		}
+		log.Println("consul: critical for over", after.String()+":", id)
+		critical(&bridge.Service{
+			ID:    v.ID,
+			Name:  v.Service,
+			Port:  v.Port,
+			Tags:  v.Tags,
+			IP:    v.Address,
+			Attrs: map[string]string{},
+		})
+	}
+}
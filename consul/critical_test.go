@@ -0,0 +1,52 @@
+package consul
+
+import (
+	"context"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+func TestWatchCritical(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		switch req.URL.Path {
+		case "/v1/agent/checks":
+			w.Write([]byte(`{
+				"service:host:web:80": {"CheckID": "service:host:web:80", "Status": "critical", "ServiceID": "host:web:80"},
+				"service:host:db:5432": {"CheckID": "service:host:db:5432", "Status": "passing", "ServiceID": "host:db:5432"}
+			}`))
+		case "/v1/agent/services":
+			w.Write([]byte(`{
+				"host:web:80": {"ID": "host:web:80", "Service": "web", "Port": 8080, "Tags": ["a"]},
+				"host:db:5432": {"ID": "host:db:5432", "Service": "db", "Port": 5432}
+			}`))
+		}
+	}))
+	defer server.Close()
+
+	defer func(interval time.Duration) { criticalPollInterval = interval }(criticalPollInterval)
+	criticalPollInterval = 10 * time.Millisecond
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri).(*ConsulAdapter)
+
+	ctx, cancel := context.WithCancel(context.Background())
+	defer cancel()
+	reported := make(chan *bridge.Service, 10)
+	start := time.Now()
+	go adapter.WatchCritical(ctx, 50*time.Millisecond, func(service *bridge.Service) { reported <- service })
+
+	select {
+	case service := <-reported:
+		assert.True(t, time.Since(start) >= 50*time.Millisecond, "reported before the threshold")
+		assert.Equal(t, "host:web:80", service.ID)
+		assert.Equal(t, "web", service.Name)
+		assert.Equal(t, []string{"a"}, service.Tags)
+	case <-time.After(time.Second):
+		t.Fatal("critical service not reported")
+	}
+}
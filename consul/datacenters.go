@@ -0,0 +1,186 @@
+package consul
+
+import (
+	"errors"
+	"net"
+	"sort"
+	"strings"
+	"time"
+
+	consulapi "github.com/hashicorp/consul/api"
+	"github.com/xytis/registrator/bridge"
+)
+
+// DatacentersEnvName names the environment variable with the comma-separated
+// datacenters services are also registered into, besides the agent's own.
+// The datacenters URI parameter overrides it.
+const DatacentersEnvName = "CONSUL_DATACENTERS"
+
+// remoteCheckPrefix starts the ID of the check of services registered into
+// other datacenters, followed by the service ID.
+const remoteCheckPrefix = "registrator:"
+
+// remoteDatacenterAttr marks a listed service that is registered only in
+// another datacenter, with the name of that datacenter.
+const remoteDatacenterAttr = "remote_datacenter"
+
+// parseDatacenters splits a comma-separated list of datacenters.
+func parseDatacenters(list string) []string {
+	var datacenters []string
+	for _, dc := range strings.Split(list, ",") {
+		if dc = strings.TrimSpace(dc); dc != "" {
+			datacenters = append(datacenters, dc)
+		}
+	}
+	return datacenters
+}
+
+// datacenterErrors are the errors of a call made in several datacenters, by
+// datacenter. The agent's own datacenter is "local".
+type datacenterErrors map[string]error
+
+func (e datacenterErrors) Error() string {
+	failed := make([]string, 0, len(e))
+	for dc, err := range e {
+		failed = append(failed, dc+": "+err.Error())
+	}
+	sort.Strings(failed)
+	return "consul: " + strings.Join(failed, "; ")
+}
+
+// Temporary reports whether any of the errors is a network error or
+// temporary, so the bridge retries the call when a datacenter was unreachable.
+func (e datacenterErrors) Temporary() bool {
+	for _, err := range e {
+		var netErr net.Error
+		if errors.As(err, &netErr) {
+			return true
+		}
+		var temporary interface{ Temporary() bool }
+		if errors.As(err, &temporary) && temporary.Temporary() {
+			return true
+		}
+	}
+	return false
+}
+
+// inDatacenters takes the error of a call to the local agent and runs fn in
+// every other datacenter, returning the errors of all that failed. Without
+// other datacenters the local error is returned as is.
+func (r *ConsulAdapter) inDatacenters(local error, fn func(dc string) error) error {
+	if len(r.datacenters) == 0 {
+		return local
+	}
+	errs := make(datacenterErrors)
+	if local != nil {
+		errs["local"] = local
+	}
+	for _, dc := range r.datacenters {
+		if err := fn(dc); err != nil {
+			errs[dc] = err
+		}
+	}
+	if len(errs) == 0 {
+		return nil
+	}
+	return errs
+}
+
+// node returns the name and address of the agent's node, which services
+// registered into other datacenters are put on.
+func (r *ConsulAdapter) node() (string, string, error) {
+	r.Lock()
+	name, addr := r.nodeName, r.nodeAddr
+	r.Unlock()
+	if name != "" {
+		return name, addr, nil
+	}
+	self, err := r.api().Agent().Self()
+	if err != nil {
+		return "", "", err
+	}
+	name, _ = self["Config"]["NodeName"].(string)
+	addr, _ = self["Config"]["AdvertiseAddr"].(string)
+	if name == "" {
+		return "", "", errors.New("agent did not report its node name")
+	}
+	r.Lock()
+	r.nodeName, r.nodeAddr = name, addr
+	r.Unlock()
+	return name, addr, nil
+}
+
+// registerIn registers the service in the catalog of another datacenter,
+// forwarded there by the agent over the WAN. No agent runs checks of catalog
+// registrations, so the service carries a check whose status Registrator
+// sets itself: passing when registered and refreshed, critical while it is
+// in maintenance.
+func (r *ConsulAdapter) registerIn(dc string, service *bridge.Service) error {
+	node, addr, err := r.node()
+	if err != nil {
+		return err
+	}
+	if addr == "" {
+		addr = service.IP
+	}
+	check := &consulapi.AgentCheck{
+		Node:        node,
+		CheckID:     remoteCheckPrefix + service.ID,
+		Name:        "Registrator",
+		Status:      consulapi.HealthPassing,
+		Output:      "refreshed at " + time.Now().UTC().Format(time.RFC3339),
+		ServiceID:   service.ID,
+		ServiceName: service.Name,
+	}
+	r.Lock()
+	if reason, ok := r.maintenance[service.ID]; ok {
+		check.Status, check.Notes = consulapi.HealthCritical, reason
+	}
+	r.Unlock()
+	registration := &consulapi.CatalogRegistration{
+		Node:       node,
+		Address:    addr,
+		Datacenter: dc,
+		Service: &consulapi.AgentService{
+			ID:      service.ID,
+			Service: service.Name,
+			Tags:    service.Tags,
+			Port:    service.Port,
+			Address: service.IP,
+
+			EnableTagOverride: r.enableTagOverride(service),
+		},
+		Check: check,
+	}
+	_, err = r.in(serviceScope(service)).Catalog().Register(registration, &consulapi.WriteOptions{Datacenter: dc})
+	return err
+}
+
+// remoteServices lists the services on the agent's node in the catalog of
+// another datacenter.
+func (r *ConsulAdapter) remoteServices(s scope, dc string) ([]*consulapi.AgentService, error) {
+	node, _, err := r.node()
+	if err != nil {
+		return nil, err
+	}
+	listed, _, err := r.in(s).Catalog().Node(node, &consulapi.QueryOptions{Datacenter: dc})
+	if err != nil || listed == nil {
+		return nil, err
+	}
+	services := make([]*consulapi.AgentService, 0, len(listed.Services))
+	for _, service := range listed.Services {
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// deregisterIn removes the service from the catalog of another datacenter.
+func (r *ConsulAdapter) deregisterIn(dc string, service *bridge.Service) error {
+	node, _, err := r.node()
+	if err != nil {
+		return err
+	}
+	deregistration := &consulapi.CatalogDeregistration{Node: node, Datacenter: dc, ServiceID: service.ID}
+	_, err = r.in(serviceScope(service)).Catalog().Deregister(deregistration, &consulapi.WriteOptions{Datacenter: dc})
+	return err
+}
@@ -0,0 +1,156 @@
+package consul
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+func TestRegisterIntoDatacenters(t *testing.T) {
+	var lock sync.Mutex
+	catalog := make(map[string]map[string]interface{})
+	var agentCalls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		dc := req.URL.Query().Get("dc")
+		switch req.URL.Path {
+		case "/v1/agent/self":
+			w.Write([]byte(`{"Config": {"NodeName": "node-1", "AdvertiseAddr": "10.0.0.1"}}`))
+		case "/v1/catalog/register":
+			if dc == "dc3" {
+				http.Error(w, "No path to datacenter", http.StatusInternalServerError)
+				return
+			}
+			var body map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&body)
+			catalog[dc] = body
+		case "/v1/catalog/deregister":
+			delete(catalog, dc)
+		default:
+			agentCalls = append(agentCalls, req.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String() + "?datacenters=dc2,dc3")
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.5", Port: 8080, Tags: []string{"a"}, Attrs: map[string]string{}}
+
+	err := adapter.Register(service)
+	assert.Error(t, err)
+	assert.Contains(t, err.Error(), "dc3: ")
+	assert.NotContains(t, err.Error(), "local")
+	assert.Equal(t, []string{"/v1/agent/service/register"}, agentCalls)
+	assert.Len(t, catalog, 1)
+	assert.Equal(t, "node-1", catalog["dc2"]["Node"])
+	assert.Equal(t, "10.0.0.1", catalog["dc2"]["Address"])
+	assert.Equal(t, "dc2", catalog["dc2"]["Datacenter"])
+	registered := catalog["dc2"]["Service"].(map[string]interface{})
+	assert.Equal(t, "host:web:80", registered["ID"])
+	assert.Equal(t, "web", registered["Service"])
+	assert.Equal(t, "10.0.0.5", registered["Address"])
+	assert.Equal(t, 8080.0, registered["Port"])
+	assert.Equal(t, []interface{}{"a"}, registered["Tags"])
+
+	assert.NoError(t, adapter.Deregister(service))
+	assert.Empty(t, catalog)
+	assert.Equal(t, []string{"/v1/agent/service/register", "/v1/agent/service/deregister/host:web:80"}, agentCalls)
+}
+
+func TestDatacenterErrorsTemporary(t *testing.T) {
+	unreachable := &net.OpError{Op: "dial", Net: "tcp", Err: errors.New("connection refused")}
+	assert.True(t, datacenterErrors{"dc2": unreachable, "dc3": errors.New("denied")}.Temporary())
+	assert.False(t, datacenterErrors{"dc3": errors.New("denied")}.Temporary())
+	assert.Equal(t, "consul: dc2: a; local: b", datacenterErrors{"local": errors.New("b"), "dc2": errors.New("a")}.Error())
+}
+
+func TestDatacentersCheckAndListing(t *testing.T) {
+	var lock sync.Mutex
+	catalog := make(map[string]map[string]interface{})
+	var agentCalls []string
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		dc := req.URL.Query().Get("dc")
+		switch req.URL.Path {
+		case "/v1/agent/self":
+			w.Write([]byte(`{"Config": {"NodeName": "node-1", "AdvertiseAddr": "10.0.0.1"}}`))
+		case "/v1/agent/services":
+			w.Write([]byte(`{"host:web:80": {"ID": "host:web:80", "Service": "web"}}`))
+		case "/v1/catalog/node/node-1":
+			w.Write([]byte(`{"Services": {
+				"host:web:80": {"ID": "host:web:80", "Service": "web"},
+				"host:old:80": {"ID": "host:old:80", "Service": "old"}}}`))
+		case "/v1/catalog/register":
+			var body map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&body)
+			catalog[dc] = body
+		case "/v1/catalog/deregister":
+			var body map[string]interface{}
+			json.NewDecoder(req.Body).Decode(&body)
+			catalog[dc] = body
+		default:
+			agentCalls = append(agentCalls, req.URL.Path)
+		}
+	}))
+	defer server.Close()
+
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String() + "?datacenters=dc2")
+	adapter := new(Factory).New(uri)
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.5", Port: 8080, Attrs: map[string]string{}}
+	status := func() interface{} {
+		lock.Lock()
+		defer lock.Unlock()
+		check := catalog["dc2"]["Check"].(map[string]interface{})
+		assert.Equal(t, "registrator:host:web:80", check["CheckID"])
+		assert.Equal(t, "host:web:80", check["ServiceID"])
+		return check["Status"]
+	}
+
+	// the check in other datacenters follows maintenance, also on refreshes
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, "passing", status())
+	maintenance := adapter.(bridge.MaintenanceAdapter)
+	assert.NoError(t, maintenance.Maintenance(service, true, "draining"))
+	assert.Equal(t, "critical", status())
+	lock.Lock()
+	delete(catalog, "dc2")
+	lock.Unlock()
+	assert.NoError(t, adapter.Refresh(service))
+	assert.Equal(t, "critical", status())
+	assert.NoError(t, maintenance.Maintenance(service, false, ""))
+	assert.Equal(t, "passing", status())
+
+	// services left only in another datacenter are listed, and deregistered
+	// there alone
+	services, err := adapter.Services()
+	assert.NoError(t, err)
+	if assert.Len(t, services, 2) {
+		var old *bridge.Service
+		for _, listed := range services {
+			if listed.ID == "host:old:80" {
+				old = listed
+			} else {
+				assert.Empty(t, listed.Attrs)
+			}
+		}
+		if assert.NotNil(t, old) {
+			assert.Equal(t, "dc2", old.Attrs[remoteDatacenterAttr])
+			lock.Lock()
+			agentCalls = nil
+			lock.Unlock()
+			assert.NoError(t, adapter.Deregister(old))
+			assert.Empty(t, agentCalls)
+			assert.Equal(t, "host:old:80", catalog["dc2"]["ServiceID"])
+		}
+	}
+}
@@ -0,0 +1,24 @@
+package consul
+
+import (
+	consulapi "github.com/hashicorp/consul/api"
+)
+
+// stateKeyPrefix is where registrator keeps its own state in the KV store,
+// by host, for -state-backend consul.
+const stateKeyPrefix = "registrator/state/"
+
+// SaveState stores the state of the registrator on host in the KV store.
+func (r *ConsulAdapter) SaveState(host string, state []byte) error {
+	_, err := r.api().KV().Put(&consulapi.KVPair{Key: stateKeyPrefix + host, Value: state}, nil)
+	return err
+}
+
+// LoadState returns the state stored for host, or nil if there is none.
+func (r *ConsulAdapter) LoadState(host string) ([]byte, error) {
+	pair, _, err := r.api().KV().Get(stateKeyPrefix+host, nil)
+	if err != nil || pair == nil {
+		return nil, err
+	}
+	return pair.Value, nil
+}
@@ -0,0 +1,65 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+// fakeKV serves the Consul KV endpoints from memory.
+func fakeKV() (*httptest.Server, map[string][]byte) {
+	var lock sync.Mutex
+	kv := make(map[string][]byte)
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		lock.Lock()
+		defer lock.Unlock()
+		key := strings.TrimPrefix(req.URL.Path, "/v1/kv/")
+		switch req.Method {
+		case "PUT":
+			kv[key], _ = ioutil.ReadAll(req.Body)
+			w.Write([]byte("true"))
+		case "GET":
+			value, ok := kv[key]
+			if !ok {
+				http.NotFound(w, req)
+				return
+			}
+			json.NewEncoder(w).Encode([]map[string]interface{}{{"Key": key, "Value": value}})
+		}
+	}))
+	return server, kv
+}
+
+func TestStateSnapshotRestore(t *testing.T) {
+	server, kv := fakeKV()
+	defer server.Close()
+	uri, _ := url.Parse("consul://" + server.Listener.Addr().String())
+	adapter := new(Factory).New(uri)
+	store, ok := adapter.(bridge.StateStore)
+	if !assert.True(t, ok, "consul adapter is not a state store") {
+		return
+	}
+
+	state, err := store.LoadState("node-1")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+
+	snapshot := []byte(`{"version":1,"host":"node-1","services":{"0123456789abcdef":[{"ID":"node-1:web:80"}]}}`)
+	assert.NoError(t, store.SaveState("node-1", snapshot))
+	assert.Equal(t, snapshot, kv["registrator/state/node-1"])
+
+	state, err = store.LoadState("node-1")
+	assert.NoError(t, err)
+	assert.Equal(t, snapshot, state)
+	state, err = store.LoadState("node-2")
+	assert.NoError(t, err)
+	assert.Nil(t, state)
+}
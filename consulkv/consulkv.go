@@ -1,6 +1,8 @@
 package consul
 
 import (
+	"errors"
+	"fmt"
 	"log"
 	"net"
 	"net/url"
@@ -19,6 +21,13 @@ func init() {
 
 type Factory struct{}
 
+func (f *Factory) Validate(uri *url.URL) error {
+	if uri.Scheme == "consulkv-unix" && !strings.Contains(uri.Path, ":") {
+		return errors.New("socket path and prefix required e.g.: consulkv-unix:///path/to/consul.sock:/prefix")
+	}
+	return nil
+}
+
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	config := consulapi.DefaultConfig()
 	path := uri.Path
@@ -32,7 +41,7 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	if err != nil {
 		log.Fatal("consulkv: ", uri.Scheme)
 	}
-	return &ConsulKVAdapter{client: client, path: path}
+	return &ConsulKVAdapter{client: client, path: strings.Trim(path, "/")}
 }
 
 type ConsulKVAdapter struct {
@@ -53,12 +62,9 @@ func (r *ConsulKVAdapter) Ping() error {
 }
 
 func (r *ConsulKVAdapter) Register(service *bridge.Service) error {
-	log.Println("Register")
-	path := r.path[1:] + "/" + service.Name + "/" + service.ID
 	port := strconv.Itoa(service.Port)
 	addr := net.JoinHostPort(service.IP, port)
-	log.Printf("path: %s", path)
-	_, err := r.client.KV().Put(&consulapi.KVPair{Key: path, Value: []byte(addr)}, nil)
+	_, err := r.client.KV().Put(&consulapi.KVPair{Key: r.servicePath(service), Value: []byte(addr)}, nil)
 	if err != nil {
 		log.Println("consulkv: failed to register service:", err)
 	}
@@ -66,18 +72,81 @@ func (r *ConsulKVAdapter) Register(service *bridge.Service) error {
 }
 
 func (r *ConsulKVAdapter) Deregister(service *bridge.Service) error {
-	path := r.path[1:] + "/" + service.Name + "/" + service.ID
-	_, err := r.client.KV().Delete(path, nil)
+	_, err := r.client.KV().Delete(r.servicePath(service), nil)
 	if err != nil {
 		log.Println("consulkv: failed to deregister service:", err)
 	}
 	return err
 }
 
-func (r *ConsulKVAdapter) Refresh(service *bridge.Service) error {
+// maxTxnOps is the most operations Consul accepts in one transaction.
+const maxTxnOps = 64
+
+// BatchDeregister deletes the keys of many services in as few transactions
+// as Consul allows.
+func (r *ConsulKVAdapter) BatchDeregister(services []*bridge.Service) error {
+	for len(services) > 0 {
+		n := len(services)
+		if n > maxTxnOps {
+			n = maxTxnOps
+		}
+		ops := make(consulapi.KVTxnOps, 0, n)
+		for _, service := range services[:n] {
+			ops = append(ops, &consulapi.KVTxnOp{Verb: consulapi.KVDelete, Key: r.servicePath(service)})
+		}
+		ok, resp, _, err := r.client.KV().Txn(ops, nil)
+		if err == nil && !ok {
+			err = fmt.Errorf("transaction rolled back: %v", resp.Errors)
+		}
+		if err != nil {
+			log.Println("consulkv: failed to deregister services:", err)
+			return err
+		}
+		services = services[n:]
+	}
 	return nil
 }
 
+func (r *ConsulKVAdapter) Refresh(service *bridge.Service) error {
+	return r.Register(service)
+}
+
+// Services lists the services stored under the prefix. Keys that do not
+// follow the <prefix>/<service-name>/<service-id> layout are left out.
 func (r *ConsulKVAdapter) Services() ([]*bridge.Service, error) {
-	return []*bridge.Service{}, nil
+	prefix := r.keyPrefix()
+	pairs, _, err := r.client.KV().List(prefix, nil)
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	services := make([]*bridge.Service, 0, len(pairs))
+	for _, pair := range pairs {
+		parts := strings.Split(strings.TrimPrefix(pair.Key, prefix), "/")
+		if len(parts) != 2 || parts[0] == "" || parts[1] == "" {
+			continue
+		}
+		host, port, err := net.SplitHostPort(string(pair.Value))
+		if err != nil {
+			continue
+		}
+		p, _ := strconv.Atoi(port)
+		services = append(services, &bridge.Service{
+			ID:   parts[1],
+			Name: parts[0],
+			IP:   host,
+			Port: p,
+		})
+	}
+	return services, nil
+}
+
+func (r *ConsulKVAdapter) keyPrefix() string {
+	if r.path == "" {
+		return ""
+	}
+	return r.path + "/"
+}
+
+func (r *ConsulKVAdapter) servicePath(service *bridge.Service) string {
+	return r.keyPrefix() + service.Name + "/" + service.ID
 }
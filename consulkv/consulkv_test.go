@@ -0,0 +1,114 @@
+package consul
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+// fakeKV serves the parts of the Consul KV HTTP API used by the adapter.
+type fakeKV struct {
+	sync.Mutex
+	data map[string][]byte
+	txns int
+}
+
+func (kv *fakeKV) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	kv.Lock()
+	defer kv.Unlock()
+	if req.URL.Path == "/v1/txn" {
+		var ops []struct{ KV struct{ Verb, Key string } }
+		json.NewDecoder(req.Body).Decode(&ops)
+		kv.txns++
+		for _, op := range ops {
+			if op.KV.Verb == "delete" {
+				delete(kv.data, op.KV.Key)
+			}
+		}
+		w.Write([]byte(`{"Results": [], "Errors": null}`))
+		return
+	}
+	key := strings.TrimPrefix(req.URL.Path, "/v1/kv/")
+	switch req.Method {
+	case "PUT":
+		body, _ := ioutil.ReadAll(req.Body)
+		kv.data[key] = body
+		w.Write([]byte("true"))
+	case "DELETE":
+		delete(kv.data, key)
+		w.Write([]byte("true"))
+	case "GET":
+		pairs := make([]map[string]interface{}, 0)
+		for k, v := range kv.data {
+			if strings.HasPrefix(k, key) {
+				pairs = append(pairs, map[string]interface{}{"Key": k, "Value": v})
+			}
+		}
+		if len(pairs) == 0 {
+			w.WriteHeader(http.StatusNotFound)
+			return
+		}
+		json.NewEncoder(w).Encode(pairs)
+	}
+}
+
+func newTestAdapter(t *testing.T, path string) (*ConsulKVAdapter, *fakeKV, func()) {
+	kv := &fakeKV{data: make(map[string][]byte)}
+	server := httptest.NewServer(kv)
+	uri, err := url.Parse("consulkv://" + server.Listener.Addr().String() + path)
+	assert.NoError(t, err)
+	return new(Factory).New(uri).(*ConsulKVAdapter), kv, server.Close
+}
+
+func TestKVLayout(t *testing.T) {
+	adapter, kv, done := newTestAdapter(t, "/services")
+	defer done()
+
+	service := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8080}
+	assert.NoError(t, adapter.Register(service))
+	assert.Equal(t, "10.0.0.1:8080", string(kv.data["services/web/host:web:80"]))
+
+	assert.NoError(t, adapter.Deregister(service))
+	assert.Empty(t, kv.data)
+}
+
+func TestKVServicesScopedToPrefix(t *testing.T) {
+	adapter, kv, done := newTestAdapter(t, "/services")
+	defer done()
+
+	kv.data["services/web/host:web:80"] = []byte("10.0.0.1:8080")
+	kv.data["services/web/extra/key"] = []byte("10.0.0.1:1")
+	kv.data["servicesother/web/host:web:80"] = []byte("10.0.0.2:8080")
+	kv.data["other/web/host:web:80"] = []byte("10.0.0.3:8080")
+
+	services, err := adapter.Services()
+	assert.NoError(t, err)
+	assert.Len(t, services, 1)
+	assert.Equal(t, &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8080}, services[0])
+}
+
+func TestKVBatchDeregister(t *testing.T) {
+	adapter, kv, done := newTestAdapter(t, "/services")
+	defer done()
+
+	var services []*bridge.Service
+	for i := 0; i < maxTxnOps+1; i++ {
+		service := &bridge.Service{ID: "host:web:" + strconv.Itoa(i), Name: "web", IP: "10.0.0.1", Port: 8080}
+		assert.NoError(t, adapter.Register(service))
+		services = append(services, service)
+	}
+	kv.data["services/db/host:db:5432"] = []byte("10.0.0.1:5432")
+
+	assert.NoError(t, adapter.BatchDeregister(services))
+	assert.Equal(t, 2, kv.txns)
+	assert.Len(t, kv.data, 1)
+}
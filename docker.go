@@ -0,0 +1,116 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"net"
+	"net/http"
+	"net/url"
+	"strconv"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+// apiClient is a Docker client that also reads what go-dockerclient leaves
+// out of its types from the API directly: the addresses configured with IPAM
+// for the networks of a container, for -prefer-ipam-address, and the ingress
+// ports of Swarm services, for -swarm-aware.
+type apiClient struct {
+	*dockerapi.Client
+	http *http.Client
+	base string
+}
+
+func newAPIClient(docker *dockerapi.Client) (*apiClient, error) {
+	endpoint, err := url.Parse(docker.Endpoint())
+	if err != nil {
+		return nil, err
+	}
+	transport := &http.Transport{TLSClientConfig: docker.TLSConfig}
+	client := &apiClient{Client: docker, http: &http.Client{Transport: transport}}
+	switch endpoint.Scheme {
+	case "unix":
+		transport.Dial = func(string, string) (net.Conn, error) {
+			return net.Dial("unix", endpoint.Path)
+		}
+		client.base = "http://docker"
+	default:
+		scheme := "http"
+		if docker.TLSConfig != nil {
+			scheme = "https"
+		}
+		client.base = scheme + "://" + endpoint.Host
+	}
+	return client, nil
+}
+
+// InspectIPAM returns the static IPv4 address of each network of the
+// container that has one.
+func (c *apiClient) InspectIPAM(id string) (map[string]string, error) {
+	resp, err := c.http.Get(c.base + "/containers/" + id + "/json")
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("inspecting " + id + ": " + resp.Status)
+	}
+	var inspect struct {
+		NetworkSettings struct {
+			Networks map[string]struct {
+				IPAMConfig *struct {
+					IPv4Address string
+				}
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return nil, err
+	}
+	addresses := make(map[string]string)
+	for name, network := range inspect.NetworkSettings.Networks {
+		if network.IPAMConfig != nil && network.IPAMConfig.IPv4Address != "" {
+			addresses[name] = network.IPAMConfig.IPv4Address
+		}
+	}
+	return addresses, nil
+}
+
+// InspectSwarmPorts returns the published port of each target port, e.g.
+// "80/tcp", the Swarm service publishes on the ingress network.
+func (c *apiClient) InspectSwarmPorts(serviceId string) (map[string]string, error) {
+	resp, err := c.http.Get(c.base + "/services/" + serviceId)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return nil, errors.New("inspecting service " + serviceId + ": " + resp.Status)
+	}
+	var inspect struct {
+		Endpoint struct {
+			Ports []struct {
+				Protocol      string
+				TargetPort    int
+				PublishedPort int
+				PublishMode   string
+			}
+		}
+	}
+	if err := json.NewDecoder(resp.Body).Decode(&inspect); err != nil {
+		return nil, err
+	}
+	ports := make(map[string]string)
+	for _, port := range inspect.Endpoint.Ports {
+		// ports published in host mode show up on the task container
+		if port.PublishedPort == 0 || (port.PublishMode != "" && port.PublishMode != "ingress") {
+			continue
+		}
+		protocol := port.Protocol
+		if protocol == "" {
+			protocol = "tcp"
+		}
+		ports[strconv.Itoa(port.TargetPort)+"/"+protocol] = strconv.Itoa(port.PublishedPort)
+	}
+	return ports, nil
+}
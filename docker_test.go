@@ -0,0 +1,79 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+)
+
+func TestInspectIPAM(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/containers/0123456789ab/json" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(`{"NetworkSettings": {"Networks": {
+			"backend": {"IPAddress": "172.20.0.9", "IPAMConfig": {"IPv4Address": "172.20.0.10"}},
+			"bridge": {"IPAddress": "172.17.0.2", "IPAMConfig": null}
+		}}}`))
+	}))
+	defer server.Close()
+
+	docker, err := dockerapi.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newAPIClient(docker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	addresses, err := client.InspectIPAM("0123456789ab")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"backend": "172.20.0.10"}; !reflect.DeepEqual(addresses, want) {
+		t.Errorf("InspectIPAM() = %v, want %v", addresses, want)
+	}
+	if _, err := client.InspectIPAM("fedcba987654"); err == nil {
+		t.Errorf("InspectIPAM() of a missing container succeeded")
+	}
+}
+
+func TestInspectSwarmPorts(t *testing.T) {
+	server := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, req *http.Request) {
+		if req.URL.Path != "/services/svc1" {
+			http.NotFound(w, req)
+			return
+		}
+		w.Write([]byte(`{"Endpoint": {"Ports": [
+			{"Protocol": "tcp", "TargetPort": 80, "PublishedPort": 8080, "PublishMode": "ingress"},
+			{"Protocol": "udp", "TargetPort": 53, "PublishedPort": 5353, "PublishMode": "ingress"},
+			{"Protocol": "tcp", "TargetPort": 9090, "PublishedPort": 9090, "PublishMode": "host"}
+		]}}`))
+	}))
+	defer server.Close()
+
+	docker, err := dockerapi.NewClient(server.URL)
+	if err != nil {
+		t.Fatal(err)
+	}
+	client, err := newAPIClient(docker)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ports, err := client.InspectSwarmPorts("svc1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if want := map[string]string{"80/tcp": "8080", "53/udp": "5353"}; !reflect.DeepEqual(ports, want) {
+		t.Errorf("InspectSwarmPorts() = %v, want %v", ports, want)
+	}
+	if _, err := client.InspectSwarmPorts("svc2"); err == nil {
+		t.Errorf("InspectSwarmPorts() of a missing service succeeded")
+	}
+}
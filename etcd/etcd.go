@@ -1,6 +1,7 @@
 package etcd
 
 import (
+	"errors"
 	"io/ioutil"
 	"log"
 	"net"
@@ -8,6 +9,8 @@ import (
 	"net/url"
 	"regexp"
 	"strconv"
+	"sync"
+	"time"
 
 	etcd2 "github.com/coreos/go-etcd/etcd"
 	"github.com/xytis/registrator/bridge"
@@ -36,19 +39,46 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	defer res.Body.Close()
 	body, _ := ioutil.ReadAll(res.Body)
 
+	mode := uri.Query().Get("ttl-mode")
 	if match, _ := regexp.Match("0\\.4\\.*", body); match == true {
 		log.Println("etcd: using v0 client")
-		return &EtcdAdapter{client: etcd.NewClient(urls), path: uri.Path}
+		client := etcd.NewClient(urls)
+		return &EtcdAdapter{client: client, kv: &client0{client}, path: uri.Path, mode: mode}
 	}
 
-	return &EtcdAdapter{client2: etcd2.NewClient(urls), path: uri.Path}
+	client := etcd2.NewClient(urls)
+	return &EtcdAdapter{client2: client, kv: &client2{client}, path: uri.Path, mode: mode}
 }
 
+// Validate rejects unknown TTL modes.
+func (f *Factory) Validate(uri *url.URL) error {
+	switch uri.Query().Get("ttl-mode") {
+	case "", keyMode, leaseMode:
+		return nil
+	}
+	return errors.New("ttl-mode must be key or lease")
+}
+
+const (
+	// keyMode gives every key its own TTL, set again on every refresh.
+	keyMode = "key"
+	// leaseMode keeps the keys of this host in one directory whose TTL is
+	// their shared lease, so one request refreshes all of them. etcd v2 has
+	// no leases, a directory TTL expires all keys in it at once the same way.
+	leaseMode = "lease"
+)
+
 type EtcdAdapter struct {
 	client  *etcd.Client
 	client2 *etcd2.Client
+	kv      keyValues
 
 	path string
+	mode string
+
+	sync.Mutex
+	leased  map[string]string // value of every key written under the lease
+	renewed time.Time
 }
 
 func (r *EtcdAdapter) Ping() error {
@@ -70,30 +100,35 @@ func (r *EtcdAdapter) Ping() error {
 }
 
 func (r *EtcdAdapter) syncEtcdCluster() {
-	var result bool
-	if r.client != nil {
-		result = r.client.SyncCluster()
-	} else {
-		result = r.client2.SyncCluster()
+	if !r.kv.SyncCluster() {
+		log.Println("etcd: sync cluster was unsuccessful")
 	}
+}
 
-	if !result {
-		log.Println("etcd: sync cluster was unsuccessful")
+// leasePath is the directory holding the keys of this host in lease mode.
+func (r *EtcdAdapter) leasePath() string {
+	return r.path + "/" + bridge.Hostname
+}
+
+func (r *EtcdAdapter) servicePath(service *bridge.Service) string {
+	if r.mode == leaseMode {
+		return r.leasePath() + "/" + service.Name + "/" + service.ID
 	}
+	return r.path + "/" + service.Name + "/" + service.ID
 }
 
 func (r *EtcdAdapter) Register(service *bridge.Service) error {
 	r.syncEtcdCluster()
 
-	path := r.path + "/" + service.Name + "/" + service.ID
+	path := r.servicePath(service)
 	port := strconv.Itoa(service.Port)
 	addr := net.JoinHostPort(service.IP, port)
 
 	var err error
-	if r.client != nil {
-		_, err = r.client.Set(path, addr, uint64(service.TTL))
+	if r.mode == leaseMode {
+		err = r.registerLeased(path, addr, service.TTL)
 	} else {
-		_, err = r.client2.Set(path, addr, uint64(service.TTL))
+		err = r.kv.Set(path, addr, uint64(service.TTL))
 	}
 
 	if err != nil {
@@ -102,28 +137,131 @@ func (r *EtcdAdapter) Register(service *bridge.Service) error {
 	return err
 }
 
-func (r *EtcdAdapter) Deregister(service *bridge.Service) error {
-	r.syncEtcdCluster()
-
-	path := r.path + "/" + service.Name + "/" + service.ID
+// registerLeased writes a key without a TTL of its own under the lease,
+// taking out the lease first if there is none yet.
+func (r *EtcdAdapter) registerLeased(path, addr string, ttl int) error {
+	r.Lock()
+	defer r.Unlock()
+	if r.renewed.IsZero() {
+		if err := r.renew(ttl); err != nil {
+			return err
+		}
+	}
+	if err := r.kv.Set(path, addr, 0); err != nil {
+		return err
+	}
+	if r.leased == nil {
+		r.leased = make(map[string]string)
+	}
+	r.leased[path] = addr
+	return nil
+}
 
-	var err error
-	if r.client != nil {
-		_, err = r.client.Delete(path, false)
-	} else {
-		_, err = r.client2.Delete(path, false)
+// renew extends the lease, or takes it out again if it expired, which
+// expired all keys under it too, so they are written again. Callers hold the
+// lock.
+func (r *EtcdAdapter) renew(ttl int) error {
+	dir := r.leasePath()
+	if err := r.kv.UpdateDir(dir, uint64(ttl)); err != nil {
+		if err := r.kv.CreateDir(dir, uint64(ttl)); err != nil {
+			return err
+		}
+		if !r.renewed.IsZero() {
+			log.Println("etcd: lease expired, registering", len(r.leased), "keys again")
+		}
+		for path, addr := range r.leased {
+			if err := r.kv.Set(path, addr, 0); err != nil {
+				return err
+			}
+		}
 	}
+	r.renewed = time.Now()
+	return nil
+}
 
+func (r *EtcdAdapter) Deregister(service *bridge.Service) error {
+	r.syncEtcdCluster()
+
+	path := r.servicePath(service)
+	err := r.kv.Delete(path)
 	if err != nil {
 		log.Println("etcd: failed to deregister service:", err)
 	}
+	if r.mode == leaseMode {
+		r.Lock()
+		delete(r.leased, path)
+		r.Unlock()
+	}
 	return err
 }
 
+// Refresh sets the key and its TTL again in key mode. In lease mode the
+// refreshes of all services renew the lease once per half TTL.
 func (r *EtcdAdapter) Refresh(service *bridge.Service) error {
-	return r.Register(service)
+	if r.mode != leaseMode {
+		return r.Register(service)
+	}
+	r.Lock()
+	defer r.Unlock()
+	ttl := time.Duration(service.TTL) * time.Second
+	if !r.renewed.IsZero() && time.Since(r.renewed) < ttl/2 {
+		return nil
+	}
+	if err := r.renew(service.TTL); err != nil {
+		log.Println("etcd: failed to renew lease:", err)
+		return err
+	}
+	return nil
 }
 
 func (r *EtcdAdapter) Services() ([]*bridge.Service, error) {
 	return []*bridge.Service{}, nil
 }
+
+// keyValues is the part of the etcd v0 and v2 clients the adapter writes
+// keys with.
+type keyValues interface {
+	SyncCluster() bool
+	Set(key, value string, ttl uint64) error
+	Delete(key string) error
+	CreateDir(key string, ttl uint64) error
+	UpdateDir(key string, ttl uint64) error
+}
+
+type client0 struct{ *etcd.Client }
+
+func (c *client0) Set(key, value string, ttl uint64) error {
+	_, err := c.Client.Set(key, value, ttl)
+	return err
+}
+func (c *client0) Delete(key string) error {
+	_, err := c.Client.Delete(key, false)
+	return err
+}
+func (c *client0) CreateDir(key string, ttl uint64) error {
+	_, err := c.Client.CreateDir(key, ttl)
+	return err
+}
+func (c *client0) UpdateDir(key string, ttl uint64) error {
+	_, err := c.Client.UpdateDir(key, ttl)
+	return err
+}
+
+type client2 struct{ *etcd2.Client }
+
+func (c *client2) Set(key, value string, ttl uint64) error {
+	_, err := c.Client.Set(key, value, ttl)
+	return err
+}
+func (c *client2) Delete(key string) error {
+	_, err := c.Client.Delete(key, false)
+	return err
+}
+func (c *client2) CreateDir(key string, ttl uint64) error {
+	_, err := c.Client.CreateDir(key, ttl)
+	return err
+}
+func (c *client2) UpdateDir(key string, ttl uint64) error {
+	_, err := c.Client.UpdateDir(key, ttl)
+	return err
+}
@@ -0,0 +1,145 @@
+package etcd
+
+import (
+	"errors"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+// fakeEtcd keeps keys and directories with their TTLs, counting writes.
+type fakeEtcd struct {
+	sync.Mutex
+	keys   map[string]uint64
+	dirs   map[string]uint64
+	writes int
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{keys: make(map[string]uint64), dirs: make(map[string]uint64)}
+}
+
+func (f *fakeEtcd) SyncCluster() bool { return true }
+func (f *fakeEtcd) Set(key, value string, ttl uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	f.writes++
+	f.keys[key] = ttl
+	return nil
+}
+func (f *fakeEtcd) Delete(key string) error {
+	f.Lock()
+	defer f.Unlock()
+	f.writes++
+	delete(f.keys, key)
+	return nil
+}
+func (f *fakeEtcd) CreateDir(key string, ttl uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	f.writes++
+	if _, ok := f.dirs[key]; ok {
+		return errors.New("Key already exists")
+	}
+	f.dirs[key] = ttl
+	return nil
+}
+func (f *fakeEtcd) UpdateDir(key string, ttl uint64) error {
+	f.Lock()
+	defer f.Unlock()
+	f.writes++
+	if _, ok := f.dirs[key]; !ok {
+		return errors.New("Key not found")
+	}
+	f.dirs[key] = ttl
+	return nil
+}
+
+// expire drops a directory and the keys in it, as etcd does once its TTL
+// runs out.
+func (f *fakeEtcd) expire(dir string) {
+	f.Lock()
+	defer f.Unlock()
+	delete(f.dirs, dir)
+	for key := range f.keys {
+		if strings.HasPrefix(key, dir+"/") {
+			delete(f.keys, key)
+		}
+	}
+}
+
+func testServices() []*bridge.Service {
+	return []*bridge.Service{
+		{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8080, TTL: 30},
+		{ID: "host:db:5432", Name: "db", IP: "10.0.0.1", Port: 5432, TTL: 30},
+	}
+}
+
+func TestKeyModeRefresh(t *testing.T) {
+	kv := newFakeEtcd()
+	adapter := &EtcdAdapter{kv: kv, path: "/services"}
+	for _, service := range testServices() {
+		assert.NoError(t, adapter.Register(service))
+	}
+	assert.Equal(t, map[string]uint64{"/services/web/host:web:80": 30, "/services/db/host:db:5432": 30}, kv.keys)
+
+	kv.writes = 0
+	for _, service := range testServices() {
+		assert.NoError(t, adapter.Refresh(service))
+	}
+	assert.Equal(t, 2, kv.writes)
+	assert.Empty(t, kv.dirs)
+}
+
+func TestLeaseModeRefresh(t *testing.T) {
+	bridge.Hostname = "host"
+	kv := newFakeEtcd()
+	adapter := &EtcdAdapter{kv: kv, path: "/services", mode: leaseMode}
+	for _, service := range testServices() {
+		assert.NoError(t, adapter.Register(service))
+	}
+	assert.Equal(t, map[string]uint64{"/services/host": 30}, kv.dirs)
+	assert.Equal(t, map[string]uint64{"/services/host/web/host:web:80": 0, "/services/host/db/host:db:5432": 0}, kv.keys)
+
+	// refreshed within half the TTL, nothing is written
+	kv.writes = 0
+	for _, service := range testServices() {
+		assert.NoError(t, adapter.Refresh(service))
+	}
+	assert.Equal(t, 0, kv.writes)
+
+	// later, one renewal of the lease covers all services
+	adapter.renewed = time.Now().Add(-20 * time.Second)
+	for _, service := range testServices() {
+		assert.NoError(t, adapter.Refresh(service))
+	}
+	assert.Equal(t, 1, kv.writes)
+
+	// an expired lease is taken out again with all its keys
+	kv.expire("/services/host")
+	adapter.renewed = time.Now().Add(-20 * time.Second)
+	assert.NoError(t, adapter.Refresh(testServices()[0]))
+	assert.Len(t, kv.keys, 2)
+	assert.Contains(t, kv.dirs, "/services/host")
+
+	assert.NoError(t, adapter.Deregister(testServices()[1]))
+	assert.Equal(t, map[string]uint64{"/services/host/web/host:web:80": 0}, kv.keys)
+	assert.Len(t, adapter.leased, 1)
+}
+
+func TestValidateTTLMode(t *testing.T) {
+	for uri, valid := range map[string]bool{
+		"etcd://127.0.0.1:4001/services":                true,
+		"etcd://127.0.0.1:4001/services?ttl-mode=key":   true,
+		"etcd://127.0.0.1:4001/services?ttl-mode=lease": true,
+		"etcd://127.0.0.1:4001/services?ttl-mode=lazy":  false,
+	} {
+		parsed, _ := url.Parse(uri)
+		assert.Equal(t, valid, new(Factory).Validate(parsed) == nil, uri)
+	}
+}
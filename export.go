@@ -0,0 +1,134 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"github.com/xytis/registrator/bridge"
+	. "github.com/xytis/registrator/common"
+)
+
+// exportVersion is the version of the export schema, raised on changes
+// readers have to know about.
+const exportVersion = 1
+
+// export is the JSON snapshot of the registered services written by
+// POST /export, for backups, inspection and moving services between
+// backends.
+type export struct {
+	Version  int               `json:"version"`
+	Host     string            `json:"host"`
+	Backend  string            `json:"backend"`
+	Exported time.Time         `json:"exported"`
+	Services []exportedService `json:"services"`
+}
+
+// exportedService is one service of an export.
+type exportedService struct {
+	ID              string            `json:"id"`
+	Name            string            `json:"name"`
+	IP              string            `json:"ip"`
+	Port            int               `json:"port"`
+	Tags            []string          `json:"tags"`
+	Attrs           map[string]string `json:"attrs"`
+	TTL             int               `json:"ttl,omitempty"`
+	Weight          int               `json:"weight,omitempty"`
+	TaggedAddresses map[string]string `json:"tagged_addresses,omitempty"`
+	Container       string            `json:"container"`
+}
+
+// exported is the part of the bridge an export reads.
+type exported interface {
+	Services() []bridge.Service
+	Backend() string
+}
+
+func newExport(b exported, now time.Time) *export {
+	services := b.Services()
+	e := &export{
+		Version:  exportVersion,
+		Host:     bridge.Hostname,
+		Backend:  b.Backend(),
+		Exported: now.UTC(),
+		Services: make([]exportedService, 0, len(services)),
+	}
+	for _, service := range services {
+		tags, attrs := service.Tags, service.Attrs
+		if tags == nil {
+			tags = []string{}
+		}
+		if attrs == nil {
+			attrs = map[string]string{}
+		}
+		e.Services = append(e.Services, exportedService{
+			ID:              service.ID,
+			Name:            service.Name,
+			IP:              service.IP,
+			Port:            service.Port,
+			Tags:            tags,
+			Attrs:           attrs,
+			TTL:             service.TTL,
+			Weight:          service.Weight,
+			TaggedAddresses: service.TaggedAddresses,
+			Container:       service.Origin.ContainerID,
+		})
+	}
+	return e
+}
+
+// writeExport writes the export to path. It is written to a temporary file
+// next to it first and renamed over it, so readers never see a partial
+// export.
+func writeExport(path string, e *export) error {
+	data, err := json.MarshalIndent(e, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	if _, err := tmp.Write(append(data, '\n')); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Chmod(tmp.Name(), 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp.Name(), path)
+}
+
+// exportHandler writes an export to the -export-file on POST.
+type exportHandler struct {
+	path   string
+	bridge exported
+}
+
+func (h *exportHandler) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	e := newExport(h.bridge, time.Now())
+	if err := writeExport(h.path, e); err != nil {
+		Log.Errorln("unable to export services:", err)
+		http.Error(w, "export failed: "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	Log.Infoln("HTTP triggered export of", len(e.Services), "services to", h.path)
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(map[string]interface{}{
+		"operation": "export",
+		"services":  len(e.Services),
+		"file":      h.path,
+	})
+}
@@ -0,0 +1,114 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+
+	"github.com/xytis/registrator/bridge"
+)
+
+type fakeExported struct {
+	services []bridge.Service
+}
+
+func (e *fakeExported) Services() []bridge.Service { return e.services }
+func (e *fakeExported) Backend() string            { return "consul://localhost:8500" }
+
+func TestExportSchema(t *testing.T) {
+	bridge.Hostname = "node-1"
+	defer func() { bridge.Hostname = "" }()
+	b := &fakeExported{[]bridge.Service{
+		{
+			ID: "node-1:web:80", Name: "web", IP: "10.0.0.1", Port: 8080,
+			Tags: []string{"prod"}, Attrs: map[string]string{"region": "us-east"},
+			TTL: 30, Origin: bridge.ServicePort{ContainerID: "0123456789abcdef"},
+		},
+		{
+			ID: "node-1:dns:53:udp", Name: "dns", IP: "10.0.0.1", Port: 5353, Weight: 3,
+			TaggedAddresses: map[string]string{"wan": "203.0.113.1:5353"},
+			Origin:          bridge.ServicePort{ContainerID: "fedcba9876543210"},
+		},
+	}}
+
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	if err := writeExport(path, newExport(b, time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC))); err != nil {
+		t.Fatal(err)
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var got, want interface{}
+	if err := json.Unmarshal(data, &got); err != nil {
+		t.Fatal(err)
+	}
+	json.Unmarshal([]byte(`{
+		"version": 1,
+		"host": "node-1",
+		"backend": "consul://localhost:8500",
+		"exported": "2016-03-01T12:00:00Z",
+		"services": [
+			{"id": "node-1:web:80", "name": "web", "ip": "10.0.0.1", "port": 8080,
+			 "tags": ["prod"], "attrs": {"region": "us-east"}, "ttl": 30, "container": "0123456789abcdef"},
+			{"id": "node-1:dns:53:udp", "name": "dns", "ip": "10.0.0.1", "port": 5353,
+			 "tags": [], "attrs": {}, "weight": 3, "tagged_addresses": {"wan": "203.0.113.1:5353"},
+			 "container": "fedcba9876543210"}
+		]
+	}`), &want)
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("export = %s, want %v", data, want)
+	}
+
+	files, _ := ioutil.ReadDir(dir)
+	if len(files) != 1 {
+		t.Errorf("export left %d files behind, want only the export", len(files))
+	}
+}
+
+func TestExportHandler(t *testing.T) {
+	dir, err := ioutil.TempDir("", "export")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "services.json")
+	handler := &exportHandler{path: path, bridge: &fakeExported{[]bridge.Service{{ID: "a", Name: "web"}}}}
+
+	w := httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("GET", "/export", nil))
+	if w.Code != http.StatusMethodNotAllowed {
+		t.Errorf("GET /export = %d, want %d", w.Code, http.StatusMethodNotAllowed)
+	}
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Errorf("GET /export wrote the export")
+	}
+
+	w = httptest.NewRecorder()
+	handler.ServeHTTP(w, httptest.NewRequest("POST", "/export", nil))
+	if w.Code != http.StatusOK {
+		t.Fatalf("POST /export = %d, want %d", w.Code, http.StatusOK)
+	}
+	var summary map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary["services"] != 1.0 || summary["file"] != path {
+		t.Errorf("summary = %v, want 1 service exported to %s", summary, path)
+	}
+	if _, err := os.Stat(path); err != nil {
+		t.Errorf("POST /export did not write the export: %v", err)
+	}
+}
@@ -0,0 +1,176 @@
+package hosts
+
+import (
+	"bufio"
+	"errors"
+	"io/ioutil"
+	"log"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+
+	"github.com/xytis/registrator/bridge"
+)
+
+func init() {
+	bridge.Register(new(Factory), "hosts")
+}
+
+type Factory struct{}
+
+func (f *Factory) Validate(uri *url.URL) error {
+	if uri.Path == "" {
+		return errors.New("file path required e.g.: hosts:///etc/registrator.hosts")
+	}
+	return nil
+}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	return &HostsAdapter{path: uri.Path}
+}
+
+// HostsAdapter keeps services in a file in /etc/hosts format, one line per
+// service of the form "<ip> <name> # <id>", for a local resolver to read.
+// Lines without an ID comment are left alone.
+type HostsAdapter struct {
+	sync.Mutex
+	path string
+}
+
+type entry struct {
+	line string
+	ip   string
+	name string
+	id   string
+}
+
+// Ping checks the directory of the file exists.
+func (r *HostsAdapter) Ping() error {
+	_, err := os.Stat(filepath.Dir(r.path))
+	return err
+}
+
+func (r *HostsAdapter) Register(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	entries, err := r.read()
+	if err != nil {
+		return err
+	}
+	line := formatEntry(service)
+	found := false
+	for i := range entries {
+		if entries[i].id == service.ID {
+			entries[i].line = line
+			found = true
+		}
+	}
+	if !found {
+		entries = append(entries, entry{line: line})
+	}
+	return r.write(entries)
+}
+
+func (r *HostsAdapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	entries, err := r.read()
+	if err != nil {
+		return err
+	}
+	kept := make([]entry, 0, len(entries))
+	for _, e := range entries {
+		if e.id != service.ID {
+			kept = append(kept, e)
+		}
+	}
+	return r.write(kept)
+}
+
+func (r *HostsAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+// NamesDNS reports that the entries are resolved as host names, for
+// -dns-safe-names.
+func (r *HostsAdapter) NamesDNS() bool {
+	return true
+}
+
+func (r *HostsAdapter) Services() ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+	entries, err := r.read()
+	if err != nil {
+		return []*bridge.Service{}, err
+	}
+	services := make([]*bridge.Service, 0)
+	for _, e := range entries {
+		if e.id != "" {
+			services = append(services, &bridge.Service{ID: e.id, Name: e.name, IP: e.ip})
+		}
+	}
+	return services, nil
+}
+
+func formatEntry(service *bridge.Service) string {
+	return service.IP + " " + service.Name + " # " + service.ID
+}
+
+func parseEntry(line string) entry {
+	e := entry{line: line}
+	fields := strings.Fields(line)
+	if len(fields) == 4 && fields[2] == "#" {
+		e.ip, e.name, e.id = fields[0], fields[1], fields[3]
+	}
+	return e
+}
+
+func (r *HostsAdapter) read() ([]entry, error) {
+	file, err := os.Open(r.path)
+	if os.IsNotExist(err) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+	entries := make([]entry, 0)
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		entries = append(entries, parseEntry(scanner.Text()))
+	}
+	return entries, scanner.Err()
+}
+
+// write replaces the file through a rename, so readers never see it half
+// written.
+func (r *HostsAdapter) write(entries []entry) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(r.path), "."+filepath.Base(r.path))
+	if err != nil {
+		return err
+	}
+	defer os.Remove(tmp.Name())
+	writer := bufio.NewWriter(tmp)
+	for _, e := range entries {
+		writer.WriteString(e.line + "\n")
+	}
+	if err := writer.Flush(); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Chmod(0644); err != nil {
+		tmp.Close()
+		return err
+	}
+	if err := tmp.Close(); err != nil {
+		return err
+	}
+	if err := os.Rename(tmp.Name(), r.path); err != nil {
+		log.Println("hosts: failed to replace", r.path+":", err)
+		return err
+	}
+	return nil
+}
@@ -0,0 +1,46 @@
+package hosts
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+func TestHostsFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "hosts")
+	assert.NoError(t, err)
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "registrator.hosts")
+	assert.NoError(t, ioutil.WriteFile(path, []byte("127.0.0.1 localhost\n"), 0644))
+	adapter := &HostsAdapter{path: path}
+
+	web1 := &bridge.Service{ID: "host1:web:80", Name: "web", IP: "10.0.0.1"}
+	web2 := &bridge.Service{ID: "host2:web:80", Name: "web", IP: "10.0.0.2"}
+	assert.NoError(t, adapter.Ping())
+	assert.NoError(t, adapter.Register(web1))
+	assert.NoError(t, adapter.Register(web2))
+	web1.IP = "10.0.0.3"
+	assert.NoError(t, adapter.Register(web1))
+
+	data, err := ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n10.0.0.3 web # host1:web:80\n10.0.0.2 web # host2:web:80\n", string(data))
+
+	services, err := adapter.Services()
+	assert.NoError(t, err)
+	assert.Equal(t, []*bridge.Service{web1, web2}, services)
+
+	assert.NoError(t, adapter.Deregister(web1))
+	data, err = ioutil.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, "127.0.0.1 localhost\n10.0.0.2 web # host2:web:80\n", string(data))
+
+	// the file is replaced, leaving no temporary files behind
+	files, err := ioutil.ReadDir(dir)
+	assert.NoError(t, err)
+	assert.Len(t, files, 1)
+}
@@ -4,6 +4,8 @@ import (
 	_ "github.com/xytis/registrator/consul"
 	_ "github.com/xytis/registrator/consulkv"
 	_ "github.com/xytis/registrator/etcd"
+	_ "github.com/xytis/registrator/hosts"
 	_ "github.com/xytis/registrator/skydns2"
+	_ "github.com/xytis/registrator/xds"
 	_ "github.com/xytis/registrator/zookeeper"
 )
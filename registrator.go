@@ -1,9 +1,16 @@
 package main
 
 import (
+	"context"
+	"encoding/json"
 	"errors"
+	"io"
+	"log"
 	"os"
-	"time"
+	"os/signal"
+	"regexp"
+	"strings"
+	"syscall"
 
 	dockerapi "github.com/fsouza/go-dockerclient"
 	"github.com/xytis/registrator/bridge"
@@ -12,6 +19,89 @@ import (
 	"github.com/jawher/mow.cli"
 )
 
+var envPattern = regexp.MustCompile(`\$\$|\$\{([A-Za-z_][A-Za-z0-9_]*)\}`)
+
+// expandEnv replaces ${VAR} with the value of the environment variable VAR.
+// $$ stands for a literal $.
+func expandEnv(s string) string {
+	return envPattern.ReplaceAllStringFunc(s, func(match string) string {
+		if match == "$$" {
+			return "$"
+		}
+		return os.Getenv(match[2 : len(match)-1])
+	})
+}
+
+// logLevelFor picks the log level from -log-level, -q, -verbose and -trace.
+// An explicit level wins.
+func logLevelFor(explicit string, quiet, verbose, trace bool) string {
+	switch {
+	case explicit != "":
+		return explicit
+	case trace:
+		return "trace"
+	case verbose:
+		return "debug"
+	case quiet:
+		return "error"
+	}
+	return "info"
+}
+
+// splitList splits a comma-separated flag value, trimming spaces and
+// dropping empty fields, so that an empty value is an empty list.
+func splitList(value string) []string {
+	list := []string{}
+	for _, field := range strings.Split(value, ",") {
+		if field = strings.TrimSpace(field); field != "" {
+			list = append(list, field)
+		}
+	}
+	return list
+}
+
+// flagError names the flag in err.
+func flagError(flag string, err error) error {
+	if err == nil {
+		return nil
+	}
+	return errors.New("-" + flag + " " + err.Error())
+}
+
+// commandOptions are the options the command acts on itself instead of
+// passing them to the bridge, for -dump-config.
+type commandOptions struct {
+	LogFile           string `json:"log_file"`
+	LogFileMaxSize    int    `json:"log_file_max_size"`
+	LogFileMaxBackups int    `json:"log_file_max_backups"`
+	ListenAddr        string `json:"listen_addr"`
+	RPCAddr           string `json:"rpc_addr"`
+	ExportFile        string `json:"export_file"`
+	ConsulTokenFile   string `json:"consul_token_file"`
+	ConsulDatacenters string `json:"consul_datacenters"`
+	ConsulNamespace   string `json:"consul_namespace"`
+	ConsulPartition   string `json:"consul_partition"`
+	TagOverride       bool   `json:"tag_override"`
+}
+
+// dumpConfig writes the effective configuration as JSON, with secrets in the
+// registry URI redacted.
+func dumpConfig(w io.Writer, registry string, options commandOptions, config bridge.Config) error {
+	dump := struct {
+		Registry   string `json:"registry"`
+		DockerHost string `json:"docker_host"`
+		LogLevel   string `json:"log_level"`
+		commandOptions
+		Config bridge.Config `json:"config"`
+	}{bridge.RedactURI(registry), os.Getenv("DOCKER_HOST"), Log.Level.String(), options, config}
+	out, err := json.MarshalIndent(dump, "", "  ")
+	if err != nil {
+		return err
+	}
+	_, err = w.Write(append(out, '\n'))
+	return err
+}
+
 func assert(err error) {
 	if err != nil {
 		Log.Fatalln(err)
@@ -35,16 +125,52 @@ func main() {
 	var (
 		logLevel = app.String(cli.StringOpt{
 			Name:   "log-level",
-			Value:  "info",
-			Desc:   "logging level (debug, info, warning, error)",
+			Value:  "",
+			Desc:   "logging level (trace, debug, info, warning, error), default info",
 			EnvVar: "LOG_LEVEL",
 		})
+		logFile = app.String(cli.StringOpt{
+			Name:   "log-file",
+			Value:  "",
+			Desc:   "File to log to instead of stderr, rotated by size",
+			EnvVar: "LOG_FILE",
+		})
+		logFileMaxSize = app.Int(cli.IntOpt{
+			Name:   "log-file-max-size",
+			Value:  100,
+			Desc:   "Megabytes the -log-file grows to before it is rotated (never if 0)",
+			EnvVar: "LOG_FILE_MAX_SIZE",
+		})
+		logFileMaxBackups = app.Int(cli.IntOpt{
+			Name:   "log-file-max-backups",
+			Value:  3,
+			Desc:   "Rotated -log-file backups to keep",
+			EnvVar: "LOG_FILE_MAX_BACKUPS",
+		})
 		hostIp = app.String(cli.StringOpt{
 			Name:   "ip",
 			Value:  "",
 			Desc:   "IP for ports mapped to the host",
 			EnvVar: "HOST_IP",
 		})
+		hostIpFrom = app.String(cli.StringOpt{
+			Name:   "host-ip-from",
+			Value:  "static",
+			Desc:   "Source of the host IP: static (-ip), interface:<name>, cloud or cloud:public",
+			EnvVar: "HOST_IP_FROM",
+		})
+		ipFromLabel = app.String(cli.StringOpt{
+			Name:   "ip-from-label",
+			Value:  "",
+			Desc:   "Container label holding the IP or hostname to register its services with",
+			EnvVar: "IP_FROM_LABEL",
+		})
+		publishIpFilter = app.String(cli.StringOpt{
+			Name:   "publish-ip-filter",
+			Value:  "",
+			Desc:   "Prefer ports published on this host IP or interface",
+			EnvVar: "PUBLISH_IP_FILTER",
+		})
 		internal = app.Bool(cli.BoolOpt{
 			Name:   "internal",
 			Value:  false,
@@ -57,44 +183,317 @@ func main() {
 			Desc:   "Use container IP's as they are publicly available",
 			EnvVar: "PUBLISH_GLOBAL",
 		})
-		refreshTtl = app.Int(cli.IntOpt{
-			Name:   "ttl-refresh",
-			Value:  0,
-			Desc:   "Frequency with which service TTLs are refreshed",
+		refreshTtlFlag = app.String(cli.StringOpt{
+			Name:   "ttl",
+			Value:  "0",
+			Desc:   "TTL for services, in seconds or as a duration like 30s (default is no expiry)",
 			EnvVar: "REFRESH_TTL",
 		})
-		refreshInterval = app.Int(cli.IntOpt{
-			Name:   "ttl",
-			Value:  0,
-			Desc:   "TTL for services (default is no expiry)",
+		refreshIntervalFlag = app.String(cli.StringOpt{
+			Name:   "ttl-refresh",
+			Value:  "0",
+			Desc:   "Frequency with which service TTLs are refreshed, in seconds or as a duration",
 			EnvVar: "REFRESH_INTERVAL",
 		})
-		resyncInterval = app.Int(cli.IntOpt{
+		restartGraceFlag = app.String(cli.StringOpt{
+			Name:   "restart-grace",
+			Value:  "0",
+			Desc:   "How long to keep services of containers their restart policy restarts registered, in seconds or as a duration (disabled if 0)",
+			EnvVar: "RESTART_GRACE",
+		})
+		shutdownDrainFlag = app.String(cli.StringOpt{
+			Name:   "shutdown-drain",
+			Value:  "0",
+			Desc:   "Seconds or duration to keep services in maintenance on shutdown before deregistering them (0 to leave them registered)",
+			EnvVar: "SHUTDOWN_DRAIN",
+		})
+		unhealthyGraceFlag = app.String(cli.StringOpt{
+			Name:   "unhealthy-grace",
+			Value:  "0",
+			Desc:   "How long a container must stay unhealthy before its services are deregistered, in seconds or as a duration (disabled if 0)",
+			EnvVar: "UNHEALTHY_GRACE",
+		})
+		heartbeatLogsFlag = app.String(cli.StringOpt{
+			Name:   "heartbeat-from-logs",
+			Value:  "0",
+			Desc:   "Log silence after which a container's services are no longer refreshed, in seconds or as a duration (disabled if 0)",
+			EnvVar: "HEARTBEAT_FROM_LOGS",
+		})
+		deregisterCriticalFlag = app.String(cli.StringOpt{
+			Name:   "deregister-critical",
+			Value:  "0",
+			Desc:   "How long a service may stay critical in Consul before it is deregistered if its container is gone, in seconds or as a duration (disabled if 0)",
+			EnvVar: "DEREGISTER_CRITICAL",
+		})
+		startDelayFlag = app.String(cli.StringOpt{
+			Name:   "start-delay",
+			Value:  "0",
+			Desc:   "How long to wait after a container started before registering it, in seconds or as a duration",
+			EnvVar: "START_DELAY",
+		})
+		pingIntervalFlag = app.String(cli.StringOpt{
+			Name:   "backend-health-interval",
+			Value:  "0",
+			Desc:   "Interval between pings of the backend for /health, in seconds or as a duration (disabled if 0)",
+			EnvVar: "BACKEND_HEALTH_INTERVAL",
+		})
+		refreshConcurrency = app.Int(cli.IntOpt{
+			Name:   "refresh-concurrency",
+			Value:  8,
+			Desc:   "Max service TTLs refreshed at once",
+			EnvVar: "REFRESH_CONCURRENCY",
+		})
+		resyncIntervalFlag = app.String(cli.StringOpt{
 			Name:   "resync",
-			Value:  0,
-			Desc:   "Frequency with which services are resynchronized",
+			Value:  "0",
+			Desc:   "Frequency with which services are resynchronized, in seconds or as a duration",
 			EnvVar: "RESYNC_INTERVAL",
 		})
 		retryAttempts = app.Int(cli.IntOpt{
 			Name:   "retry-attempts",
 			Value:  0,
-			Desc:   "Max retry attempts to establish a connection with the backend. Use -1 for infinite retries",
+			Desc:   "Max retry attempts to establish a connection with the backend or of a failed registration. Use -1 for infinite retries",
 			EnvVar: "RETRY_ATTEMPTS",
 		})
-		retryInterval = app.Int(cli.IntOpt{
+		retryIntervalFlag = app.String(cli.StringOpt{
 			Name:   "retry-interval",
-			Value:  2000,
-			Desc:   "Interval (in millisecond) between retry-attempts.",
+			Value:  "2000",
+			Desc:   "Interval between retry-attempts, in milliseconds or as a duration like 2s",
 			EnvVar: "RETRY_INTERVAL",
 		})
+		backendTimeoutFlag = app.String(cli.StringOpt{
+			Name:   "backend-timeout",
+			Value:  "0",
+			Desc:   "How long to wait for a backend call before it counts as failed, in milliseconds or as a duration (no limit if 0)",
+			EnvVar: "BACKEND_TIMEOUT",
+		})
+		consulTokenFile = app.String(cli.StringOpt{
+			Name:   "consul-token-file",
+			Value:  "",
+			Desc:   "File with the Consul ACL token, reloaded when it changes",
+			EnvVar: "CONSUL_HTTP_TOKEN_FILE",
+		})
+		consulDatacenters = app.String(cli.StringOpt{
+			Name:   "consul-datacenters",
+			Value:  "",
+			Desc:   "Comma-separated Consul datacenters to also register services into over the WAN",
+			EnvVar: "CONSUL_DATACENTERS",
+		})
+		consulNamespace = app.String(cli.StringOpt{
+			Name:   "consul-namespace",
+			Value:  "",
+			Desc:   "Consul Enterprise namespace for services without SERVICE_NAMESPACE",
+			EnvVar: "CONSUL_NAMESPACE",
+		})
+		consulPartition = app.String(cli.StringOpt{
+			Name:   "consul-partition",
+			Value:  "",
+			Desc:   "Consul Enterprise admin partition for services without SERVICE_PARTITION",
+			EnvVar: "CONSUL_PARTITION",
+		})
+		tagOverride = app.Bool(cli.BoolOpt{
+			Name:   "tag-override",
+			Value:  false,
+			Desc:   "Set Consul's EnableTagOverride for services without SERVICE_TAG_OVERRIDE",
+			EnvVar: "TAG_OVERRIDE",
+		})
+		inspectRetries = app.Int(cli.IntOpt{
+			Name:   "inspect-retries",
+			Value:  3,
+			Desc:   "Times to re-inspect a started container until its network settings are filled in",
+			EnvVar: "INSPECT_RETRIES",
+		})
+		watchEvents = app.String(cli.StringOpt{
+			Name:   "watch-events",
+			Value:  "start,die,destroy,update",
+			Desc:   "Comma-separated Docker events to act on (start, die, destroy, rename, update, health_status)",
+			EnvVar: "WATCH_EVENTS",
+		})
+		eventWorkers = app.Int(cli.IntOpt{
+			Name:   "event-workers",
+			Value:  0,
+			Desc:   "Docker events handled at once (default two per CPU)",
+			EnvVar: "EVENT_WORKERS",
+		})
+		eventBuffer = app.Int(cli.IntOpt{
+			Name:   "event-buffer",
+			Value:  0,
+			Desc:   "Docker events buffered while workers are busy (default from workers and memory)",
+			EnvVar: "EVENT_BUFFER",
+		})
+		breakerThreshold = app.Int(cli.IntOpt{
+			Name:   "breaker-threshold",
+			Value:  5,
+			Desc:   "Consecutive backend failures before calls are short-circuited (0 to disable)",
+			EnvVar: "BREAKER_THRESHOLD",
+		})
+		breakerCooldownFlag = app.String(cli.StringOpt{
+			Name:   "breaker-cooldown",
+			Value:  "30",
+			Desc:   "Seconds or duration to short-circuit backend calls before probing again",
+			EnvVar: "BREAKER_COOLDOWN",
+		})
+		incrementalCleanupFlag = app.String(cli.StringOpt{
+			Name:   "incremental-cleanup",
+			Value:  "0",
+			Desc:   "With -cleanup, seconds or duration between cleanups of recently changed containers, also cleaned up on die and destroy (disabled if 0)",
+			EnvVar: "INCREMENTAL_CLEANUP",
+		})
+		composeProject = app.String(cli.StringOpt{
+			Name:   "compose-project",
+			Value:  "",
+			Desc:   "Only register containers of this Docker Compose project",
+			EnvVar: "COMPOSE_PROJECT",
+		})
+		ignoreLabels = app.String(cli.StringOpt{
+			Name:   "ignore-labels",
+			Value:  "",
+			Desc:   "Comma-separated labels, as <key>=<value> or <key>, of containers never to register",
+			EnvVar: "IGNORE_LABELS",
+		})
+		ignoreEnv = app.String(cli.StringOpt{
+			Name:   "ignore-env",
+			Value:  "",
+			Desc:   "Comma-separated environment variables, as <name>=<value> or <name>, of containers never to register",
+			EnvVar: "IGNORE_ENV",
+		})
+		ignoreImages = app.String(cli.StringOpt{
+			Name:   "ignore-images",
+			Value:  "",
+			Desc:   "Comma-separated image name patterns, e.g. datadog/*, of containers never to register",
+			EnvVar: "IGNORE_IMAGES",
+		})
+		tagLabelPrefix = app.String(cli.StringOpt{
+			Name:   "tag-label-prefix",
+			Value:  "",
+			Desc:   "Turn container labels with this prefix into service tags",
+			EnvVar: "TAG_LABEL_PREFIX",
+		})
+		serviceFileLabel = app.String(cli.StringOpt{
+			Name:   "service-file-label",
+			Value:  "",
+			Desc:   "Container label naming a JSON file of SERVICE_ metadata on a mount of the container",
+			EnvVar: "SERVICE_FILE_LABEL",
+		})
+		mappingFile = app.String(cli.StringOpt{
+			Name:   "mapping-file",
+			Value:  "",
+			Desc:   "JSON file of rules mapping containers to services, reloaded on SIGHUP",
+			EnvVar: "MAPPING_FILE",
+		})
+		weightFrom = app.String(cli.StringOpt{
+			Name:   "weight-from",
+			Value:  "none",
+			Desc:   "Container limit to weigh services by: none, cpu or memory",
+			EnvVar: "WEIGHT_FROM",
+		})
+		minPort = app.Int(cli.IntOpt{
+			Name:   "min-port",
+			Value:  0,
+			Desc:   "Lowest port to advertise services on, picked by a hash of the service ID",
+			EnvVar: "MIN_PORT",
+		})
+		maxPort = app.Int(cli.IntOpt{
+			Name:   "max-port",
+			Value:  0,
+			Desc:   "Highest port to advertise services on, picked by a hash of the service ID",
+			EnvVar: "MAX_PORT",
+		})
+		maxServices = app.Int(cli.IntOpt{
+			Name:   "max-services",
+			Value:  0,
+			Desc:   "Most services to keep registered, refusing to register more (no limit if 0)",
+			EnvVar: "MAX_SERVICES",
+		})
+		passthroughEnv = app.String(cli.StringOpt{
+			Name:   "passthrough-env",
+			Value:  "",
+			Desc:   "Comma-separated container environment variables to copy into service attributes",
+			EnvVar: "PASSTHROUGH_ENV",
+		})
+		auditLog = app.String(cli.StringOpt{
+			Name:   "audit-log",
+			Value:  "",
+			Desc:   "File to append a JSON line to for every registry change (disabled if empty)",
+			EnvVar: "AUDIT_LOG",
+		})
+		onChangeExec = app.String(cli.StringOpt{
+			Name:   "on-change-exec",
+			Value:  "",
+			Desc:   "Shell command to run once the registered services changed (disabled if empty)",
+			EnvVar: "ON_CHANGE_EXEC",
+		})
+		onChangeDebounceFlag = app.String(cli.StringOpt{
+			Name:   "on-change-debounce",
+			Value:  "1000",
+			Desc:   "How long to wait without changes before running -on-change-exec, in milliseconds or as a duration",
+			EnvVar: "ON_CHANGE_DEBOUNCE",
+		})
+		listenAddr = app.String(cli.StringOpt{
+			Name:   "listen-addr",
+			Value:  "",
+			Desc:   "Address for the HTTP health and metrics endpoints (disabled if empty)",
+			EnvVar: "LISTEN_ADDR",
+		})
+		dnsTTLFlag = app.String(cli.StringOpt{
+			Name:   "dns-ttl",
+			Value:  "0",
+			Desc:   "How long DNS backends let resolvers cache records, unless SERVICE_DNS_TTL is set, in seconds or as a duration (backend default if 0)",
+			EnvVar: "DNS_TTL",
+		})
+		stateBackend = app.String(cli.StringOpt{
+			Name:   "state-backend",
+			Value:  "",
+			Desc:   "Where to keep the registered services across restarts: consul, in the KV store of the consul registry (disabled if empty)",
+			EnvVar: "STATE_BACKEND",
+		})
+		exportFile = app.String(cli.StringOpt{
+			Name:   "export-file",
+			Value:  "",
+			Desc:   "File POST /export on -listen-addr writes the registered services to, as JSON (disabled if empty)",
+			EnvVar: "EXPORT_FILE",
+		})
+		rpcAddr = app.String(cli.StringOpt{
+			Name:   "rpc-addr",
+			Value:  "",
+			Desc:   "Address for the JSON-RPC control API (disabled if empty)",
+			EnvVar: "RPC_ADDR",
+		})
 		forceTags  = app.StringOpt("tags", "", "Append tags for all registered services")
+		tagsSep    = app.StringOpt("tags-separator", ",", "Separator SERVICE_TAGS and -tags are split on")
 		deregister = app.StringOpt("deregister", "always", "Deregister exited services \"always\" or \"on-success\"")
+		success    = app.StringOpt("success-label", "", "Label marking a container as succeeded for -deregister on-success, as <key>=<value>")
+		successBy  = app.StringOpt("success-mode", "override", "How the success label combines with the exit code: override, any or all")
 		cleanup    = app.BoolOpt("cleanup", false, "Remove dangling services")
+		foreign    = app.BoolOpt("cleanup-foreign", false, "Also remove dangling services not tagged as registered by this host")
+		purge      = app.StringOpt("purge-on-start", "", "Deregister all services with this tag, or a tag prefix ending in *, before the first sync")
+		stopped    = app.BoolOpt("register-stopped", false, "Keep services of stopped containers registered in maintenance")
+		restarting = app.BoolOpt("register-restarting", false, "Keep services of containers Docker restarts registered with a warning")
+		hostSvc    = app.BoolOpt("register-host-service", false, "Register a service for this host itself")
+		multiport  = app.BoolOpt("srv-multiport", false, "Register all ports of a container under one service name")
+		protoTags  = app.BoolOpt("protocol-tags", false, "Tag services with _tcp or _udp after the protocol of their port")
+		ociTags    = app.BoolOpt("oci-label-tags", false, "Tag services with the version and revision OCI image labels")
+		useAlias   = app.BoolOpt("use-network-alias", false, "Name services after the container's network alias unless SERVICE_NAME is set")
+		dnsSafe    = app.BoolOpt("dns-safe-names", false, "Lowercase service names and replace characters invalid in DNS with hyphens")
+		ipamAddr   = app.BoolOpt("prefer-ipam-address", false, "Use the static IPAM address of a network over the one assigned at runtime")
+		swarmAware = app.BoolOpt("swarm-aware", false, "Name Swarm tasks after their service and register its ingress ports")
+		primary    = app.BoolOpt("primary-port-only", false, "Register only the primary port of each container")
+		primaryBy  = app.StringOpt("primary-port-by", "named", "How the primary port is picked: named or lowest")
+		quiet      = app.BoolOpt("q quiet", false, "Only log errors, unless -log-level is set")
+		verbose    = app.BoolOpt("verbose", false, "Log debug messages, unless -log-level is set")
+		trace      = app.BoolOpt("trace", false, "Log every Docker event and registration besides debug messages, unless -log-level is set")
+		dump       = app.BoolOpt("dump-config", false, "Print the effective configuration as JSON and exit")
 		registry   = app.StringArg("REGISTRY", "", "Registry url")
 	)
 
 	app.Action = func() {
-		SetLogLevel(*logLevel)
+		SetLogLevel(logLevelFor(*logLevel, *quiet, *verbose, *trace))
+		if *logFile != "" {
+			out, err := NewRotatingFile(*logFile, int64(*logFileMaxSize)<<20, *logFileMaxBackups)
+			assert(err)
+			Log.Out = out
+			log.SetOutput(out) // backends log with the standard logger
+		}
 
 		Log.Infof("Starting registrator %s ...", Version)
 
@@ -102,13 +501,46 @@ func main() {
 			Log.Infoln("Forcing host IP to", *hostIp)
 		}
 
-		if (*refreshTtl == 0 && *refreshInterval > 0) || (*refreshTtl > 0 && *refreshInterval == 0) {
+		refreshTtl, err := bridge.ParseSeconds(*refreshTtlFlag)
+		assert(flagError("ttl", err))
+		refreshInterval, err := bridge.ParseSeconds(*refreshIntervalFlag)
+		assert(flagError("ttl-refresh", err))
+		resyncInterval, err := bridge.ParseSeconds(*resyncIntervalFlag)
+		assert(flagError("resync", err))
+		restartGrace, err := bridge.ParseSeconds(*restartGraceFlag)
+		assert(flagError("restart-grace", err))
+		unhealthyGrace, err := bridge.ParseSeconds(*unhealthyGraceFlag)
+		assert(flagError("unhealthy-grace", err))
+		heartbeatLogs, err := bridge.ParseSeconds(*heartbeatLogsFlag)
+		assert(flagError("heartbeat-from-logs", err))
+		deregisterCritical, err := bridge.ParseSeconds(*deregisterCriticalFlag)
+		assert(flagError("deregister-critical", err))
+		startDelay, err := bridge.ParseSeconds(*startDelayFlag)
+		assert(flagError("start-delay", err))
+		pingInterval, err := bridge.ParseSeconds(*pingIntervalFlag)
+		assert(flagError("backend-health-interval", err))
+		backendTimeout, err := bridge.ParseMillis(*backendTimeoutFlag)
+		assert(flagError("backend-timeout", err))
+		onChangeDebounce, err := bridge.ParseMillis(*onChangeDebounceFlag)
+		assert(flagError("on-change-debounce", err))
+		dnsTTL, err := bridge.ParseSeconds(*dnsTTLFlag)
+		assert(flagError("dns-ttl", err))
+		shutdownDrain, err := bridge.ParseSeconds(*shutdownDrainFlag)
+		assert(flagError("shutdown-drain", err))
+		breakerCooldown, err := bridge.ParseSeconds(*breakerCooldownFlag)
+		assert(flagError("breaker-cooldown", err))
+		incrementalCleanup, err := bridge.ParseSeconds(*incrementalCleanupFlag)
+		assert(flagError("incremental-cleanup", err))
+
+		if (refreshTtl == 0 && refreshInterval > 0) || (refreshTtl > 0 && refreshInterval == 0) {
 			assert(errors.New("-ttl and -ttl-refresh must be specified together or not at all"))
-		} else if *refreshTtl > 0 && *refreshTtl <= *refreshInterval {
+		} else if refreshTtl > 0 && refreshTtl <= refreshInterval {
 			assert(errors.New("-ttl must be greater than -ttl-refresh"))
 		}
 
-		if *retryInterval <= 0 {
+		retryInterval, err := bridge.ParseMillis(*retryIntervalFlag)
+		assert(flagError("retry-interval", err))
+		if retryInterval <= 0 {
 			assert(errors.New("-retry-interval must be greater than 0"))
 		}
 
@@ -117,97 +549,151 @@ func main() {
 			os.Setenv("DOCKER_HOST", "unix:///tmp/docker.sock")
 		}
 
-		docker, err := dockerapi.NewClientFromEnv()
-		assert(err)
+		if *consulTokenFile != "" {
+			os.Setenv("CONSUL_HTTP_TOKEN_FILE", *consulTokenFile)
+		}
+		if *consulDatacenters != "" {
+			os.Setenv("CONSUL_DATACENTERS", *consulDatacenters)
+		}
+		if *consulNamespace != "" {
+			os.Setenv("CONSUL_NAMESPACE", *consulNamespace)
+		}
+		if *consulPartition != "" {
+			os.Setenv("CONSUL_PARTITION", *consulPartition)
+		}
+		if *tagOverride {
+			os.Setenv("CONSUL_TAG_OVERRIDE", "true")
+		}
 
 		if *deregister != "always" && *deregister != "on-success" {
 			assert(errors.New("-deregister must be \"always\" or \"on-success\""))
 		}
 
-		b, err := bridge.New(docker, *registry, bridge.Config{
-			HostIp:          *hostIp,
-			Internal:        *internal,
-			Global:          *global,
-			ForceTags:       *forceTags,
-			RefreshTtl:      *refreshTtl,
-			RefreshInterval: *refreshInterval,
-			DeregisterCheck: *deregister,
-			Cleanup:         *cleanup,
-		})
-
-		assert(err)
-
-		attempt := 0
-		for *retryAttempts == -1 || attempt <= *retryAttempts {
-			Log.Infof("Connecting to backend (%v/%v)", attempt, *retryAttempts)
-
-			err = b.Ping()
-			if err == nil {
-				break
-			}
+		config := bridge.Config{
+			HostIp:             *hostIp,
+			HostIpFrom:         *hostIpFrom,
+			IPFromLabel:        *ipFromLabel,
+			PublishIpFilter:    *publishIpFilter,
+			ComposeProject:     *composeProject,
+			IgnoreLabels:       splitList(*ignoreLabels),
+			IgnoreEnv:          splitList(*ignoreEnv),
+			IgnoreImages:       splitList(*ignoreImages),
+			Internal:           *internal,
+			Global:             *global,
+			ProtocolTags:       *protoTags,
+			ForceTags:          *forceTags,
+			TagsSeparator:      *tagsSep,
+			PassthroughEnv:     splitList(*passthroughEnv),
+			TagLabelPrefix:     *tagLabelPrefix,
+			ServiceFileLabel:   *serviceFileLabel,
+			MappingFile:        *mappingFile,
+			OCILabelTags:       *ociTags,
+			NetworkAlias:       *useAlias,
+			DNSSafeNames:       *dnsSafe,
+			PreferIPAM:         *ipamAddr,
+			SwarmAware:         *swarmAware,
+			StateBackend:       *stateBackend,
+			DNSTTL:             dnsTTL,
+			RefreshTtl:         refreshTtl,
+			RefreshInterval:    refreshInterval,
+			RefreshConcurrency: *refreshConcurrency,
+			ResyncInterval:     resyncInterval,
+			PingInterval:       pingInterval,
+			RetryAttempts:      *retryAttempts,
+			RetryInterval:      retryInterval,
+			BackendTimeout:     backendTimeout,
+			DeregisterCheck:    *deregister,
+			DeregisterCritical: deregisterCritical,
+			RestartGrace:       restartGrace,
+			UnhealthyGrace:     unhealthyGrace,
+			HeartbeatFromLogs:  heartbeatLogs,
+			StartDelay:         startDelay,
+			SuccessLabel:       *success,
+			SuccessMode:        *successBy,
+			Cleanup:            *cleanup,
+			CleanupForeign:     *foreign,
+			IncrementalCleanup: incrementalCleanup,
+			PurgeOnStart:       *purge,
+			RegisterStopped:    *stopped,
+			RegisterRestarting: *restarting,
+			ShutdownDrain:      shutdownDrain,
+			HostService:        *hostSvc,
+			SrvMultiport:       *multiport,
+			PrimaryPortOnly:    *primary,
+			PrimaryPortBy:      *primaryBy,
+			WeightFrom:         *weightFrom,
+			MinPort:            *minPort,
+			MaxPort:            *maxPort,
+			MaxServices:        *maxServices,
+			InspectRetries:     *inspectRetries,
+			EventWorkers:       *eventWorkers,
+			EventBuffer:        *eventBuffer,
+			WatchEvents:        splitList(*watchEvents),
+			BreakerThreshold:   *breakerThreshold,
+			BreakerCooldown:    breakerCooldown,
+			AuditLog:           *auditLog,
+			OnChangeExec:       *onChangeExec,
+			OnChangeDebounce:   onChangeDebounce,
+		}
 
-			if err != nil && attempt == *retryAttempts {
-				assert(err)
+		if *dump {
+			options := commandOptions{
+				LogFile:           *logFile,
+				LogFileMaxSize:    *logFileMaxSize,
+				LogFileMaxBackups: *logFileMaxBackups,
+				ListenAddr:        *listenAddr,
+				RPCAddr:           *rpcAddr,
+				ExportFile:        *exportFile,
+				ConsulTokenFile:   *consulTokenFile,
+				ConsulDatacenters: *consulDatacenters,
+				ConsulNamespace:   *consulNamespace,
+				ConsulPartition:   *consulPartition,
+				TagOverride:       *tagOverride,
 			}
-
-			time.Sleep(time.Duration(*retryInterval) * time.Millisecond)
-			attempt++
+			assert(dumpConfig(os.Stdout, expandEnv(*registry), options, config))
+			return
 		}
 
-		// Start event listener before listing containers to avoid missing anything
-		events := make(chan *dockerapi.APIEvents)
-		assert(docker.AddEventListener(events))
-		Log.Infoln("Listening for Docker events ...")
+		docker, err := dockerapi.NewClientFromEnv()
+		assert(err)
+		var client bridge.DockerClient = docker
+		if *ipamAddr || *swarmAware {
+			client, err = newAPIClient(docker)
+			assert(err)
+		}
 
-		b.Sync(false)
+		b, err := bridge.New(client, expandEnv(*registry), config)
 
-		quit := make(chan struct{})
+		assert(err)
 
-		// Start the TTL refresh timer
-		if *refreshInterval > 0 {
-			ticker := time.NewTicker(time.Duration(*refreshInterval) * time.Second)
-			go func() {
-				for {
-					select {
-					case <-ticker.C:
-						b.Refresh()
-					case <-quit:
-						ticker.Stop()
-						return
-					}
-				}
-			}()
+		ops := newTriggers(b)
+		if *listenAddr != "" {
+			serve(*listenAddr, *exportFile, b, ops)
+		}
+		if *rpcAddr != "" {
+			serveRPC(*rpcAddr, b, ops)
 		}
 
-		// Start the resync timer if enabled
-		if *resyncInterval > 0 {
-			resyncTicker := time.NewTicker(time.Duration(*resyncInterval) * time.Second)
+		ctx, cancel := context.WithCancel(context.Background())
+		signals := make(chan os.Signal, 1)
+		signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM)
+		go func() {
+			<-signals
+			cancel()
+		}()
+		if *mappingFile != "" {
+			hangups := make(chan os.Signal, 1)
+			signal.Notify(hangups, syscall.SIGHUP)
 			go func() {
-				for {
-					select {
-					case <-resyncTicker.C:
-						b.Sync(true)
-					case <-quit:
-						resyncTicker.Stop()
-						return
+				for range hangups {
+					if err := b.ReloadMapping(); err != nil {
+						Log.Errorln("unable to reload mapping file:", err)
 					}
 				}
 			}()
 		}
 
-		// Process Docker events
-		for msg := range events {
-			switch msg.Status {
-			case "start":
-				go b.Add(msg.ID)
-			case "die":
-				go b.RemoveOnExit(msg.ID)
-			}
-		}
-
-		close(quit)
-		Log.Fatalln("Docker event loop closed") // todo: reconnect?
-
+		assert(b.Run(ctx)) // todo: reconnect when the event loop closes?
 	}
 	app.Run(os.Args)
 }
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/rpc"
+	"net/rpc/jsonrpc"
+	"time"
+
+	"github.com/xytis/registrator/bridge"
+	. "github.com/xytis/registrator/common"
+)
+
+// controlled is the part of the bridge the control API drives.
+type controlled interface {
+	counter
+	Services() []bridge.Service
+	Sync(quiet bool)
+	Refresh()
+	Changes(since uint64, wait time.Duration) ([]bridge.Change, uint64)
+}
+
+// control is the JSON-RPC API served on -rpc-addr, for control planes
+// driving registrator. Its methods are called as Registrator.<Method>.
+type control struct {
+	bridge controlled
+	ops    triggers
+}
+
+// ServiceInfo is a registered service as listed by ListServices.
+type ServiceInfo struct {
+	ID        string
+	Name      string
+	IP        string
+	Port      int
+	Tags      []string
+	Container string
+}
+
+// RunReply summarizes a ForceSync or ForceRefresh.
+type RunReply struct {
+	Services int
+	Errors   uint64
+	Took     string
+}
+
+// WatchArgs asks for the changes after version Since, waiting up to Wait
+// milliseconds for one; 0 or more than maxWatchWait waits maxWatchWait.
+type WatchArgs struct {
+	Since uint64
+	Wait  int
+}
+
+// WatchReply holds the changes after the requested version and the latest
+// version, to watch from next.
+type WatchReply struct {
+	Version uint64
+	Changes []bridge.Change
+}
+
+const maxWatchWait = 30 * time.Second
+
+func (c *control) ListServices(_ *struct{}, reply *[]ServiceInfo) error {
+	services := c.bridge.Services()
+	infos := make([]ServiceInfo, 0, len(services))
+	for _, service := range services {
+		infos = append(infos, ServiceInfo{
+			ID:        service.ID,
+			Name:      service.Name,
+			IP:        service.IP,
+			Port:      service.Port,
+			Tags:      service.Tags,
+			Container: service.Origin.ContainerID,
+		})
+	}
+	*reply = infos
+	return nil
+}
+
+func (c *control) ForceSync(_ *struct{}, reply *RunReply) error {
+	Log.Infoln("RPC triggered sync")
+	return c.fire(c.ops.sync, reply)
+}
+
+func (c *control) ForceRefresh(_ *struct{}, reply *RunReply) error {
+	Log.Infoln("RPC triggered refresh")
+	return c.fire(c.ops.refresh, reply)
+}
+
+func (c *control) fire(t *trigger, reply *RunReply) error {
+	run, ok := t.fire()
+	if !ok {
+		return errors.New(t.name + " already running")
+	}
+	*reply = run
+	return nil
+}
+
+func (c *control) GetStats(_ *struct{}, reply *map[string]interface{}) error {
+	*reply = statsSummary(c.bridge.Stats())
+	return nil
+}
+
+// WatchChanges long-polls for registry changes. Calling it again with the
+// returned version streams all changes.
+func (c *control) WatchChanges(args *WatchArgs, reply *WatchReply) error {
+	wait := time.Duration(args.Wait) * time.Millisecond
+	if wait <= 0 || wait > maxWatchWait {
+		wait = maxWatchWait
+	}
+	changes, version := c.bridge.Changes(args.Since, wait)
+	*reply = WatchReply{Version: version, Changes: changes}
+	return nil
+}
+
+func newRPCServer(b controlled, ops triggers) *rpc.Server {
+	server := rpc.NewServer()
+	server.RegisterName("Registrator", &control{b, ops})
+	return server
+}
+
+// serveRPC starts the JSON-RPC control API, one JSON-RPC 1.0 connection per
+// TCP connection.
+func serveRPC(addr string, b controlled, ops triggers) {
+	listener, err := net.Listen("tcp", addr)
+	if err != nil {
+		Log.Fatalln(err)
+	}
+	server := newRPCServer(b, ops)
+	Log.Infoln("Listening for JSON-RPC on", addr)
+	go func() {
+		for {
+			conn, err := listener.Accept()
+			if err != nil {
+				Log.Errorln("rpc accept failed:", err)
+				time.Sleep(100 * time.Millisecond)
+				continue
+			}
+			go server.ServeCodec(jsonrpc.NewServerCodec(conn))
+		}
+	}()
+}
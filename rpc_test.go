@@ -0,0 +1,97 @@
+package main
+
+import (
+	"net"
+	"net/http/httptest"
+	"net/rpc/jsonrpc"
+	"testing"
+	"time"
+
+	"github.com/xytis/registrator/bridge"
+)
+
+type fakeControlled struct {
+	fakeCounter
+	services []bridge.Service
+	syncs    int
+	changes  []bridge.Change
+}
+
+func (c *fakeControlled) Services() []bridge.Service { return c.services }
+func (c *fakeControlled) Sync(quiet bool)            { c.syncs++ }
+func (c *fakeControlled) Refresh()                   {}
+
+func (c *fakeControlled) Changes(since uint64, wait time.Duration) ([]bridge.Change, uint64) {
+	var changes []bridge.Change
+	for _, change := range c.changes {
+		if change.Version > since {
+			changes = append(changes, change)
+		}
+	}
+	return changes, uint64(len(c.changes))
+}
+
+func TestRPCListServices(t *testing.T) {
+	controlled := &fakeControlled{services: []bridge.Service{{
+		ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8080, Tags: []string{"a"},
+		Origin: bridge.ServicePort{ContainerID: "0123456789abcdef"},
+	}}}
+	serverConn, clientConn := net.Pipe()
+	go newRPCServer(controlled, newTriggers(controlled)).ServeCodec(jsonrpc.NewServerCodec(serverConn))
+	client := jsonrpc.NewClient(clientConn)
+	defer client.Close()
+
+	var services []ServiceInfo
+	if err := client.Call("Registrator.ListServices", struct{}{}, &services); err != nil {
+		t.Fatal(err)
+	}
+	want := ServiceInfo{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8080, Tags: []string{"a"}, Container: "0123456789abcdef"}
+	if len(services) != 1 || services[0].ID != want.ID || services[0].IP != want.IP || services[0].Port != want.Port || services[0].Container != want.Container || len(services[0].Tags) != 1 {
+		t.Errorf("ListServices = %+v, want [%+v]", services, want)
+	}
+
+	var run RunReply
+	if err := client.Call("Registrator.ForceSync", struct{}{}, &run); err != nil || controlled.syncs != 1 {
+		t.Errorf("ForceSync = %v after %d syncs, want one sync", err, controlled.syncs)
+	}
+
+	controlled.changes = []bridge.Change{{Version: 1, Action: "register", Service: "a"}, {Version: 2, Action: "deregister", Service: "a"}}
+	var watch WatchReply
+	if err := client.Call("Registrator.WatchChanges", WatchArgs{Since: 1}, &watch); err != nil {
+		t.Fatal(err)
+	}
+	if watch.Version != 2 || len(watch.Changes) != 1 || watch.Changes[0].Action != "deregister" {
+		t.Errorf("WatchChanges since 1 = %+v, want the deregistration at version 2", watch)
+	}
+}
+
+func TestRPCSharesTriggers(t *testing.T) {
+	controlled := &fakeControlled{}
+	ops := newTriggers(controlled)
+	started, release := make(chan bool), make(chan bool)
+	ops.refresh.run = func() {
+		started <- true
+		<-release
+	}
+	serverConn, clientConn := net.Pipe()
+	go newRPCServer(controlled, ops).ServeCodec(jsonrpc.NewServerCodec(serverConn))
+	client := jsonrpc.NewClient(clientConn)
+	defer client.Close()
+
+	done := make(chan bool)
+	go func() {
+		ops.refresh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/refresh", nil))
+		done <- true
+	}()
+	<-started
+
+	var run RunReply
+	if err := client.Call("Registrator.ForceRefresh", struct{}{}, &run); err == nil {
+		t.Errorf("ForceRefresh during an HTTP refresh succeeded, want it turned away")
+	}
+	close(release)
+	<-done
+	if err := client.Call("Registrator.ForceSync", struct{}{}, &run); err != nil || controlled.syncs != 1 {
+		t.Errorf("ForceSync = %v after %d syncs, want one sync", err, controlled.syncs)
+	}
+}
@@ -0,0 +1,143 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"sync/atomic"
+	"time"
+
+	"github.com/xytis/registrator/bridge"
+	. "github.com/xytis/registrator/common"
+)
+
+// serve starts the HTTP server for health and metrics endpoints. With an
+// export file, POST /export writes the registered services to it.
+func serve(addr, exportFile string, b *bridge.Bridge, ops triggers) {
+	mux := http.NewServeMux()
+	mux.HandleFunc("/health", func(w http.ResponseWriter, r *http.Request) {
+		state := b.BreakerState()
+		health := map[string]string{
+			"backend": b.Backend(),
+			"breaker": state.String(),
+		}
+		status := http.StatusOK
+		if state == bridge.BreakerOpen {
+			status = http.StatusServiceUnavailable
+		}
+		if err := b.LastPingError(); err != nil {
+			status = http.StatusServiceUnavailable
+			health["error"] = err.Error()
+		}
+		w.Header().Set("Content-Type", "application/json")
+		w.WriteHeader(status)
+		json.NewEncoder(w).Encode(health)
+	})
+	mux.HandleFunc("/metrics", func(w http.ResponseWriter, r *http.Request) {
+		publishStats(b.Stats())
+		w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+		Metrics.Write(w)
+	})
+	mux.HandleFunc("/stats", func(w http.ResponseWriter, r *http.Request) {
+		w.Header().Set("Content-Type", "application/json")
+		json.NewEncoder(w).Encode(statsSummary(b.Stats()))
+	})
+
+	mux.Handle("/sync", ops.sync)
+	mux.Handle("/refresh", ops.refresh)
+	if exportFile != "" {
+		mux.Handle("/export", &exportHandler{path: exportFile, bridge: b})
+	}
+
+	Log.Infoln("Listening for HTTP on", addr)
+	go func() {
+		Log.Fatalln(http.ListenAndServe(addr, mux))
+	}()
+}
+
+// publishStats sets the gauges of the bridge stats for /metrics.
+func publishStats(stats bridge.Stats) {
+	Metrics.Set("registrator_services", float64(stats.Services))
+	Metrics.Set("registrator_containers", float64(stats.Containers))
+	Metrics.Set("registrator_backend_errors_total", float64(stats.BackendErrors))
+	if !stats.LastSync.IsZero() {
+		Metrics.Set("registrator_last_sync_timestamp_seconds", float64(stats.LastSync.Unix()))
+	}
+}
+
+// statsSummary is the /stats answer.
+func statsSummary(stats bridge.Stats) map[string]interface{} {
+	summary := map[string]interface{}{
+		"services":         stats.Services,
+		"containers":       stats.Containers,
+		"errors":           stats.BackendErrors,
+		"refresh_duration": stats.RefreshDuration.String(),
+	}
+	if !stats.LastSync.IsZero() {
+		summary["last_sync"] = stats.LastSync.UTC().Format(time.RFC3339)
+	}
+	return summary
+}
+
+// counter is the part of the bridge a trigger summarizes.
+type counter interface {
+	Stats() bridge.Stats
+}
+
+// trigger runs a bridge operation on request and summarizes it. Requests
+// arriving while the operation runs are turned away as busy.
+type trigger struct {
+	name    string
+	bridge  counter
+	run     func()
+	running int32
+}
+
+// triggers are the operations the HTTP and control APIs share, so that one
+// running through either API turns the other away as busy too.
+type triggers struct {
+	sync, refresh *trigger
+}
+
+func newTriggers(b controlled) triggers {
+	return triggers{
+		sync:    &trigger{name: "sync", bridge: b, run: func() { b.Sync(true) }},
+		refresh: &trigger{name: "refresh", bridge: b, run: b.Refresh},
+	}
+}
+
+// fire runs the operation if it isn't already running, reporting whether it
+// did.
+func (t *trigger) fire() (RunReply, bool) {
+	if !atomic.CompareAndSwapInt32(&t.running, 0, 1) {
+		return RunReply{}, false
+	}
+	defer atomic.StoreInt32(&t.running, 0)
+
+	failed := t.bridge.Stats().BackendErrors
+	start := time.Now()
+	t.run()
+	stats := t.bridge.Stats()
+	return RunReply{Services: stats.Services, Errors: stats.BackendErrors - failed, Took: time.Since(start).String()}, true
+}
+
+func (t *trigger) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	Log.Infoln("HTTP triggered", t.name)
+	reply, ok := t.fire()
+	if !ok {
+		http.Error(w, t.name+" already running", http.StatusConflict)
+		return
+	}
+	summary := map[string]interface{}{
+		"operation": t.name,
+		"services":  reply.Services,
+		"errors":    reply.Errors,
+		"took":      reply.Took,
+	}
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(summary)
+}
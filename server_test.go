@@ -0,0 +1,151 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	dockerapi "github.com/fsouza/go-dockerclient"
+	"github.com/xytis/registrator/bridge"
+	. "github.com/xytis/registrator/common"
+)
+
+type fakeCounter struct {
+	services int
+	errors   uint64
+}
+
+func (c *fakeCounter) Stats() bridge.Stats {
+	return bridge.Stats{Services: c.services, BackendErrors: c.errors}
+}
+
+func TestSyncTrigger(t *testing.T) {
+	counter := &fakeCounter{errors: 3}
+	syncs := 0
+	sync := &trigger{name: "sync", bridge: counter, run: func() {
+		syncs++
+		counter.services = 2
+		counter.errors++
+	}}
+
+	w := httptest.NewRecorder()
+	sync.ServeHTTP(w, httptest.NewRequest("GET", "/sync", nil))
+	if w.Code != http.StatusMethodNotAllowed || syncs != 0 {
+		t.Errorf("GET /sync = %d after %d syncs, want %d after none", w.Code, syncs, http.StatusMethodNotAllowed)
+	}
+
+	w = httptest.NewRecorder()
+	sync.ServeHTTP(w, httptest.NewRequest("POST", "/sync", nil))
+	if w.Code != http.StatusOK || syncs != 1 {
+		t.Fatalf("POST /sync = %d after %d syncs, want %d after one", w.Code, syncs, http.StatusOK)
+	}
+	var summary map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	if summary["operation"] != "sync" || summary["services"] != 2.0 || summary["errors"] != 1.0 {
+		t.Errorf("summary = %v, want sync of 2 services with 1 error", summary)
+	}
+}
+
+func TestTriggerBusy(t *testing.T) {
+	started, release := make(chan bool), make(chan bool)
+	refresh := &trigger{name: "refresh", bridge: &fakeCounter{}, run: func() {
+		started <- true
+		<-release
+	}}
+
+	done := make(chan bool)
+	go func() {
+		refresh.ServeHTTP(httptest.NewRecorder(), httptest.NewRequest("POST", "/refresh", nil))
+		done <- true
+	}()
+	<-started
+
+	w := httptest.NewRecorder()
+	refresh.ServeHTTP(w, httptest.NewRequest("POST", "/refresh", nil))
+	if w.Code != http.StatusConflict {
+		t.Errorf("concurrent POST /refresh = %d, want %d", w.Code, http.StatusConflict)
+	}
+	close(release)
+	<-done
+}
+
+// oneContainer is a Docker client running a single container.
+type oneContainer struct {
+	container *dockerapi.Container
+}
+
+func (d *oneContainer) InspectContainer(id string) (*dockerapi.Container, error) {
+	if id != d.container.ID {
+		return nil, &dockerapi.NoSuchContainer{ID: id}
+	}
+	return d.container, nil
+}
+
+func (d *oneContainer) InspectImage(name string) (*dockerapi.Image, error) {
+	return nil, dockerapi.ErrNoSuchImage
+}
+
+func (d *oneContainer) ListContainers(opts dockerapi.ListContainersOptions) ([]dockerapi.APIContainers, error) {
+	return []dockerapi.APIContainers{{ID: d.container.ID, State: "running"}}, nil
+}
+
+func (d *oneContainer) AddEventListener(listener chan<- *dockerapi.APIEvents) error  { return nil }
+func (d *oneContainer) RemoveEventListener(listener chan *dockerapi.APIEvents) error { return nil }
+
+func TestSyncTriggerRegistersInMemory(t *testing.T) {
+	docker := &oneContainer{&dockerapi.Container{
+		ID:         "0123456789abcdef",
+		Name:       "/web",
+		Config:     &dockerapi.Config{Image: "nginx"},
+		HostConfig: &dockerapi.HostConfig{},
+		State:      dockerapi.State{Running: true},
+		NetworkSettings: &dockerapi.NetworkSettings{Ports: map[dockerapi.Port][]dockerapi.PortBinding{
+			"80/tcp": {{HostIP: "10.0.0.1", HostPort: "8080"}},
+		}},
+	}}
+	b, err := bridge.New(docker, "memory://sync-trigger", bridge.Config{HostIp: "10.0.0.1"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	memory := bridge.Memory("sync-trigger")
+	defer memory.Reset()
+
+	w := httptest.NewRecorder()
+	newTriggers(b).sync.ServeHTTP(w, httptest.NewRequest("POST", "/sync", nil))
+	var summary map[string]interface{}
+	if err := json.NewDecoder(w.Body).Decode(&summary); err != nil {
+		t.Fatal(err)
+	}
+	registered := memory.Registered()
+	if len(registered) != 1 || registered[0].Name != "nginx" || registered[0].Port != 8080 {
+		t.Fatalf("registered %v, want nginx on port 8080", registered)
+	}
+	if summary["services"] != 1.0 || summary["errors"] != 0.0 {
+		t.Errorf("summary = %v, want 1 service without errors", summary)
+	}
+}
+
+func TestStatsEndpoints(t *testing.T) {
+	synced := time.Date(2016, 3, 1, 12, 0, 0, 0, time.UTC)
+	stats := bridge.Stats{Services: 3, Containers: 2, LastSync: synced, RefreshDuration: 1500 * time.Millisecond, BackendErrors: 4}
+
+	publishStats(stats)
+	if Metrics.Value("registrator_services") != 3 || Metrics.Value("registrator_containers") != 2 {
+		t.Errorf("service and container gauges = %v and %v, want 3 and 2", Metrics.Value("registrator_services"), Metrics.Value("registrator_containers"))
+	}
+	if Metrics.Value("registrator_last_sync_timestamp_seconds") != float64(synced.Unix()) {
+		t.Errorf("last sync gauge = %v, want %v", Metrics.Value("registrator_last_sync_timestamp_seconds"), synced.Unix())
+	}
+
+	summary := statsSummary(stats)
+	if summary["last_sync"] != "2016-03-01T12:00:00Z" || summary["refresh_duration"] != "1.5s" || summary["errors"] != uint64(4) {
+		t.Errorf("summary = %v", summary)
+	}
+	if _, ok := statsSummary(bridge.Stats{})["last_sync"]; ok {
+		t.Errorf("summary before the first sync has a last sync time")
+	}
+}
@@ -1,6 +1,8 @@
 package skydns2
 
 import (
+	"encoding/json"
+	"errors"
 	"log"
 	"net/url"
 	"strconv"
@@ -16,6 +18,13 @@ func init() {
 
 type Factory struct{}
 
+func (f *Factory) Validate(uri *url.URL) error {
+	if len(uri.Path) < 2 {
+		return errors.New("dns domain required e.g.: skydns2://<host>/<domain>")
+	}
+	return nil
+}
+
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	urls := make([]string, 0)
 	if uri.Host != "" {
@@ -29,8 +38,15 @@ func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	return &Skydns2Adapter{client: etcd.NewClient(urls), path: domainPath(uri.Path[1:])}
 }
 
+// etcdClient is the part of *etcd.Client the adapter uses.
+type etcdClient interface {
+	SendRequest(rr *etcd.RawRequest) (*etcd.RawResponse, error)
+	Set(key, value string, ttl uint64) (*etcd.Response, error)
+	Delete(key string, recursive bool) (*etcd.Response, error)
+}
+
 type Skydns2Adapter struct {
-	client *etcd.Client
+	client etcdClient
 	path   string
 }
 
@@ -44,9 +60,11 @@ func (r *Skydns2Adapter) Ping() error {
 }
 
 func (r *Skydns2Adapter) Register(service *bridge.Service) error {
-	port := strconv.Itoa(service.Port)
-	record := `{"host":"` + service.IP + `","port":` + port + `}`
-	_, err := r.client.Set(r.servicePath(service), record, uint64(service.TTL))
+	record, err := serviceRecord(service)
+	if err != nil {
+		return err
+	}
+	_, err = r.client.Set(r.servicePath(service), record, uint64(service.TTL))
 	if err != nil {
 		log.Println("skydns2: failed to register service:", err)
 	}
@@ -56,7 +74,7 @@ func (r *Skydns2Adapter) Register(service *bridge.Service) error {
 func (r *Skydns2Adapter) Deregister(service *bridge.Service) error {
 	_, err := r.client.Delete(r.servicePath(service), false)
 	if err != nil {
-		log.Println("skydns2: failed to register service:", err)
+		log.Println("skydns2: failed to deregister service:", err)
 	}
 	return err
 }
@@ -65,18 +83,58 @@ func (r *Skydns2Adapter) Refresh(service *bridge.Service) error {
 	return r.Register(service)
 }
 
+// NamesDNS reports that SkyDNS serves the services by name, for
+// -dns-safe-names.
+func (r *Skydns2Adapter) NamesDNS() bool {
+	return true
+}
+
 func (r *Skydns2Adapter) Services() ([]*bridge.Service, error) {
 	return []*bridge.Service{}, nil
 }
 
+type record struct {
+	Host     string `json:"host"`
+	Port     int    `json:"port"`
+	Priority int    `json:"priority,omitempty"`
+	Weight   int    `json:"weight,omitempty"`
+	TTL      int    `json:"ttl,omitempty"`
+}
+
+// serviceRecord builds the SkyDNS record of a service, with the SRV priority
+// from SERVICE_PRIORITY, its weight as the SRV weight and the TTL of its
+// answers from SERVICE_DNS_TTL or -dns-ttl if set.
+func serviceRecord(service *bridge.Service) (string, error) {
+	rec := record{Host: service.IP, Port: service.Port, Weight: service.Weight}
+	for attr, field := range map[string]*int{"priority": &rec.Priority, "dns_ttl": &rec.TTL} {
+		if value := service.Attrs[attr]; value != "" {
+			n, err := strconv.Atoi(value)
+			if err != nil {
+				return "", errors.New("skydns2: bad SERVICE_" + strings.ToUpper(attr) + ": " + value)
+			}
+			*field = n
+		}
+	}
+	data, err := json.Marshal(rec)
+	return string(data), err
+}
+
+// servicePath is the key of a service, below the path of its name. Like the
+// domain, a dotted name is a DNS subdomain, so api.v1 is stored under v1/api.
 func (r *Skydns2Adapter) servicePath(service *bridge.Service) string {
-	return r.path + "/" + service.Name + "/" + service.ID
+	return r.path + "/" + reversed(service.Name) + "/" + service.ID
 }
 
 func domainPath(domain string) string {
-	components := strings.Split(domain, ".")
+	return "/skydns/" + reversed(domain)
+}
+
+// reversed turns a dotted DNS name into etcd path components, most
+// significant first.
+func reversed(name string) string {
+	components := strings.Split(name, ".")
 	for i, j := 0, len(components)-1; i < j; i, j = i+1, j-1 {
 		components[i], components[j] = components[j], components[i]
 	}
-	return "/skydns/" + strings.Join(components, "/")
+	return strings.Join(components, "/")
 }
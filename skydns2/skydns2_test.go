@@ -0,0 +1,95 @@
+package skydns2
+
+import (
+	"testing"
+
+	"github.com/coreos/go-etcd/etcd"
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+func TestServiceRecord(t *testing.T) {
+	adapter := &Skydns2Adapter{path: domainPath("cluster.local")}
+	service := &bridge.Service{ID: "web-80", Name: "web", IP: "10.0.0.1", Port: 8080, Attrs: map[string]string{}}
+
+	assert.Equal(t, "/skydns/local/cluster/web/web-80", adapter.servicePath(service))
+	record, err := serviceRecord(service)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"host":"10.0.0.1","port":8080}`, record)
+
+	service.Attrs = map[string]string{"priority": "10"}
+	service.Weight = 50
+	record, err = serviceRecord(service)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"host":"10.0.0.1","port":8080,"priority":10,"weight":50}`, record)
+	service.Weight = 0
+
+	service.Attrs = map[string]string{"dns_ttl": "300"}
+	record, err = serviceRecord(service)
+	assert.NoError(t, err)
+	assert.Equal(t, `{"host":"10.0.0.1","port":8080,"ttl":300}`, record)
+
+	service.Attrs = map[string]string{"priority": "high"}
+	_, err = serviceRecord(service)
+	assert.Error(t, err)
+}
+
+// fakeEtcd records the keys set through it.
+type fakeEtcd struct {
+	etcdClient
+	values map[string]string
+	ttls   map[string]uint64
+}
+
+func (e *fakeEtcd) Set(key, value string, ttl uint64) (*etcd.Response, error) {
+	e.values[key], e.ttls[key] = value, ttl
+	return &etcd.Response{}, nil
+}
+
+func (e *fakeEtcd) Delete(key string, recursive bool) (*etcd.Response, error) {
+	delete(e.values, key)
+	return &etcd.Response{}, nil
+}
+
+func newFakeEtcd() *fakeEtcd {
+	return &fakeEtcd{values: make(map[string]string), ttls: make(map[string]uint64)}
+}
+
+func TestRegisterDNSTTL(t *testing.T) {
+	client := newFakeEtcd()
+	adapter := &Skydns2Adapter{client: client, path: domainPath("cluster.local")}
+	service := &bridge.Service{ID: "web-80", Name: "web", IP: "10.0.0.1", Port: 8080, TTL: 30, Attrs: map[string]string{"dns_ttl": "60"}}
+
+	assert.NoError(t, adapter.Register(service))
+	key := "/skydns/local/cluster/web/web-80"
+	assert.Equal(t, `{"host":"10.0.0.1","port":8080,"ttl":60}`, client.values[key])
+	// the key keeps the service TTL, apart from the TTL of DNS answers
+	assert.Equal(t, uint64(30), client.ttls[key])
+}
+
+func TestRegisterMultipleTargets(t *testing.T) {
+	client := newFakeEtcd()
+	adapter := &Skydns2Adapter{client: client, path: domainPath("cluster.local")}
+	// the ports of a container as -srv-multiport registers them, all under
+	// one name
+	http := &bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8080}
+	https := &bridge.Service{ID: "host:web:443", Name: "web", IP: "10.0.0.1", Port: 8443}
+
+	assert.NoError(t, adapter.Register(http))
+	assert.NoError(t, adapter.Register(https))
+	assert.Equal(t, map[string]string{
+		"/skydns/local/cluster/web/host:web:80":  `{"host":"10.0.0.1","port":8080}`,
+		"/skydns/local/cluster/web/host:web:443": `{"host":"10.0.0.1","port":8443}`,
+	}, client.values)
+
+	// each target goes on its own
+	assert.NoError(t, adapter.Deregister(http))
+	assert.Equal(t, map[string]string{
+		"/skydns/local/cluster/web/host:web:443": `{"host":"10.0.0.1","port":8443}`,
+	}, client.values)
+
+	// a dotted name is a subdomain, v1/api answering for api.v1.cluster.local
+	versioned := &bridge.Service{ID: "host:api:80", Name: "api.v1", IP: "10.0.0.1", Port: 8080}
+	assert.NoError(t, adapter.Register(versioned))
+	assert.Equal(t, `{"host":"10.0.0.1","port":8080}`, client.values["/skydns/local/cluster/v1/api/host:api:80"])
+}
@@ -0,0 +1,253 @@
+package xds
+
+import (
+	"encoding/json"
+	"errors"
+	"log"
+	"net"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/xytis/registrator/bridge"
+)
+
+func init() {
+	bridge.Register(new(Factory), "xds")
+}
+
+const (
+	// EndpointsPath is where Envoy polls for endpoints with the REST-JSON
+	// variant of EDS.
+	EndpointsPath = "/v3/discovery:endpoints"
+	// EndpointsType is the type URL of the resources served.
+	EndpointsType = "type.googleapis.com/envoy.config.endpoint.v3.ClusterLoadAssignment"
+)
+
+// how long a poll for an unchanged version waits for a change before it is
+// answered with the current endpoints again
+var pollTimeout = 30 * time.Second
+
+type Factory struct{}
+
+func (f *Factory) Validate(uri *url.URL) error {
+	if uri.Host == "" {
+		return errors.New("listen address required e.g.: xds://0.0.0.0:18000")
+	}
+	return nil
+}
+
+func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
+	adapter := newAdapter()
+	listener, err := net.Listen("tcp", uri.Host)
+	if err != nil {
+		adapter.err = err
+		log.Println("xds: unable to listen:", err)
+		return adapter
+	}
+	log.Println("xds: serving endpoints on", listener.Addr())
+	mux := http.NewServeMux()
+	mux.Handle(EndpointsPath, adapter)
+	go func() {
+		if err := http.Serve(listener, mux); err != nil {
+			log.Println("xds: server stopped:", err)
+		}
+	}()
+	return adapter
+}
+
+// XDSAdapter serves the registered services to Envoy as an EDS snapshot,
+// one cluster per service name with an endpoint per service. Every change
+// makes a new version of the snapshot, answering the polls waiting for it.
+type XDSAdapter struct {
+	sync.Mutex
+	services map[string]*bridge.Service
+	version  uint64
+	changed  chan struct{}
+	err      error
+}
+
+func newAdapter() *XDSAdapter {
+	return &XDSAdapter{
+		services: make(map[string]*bridge.Service),
+		changed:  make(chan struct{}),
+	}
+}
+
+// Ping reports whether the endpoints are being served.
+func (r *XDSAdapter) Ping() error {
+	return r.err
+}
+
+func (r *XDSAdapter) Register(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	r.services[service.ID] = service
+	r.update()
+	return nil
+}
+
+func (r *XDSAdapter) Deregister(service *bridge.Service) error {
+	r.Lock()
+	defer r.Unlock()
+	if _, ok := r.services[service.ID]; !ok {
+		return nil
+	}
+	delete(r.services, service.ID)
+	r.update()
+	return nil
+}
+
+// Refresh does nothing, endpoints stay in the snapshot until deregistered.
+func (r *XDSAdapter) Refresh(service *bridge.Service) error {
+	return nil
+}
+
+// Services returns the services in the current snapshot.
+func (r *XDSAdapter) Services() ([]*bridge.Service, error) {
+	r.Lock()
+	defer r.Unlock()
+	services := make([]*bridge.Service, 0, len(r.services))
+	for _, service := range r.services {
+		services = append(services, service)
+	}
+	return services, nil
+}
+
+// update moves to the next version and wakes up the polls waiting for it.
+// Callers hold the lock.
+func (r *XDSAdapter) update() {
+	r.version++
+	close(r.changed)
+	r.changed = make(chan struct{})
+}
+
+type discoveryRequest struct {
+	VersionInfo   string   `json:"version_info"`
+	ResourceNames []string `json:"resource_names"`
+	TypeURL       string   `json:"type_url"`
+}
+
+type discoveryResponse struct {
+	VersionInfo string              `json:"version_info"`
+	Resources   []clusterAssignment `json:"resources"`
+	TypeURL     string              `json:"type_url"`
+}
+
+type clusterAssignment struct {
+	Type        string             `json:"@type"`
+	ClusterName string             `json:"cluster_name"`
+	Endpoints   []localityEndpoint `json:"endpoints"`
+}
+
+type localityEndpoint struct {
+	LbEndpoints []lbEndpoint `json:"lb_endpoints"`
+}
+
+type lbEndpoint struct {
+	Endpoint            endpoint `json:"endpoint"`
+	LoadBalancingWeight int      `json:"load_balancing_weight,omitempty"`
+}
+
+type endpoint struct {
+	Address address `json:"address"`
+}
+
+type address struct {
+	SocketAddress socketAddress `json:"socket_address"`
+}
+
+type socketAddress struct {
+	Protocol  string `json:"protocol,omitempty"`
+	Address   string `json:"address"`
+	PortValue int    `json:"port_value"`
+}
+
+// ServeHTTP answers a REST-JSON EDS poll. A poll naming the current version
+// waits for the next one, up to pollTimeout.
+func (r *XDSAdapter) ServeHTTP(w http.ResponseWriter, req *http.Request) {
+	if req.Method != "POST" {
+		w.Header().Set("Allow", "POST")
+		http.Error(w, "method not allowed", http.StatusMethodNotAllowed)
+		return
+	}
+	var request discoveryRequest
+	if err := json.NewDecoder(req.Body).Decode(&request); err != nil {
+		http.Error(w, "bad discovery request: "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if request.TypeURL != "" && request.TypeURL != EndpointsType {
+		http.Error(w, "unsupported type: "+request.TypeURL, http.StatusBadRequest)
+		return
+	}
+
+	r.Lock()
+	if request.VersionInfo == strconv.FormatUint(r.version, 10) {
+		changed := r.changed
+		r.Unlock()
+		select {
+		case <-changed:
+		case <-time.After(pollTimeout):
+		case <-req.Context().Done():
+			return
+		}
+		r.Lock()
+	}
+	response := r.snapshot(request.ResourceNames)
+	r.Unlock()
+
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+// snapshot returns the assignments of the named clusters, or of all of them
+// if none are named. Callers hold the lock.
+func (r *XDSAdapter) snapshot(names []string) discoveryResponse {
+	clusters := make(map[string][]lbEndpoint)
+	for _, name := range names {
+		// named clusters without services are sent without endpoints, so
+		// Envoy drops the ones that went away
+		clusters[name] = []lbEndpoint{}
+	}
+	ids := make([]string, 0, len(r.services))
+	for id := range r.services {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	for _, id := range ids {
+		service := r.services[id]
+		if _, ok := clusters[service.Name]; !ok && len(names) > 0 {
+			continue
+		}
+		socket := socketAddress{Address: service.IP, PortValue: service.Port}
+		if service.Origin.PortType == "udp" {
+			socket.Protocol = "UDP"
+		}
+		clusters[service.Name] = append(clusters[service.Name], lbEndpoint{
+			Endpoint:            endpoint{address{socket}},
+			LoadBalancingWeight: service.Weight,
+		})
+	}
+
+	response := discoveryResponse{
+		VersionInfo: strconv.FormatUint(r.version, 10),
+		Resources:   make([]clusterAssignment, 0, len(clusters)),
+		TypeURL:     EndpointsType,
+	}
+	clusterNames := make([]string, 0, len(clusters))
+	for name := range clusters {
+		clusterNames = append(clusterNames, name)
+	}
+	sort.Strings(clusterNames)
+	for _, name := range clusterNames {
+		response.Resources = append(response.Resources, clusterAssignment{
+			Type:        EndpointsType,
+			ClusterName: name,
+			Endpoints:   []localityEndpoint{{clusters[name]}},
+		})
+	}
+	return response
+}
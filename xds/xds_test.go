@@ -0,0 +1,134 @@
+package xds
+
+import (
+	"bytes"
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strconv"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+	"github.com/xytis/registrator/bridge"
+)
+
+// poll sends an EDS request the way Envoy does and decodes the answer.
+func poll(t *testing.T, server *httptest.Server, version string, names ...string) discoveryResponse {
+	body, _ := json.Marshal(map[string]interface{}{
+		"version_info":   version,
+		"resource_names": names,
+		"type_url":       EndpointsType,
+		"node":           map[string]string{"id": "envoy-1"},
+	})
+	res, err := http.Post(server.URL+EndpointsPath, "application/json", bytes.NewReader(body))
+	assert.NoError(t, err)
+	defer res.Body.Close()
+	assert.Equal(t, http.StatusOK, res.StatusCode)
+	var response discoveryResponse
+	assert.NoError(t, json.NewDecoder(res.Body).Decode(&response))
+	return response
+}
+
+// endpoints lists the addresses of a cluster in a response.
+func endpoints(response discoveryResponse, cluster string) []string {
+	addrs := make([]string, 0)
+	for _, assignment := range response.Resources {
+		if assignment.ClusterName != cluster {
+			continue
+		}
+		for _, locality := range assignment.Endpoints {
+			for _, lb := range locality.LbEndpoints {
+				socket := lb.Endpoint.Address.SocketAddress
+				addrs = append(addrs, socket.Address+":"+strconv.Itoa(socket.PortValue))
+			}
+		}
+	}
+	return addrs
+}
+
+func TestEndpointsUpdate(t *testing.T) {
+	adapter := newAdapter()
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	web1 := &bridge.Service{ID: "host:web-1:80", Name: "web", IP: "10.0.0.1", Port: 8081}
+	web2 := &bridge.Service{ID: "host:web-2:80", Name: "web", IP: "10.0.0.2", Port: 8082, Weight: 3}
+	assert.NoError(t, adapter.Register(web1))
+
+	response := poll(t, server, "", "web")
+	assert.Equal(t, EndpointsType, response.TypeURL)
+	assert.Equal(t, []string{"10.0.0.1:8081"}, endpoints(response, "web"))
+	assert.Equal(t, EndpointsType, response.Resources[0].Type)
+
+	// a poll for the current version waits for the next change
+	answered := make(chan discoveryResponse)
+	go func() {
+		answered <- poll(t, server, response.VersionInfo, "web")
+	}()
+	select {
+	case <-answered:
+		t.Fatal("answered without a change")
+	case <-time.After(20 * time.Millisecond):
+	}
+	assert.NoError(t, adapter.Register(web2))
+	updated := <-answered
+	assert.NotEqual(t, response.VersionInfo, updated.VersionInfo)
+	assert.Equal(t, []string{"10.0.0.1:8081", "10.0.0.2:8082"}, endpoints(updated, "web"))
+	assert.Equal(t, 3, updated.Resources[0].Endpoints[0].LbEndpoints[1].LoadBalancingWeight)
+
+	// deregistered services leave the cluster empty, not missing
+	assert.NoError(t, adapter.Deregister(web1))
+	assert.NoError(t, adapter.Deregister(web2))
+	emptied := poll(t, server, updated.VersionInfo, "web")
+	assert.Len(t, emptied.Resources, 1)
+	assert.Empty(t, endpoints(emptied, "web"))
+
+	services, err := adapter.Services()
+	assert.NoError(t, err)
+	assert.Empty(t, services)
+}
+
+func TestPollTimeout(t *testing.T) {
+	defer func(timeout time.Duration) { pollTimeout = timeout }(pollTimeout)
+	pollTimeout = 20 * time.Millisecond
+	adapter := newAdapter()
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+	adapter.Register(&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8081})
+
+	// without a change the same version is answered once the poll timed out,
+	// which Envoy's request_timeout has to wait for
+	response := poll(t, server, "", "web")
+	started := time.Now()
+	unchanged := poll(t, server, response.VersionInfo, "web")
+	assert.True(t, time.Since(started) >= pollTimeout)
+	assert.Equal(t, response.VersionInfo, unchanged.VersionInfo)
+	assert.Equal(t, []string{"10.0.0.1:8081"}, endpoints(unchanged, "web"))
+}
+
+func TestEndpointsOfAllClusters(t *testing.T) {
+	adapter := newAdapter()
+	server := httptest.NewServer(adapter)
+	defer server.Close()
+
+	adapter.Register(&bridge.Service{ID: "host:web:80", Name: "web", IP: "10.0.0.1", Port: 8081})
+	adapter.Register(&bridge.Service{ID: "host:dns:53:udp", Name: "dns", IP: "10.0.0.1", Port: 53,
+		Origin: bridge.ServicePort{PortType: "udp"}})
+
+	response := poll(t, server, "")
+	assert.Len(t, response.Resources, 2)
+	assert.Equal(t, "dns", response.Resources[0].ClusterName)
+	assert.Equal(t, "UDP", response.Resources[0].Endpoints[0].LbEndpoints[0].Endpoint.Address.SocketAddress.Protocol)
+
+	services, _ := adapter.Services()
+	assert.Len(t, services, 2)
+}
+
+func TestValidate(t *testing.T) {
+	uri, _ := url.Parse("xds://")
+	assert.Error(t, new(Factory).Validate(uri))
+	uri, _ = url.Parse("xds://0.0.0.0:18000")
+	assert.NoError(t, new(Factory).Validate(uri))
+}
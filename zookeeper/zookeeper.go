@@ -2,6 +2,7 @@ package zookeeper
 
 import (
 	"encoding/json"
+	"errors"
 	"log"
 	"net/url"
 	"strconv"
@@ -17,6 +18,16 @@ func init() {
 
 type Factory struct{}
 
+func (f *Factory) Validate(uri *url.URL) error {
+	if uri.Host == "" {
+		return errors.New("zookeeper host required e.g.: zookeeper://<host>/<basepath>")
+	}
+	if len(uri.Path) < 2 {
+		return errors.New("base path required e.g.: zookeeper://<host>/<basepath>")
+	}
+	return nil
+}
+
 func (f *Factory) New(uri *url.URL) bridge.RegistryAdapter {
 	c, _, err := zk.Connect([]string{uri.Host}, (time.Second * 10))
 	if err != nil {